@@ -0,0 +1,30 @@
+package kvdb
+
+import (
+	"encoding/json"
+)
+
+// Codec encodes the values stored in a kvdb, other than strings and byte
+// slices which are stored as is, and decodes them in GetVal.
+type Codec interface {
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodecName is the name JSONCodec is registered under.
+const JSONCodecName = "json"
+
+// JSONCodec is the default Codec, it stores values as JSON.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
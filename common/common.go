@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/portworx/kvdb"
 	"sync"
@@ -88,3 +89,55 @@ func (w *watchQueue) Enqueue(key string, kvp *kvdb.KVPair, err error) {
 	w.cv.Signal()
 	w.m.Unlock()
 }
+
+// contextWatch ends a watch once its context is done.
+type contextWatch struct {
+	// mutex serializes the calls to cb
+	mutex sync.Mutex
+	// ended is closed once cb got ErrWatchStopped
+	ended chan struct{}
+	cb    kvdb.WatchCB
+}
+
+// WatchCBWithContext wraps the callback of a watch on prefix so that, once
+// ctx is done, cb is called with ErrWatchStopped without waiting for an
+// update. cb is called with ErrWatchStopped only once and not called after
+// it, the wrapped callback returns ErrWatchStopped instead so that the
+// backend stops the watch.
+func WatchCBWithContext(
+	ctx context.Context,
+	prefix string,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) kvdb.WatchCB {
+	w := &contextWatch{ended: make(chan struct{}), cb: cb}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = w.call(prefix, opaque, nil, kvdb.ErrWatchStopped)
+			case <-w.ended:
+			}
+		}()
+	}
+	return w.call
+}
+
+func (w *contextWatch) call(
+	prefix string,
+	opaque interface{},
+	kvp *kvdb.KVPair,
+	err error,
+) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	select {
+	case <-w.ended:
+		return kvdb.ErrWatchStopped
+	default:
+	}
+	if err == kvdb.ErrWatchStopped {
+		close(w.ended)
+	}
+	return w.cb(prefix, opaque, kvp, err)
+}
@@ -0,0 +1,70 @@
+package kvdb
+
+import (
+	"sync"
+)
+
+const (
+	// ConnStateConnected the backend is connected to the kvdb cluster.
+	ConnStateConnected ConnState = iota
+	// ConnStateDisconnected the backend lost its connection to the cluster.
+	ConnStateDisconnected
+	// ConnStateFailedOver the backend switched to another cluster endpoint.
+	ConnStateFailedOver
+)
+
+// ConnState is the connection state of a kvdb backend.
+type ConnState int
+
+// ConnStateCB is called when the connection state of a backend changes.
+type ConnStateCB func(state ConnState)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnected:
+		return "Connected"
+	case ConnStateDisconnected:
+		return "Disconnected"
+	case ConnStateFailedOver:
+		return "FailedOver"
+	default:
+		return "Unknown"
+	}
+}
+
+// ConnStateNotifier delivers connection state changes to registered
+// callbacks. Backends use it to implement OnConnectionStateChange. The zero
+// value is ready to use.
+type ConnStateNotifier struct {
+	sync.Mutex
+	// cbs are the registered callbacks
+	cbs []ConnStateCB
+	// state is the last state notified
+	state ConnState
+	// notified is true once a state has been notified
+	notified bool
+}
+
+// Register adds cb to the callbacks notified of state changes. If a state
+// was already notified, cb is called with it immediately.
+func (n *ConnStateNotifier) Register(cb ConnStateCB) {
+	n.Lock()
+	defer n.Unlock()
+	n.cbs = append(n.cbs, cb)
+	if n.notified {
+		cb(n.state)
+	}
+}
+
+// Notify calls every registered callback with state, in registration order.
+// Callbacks are called with the notifier locked, so transitions are received
+// in the order they were notified.
+func (n *ConnStateNotifier) Notify(state ConnState) {
+	n.Lock()
+	defer n.Unlock()
+	n.state = state
+	n.notified = true
+	for _, cb := range n.cbs {
+		cb(state)
+	}
+}
@@ -0,0 +1,40 @@
+package kvdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackend emits connection state transitions through a notifier the way
+// a network backend would.
+type fakeBackend struct {
+	ConnStateNotifier
+}
+
+func (f *fakeBackend) OnConnectionStateChange(cb ConnStateCB) {
+	f.Register(cb)
+}
+
+func TestConnStateNotifier(t *testing.T) {
+	backend := &fakeBackend{}
+	backend.Notify(ConnStateConnected)
+
+	var first, second []ConnState
+	backend.OnConnectionStateChange(func(s ConnState) { first = append(first, s) })
+	backend.OnConnectionStateChange(func(s ConnState) { second = append(second, s) })
+
+	transitions := []ConnState{
+		ConnStateDisconnected,
+		ConnStateFailedOver,
+		ConnStateConnected,
+	}
+	for _, s := range transitions {
+		backend.Notify(s)
+	}
+
+	expected := append([]ConnState{ConnStateConnected}, transitions...)
+	assert.Equal(t, expected, first, "Unexpected state transitions")
+	assert.Equal(t, expected, second, "Unexpected state transitions")
+	assert.Equal(t, "FailedOver", ConnStateFailedOver.String())
+}
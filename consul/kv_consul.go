@@ -4,8 +4,10 @@ package consul
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
 	"regexp"
@@ -151,6 +153,14 @@ func (kv *consulKV) String() string {
 	return Name
 }
 
+func (kv *consulKV) Domain() string {
+	return kv.domain
+}
+
+func (kv *consulKV) FullKey(key string) string {
+	return stripConsecutiveForwardslash(kv.domain + key)
+}
+
 func (kv *consulKV) Capabilities() int {
 	return 0
 }
@@ -180,6 +190,22 @@ func (kv *consulKV) GetVal(key string, val interface{}) (*kvdb.KVPair, error) {
 	return kvp, json.Unmarshal(kvp.Value, val)
 }
 
+func (kv *consulKV) GetValMulti(
+	key string,
+	targets ...interface{},
+) (*kvdb.KVPair, error) {
+	kvp, err := kv.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range targets {
+		if err := json.Unmarshal(kvp.Value, val); err != nil {
+			return kvp, fmt.Errorf("target %d: %w", i, err)
+		}
+	}
+	return kvp, nil
+}
+
 func (kv *consulKV) createTTLSession(
 	key string,
 	val interface{},
@@ -301,6 +327,13 @@ func (kv *consulKV) Delete(key string) (*kvdb.KVPair, error) {
 }
 
 func (kv *consulKV) DeleteTree(key string) error {
+	if key == "" {
+		return kvdb.ErrRefusingRootDelete
+	}
+	return kv.DeleteTreeForce(key)
+}
+
+func (kv *consulKV) DeleteTreeForce(key string) error {
 	key = kv.domain + key
 	key = stripConsecutiveForwardslash(key)
 	if _, err := kv.client.KV().DeleteTree(key, nil); err != nil {
@@ -309,6 +342,10 @@ func (kv *consulKV) DeleteTree(key string) error {
 	return nil
 }
 
+func (kv *consulKV) DeleteTreeWithResult(prefix string) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
 func (kv *consulKV) Keys(prefix, sep string) ([]string, error) {
 	if "" == sep {
 		sep = "/"
@@ -422,6 +459,22 @@ func (kv *consulKV) WatchKey(
 	waitIndex uint64,
 	opaque interface{},
 	cb kvdb.WatchCB,
+) error {
+	return kv.WatchKeyWithContext(context.Background(), key, waitIndex,
+		opaque, cb)
+}
+
+func (kv *consulKV) WatchTree(prefix string, waitIndex uint64, opaque interface{}, cb kvdb.WatchCB) error {
+	return kv.WatchTreeWithContext(context.Background(), prefix, waitIndex,
+		opaque, cb)
+}
+
+func (kv *consulKV) WatchKeyWithContext(
+	ctx context.Context,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
 ) error {
 	var keyExist bool
 	kvp, err := kv.Get(key)
@@ -438,11 +491,17 @@ func (kv *consulKV) WatchKey(
 	}
 
 	key = kv.domain + key
-	go kv.watchKeyStart(key, keyExist, waitIndex, opaque, cb)
+	go kv.watchKeyStart(ctx, key, keyExist, waitIndex, opaque, cb)
 	return nil
 }
 
-func (kv *consulKV) WatchTree(prefix string, waitIndex uint64, opaque interface{}, cb kvdb.WatchCB) error {
+func (kv *consulKV) WatchTreeWithContext(
+	ctx context.Context,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
 	var prefixExist bool
 	kvps, err := kv.Enumerate(prefix)
 	if err == kvdb.ErrNotFound {
@@ -458,7 +517,7 @@ func (kv *consulKV) WatchTree(prefix string, waitIndex uint64, opaque interface{
 	}
 
 	prefix = kv.domain + prefix
-	go kv.watchTreeStart(prefix, prefixExist, waitIndex, opaque, cb)
+	go kv.watchTreeStart(ctx, prefix, prefixExist, waitIndex, opaque, cb)
 	return nil
 }
 
@@ -507,6 +566,10 @@ func (kv *consulKV) Unlock(kvp *kvdb.KVPair) error {
 	return err
 }
 
+func (kv *consulKV) RefreshLock(kvp *kvdb.KVPair, ttl uint64) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
 func (kv *consulKV) TxNew() (kvdb.Tx, error) {
 	return nil, kvdb.ErrNotSupported
 }
@@ -776,6 +839,7 @@ func (kv *consulKV) getLock(key string, tag interface{}, ttl time.Duration) (
 }
 
 func (kv *consulKV) watchTreeStart(
+	ctx context.Context,
 	prefix string,
 	prefixExisted bool,
 	waitIndex uint64,
@@ -783,6 +847,7 @@ func (kv *consulKV) watchTreeStart(
 	cb kvdb.WatchCB,
 ) {
 	prefix = stripConsecutiveForwardslash(prefix)
+	cb = common.WatchCBWithContext(ctx, prefix, opaque, cb)
 	opts := &api.QueryOptions{
 		WaitIndex:         waitIndex,
 		RequireConsistent: true,
@@ -802,6 +867,10 @@ func (kv *consulKV) watchTreeStart(
 	}
 
 	for {
+		// The callback got ErrWatchStopped once ctx was done.
+		if ctx.Err() != nil {
+			break
+		}
 		// Make a blocking List query
 		kvPairs, meta, err := kv.client.KV().List(prefix, opts)
 		pairs := CKVPairs(kvPairs)
@@ -896,6 +965,7 @@ func (kv *consulKV) watchTreeStart(
 }
 
 func (kv *consulKV) watchKeyStart(
+	ctx context.Context,
 	key string,
 	keyExisted bool,
 	waitIndex uint64,
@@ -903,6 +973,7 @@ func (kv *consulKV) watchKeyStart(
 	cb kvdb.WatchCB,
 ) {
 	key = stripConsecutiveForwardslash(key)
+	cb = common.WatchCBWithContext(ctx, key, opaque, cb)
 	opts := &api.QueryOptions{
 		WaitIndex: waitIndex,
 	}
@@ -911,6 +982,10 @@ func (kv *consulKV) watchKeyStart(
 	keyDeleted := false
 	var cbErr error
 	for {
+		// The callback got ErrWatchStopped once ctx was done.
+		if ctx.Err() != nil {
+			break
+		}
 		// Make a blocking Get query
 		pair, meta, err := kv.client.KV().Get(key, opts)
 		if err != nil {
@@ -1050,6 +1125,10 @@ func (kv *consulKV) SnapPut(snapKvp *kvdb.KVPair) (*kvdb.KVPair, error) {
 	return nil, kvdb.ErrNotSupported
 }
 
+func (kv *consulKV) Restore(snap kvdb.Kvdb) error {
+	return kvdb.ErrNotSupported
+}
+
 func (kv *consulKV) AddUser(username string, password string) error {
 	return kvdb.ErrNotSupported
 }
@@ -1073,3 +1152,347 @@ func (kv *consulKV) RevokeUsersAccess(
 ) error {
 	return kvdb.ErrNotSupported
 }
+
+func (kv *consulKV) EnqueueDelayed(
+	queuePrefix string,
+	value []byte,
+	delay time.Duration,
+) (string, error) {
+	return "", kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) DequeueReady(queuePrefix string) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) DeleteIfExists(key string) (bool, error) {
+	if _, err := kv.Delete(key); err != nil {
+		if err == kvdb.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (kv *consulKV) WithLock(lock *kvdb.KVPair) (kvdb.Kvdb, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) KeysWrittenBy(lockerID string) ([]string, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) WatchKeyOpts(
+	key string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) WatchTreeOpts(
+	prefix string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) WatchAll(
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) WatchAllWithContext(
+	ctx context.Context,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) DeleteIf(key string, pred func([]byte) bool) (bool, error) {
+	kvp, err := kv.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if !pred(kvp.Value) {
+		return false, nil
+	}
+	// The key is deleted only if it was not modified since pred was called.
+	if _, err := kv.CompareAndDelete(kvp, kvdb.KVModifiedIndex); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (kv *consulKV) OnConnectionStateChange(cb kvdb.ConnStateCB) {
+	// The client is set up in New and transitions are not tracked yet, so
+	// only the initial connected state is reported.
+	cb(kvdb.ConnStateConnected)
+}
+
+func (kv *consulKV) EnumerateAt(prefix string) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) EnumeratePaged(
+	prefix string,
+	limit int,
+	cursor string,
+) (kvdb.KVPairs, string, error) {
+	return nil, "", kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) PollChanges(
+	prefix string,
+	sinceIndex uint64,
+) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) ReplaceTree(
+	prefix string,
+	pairs map[string]interface{},
+	ttl uint64,
+) (int, int, error) {
+	return 0, 0, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) CreateBatch(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) PutBulk(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvps := make(kvdb.KVPairs, 0, len(keys))
+	for _, key := range keys {
+		kvp, err := kv.Put(key, pairs[key], ttl)
+		if err != nil {
+			return kvps, fmt.Errorf("key %q: %w", key, err)
+		}
+		kvps = append(kvps, kvp)
+	}
+	return kvps, nil
+}
+
+func (kv *consulKV) AtomicAddBatch(
+	deltas map[string]int64,
+) (map[string]int64, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) AtomicIncrement(key string, delta int64) (int64, error) {
+	for {
+		kvp, err := kv.Get(key)
+		var n int64
+		if err == kvdb.ErrNotFound {
+			// A ModifiedIndex of 0 only sets a key that does not exist.
+			kvp = &kvdb.KVPair{Key: key}
+		} else if err != nil {
+			return 0, err
+		} else if n, err = strconv.ParseInt(string(kvp.Value), 10, 64); err != nil {
+			return 0, kvdb.ErrNotNumeric
+		}
+		kvp.Value = []byte(strconv.FormatInt(n+delta, 10))
+		// Retry if the counter was changed since it was read.
+		_, err = kv.CompareAndSet(kvp, kvdb.KVModifiedIndex, nil)
+		if err == nil {
+			return n + delta, nil
+		}
+		if err != kvdb.ErrModified {
+			return 0, err
+		}
+	}
+}
+
+func (kv *consulKV) AtomicDecrement(key string, delta int64) (int64, error) {
+	return kv.AtomicIncrement(key, -delta)
+}
+
+func (kv *consulKV) PauseWatch(key string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) ResumeWatch(key string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) StopWatchGroup(group string) int {
+	// Grouped watches need WatchKeyOpts or WatchTreeOpts, which are not
+	// supported.
+	return 0
+}
+
+func (kv *consulKV) MoveIf(
+	src string,
+	dst string,
+	expectedDstValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) LockStats(key string) (kvdb.LockStat, error) {
+	return kvdb.LockStat{}, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) PutIfOther(
+	key string,
+	value interface{},
+	ttl uint64,
+	guardKey string,
+	guardValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) ReplayHistory(
+	fromIndex uint64,
+	fn func(kvp *kvdb.KVPair) error,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) LockWithPriority(
+	key string,
+	lockerID string,
+	priority int,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) LockWithTimeout(
+	key string,
+	lockerID string,
+	lockTimeout time.Duration,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) Rates() (float64, float64) {
+	return 0, 0
+}
+
+func (kv *consulKV) PutWithFallback(
+	key string,
+	value interface{},
+	fallback interface{},
+	after time.Duration,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) HasWatchers(key string) (bool, error) {
+	return false, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) WatchFrom(
+	key string,
+) (*kvdb.KVPair, <-chan *kvdb.KVPair, func(), error) {
+	return nil, nil, nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) Rename(oldKey, newKey string) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) GetMultiConsistent(keys []string) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) Recode(newCodec kvdb.Codec) (int, error) {
+	return 0, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) GetRaw(key string) (*kvdb.KVPair, error) {
+	// Aliases are not supported, so no key is ever resolved.
+	return kv.Get(key)
+}
+
+func (kv *consulKV) GetConsistent(
+	key string,
+	level kvdb.Consistency,
+) (*kvdb.KVPair, error) {
+	if level < kvdb.Linearizable || level > kvdb.Stale {
+		return nil, kvdb.ErrIllegal
+	}
+	// The levels are not distinguished, every read is served as by Get.
+	return kv.Get(key)
+}
+
+func (kv *consulKV) CreateAlias(alias, target string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) PutMonotonic(
+	key string,
+	value int64,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) EnumerateGrouped(prefix string) (map[string]kvdb.KVPairs, error) {
+	kvps, err := kv.Enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return kvdb.GroupBySegment(prefix, kvps), nil
+}
+
+func (kv *consulKV) TryLockMany(
+	keys []string,
+	lockerID string,
+	ttl uint64,
+) ([]*kvdb.KVPair, []string, error) {
+	return nil, nil, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) DeleteTreeIfVersion(
+	prefix string,
+	versionKey string,
+	expectedValue []byte,
+) (int, error) {
+	return 0, kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) LatestUnder(prefix string) (*kvdb.KVPair, error) {
+	kvps, err := kv.Enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var latest *kvdb.KVPair
+	for _, kvp := range kvps {
+		if latest == nil || kvp.ModifiedIndex > latest.ModifiedIndex {
+			latest = kvp
+		}
+	}
+	if latest == nil {
+		return nil, kvdb.ErrNotFound
+	}
+	return latest, nil
+}
+
+func (kv *consulKV) WriteMetrics(w io.Writer) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *consulKV) AllowN(key string, rate float64, burst int, n int) (bool, error) {
+	return false, kvdb.ErrNotSupported
+}
@@ -0,0 +1,38 @@
+package kvdb
+
+// EnumerateUpdateFn returns the new value for kvp, whether to write it, and
+// an error that stops the enumeration.
+type EnumerateUpdateFn func(kvp *KVPair) ([]byte, bool, error)
+
+// EnumerateUpdate calls fn for every key that shares prefix and writes the
+// value it returns with a CompareAndSet on the enumerated ModifiedIndex. Keys
+// modified or deleted after they were enumerated are skipped as conflicts.
+// It returns the number of keys updated.
+func EnumerateUpdate(db Kvdb, prefix string, fn EnumerateUpdateFn) (int, error) {
+	kvps, err := db.Enumerate(prefix)
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, kvp := range kvps {
+		value, write, err := fn(kvp)
+		if err != nil {
+			return updated, err
+		}
+		if !write {
+			continue
+		}
+		update := *kvp
+		update.Value = value
+		_, err = db.CompareAndSet(&update, KVModifiedIndex, nil)
+		switch err {
+		case nil:
+			updated++
+		case ErrValueMismatch, ErrModified, ErrNotFound:
+			// Conflict, the key changed since it was enumerated.
+		default:
+			return updated, err
+		}
+	}
+	return updated, nil
+}
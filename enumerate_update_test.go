@@ -0,0 +1,64 @@
+package kvdb_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnumerateUpdate(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	for _, k := range []string{"a", "b", "skip", "conflict"} {
+		_, err = kv.Put("update/"+k, []byte(k), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+
+	updated, err := kvdb.EnumerateUpdate(kv, "update",
+		func(kvp *kvdb.KVPair) ([]byte, bool, error) {
+			switch kvp.Key {
+			case "update/skip":
+				return nil, false, nil
+			case "update/conflict":
+				// A concurrent writer gets in before the CompareAndSet.
+				_, err := kv.Put(kvp.Key, []byte("concurrent"), 0)
+				require.NoError(t, err, "Unexpected error in Put")
+			}
+			return []byte(strings.ToUpper(string(kvp.Value))), true, nil
+		})
+	require.NoError(t, err, "Unexpected error in EnumerateUpdate")
+	assert.Equal(t, 2, updated, "Unexpected number of updated keys")
+
+	expected := map[string]string{
+		"update/a":        "A",
+		"update/b":        "B",
+		"update/skip":     "skip",
+		"update/conflict": "concurrent",
+	}
+	for key, value := range expected {
+		kvp, err := kv.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, value, string(kvp.Value), "Unexpected value for %v", key)
+	}
+}
+
+func TestEnumerateUpdateError(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	_, err = kv.Put("update/a", []byte("a"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	stop := errors.New("stop")
+	updated, err := kvdb.EnumerateUpdate(kv, "update",
+		func(kvp *kvdb.KVPair) ([]byte, bool, error) {
+			return nil, false, stop
+		})
+	assert.Equal(t, stop, err, "Expected the error returned by fn")
+	assert.Equal(t, 0, updated, "Unexpected number of updated keys")
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -96,6 +98,14 @@ func (kv *etcdKV) String() string {
 	return Name
 }
 
+func (kv *etcdKV) Domain() string {
+	return kv.domain
+}
+
+func (kv *etcdKV) FullKey(key string) string {
+	return kv.domain + key
+}
+
 func (kv *etcdKV) Capabilities() int {
 	return kvdb.KVCapabilityOrderedUpdates
 }
@@ -116,6 +126,22 @@ func (kv *etcdKV) GetVal(key string, val interface{}) (*kvdb.KVPair, error) {
 	return kvp, nil
 }
 
+func (kv *etcdKV) GetValMulti(
+	key string,
+	targets ...interface{},
+) (*kvdb.KVPair, error) {
+	kvp, err := kv.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range targets {
+		if err := json.Unmarshal(kvp.Value, val); err != nil {
+			return kvp, fmt.Errorf("target %d: %w", i, err)
+		}
+	}
+	return kvp, nil
+}
+
 func (kv *etcdKV) Put(
 	key string,
 	val interface{},
@@ -215,6 +241,13 @@ func (kv *etcdKV) Delete(key string) (*kvdb.KVPair, error) {
 }
 
 func (kv *etcdKV) DeleteTree(prefix string) error {
+	if prefix == "" {
+		return kvdb.ErrRefusingRootDelete
+	}
+	return kv.DeleteTreeForce(prefix)
+}
+
+func (kv *etcdKV) DeleteTreeForce(prefix string) error {
 	prefix = kv.domain + prefix
 
 	_, err := kv.client.Delete(context.Background(), prefix, &e.DeleteOptions{
@@ -223,6 +256,10 @@ func (kv *etcdKV) DeleteTree(prefix string) error {
 	return err
 }
 
+func (kv *etcdKV) DeleteTreeWithResult(prefix string) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
 func (kv *etcdKV) Keys(prefix, sep string) ([]string, error) {
 	// etcd-v2 supports only '/' separator
 	sep = "/"
@@ -327,10 +364,8 @@ func (kv *etcdKV) WatchKey(
 	opaque interface{},
 	cb kvdb.WatchCB,
 ) error {
-
-	key = kv.domain + key
-	go kv.watchStart(key, false, waitIndex, opaque, cb)
-	return nil
+	return kv.WatchKeyWithContext(context.Background(), key, waitIndex,
+		opaque, cb)
 }
 
 func (kv *etcdKV) WatchTree(
@@ -339,10 +374,8 @@ func (kv *etcdKV) WatchTree(
 	opaque interface{},
 	cb kvdb.WatchCB,
 ) error {
-
-	prefix = kv.domain + prefix
-	go kv.watchStart(prefix, true, waitIndex, opaque, cb)
-	return nil
+	return kv.WatchTreeWithContext(context.Background(), prefix, waitIndex,
+		opaque, cb)
 }
 
 func (kv *etcdKV) Lock(key string) (*kvdb.KVPair, error) {
@@ -404,6 +437,10 @@ func (kv *etcdKV) Unlock(kvp *kvdb.KVPair) error {
 	return err
 }
 
+func (kv *etcdKV) RefreshLock(kvp *kvdb.KVPair, ttl uint64) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
 func (kv *etcdKV) TxNew() (kvdb.Tx, error) {
 	return nil, kvdb.ErrNotSupported
 }
@@ -575,13 +612,15 @@ func (kv *etcdKV) refreshLock(kvPair *kvdb.KVPair) {
 }
 
 func (kv *etcdKV) watchStart(
+	parent context.Context,
 	key string,
 	recursive bool,
 	waitIndex uint64,
 	opaque interface{},
 	cb kvdb.WatchCB,
 ) {
-	ctx, cancel := context.WithCancel(context.Background())
+	cb = common.WatchCBWithContext(parent, key, opaque, cb)
+	ctx, cancel := context.WithCancel(parent)
 	watcher := kv.client.Watcher(key, &e.WatcherOptions{
 		AfterIndex: waitIndex,
 		Recursive:  recursive,
@@ -589,7 +628,12 @@ func (kv *etcdKV) watchStart(
 	isCancelSent := false
 	for {
 		r, watchErr := watcher.Next(ctx)
-		if watchErr != nil && !isCancelSent {
+		if watchErr != nil && parent.Err() != nil {
+			// The watch was stopped through its context.
+			cancel()
+			_ = cb(key, opaque, nil, kvdb.ErrWatchStopped)
+			break
+		} else if watchErr != nil && !isCancelSent {
 			e, ok := watchErr.(e.Error)
 			if ok {
 				logrus.Errorf("Etcd error code: [%d] Message: [%s] Cause: [%s] Index: [%d]\n",
@@ -770,6 +814,10 @@ func (kv *etcdKV) SnapPut(snapKvp *kvdb.KVPair) (*kvdb.KVPair, error) {
 	return nil, kvdb.ErrNotSupported
 }
 
+func (kv *etcdKV) Restore(snap kvdb.Kvdb) error {
+	return kvdb.ErrNotSupported
+}
+
 func (kv *etcdKV) AddUser(username string, password string) error {
 	// Create a role for this user
 	roleName := username
@@ -853,3 +901,387 @@ func getEtcdPermType(permType kvdb.PermissionType) (e.PermissionType, error) {
 		return -1, kvdb.ErrUnknownPermission
 	}
 }
+
+func (kv *etcdKV) EnqueueDelayed(
+	queuePrefix string,
+	value []byte,
+	delay time.Duration,
+) (string, error) {
+	return "", kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) DequeueReady(queuePrefix string) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) DeleteIfExists(key string) (bool, error) {
+	if _, err := kv.Delete(key); err != nil {
+		if err == kvdb.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (kv *etcdKV) WithLock(lock *kvdb.KVPair) (kvdb.Kvdb, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) KeysWrittenBy(lockerID string) ([]string, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) WatchKeyOpts(
+	key string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) WatchTreeOpts(
+	prefix string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) WatchKeyWithContext(
+	ctx context.Context,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	key = kv.domain + key
+	go kv.watchStart(ctx, key, false, waitIndex, opaque, watchCB)
+	return nil
+}
+
+func (kv *etcdKV) WatchTreeWithContext(
+	ctx context.Context,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	prefix = kv.domain + prefix
+	go kv.watchStart(ctx, prefix, true, waitIndex, opaque, watchCB)
+	return nil
+}
+
+func (kv *etcdKV) WatchAll(
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) WatchAllWithContext(
+	ctx context.Context,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) DeleteIf(key string, pred func([]byte) bool) (bool, error) {
+	kvp, err := kv.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if !pred(kvp.Value) {
+		return false, nil
+	}
+	// The key is deleted only if it was not modified since pred was called.
+	if _, err := kv.CompareAndDelete(kvp, kvdb.KVModifiedIndex); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (kv *etcdKV) OnConnectionStateChange(cb kvdb.ConnStateCB) {
+	// The client is set up in New and transitions are not tracked yet, so
+	// only the initial connected state is reported.
+	cb(kvdb.ConnStateConnected)
+}
+
+func (kv *etcdKV) EnumerateAt(prefix string) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) EnumeratePaged(
+	prefix string,
+	limit int,
+	cursor string,
+) (kvdb.KVPairs, string, error) {
+	return nil, "", kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) PollChanges(
+	prefix string,
+	sinceIndex uint64,
+) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) ReplaceTree(
+	prefix string,
+	pairs map[string]interface{},
+	ttl uint64,
+) (int, int, error) {
+	return 0, 0, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) CreateBatch(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) PutBulk(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvps := make(kvdb.KVPairs, 0, len(keys))
+	for _, key := range keys {
+		kvp, err := kv.Put(key, pairs[key], ttl)
+		if err != nil {
+			return kvps, fmt.Errorf("key %q: %w", key, err)
+		}
+		kvps = append(kvps, kvp)
+	}
+	return kvps, nil
+}
+
+func (kv *etcdKV) AtomicAddBatch(
+	deltas map[string]int64,
+) (map[string]int64, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) AtomicIncrement(key string, delta int64) (int64, error) {
+	for {
+		kvp, err := kv.Get(key)
+		if err == kvdb.ErrNotFound {
+			_, err = kv.Create(key, strconv.FormatInt(delta, 10), 0)
+			if err == nil {
+				return delta, nil
+			}
+			// Retry if the counter was created since it was read.
+			if !isEtcdError(err, e.ErrorCodeNodeExist) {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(string(kvp.Value), 10, 64)
+		if err != nil {
+			return 0, kvdb.ErrNotNumeric
+		}
+		// The counter is set without its TTL, as CompareAndSet does.
+		kvp.Value = []byte(strconv.FormatInt(n+delta, 10))
+		_, err = kv.CompareAndSet(kvp, kvdb.KVModifiedIndex, nil)
+		if err == nil {
+			return n + delta, nil
+		}
+		// Retry if the counter was changed since it was read.
+		if !isEtcdError(err, e.ErrorCodeTestFailed) {
+			return 0, err
+		}
+	}
+}
+
+func (kv *etcdKV) AtomicDecrement(key string, delta int64) (int64, error) {
+	return kv.AtomicIncrement(key, -delta)
+}
+
+// isEtcdError reports whether err is an etcd error with the given code.
+func isEtcdError(err error, code int) bool {
+	etcdErr, ok := err.(e.Error)
+	return ok && etcdErr.Code == code
+}
+
+func (kv *etcdKV) PauseWatch(key string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) ResumeWatch(key string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) StopWatchGroup(group string) int {
+	// Grouped watches need WatchKeyOpts or WatchTreeOpts, which are not
+	// supported.
+	return 0
+}
+
+func (kv *etcdKV) MoveIf(
+	src string,
+	dst string,
+	expectedDstValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) LockStats(key string) (kvdb.LockStat, error) {
+	return kvdb.LockStat{}, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) PutIfOther(
+	key string,
+	value interface{},
+	ttl uint64,
+	guardKey string,
+	guardValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) ReplayHistory(
+	fromIndex uint64,
+	fn func(kvp *kvdb.KVPair) error,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) LockWithPriority(
+	key string,
+	lockerID string,
+	priority int,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) LockWithTimeout(
+	key string,
+	lockerID string,
+	lockTimeout time.Duration,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) Rates() (float64, float64) {
+	return 0, 0
+}
+
+func (kv *etcdKV) PutWithFallback(
+	key string,
+	value interface{},
+	fallback interface{},
+	after time.Duration,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) HasWatchers(key string) (bool, error) {
+	return false, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) WatchFrom(
+	key string,
+) (*kvdb.KVPair, <-chan *kvdb.KVPair, func(), error) {
+	return nil, nil, nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) Rename(oldKey, newKey string) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) GetMultiConsistent(keys []string) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) Recode(newCodec kvdb.Codec) (int, error) {
+	return 0, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) GetRaw(key string) (*kvdb.KVPair, error) {
+	// Aliases are not supported, so no key is ever resolved.
+	return kv.Get(key)
+}
+
+func (kv *etcdKV) GetConsistent(
+	key string,
+	level kvdb.Consistency,
+) (*kvdb.KVPair, error) {
+	if level < kvdb.Linearizable || level > kvdb.Stale {
+		return nil, kvdb.ErrIllegal
+	}
+	// The levels are not distinguished, every read is served as by Get.
+	return kv.Get(key)
+}
+
+func (kv *etcdKV) CreateAlias(alias, target string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) PutMonotonic(
+	key string,
+	value int64,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) EnumerateGrouped(prefix string) (map[string]kvdb.KVPairs, error) {
+	kvps, err := kv.Enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return kvdb.GroupBySegment(prefix, kvps), nil
+}
+
+func (kv *etcdKV) TryLockMany(
+	keys []string,
+	lockerID string,
+	ttl uint64,
+) ([]*kvdb.KVPair, []string, error) {
+	return nil, nil, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) DeleteTreeIfVersion(
+	prefix string,
+	versionKey string,
+	expectedValue []byte,
+) (int, error) {
+	return 0, kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) LatestUnder(prefix string) (*kvdb.KVPair, error) {
+	kvps, err := kv.Enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var latest *kvdb.KVPair
+	for _, kvp := range kvps {
+		if latest == nil || kvp.ModifiedIndex > latest.ModifiedIndex {
+			latest = kvp
+		}
+	}
+	if latest == nil {
+		return nil, kvdb.ErrNotFound
+	}
+	return latest, nil
+}
+
+func (kv *etcdKV) WriteMetrics(w io.Writer) error {
+	return kvdb.ErrNotSupported
+}
+
+func (kv *etcdKV) AllowN(key string, rate float64, burst int, n int) (bool, error) {
+	return false, kvdb.ErrNotSupported
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -147,6 +149,14 @@ func (et *etcdKV) String() string {
 	return Name
 }
 
+func (et *etcdKV) Domain() string {
+	return et.domain
+}
+
+func (et *etcdKV) FullKey(key string) string {
+	return et.domain + key
+}
+
 func (et *etcdKV) Capabilities() int {
 	return kvdb.KVCapabilityOrderedUpdates
 }
@@ -204,6 +214,22 @@ func (et *etcdKV) GetVal(key string, val interface{}) (*kvdb.KVPair, error) {
 	return kvp, nil
 }
 
+func (et *etcdKV) GetValMulti(
+	key string,
+	targets ...interface{},
+) (*kvdb.KVPair, error) {
+	kvp, err := et.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range targets {
+		if err := json.Unmarshal(kvp.Value, val); err != nil {
+			return kvp, fmt.Errorf("target %d: %w", i, err)
+		}
+	}
+	return kvp, nil
+}
+
 func (et *etcdKV) Put(
 	key string,
 	val interface{},
@@ -373,6 +399,13 @@ func (et *etcdKV) Delete(key string) (*kvdb.KVPair, error) {
 }
 
 func (et *etcdKV) DeleteTree(prefix string) error {
+	if prefix == "" {
+		return kvdb.ErrRefusingRootDelete
+	}
+	return et.DeleteTreeForce(prefix)
+}
+
+func (et *etcdKV) DeleteTreeForce(prefix string) error {
 	prefix = et.domain + prefix
 
 	ctx, cancel := et.Context()
@@ -386,6 +419,10 @@ func (et *etcdKV) DeleteTree(prefix string) error {
 	return err
 }
 
+func (et *etcdKV) DeleteTreeWithResult(prefix string) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
 func (et *etcdKV) Keys(prefix, sep string) ([]string, error) {
 	var (
 		err    error
@@ -581,9 +618,8 @@ func (et *etcdKV) WatchKey(
 	opaque interface{},
 	cb kvdb.WatchCB,
 ) error {
-	key = et.domain + key
-	go et.watchStart(key, false, waitIndex, opaque, cb)
-	return nil
+	return et.WatchKeyWithContext(context.Background(), key, waitIndex,
+		opaque, cb)
 }
 
 func (et *etcdKV) WatchTree(
@@ -592,9 +628,8 @@ func (et *etcdKV) WatchTree(
 	opaque interface{},
 	cb kvdb.WatchCB,
 ) error {
-	prefix = et.domain + prefix
-	go et.watchStart(prefix, true, waitIndex, opaque, cb)
-	return nil
+	return et.WatchTreeWithContext(context.Background(), prefix, waitIndex,
+		opaque, cb)
 }
 
 func (et *etcdKV) Lock(key string) (*kvdb.KVPair, error) {
@@ -653,6 +688,10 @@ func (et *etcdKV) Unlock(kvp *kvdb.KVPair) error {
 	return err
 }
 
+func (et *etcdKV) RefreshLock(kvp *kvdb.KVPair, ttl uint64) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
 func (et *etcdKV) TxNew() (kvdb.Tx, error) {
 	return nil, kvdb.ErrNotSupported
 }
@@ -835,12 +874,14 @@ func (et *etcdKV) refreshLock(kvPair *kvdb.KVPair) {
 }
 
 func (et *etcdKV) watchStart(
+	parent context.Context,
 	key string,
 	recursive bool,
 	waitIndex uint64,
 	opaque interface{},
 	cb kvdb.WatchCB,
 ) {
+	cb = common.WatchCBWithContext(parent, key, opaque, cb)
 	opts := []e.OpOption{}
 	opts = append(opts, e.WithCreatedNotify())
 	if recursive {
@@ -858,8 +899,10 @@ func (et *etcdKV) watchStart(
 		return
 	}
 
-	ctx, watchCancel := context.WithCancel(context.Background())
-	watchRet := make(chan error)
+	ctx, watchCancel := context.WithCancel(parent)
+	// watchRet is buffered as nobody reads it once the watch is stopped
+	// through its context.
+	watchRet := make(chan error, 1)
 	watchChan := et.kvClient.Watch(ctx, key, opts...)
 	watchQ := newWatchQ(opaque, cb, watchRet)
 	go func() {
@@ -902,6 +945,9 @@ func (et *etcdKV) watchStart(
 		// Indicate the caller that watch has been canceled
 		logrus.Errorf("Watch closing session")
 		watchQ.enqueue(key, nil, kvdb.ErrWatchStopped)
+	case <-parent.Done(): // stopped by the caller
+		watchCancel()
+		watchQ.enqueue(key, nil, kvdb.ErrWatchStopped)
 	case err := <-watchRet: // error in watcher
 		logrus.Errorf("Watch for %v stopped: %v", key, err)
 	}
@@ -1078,6 +1124,10 @@ func (et *etcdKV) SnapPut(snapKvp *kvdb.KVPair) (*kvdb.KVPair, error) {
 	return nil, kvdb.ErrNotSupported
 }
 
+func (et *etcdKV) Restore(snap kvdb.Kvdb) error {
+	return kvdb.ErrNotSupported
+}
+
 func (et *etcdKV) AddUser(username string, password string) error {
 	// Create a role for this user
 	roleName := username
@@ -1247,3 +1297,381 @@ func getEtcdPermType(permType kvdb.PermissionType) (e.PermissionType, error) {
 		return -1, kvdb.ErrUnknownPermission
 	}
 }
+
+func (et *etcdKV) EnqueueDelayed(
+	queuePrefix string,
+	value []byte,
+	delay time.Duration,
+) (string, error) {
+	return "", kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) DequeueReady(queuePrefix string) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) DeleteIfExists(key string) (bool, error) {
+	if _, err := et.Delete(key); err != nil {
+		if err == kvdb.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (et *etcdKV) WithLock(lock *kvdb.KVPair) (kvdb.Kvdb, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) KeysWrittenBy(lockerID string) ([]string, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) WatchKeyOpts(
+	key string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) WatchTreeOpts(
+	prefix string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) WatchKeyWithContext(
+	ctx context.Context,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	key = et.domain + key
+	go et.watchStart(ctx, key, false, waitIndex, opaque, watchCB)
+	return nil
+}
+
+func (et *etcdKV) WatchTreeWithContext(
+	ctx context.Context,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	prefix = et.domain + prefix
+	go et.watchStart(ctx, prefix, true, waitIndex, opaque, watchCB)
+	return nil
+}
+
+func (et *etcdKV) WatchAll(
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) WatchAllWithContext(
+	ctx context.Context,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) DeleteIf(key string, pred func([]byte) bool) (bool, error) {
+	kvp, err := et.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if !pred(kvp.Value) {
+		return false, nil
+	}
+	// The key is deleted only if it was not modified since pred was called.
+	if _, err := et.CompareAndDelete(kvp, kvdb.KVModifiedIndex); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (et *etcdKV) OnConnectionStateChange(cb kvdb.ConnStateCB) {
+	// The client is set up in New and transitions are not tracked yet, so
+	// only the initial connected state is reported.
+	cb(kvdb.ConnStateConnected)
+}
+
+func (et *etcdKV) EnumerateAt(prefix string) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) EnumeratePaged(
+	prefix string,
+	limit int,
+	cursor string,
+) (kvdb.KVPairs, string, error) {
+	return nil, "", kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) PollChanges(
+	prefix string,
+	sinceIndex uint64,
+) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) ReplaceTree(
+	prefix string,
+	pairs map[string]interface{},
+	ttl uint64,
+) (int, int, error) {
+	return 0, 0, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) CreateBatch(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) PutBulk(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvps := make(kvdb.KVPairs, 0, len(keys))
+	for _, key := range keys {
+		kvp, err := et.Put(key, pairs[key], ttl)
+		if err != nil {
+			return kvps, fmt.Errorf("key %q: %w", key, err)
+		}
+		kvps = append(kvps, kvp)
+	}
+	return kvps, nil
+}
+
+func (et *etcdKV) AtomicAddBatch(
+	deltas map[string]int64,
+) (map[string]int64, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) AtomicIncrement(key string, delta int64) (int64, error) {
+	for {
+		kvp, err := et.Get(key)
+		if err == kvdb.ErrNotFound {
+			_, err = et.Create(key, strconv.FormatInt(delta, 10), 0)
+			if err == nil {
+				return delta, nil
+			}
+			// Retry if the counter was created since it was read.
+			if err != kvdb.ErrExist {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(string(kvp.Value), 10, 64)
+		if err != nil {
+			return 0, kvdb.ErrNotNumeric
+		}
+		// The counter is set without its lease, as CompareAndSet does.
+		kvp.Value = []byte(strconv.FormatInt(n+delta, 10))
+		_, err = et.CompareAndSet(kvp, kvdb.KVModifiedIndex, nil)
+		if err == nil {
+			return n + delta, nil
+		}
+		// Retry if the counter was changed since it was read.
+		if err != kvdb.ErrModified {
+			return 0, err
+		}
+	}
+}
+
+func (et *etcdKV) AtomicDecrement(key string, delta int64) (int64, error) {
+	return et.AtomicIncrement(key, -delta)
+}
+
+func (et *etcdKV) PauseWatch(key string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) ResumeWatch(key string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) StopWatchGroup(group string) int {
+	// Grouped watches need WatchKeyOpts or WatchTreeOpts, which are not
+	// supported.
+	return 0
+}
+
+func (et *etcdKV) MoveIf(
+	src string,
+	dst string,
+	expectedDstValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) LockStats(key string) (kvdb.LockStat, error) {
+	return kvdb.LockStat{}, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) PutIfOther(
+	key string,
+	value interface{},
+	ttl uint64,
+	guardKey string,
+	guardValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) ReplayHistory(
+	fromIndex uint64,
+	fn func(kvp *kvdb.KVPair) error,
+) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) LockWithPriority(
+	key string,
+	lockerID string,
+	priority int,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) LockWithTimeout(
+	key string,
+	lockerID string,
+	lockTimeout time.Duration,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) Rates() (float64, float64) {
+	return 0, 0
+}
+
+func (et *etcdKV) PutWithFallback(
+	key string,
+	value interface{},
+	fallback interface{},
+	after time.Duration,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) HasWatchers(key string) (bool, error) {
+	return false, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) WatchFrom(
+	key string,
+) (*kvdb.KVPair, <-chan *kvdb.KVPair, func(), error) {
+	return nil, nil, nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) Rename(oldKey, newKey string) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) GetMultiConsistent(keys []string) (kvdb.KVPairs, uint64, error) {
+	return nil, 0, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) Recode(newCodec kvdb.Codec) (int, error) {
+	return 0, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) GetRaw(key string) (*kvdb.KVPair, error) {
+	// Aliases are not supported, so no key is ever resolved.
+	return et.Get(key)
+}
+
+func (et *etcdKV) GetConsistent(
+	key string,
+	level kvdb.Consistency,
+) (*kvdb.KVPair, error) {
+	if level < kvdb.Linearizable || level > kvdb.Stale {
+		return nil, kvdb.ErrIllegal
+	}
+	// The levels are not distinguished, every read is served as by Get.
+	return et.Get(key)
+}
+
+func (et *etcdKV) CreateAlias(alias, target string) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) PutMonotonic(
+	key string,
+	value int64,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	return nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) EnumerateGrouped(prefix string) (map[string]kvdb.KVPairs, error) {
+	kvps, err := et.Enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return kvdb.GroupBySegment(prefix, kvps), nil
+}
+
+func (et *etcdKV) TryLockMany(
+	keys []string,
+	lockerID string,
+	ttl uint64,
+) ([]*kvdb.KVPair, []string, error) {
+	return nil, nil, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) DeleteTreeIfVersion(
+	prefix string,
+	versionKey string,
+	expectedValue []byte,
+) (int, error) {
+	return 0, kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) LatestUnder(prefix string) (*kvdb.KVPair, error) {
+	kvps, err := et.Enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var latest *kvdb.KVPair
+	for _, kvp := range kvps {
+		if latest == nil || kvp.ModifiedIndex > latest.ModifiedIndex {
+			latest = kvp
+		}
+	}
+	if latest == nil {
+		return nil, kvdb.ErrNotFound
+	}
+	return latest, nil
+}
+
+func (et *etcdKV) WriteMetrics(w io.Writer) error {
+	return kvdb.ErrNotSupported
+}
+
+func (et *etcdKV) AllowN(key string, rate float64, burst int, n int) (bool, error) {
+	return false, kvdb.ErrNotSupported
+}
@@ -0,0 +1,34 @@
+package kvdb
+
+import (
+	"sync"
+)
+
+// FencingToken returns the fencing token of a lock acquired through Lock or
+// LockWithID. Tokens increase monotonically with every acquisition of a lock,
+// so a resource guarded by the lock can reject requests from a holder whose
+// lock has since expired and been acquired by someone else.
+func FencingToken(lock *KVPair) uint64 {
+	return lock.ModifiedIndex
+}
+
+// FencingGuard tracks the highest fencing token seen by a resource. The zero
+// value is ready to use.
+type FencingGuard struct {
+	// mu protects highest
+	mu sync.Mutex
+	// highest is the highest token accepted so far
+	highest uint64
+}
+
+// Check accepts token if it is not lower than any token seen before and
+// returns ErrStaleFence otherwise.
+func (g *FencingGuard) Check(token uint64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if token < g.highest {
+		return ErrStaleFence
+	}
+	g.highest = token
+	return nil
+}
@@ -0,0 +1,17 @@
+package kvdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFencingGuard(t *testing.T) {
+	var g FencingGuard
+
+	assert.NoError(t, g.Check(5), "First token should be accepted")
+	assert.NoError(t, g.Check(5), "Same token should be accepted")
+	assert.NoError(t, g.Check(7), "Higher token should be accepted")
+	assert.Equal(t, ErrStaleFence, g.Check(6), "Lower token should be rejected")
+	assert.NoError(t, g.Check(8), "Higher token should be accepted after a rejection")
+}
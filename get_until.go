@@ -0,0 +1,95 @@
+package kvdb
+
+import (
+	"context"
+	"time"
+)
+
+// GetUntil returns key once its value satisfies pred. The current value is
+// checked first, then every later value delivered by a watch on key.
+// ErrWatchTimeout is returned if no value satisfies pred before timeout.
+// It requires db to support WatchKeyWithContext.
+func GetUntil(
+	db Kvdb,
+	key string,
+	pred func([]byte) bool,
+	timeout time.Duration,
+) (*KVPair, error) {
+	kvps, waitIndex, err := watchStart(db, key)
+	if err != nil {
+		return nil, err
+	}
+	if kvp := findKey(kvps, key); kvp != nil && pred(kvp.Value) {
+		return kvp, nil
+	}
+
+	// Only the first outcome is delivered, so the ErrWatchStopped that
+	// follows a match is dropped.
+	type outcome struct {
+		kvp *KVPair
+		err error
+	}
+	done := make(chan outcome, 1)
+	notify := func(kvp *KVPair, err error) {
+		select {
+		case done <- outcome{kvp: kvp, err: err}:
+		default:
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = db.WatchKeyWithContext(ctx, key, waitIndex, nil,
+		func(prefix string, opaque interface{}, kvp *KVPair, err error) error {
+			if err != nil {
+				notify(nil, err)
+				return err
+			}
+			if kvp.Action == KVDelete || kvp.Action == KVExpire ||
+				!pred(kvp.Value) {
+				return nil
+			}
+			notify(kvp, nil)
+			return ErrWatchStopped
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-done:
+		return result.kvp, result.err
+	case <-time.After(timeout):
+		return nil, ErrWatchTimeout
+	}
+}
+
+// watchStart returns the pairs under prefix along with the index to watch
+// prefix from so that no later change is missed. That is the store index if
+// db supports EnumerateAt, since the index of a pair written long ago may
+// have left the watch history, which fails the watch with
+// ErrWatchRevisionCompacted. Otherwise it is the highest index of the pairs.
+func watchStart(db Kvdb, prefix string) (KVPairs, uint64, error) {
+	kvps, index, err := db.EnumerateAt(prefix)
+	if err != ErrNotSupported {
+		return kvps, index, err
+	}
+	if kvps, err = db.Enumerate(prefix); err != nil {
+		return nil, 0, err
+	}
+	for _, kvp := range kvps {
+		if kvp.ModifiedIndex > index {
+			index = kvp.ModifiedIndex
+		}
+	}
+	return kvps, index, nil
+}
+
+// findKey returns the pair of key in kvps, nil if there is none.
+func findKey(kvps KVPairs, key string) *KVPair {
+	for _, kvp := range kvps {
+		if kvp.Key == key {
+			return kvp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package kvdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func isReady(value []byte) bool {
+	return bytes.Equal(value, []byte("ready"))
+}
+
+func TestGetUntil(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("status/now", []byte("ready"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err := kvdb.GetUntil(kv, "status/now", isReady, time.Second)
+	require.NoError(t, err, "Current value should satisfy pred")
+	assert.Equal(t, "ready", string(kvp.Value), "Unexpected value")
+
+	for _, initial := range []string{"starting", ""} {
+		key := "status/later" + initial
+		if initial != "" {
+			_, err = kv.Put(key, []byte(initial), 0)
+			require.NoError(t, err, "Unexpected error in Put")
+		}
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, err := kv.Put(key, []byte("waiting"), 0)
+			assert.NoError(t, err, "Unexpected error in Put")
+			_, err = kv.Put(key, []byte("ready"), 0)
+			assert.NoError(t, err, "Unexpected error in Put")
+		}()
+		kvp, err = kvdb.GetUntil(kv, key, isReady, 5*time.Second)
+		require.NoError(t, err, "Later value should satisfy pred")
+		assert.Equal(t, "ready", string(kvp.Value), "Unexpected value")
+	}
+}
+
+func TestGetUntilTimeout(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	// A value that satisfied pred before the key was deleted doesn't count.
+	_, err = kv.Put("status/gone", []byte("ready"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Delete("status/gone")
+	require.NoError(t, err, "Unexpected error in Delete")
+	_, err = kv.Put("status/stuck", []byte("starting"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	for _, key := range []string{"status/gone", "status/stuck"} {
+		_, err = kvdb.GetUntil(kv, key, isReady, 100*time.Millisecond)
+		assert.Equal(t, kvdb.ErrWatchTimeout, err, "Expected timeout on %v", key)
+		// The watch must not outlive the call on a key that stays quiet.
+		require.Eventually(t, func() bool {
+			has, err := kv.HasWatchers(key)
+			return err == nil && !has
+		}, 5*time.Second, 10*time.Millisecond, "Watch on %v leaked", key)
+	}
+}
+
+func TestGetUntilMatchThenStop(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	// The watch is stopped right after each match, which must not be
+	// reported in place of the match.
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("status/repeat%d", i)
+		_, err = kv.Put(key, []byte("starting"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+		go func() {
+			_, err := kv.Put(key, []byte("ready"), 0)
+			assert.NoError(t, err, "Unexpected error in Put")
+		}()
+		kvp, err := kvdb.GetUntil(kv, key, isReady, 5*time.Second)
+		require.NoError(t, err, "Match should be returned, iteration %d", i)
+		assert.Equal(t, "ready", string(kvp.Value), "Unexpected value")
+	}
+}
+
+// newShortHistory returns a mem kvdb keeping only a few updates for replay,
+// and pushes the updates made so far out of its history by writing more.
+func newShortHistory(t *testing.T) (kvdb.Kvdb, func()) {
+	kv, err := mem.New("pwx/test", nil,
+		map[string]string{mem.HistorySizeKey: "10"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	return kv, func() {
+		for i := 0; i < 15; i++ {
+			_, err := kv.Put(fmt.Sprintf("other/%d", i), []byte("other"), 0)
+			require.NoError(t, err, "Unexpected error in Put")
+		}
+	}
+}
+
+func TestGetUntilOldWrite(t *testing.T) {
+	kv, compact := newShortHistory(t)
+	_, err := kv.Put("status/old", []byte("starting"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	compact()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := kv.Put("status/old", []byte("ready"), 0)
+		assert.NoError(t, err, "Unexpected error in Put")
+	}()
+	kvp, err := kvdb.GetUntil(kv, "status/old", isReady, 5*time.Second)
+	require.NoError(t, err, "A key written before the history should be watched")
+	assert.Equal(t, "ready", string(kvp.Value), "Unexpected value")
+}
@@ -0,0 +1,27 @@
+package kvdb
+
+import "strings"
+
+// GroupBySegment buckets kvps by the path segment following prefix in their
+// key. Pairs under prefix/a/ and at prefix/a go in bucket "a", a pair whose
+// key has no segment after prefix goes in bucket "" and pairs outside prefix,
+// such as prefixx/a, are left out.
+func GroupBySegment(prefix string, kvps KVPairs) map[string]KVPairs {
+	prefix = strings.TrimSuffix(prefix, "/")
+	groups := make(map[string]KVPairs)
+	for _, kvp := range kvps {
+		rest := kvp.Key
+		if prefix != "" {
+			if rest != prefix && !strings.HasPrefix(rest, prefix+"/") {
+				continue
+			}
+			rest = strings.TrimPrefix(rest[len(prefix):], "/")
+		}
+		segment := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			segment = rest[:i]
+		}
+		groups[segment] = append(groups[segment], kvp)
+	}
+	return groups
+}
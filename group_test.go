@@ -0,0 +1,44 @@
+package kvdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keysOf(kvps KVPairs) []string {
+	keys := make([]string, 0, len(kvps))
+	for _, kvp := range kvps {
+		keys = append(keys, kvp.Key)
+	}
+	return keys
+}
+
+func TestGroupBySegment(t *testing.T) {
+	kvps := KVPairs{
+		{Key: "tenants/a/x"},
+		{Key: "tenants/a/y/z"},
+		{Key: "tenants/b/y"},
+		{Key: "tenants/c"},
+		{Key: "tenants"},
+		{Key: "tenants/"},
+		{Key: "tenantsx/d"},
+	}
+	for _, prefix := range []string{"tenants", "tenants/"} {
+		groups := GroupBySegment(prefix, kvps)
+		assert.Len(t, groups, 4, "Unexpected buckets %v", groups)
+		assert.Equal(t, []string{"tenants/a/x", "tenants/a/y/z"}, keysOf(groups["a"]),
+			"Unexpected bucket a")
+		assert.Equal(t, []string{"tenants/b/y"}, keysOf(groups["b"]),
+			"Unexpected bucket b")
+		assert.Equal(t, []string{"tenants/c"}, keysOf(groups["c"]),
+			"A leaf key should be its own bucket")
+		assert.Equal(t, []string{"tenants", "tenants/"}, keysOf(groups[""]),
+			"Keys with no further segment should be in the empty bucket")
+	}
+
+	groups := GroupBySegment("", kvps)
+	assert.Len(t, groups, 2, "Unexpected buckets %v", groups)
+	assert.Len(t, groups["tenants"], 6, "Unexpected bucket tenants")
+	assert.Len(t, groups["tenantsx"], 1, "Unexpected bucket tenantsx")
+}
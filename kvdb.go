@@ -1,7 +1,11 @@
 package kvdb
 
 import (
+	"context"
 	"errors"
+	"io"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 )
 
@@ -18,6 +22,10 @@ const (
 	KVExpire
 	// KVUknown operation on KV pair
 	KVUknown
+	// KVCompacted is delivered to a watch in place of changes it had not
+	// received when they are compacted. The ModifiedIndex of the pair is the
+	// oldest index still available. See WatchOptions.CompactionEvents.
+	KVCompacted
 )
 
 const (
@@ -37,6 +45,27 @@ const (
 	KVTTL
 )
 
+// Consistency is the consistency level requested for a read.
+type Consistency int
+
+const (
+	// Linearizable reads return the latest committed value.
+	Linearizable Consistency = iota
+	// Serializable reads may be served from the local state of any member,
+	// which can lag behind the latest committed value.
+	Serializable
+	// Stale reads may return any recently committed value, possibly from a
+	// cache.
+	Stale
+)
+
+// MaxAliasDepth is the number of aliases followed when resolving an alias.
+const MaxAliasDepth = 8
+
+// NoTTL passed as the ttl of a write stores the key without expiry, even if
+// the kvdb is configured with a default TTL.
+const NoTTL = ^uint64(0)
+
 const (
 	// ReadPermission for read only access
 	ReadPermission = iota
@@ -64,6 +93,22 @@ const (
 	RetryCountKey = "RetryCount"
 	// ACLTokenKey is the token value for ACL based KV stores
 	ACLTokenKey = "ACLToken"
+	// ValueValidatorKey is the name of a ValueValidator, registered through
+	// RegisterValueValidator, that checks values on Put, Create and Update
+	ValueValidatorKey = "ValueValidator"
+	// CodecKey is the name of a Codec, registered through RegisterCodec,
+	// that encodes the values other than strings and byte slices. Values
+	// are encoded by JSONCodec by default.
+	CodecKey = "Codec"
+	// PanicHookKey is the name of a PanicHook, registered through
+	// RegisterPanicHook, that is told of panics in watch callbacks. They
+	// are logged through logrus by default.
+	PanicHookKey = "PanicHook"
+	// DefaultTTLKey is the ttl, in seconds, of keys put or created with a
+	// zero ttl, including counters and token buckets created by their first
+	// update. A default of 0, like an unset one, applies no TTL. NoTTL
+	// stores a key without expiry.
+	DefaultTTLKey = "default_ttl"
 )
 
 // List of kvdb endpoints supported versions
@@ -101,6 +146,11 @@ var (
 	ErrTTLNotSupported = errors.New("TTL value not supported")
 	// ErrInvalidLock Lock and unlock operations don't match.
 	ErrInvalidLock = errors.New("Invalid lock/unlock operation")
+	// ErrLockTimeout raised if a lock could not be acquired in time.
+	ErrLockTimeout = errors.New("Timed out waiting for lock")
+	// ErrRefusingRootDelete raised if DeleteTree is asked to delete every
+	// key in the domain.
+	ErrRefusingRootDelete = errors.New("Refusing to delete the whole domain")
 	// ErrNoPassword provided
 	ErrNoPassword = errors.New("Username provided without any password")
 	// ErrAuthNotSupported authentication not supported for this kvdb implementation
@@ -112,6 +162,31 @@ var (
 	// ErrMemberDoesNotExist returned when an operation fails for a member
 	// which does not exist
 	ErrMemberDoesNotExist = errors.New("Kvdb member does not exist")
+	// ErrInvalidCursor raised if a watch cursor token cannot be decoded
+	ErrInvalidCursor = errors.New("Invalid watch cursor")
+	// ErrStaleFence raised if an operation carries a fencing token lower than
+	// one that has already been seen
+	ErrStaleFence = errors.New("Stale fencing token")
+	// ErrWatchRevisionCompacted raised if the changes after the requested
+	// index are no longer retained
+	ErrWatchRevisionCompacted = errors.New("Requested revision has been compacted")
+	// ErrNotNumeric raised if a counter operation finds a non numeric value
+	ErrNotNumeric = errors.New("Value is not numeric")
+	// ErrWatchOverflow raised when a paused watch buffered more updates than
+	// it can hold
+	ErrWatchOverflow = errors.New("Watch buffer overflow")
+	// ErrWatchTimeout raised if a condition awaited through a watch does not
+	// hold before the timeout
+	ErrWatchTimeout = errors.New("Timed out waiting on watch")
+	// ErrValidation raised if a value is refused by the ValueValidator
+	ErrValidation = errors.New("Value failed validation")
+	// ErrAliasDepth raised if resolving an alias follows more than
+	// MaxAliasDepth aliases, which happens if aliases form a cycle
+	ErrAliasDepth = errors.New("Too many levels of aliases")
+	// ErrCorrupt raised if a stored value does not match its checksum
+	ErrCorrupt = errors.New("Value is corrupt")
+	// ErrNonMonotonic raised if PutMonotonic would decrease the stored value
+	ErrNonMonotonic = errors.New("Value is less than the stored value")
 )
 
 // KVAction specifies the action on a KV pair. This is useful to make decisions
@@ -129,9 +204,50 @@ type PermissionType int
 // with ErrWatchStopped.
 type WatchCB func(prefix string, opaque interface{}, kvp *KVPair, err error) error
 
+// WatchOptions configures a watch started through WatchKeyOpts or
+// WatchTreeOpts.
+type WatchOptions struct {
+	// WaitIndex is the oldest ModifiedIndex of a KVPair for which updates
+	// are requested.
+	WaitIndex uint64
+	// Opaque is passed back to the watch callback.
+	Opaque interface{}
+	// Filter if set is called for each update and only the updates for
+	// which it returns true are delivered.
+	Filter func(kvp *KVPair) bool
+	// StopOnDelete stops the watch once the deletion of a watched key has
+	// been delivered.
+	StopOnDelete bool
+	// InitialValue makes a key watch first deliver the current pair, with
+	// action KVGet, followed by the changes made after it. WaitIndex is
+	// ignored. If the key does not exist nothing is delivered until it is
+	// created, unless InitialNotFound is set.
+	InitialValue bool
+	// InitialNotFound makes an InitialValue watch on a missing key call the
+	// callback once with ErrNotFound. The watch continues unless the
+	// callback returns an error.
+	InitialNotFound bool
+	// Group tags the watch so that it can be stopped along with the other
+	// watches of the group by StopWatchGroup.
+	Group string
+	// CompactionEvents makes the watch drop the changes it has not received
+	// when HistoryCompactor.CompactHistory compacts them, and receive a pair
+	// with action KVCompacted in their place. Otherwise the watch receives
+	// every change whether it was compacted or not.
+	CompactionEvents bool
+}
+
 // FatalErrorCB callback is invoked incase of fatal errors
 type FatalErrorCB func(format string, args ...interface{})
 
+// ValueValidator checks value before it is written to key. A non-nil error
+// refuses the write.
+type ValueValidator func(key string, value []byte) error
+
+// PanicHook is called with the prefix of a watch and the value recovered
+// from a panic in its callback.
+type PanicHook func(prefix string, recovered interface{})
+
 // DatastoreInit is called to activate a backend KV store.
 type DatastoreInit func(domain string, machines []string, options map[string]string,
 	cb FatalErrorCB) (Kvdb, error)
@@ -147,8 +263,12 @@ type KVPair struct {
 	Value []byte
 	// Action the last action on this KVPair.
 	Action KVAction
-	// TTL value after which this key will expire from KVDB
+	// TTL value after which this key will expire from KVDB. Reads report
+	// the seconds remaining rather than the TTL the key was written with.
 	TTL int64
+	// ExpiresAt is the absolute time at which this key expires. It is the
+	// zero time if the key has no TTL.
+	ExpiresAt time.Time
 	// KVDBIndex A Monotonically index updated at each modification operation.
 	KVDBIndex uint64
 	// CreatedIndex for this kv pair
@@ -162,10 +282,50 @@ type KVPair struct {
 // KVPairs list of KVPairs
 type KVPairs []*KVPair
 
+// LockStat describes the contention on a lock.
+type LockStat struct {
+	// Waiters is the number of callers currently waiting for the lock.
+	Waiters int
+	// LongestWait is how long the longest waiting caller has been waiting.
+	LongestWait time.Duration
+}
+
+// KeyStat describes how often a key was accessed.
+type KeyStat struct {
+	// Key is the accessed key.
+	Key string
+	// Reads is the number of times the key was read.
+	Reads uint64
+	// Writes is the number of times the key was written or deleted.
+	Writes uint64
+}
+
+// MemoryStats describes the memory taken by the keys and values of a kvdb.
+type MemoryStats struct {
+	// Keys is the number of stored keys, including hidden and lock keys.
+	Keys int
+	// KeyBytes is the total length of the stored keys.
+	KeyBytes int
+	// StoredKeyBytes is the number of bytes held for the stored keys, less
+	// than KeyBytes when the keys share their prefixes.
+	StoredKeyBytes int
+	// ValueBytes is the total length of the stored values.
+	ValueBytes int
+}
+
 // Tx Interface to transactionally apply updates to a set of keys.
 type Tx interface {
 	// Put specified key value pair in TX.
 	Put(key string, value interface{}, ttl uint64) (*KVPair, error)
+	// Create is the same as Put except that ErrExist is returned if the key
+	// exists in this TXs view, or exists in the KVDB on commit.
+	Create(key string, value interface{}, ttl uint64) (*KVPair, error)
+	// Update is the same as Put except that ErrNotFound is returned if the
+	// key does not exist in this TXs view, or in the KVDB on commit.
+	Update(key string, value interface{}, ttl uint64) (*KVPair, error)
+	// Delete deletes key in TX. ErrNotFound is returned if the key does not
+	// exist in this TXs view, or in the KVDB on commit.
+	Delete(key string) (*KVPair, error)
 	// Get returns KVPair in this TXs view. If not found, returns value from
 	// backing KVDB.
 	Get(key string) (*KVPair, error)
@@ -173,8 +333,9 @@ type Tx interface {
 	GetVal(key string, value interface{}) (*KVPair, error)
 	// Prepare returns an error it transaction cannot be logged.
 	Prepare() error
-	// Commit propagates updates to the KVDB. No operations on this Tx are
-	// allowed after commit.
+	// Commit atomically propagates updates to the KVDB, or none of them if
+	// an error is returned. No operations on this Tx are allowed after
+	// commit.
 	Commit() error
 	// Abort aborts this transaction.  No operations on this Tx are allowed
 	// afer commit.
@@ -186,30 +347,147 @@ type Kvdb interface {
 	KvdbController
 	// String representation of backend datastore.
 	String() string
+	// Domain returns the prefix of the keys stored by this kvdb, with its
+	// trailing slash, or "" if there is none.
+	Domain() string
+	// FullKey returns the key that key is stored under, which is key
+	// prefixed with the domain. Tools that bypass this library should use it.
+	FullKey(key string) string
 	// Capbilities - see KVCapabilityXXX
 	Capabilities() int
-	// Get returns KVPair that maps to specified key or ErrNotFound.
+	// Get returns KVPair that maps to specified key or ErrNotFound. If key
+	// is an alias, the pair of the key it resolves to is returned.
 	Get(key string) (*KVPair, error)
+	// GetRaw is the same as Get except that aliases are not resolved, the
+	// alias record itself, whose value is the target key, is returned.
+	GetRaw(key string) (*KVPair, error)
+	// GetConsistent is the same as Get with the read served at the given
+	// consistency level. Backends that do not distinguish the levels serve
+	// every read as Get does. ErrIllegal is returned for an unknown level.
+	GetConsistent(key string, level Consistency) (*KVPair, error)
+	// CreateAlias makes alias resolve to target in Get. Aliases may point to
+	// other aliases, resolution fails with ErrAliasDepth past MaxAliasDepth.
+	// ErrExist is returned if alias exists. Target need not exist, Get
+	// returns ErrNotFound for a dangling alias.
+	CreateAlias(alias, target string) error
 	// Get returns KVPair that maps to specified key or ErrNotFound. If found
 	// value contains the unmarshalled result or error is ErrUnmarshal
 	GetVal(key string, value interface{}) (*KVPair, error)
+	// GetValMulti fetches the value at key once and unmarshals it into each
+	// of targets. A decode failure reports the index of the failing target.
+	GetValMulti(key string, targets ...interface{}) (*KVPair, error)
+	// GetMultiConsistent returns the pairs of the keys that exist, all read
+	// at the same point, and the kvdb index at which they were read. Missing
+	// keys are skipped.
+	GetMultiConsistent(keys []string) (KVPairs, uint64, error)
 	// Put inserts value at key in kvdb. If value is a runtime.Object, it is
 	// marshalled. If Value is []byte it is set directly. If Value is a string,
-	// its byte representation is stored.
+	// its byte representation is stored. A non-zero ttl expires the key after
+	// ttl seconds, a zero ttl clears any existing expiry unless the kvdb is
+	// configured with a default TTL. NoTTL always clears it.
 	Put(key string, value interface{}, ttl uint64) (*KVPair, error)
 	// Create is the same as Put except that ErrExist is returned if the key exists.
 	Create(key string, value interface{}, ttl uint64) (*KVPair, error)
 	// Update is the same as Put except that ErrNotFound is returned if the key
-	// does not exist.
+	// does not exist and that a zero ttl preserves the existing expiry of the
+	// key. A non-zero ttl resets it.
 	Update(key string, value interface{}, ttl uint64) (*KVPair, error)
+	// PutMonotonic is the same as Put for an integer value except that
+	// ErrNonMonotonic is returned if key holds an integer greater than value.
+	PutMonotonic(key string, value int64, ttl uint64) (*KVPair, error)
 	// Enumerate returns a list of KVPair for all keys that share the specified prefix.
+	// An empty prefix returns every key in the domain.
 	Enumerate(prefix string) (KVPairs, error)
+	// EnumerateAt is the same as Enumerate except that all pairs are read
+	// at a single kvdb index, which is returned along with them.
+	EnumerateAt(prefix string) (KVPairs, uint64, error)
+	// EnumeratePaged is the same as Enumerate except that at most limit
+	// pairs are returned, in key order, starting after the key cursor. The
+	// returned cursor is the last key returned, to be passed to the next
+	// call, or empty once all pairs have been returned.
+	EnumeratePaged(prefix string, limit int, cursor string) (KVPairs, string, error)
+	// EnumerateGrouped is the same as Enumerate except that the pairs are
+	// bucketed by the path segment following prefix, as by GroupBySegment.
+	EnumerateGrouped(prefix string) (map[string]KVPairs, error)
+	// LatestUnder returns the pair with the highest ModifiedIndex of those
+	// sharing prefix, or ErrNotFound if there are none.
+	LatestUnder(prefix string) (*KVPair, error)
 	// Delete deletes the KVPair specified by the key. ErrNotFound is returned
 	// if the key is not found. The old KVPair is returned if successful.
 	Delete(key string) (*KVPair, error)
 	// DeleteTree same as Delete execpt that all keys sharing the prefix are
-	// deleted.
+	// deleted. An empty prefix is refused with ErrRefusingRootDelete.
 	DeleteTree(prefix string) error
+	// DeleteTreeForce is the same as DeleteTree except that an empty prefix
+	// deletes every key in the domain.
+	DeleteTreeForce(prefix string) error
+	// DeleteTreeWithResult is the same as DeleteTree except that the deleted
+	// pairs are returned, in key order. If some keys fail to be deleted the
+	// rest are still deleted and the error lists the failed keys.
+	DeleteTreeWithResult(prefix string) (KVPairs, error)
+	// DeleteTreeIfVersion atomically deletes the keys sharing prefix, provided
+	// versionKey holds expectedValue, and returns the number of keys deleted.
+	// ErrValueMismatch is returned, and nothing deleted, otherwise.
+	DeleteTreeIfVersion(
+		prefix string,
+		versionKey string,
+		expectedValue []byte,
+	) (int, error)
+	// AtomicAddBatch atomically adds each delta to the counter stored as a
+	// decimal integer at its key and returns the new values. Missing keys
+	// count as 0. If any value is not numeric, ErrNotNumeric is returned and
+	// no counter is changed.
+	AtomicAddBatch(deltas map[string]int64) (map[string]int64, error)
+	// AtomicIncrement atomically adds delta to the counter at key, as
+	// AtomicAddBatch does, and returns its new value.
+	AtomicIncrement(key string, delta int64) (int64, error)
+	// AtomicDecrement atomically subtracts delta from the counter at key and
+	// returns its new value.
+	AtomicDecrement(key string, delta int64) (int64, error)
+	// AllowN atomically takes n tokens from the token bucket stored at key
+	// and reports whether they were available. The bucket holds up to burst
+	// tokens, starts full and refills at rate tokens per second.
+	AllowN(key string, rate float64, burst int, n int) (bool, error)
+	// PutIfOther atomically puts value at key provided the value at guardKey
+	// equals guardValue. It returns ErrValueMismatch if the guard holds
+	// another value and ErrNotFound if guardKey does not exist.
+	PutIfOther(
+		key string,
+		value interface{},
+		ttl uint64,
+		guardKey string,
+		guardValue []byte,
+	) (*KVPair, error)
+	// PutWithFallback puts value at key and, after the given duration, puts
+	// fallback at key unless key was changed or deleted in the meantime.
+	PutWithFallback(
+		key string,
+		value interface{},
+		fallback interface{},
+		after time.Duration,
+	) (*KVPair, error)
+	// MoveIf atomically moves the value and TTL of src to dst and deletes
+	// src, provided dst is absent or holds expectedDstValue. It returns the
+	// new dst pair, or ErrValueMismatch if dst holds another value.
+	MoveIf(src, dst string, expectedDstValue []byte) (*KVPair, error)
+	// Rename atomically moves the value of oldKey to newKey, keeping its
+	// CreatedIndex and expiry, and deletes oldKey. It returns ErrNotFound if
+	// oldKey does not exist and ErrExist if newKey does.
+	Rename(oldKey, newKey string) (*KVPair, error)
+	// ReplaceTree atomically makes pairs, keyed relative to prefix, the only
+	// keys under prefix. Keys missing from pairs are deleted and the rest are
+	// put with ttl. It returns the number of keys put and deleted.
+	ReplaceTree(prefix string, pairs map[string]interface{}, ttl uint64) (int, int, error)
+	// CreateBatch atomically creates every key in pairs with its value and
+	// ttl, and returns the created pairs in key order. If any of the keys
+	// exists nothing is created and an error wrapping ErrExist names the
+	// first such key.
+	CreateBatch(pairs map[string]interface{}, ttl uint64) (KVPairs, error)
+	// PutBulk puts every key in pairs with its value and ttl, in key order
+	// and with increasing indexes, and returns the put pairs. Unlike
+	// CreateBatch it is not atomic: if a key fails the keys before it stay
+	// put and they are returned with an error naming the failed key.
+	PutBulk(pairs map[string]interface{}, ttl uint64) (KVPairs, error)
 	// Keys returns an array of keys that share specified prefix (ie. "1st level directory").
 	// sep parameter defines a key-separator, and if not provided the "/" is assumed.
 	Keys(prefix, sep string) ([]string, error)
@@ -221,21 +499,135 @@ type Kvdb interface {
 	CompareAndDelete(kvp *KVPair, flags KVFlags) (*KVPair, error)
 	// WatchKey calls watchCB everytime a value at key is updated. waitIndex
 	// is the oldest ModifiedIndex of a KVPair for which updates are requestd.
+	// ErrWatchRevisionCompacted is returned if the changes after a non-zero
+	// waitIndex are no longer retained.
 	WatchKey(key string, waitIndex uint64, opaque interface{}, watchCB WatchCB) error
 	// WatchTree is the same as WatchKey except that watchCB is triggered
 	// for updates on all keys that share the prefix.
 	WatchTree(prefix string, waitIndex uint64, opaque interface{}, watchCB WatchCB) error
+	// WatchKeyOpts is the same as WatchKey with the watch configured by opts.
+	WatchKeyOpts(key string, opts WatchOptions, watchCB WatchCB) error
+	// WatchTreeOpts is the same as WatchTree with the watch configured by opts.
+	WatchTreeOpts(prefix string, opts WatchOptions, watchCB WatchCB) error
+	// WatchKeyWithContext is the same as WatchKey except that the watch is
+	// stopped, with a final call to watchCB with ErrWatchStopped, once ctx
+	// is done.
+	WatchKeyWithContext(
+		ctx context.Context,
+		key string,
+		waitIndex uint64,
+		opaque interface{},
+		watchCB WatchCB,
+	) error
+	// WatchTreeWithContext is the same as WatchTree except that the watch is
+	// stopped, with a final call to watchCB with ErrWatchStopped, once ctx
+	// is done.
+	WatchTreeWithContext(
+		ctx context.Context,
+		prefix string,
+		waitIndex uint64,
+		opaque interface{},
+		watchCB WatchCB,
+	) error
+	// WatchAll is the same as WatchTree on every key of the domain, except
+	// that hidden keys, those with a path segment starting with "_", are
+	// not delivered, as they are not enumerated.
+	WatchAll(waitIndex uint64, opaque interface{}, watchCB WatchCB) error
+	// WatchAllWithContext is the same as WatchAll except that the watch is
+	// stopped, with a final call to watchCB with ErrWatchStopped, once ctx
+	// is done.
+	WatchAllWithContext(
+		ctx context.Context,
+		waitIndex uint64,
+		opaque interface{},
+		watchCB WatchCB,
+	) error
+	// WatchFrom atomically reads key and starts a watch on it from the index
+	// of that read, so no change after the returned pair is missed. The pair
+	// is nil if key does not exist. Changes are sent on the returned channel
+	// until the returned function is called or the watch fails, after which
+	// the channel is closed.
+	WatchFrom(key string) (*KVPair, <-chan *KVPair, func(), error)
+	// ReplayHistory calls fn with every retained change, including deletes,
+	// from fromIndex onward in ascending index order. fn can return
+	// ErrWatchStopped to stop the replay early without an error.
+	// ErrWatchRevisionCompacted is returned if changes from fromIndex are no
+	// longer retained.
+	ReplayHistory(fromIndex uint64, fn func(kvp *KVPair) error) error
+	// HasWatchers reports whether any key watch on key, or tree watch whose
+	// prefix covers key, is active.
+	HasWatchers(key string) (bool, error)
+	// PauseWatch pauses delivery to the watches on key, buffering their
+	// updates until ResumeWatch is called.
+	PauseWatch(key string) error
+	// ResumeWatch delivers the updates buffered while the watches on key were
+	// paused, in order, and resumes delivery. A watch that buffered more
+	// updates than it can hold is stopped with ErrWatchOverflow instead.
+	ResumeWatch(key string) error
+	// StopWatchGroup stops the watches registered with group in their
+	// WatchOptions, each receiving a final ErrWatchStopped, and returns the
+	// number of watches stopped.
+	StopWatchGroup(group string) int
+	// PollChanges returns the changes, including deletes, to keys under
+	// prefix after sinceIndex, and the kvdb index up to which changes were
+	// returned. Passing that index to the next call observes every change
+	// exactly once. ErrWatchRevisionCompacted is returned if the changes
+	// after sinceIndex are no longer retained.
+	PollChanges(prefix string, sinceIndex uint64) (KVPairs, uint64, error)
+	// Recode decodes every stored value with the current Codec, encodes it
+	// with newCodec and makes newCodec the current Codec. Values keep their
+	// indices and no watch updates are sent. If a value fails to decode
+	// nothing is changed. It returns the number of values recoded.
+	Recode(newCodec Codec) (int, error)
 	// Snapshot returns a kvdb snapshot and its version.
 	Snapshot(prefix string) (Kvdb, uint64, error)
+	// Restore replaces the contents of the kvdb with those of snap, as
+	// returned by Snapshot. Restored keys keep the remaining part of their
+	// TTL, measured on the clock of snap and run on the local one.
+	Restore(snap Kvdb) error
 	// SnapPut records the key value pair including the index.
 	SnapPut(kvp *KVPair) (*KVPair, error)
 	// Lock specfied key and associate a lockerID with it, probably to identify
 	// who acquired the lock. The KVPair returned should be used to unlock.
+	// Its ModifiedIndex is the fencing token of this acquisition, see
+	// FencingToken.
 	LockWithID(key string, lockerID string) (*KVPair, error)
 	// Lock specfied key. The KVPair returned should be used to unlock.
+	// Its ModifiedIndex is the fencing token of this acquisition, see
+	// FencingToken.
 	Lock(key string) (*KVPair, error)
+	// LockWithPriority is the same as LockWithID except that, among the
+	// callers waiting for the lock, the one with the highest priority
+	// acquires it next. Waiters with equal priority acquire in the order
+	// they started waiting.
+	LockWithPriority(key string, lockerID string, priority int) (*KVPair, error)
+	// LockWithTimeout is the same as LockWithID except that it fails with
+	// ErrLockTimeout if the lock is not acquired within lockTimeout, unless
+	// lockTimeout is 0. The lock expires after ttl seconds unless ttl is 0.
+	LockWithTimeout(
+		key string,
+		lockerID string,
+		lockTimeout time.Duration,
+		ttl uint64,
+	) (*KVPair, error)
+	// TryLockMany acquires those of the locks at keys that are free, without
+	// waiting for the others. Each acquired lock expires after ttl seconds
+	// unless ttl is 0. It returns the acquired locks, to be unlocked as
+	// usual, and the keys whose lock is held or waited for.
+	TryLockMany(
+		keys []string,
+		lockerID string,
+		ttl uint64,
+	) (acquired []*KVPair, skipped []string, err error)
+	// LockStats returns the current contention on the lock at key.
+	LockStats(key string) (LockStat, error)
 	// Unlock kvp previously acquired through a call to lock.
 	Unlock(kvp *KVPair) error
+	// RefreshLock resets the expiry of the lock kvp to ttl seconds from now,
+	// or to the TTL it was acquired with if ttl is 0, and returns the
+	// refreshed pair. ErrNotFound is returned if the lock has expired or
+	// been released.
+	RefreshLock(kvp *KVPair, ttl uint64) (*KVPair, error)
 	// TxNew returns a new Tx coordinator object or ErrNotSupported
 	TxNew() (Tx, error)
 	// AddUser adds a new user to kvdb
@@ -246,6 +638,39 @@ type Kvdb interface {
 	GrantUserAccess(username string, permType PermissionType, subtree string) error
 	// RevokeUsersAccess revokes user's access to a subtree/prefix based on the permission
 	RevokeUsersAccess(username string, permType PermissionType, subtree string) error
+	// EnqueueDelayed stores value in the queue rooted at queuePrefix so that
+	// it is returned by DequeueReady only after delay has elapsed. The
+	// generated key of the queued item is returned.
+	EnqueueDelayed(queuePrefix string, value []byte, delay time.Duration) (string, error)
+	// DequeueReady removes and returns the items in the queue rooted at
+	// queuePrefix whose delay has elapsed, in the order they became visible.
+	DequeueReady(queuePrefix string) (KVPairs, error)
+	// DeleteIfExists is the same as Delete except that a missing key is not
+	// an error. It returns true if the key existed and was deleted.
+	DeleteIfExists(key string) (bool, error)
+	// DeleteIf atomically reads the value at key and deletes the key only if
+	// pred returns true for that value. It returns true if the key was
+	// deleted and ErrNotFound if the key does not exist.
+	DeleteIf(key string, pred func([]byte) bool) (bool, error)
+	// WithLock returns a view of the kvdb whose Put, Create and Update are
+	// attributed to the holder of lock, as returned by Lock or LockWithID.
+	// Writes through the view fail with ErrInvalidLock once the lock is no
+	// longer held.
+	WithLock(lock *KVPair) (Kvdb, error)
+	// KeysWrittenBy returns the keys whose current value was written through
+	// a WithLock view of a lock held by lockerID.
+	KeysWrittenBy(lockerID string) ([]string, error)
+	// OnConnectionStateChange registers cb to be called whenever the
+	// backend connects to, disconnects from or fails over within the kvdb
+	// cluster. cb is called with the current state on registration.
+	OnConnectionStateChange(cb ConnStateCB)
+	// Rates returns the reads and writes per second over a sliding window
+	// of recent operations. Backends that do not count operations return 0.
+	Rates() (readsPerSec, writesPerSec float64)
+	// WriteMetrics writes the operation counts and latencies, the number of
+	// keys and the number of watches to w in the Prometheus text exposition
+	// format.
+	WriteMetrics(w io.Writer) error
 }
 
 // ReplayCb provides info required for replay
@@ -10,6 +10,16 @@ var (
 	datastores        = make(map[string]DatastoreInit)
 	datastoreVersions = make(map[string]DatastoreVersion)
 	lock              sync.RWMutex
+	// validators has its own lock since backends look them up from their
+	// DatastoreInit, which New calls with lock held
+	validators     = make(map[string]ValueValidator)
+	validatorsLock sync.RWMutex
+	// codecs has its own lock for the same reason as validators
+	codecs     = map[string]Codec{JSONCodecName: JSONCodec}
+	codecsLock sync.RWMutex
+	// panicHooks has its own lock for the same reason as validators
+	panicHooks     = make(map[string]PanicHook)
+	panicHooksLock sync.RWMutex
 )
 
 // Instance returns instance set via SetInstance, nil if none was set.
@@ -76,3 +86,72 @@ func Version(name string, url string, kvdbOptions map[string]string) (string, er
 	}
 	return "", ErrNotSupported
 }
+
+// RegisterValueValidator adds validator under name, so that it can be
+// selected through the ValueValidatorKey option.
+func RegisterValueValidator(name string, validator ValueValidator) error {
+	validatorsLock.Lock()
+	defer validatorsLock.Unlock()
+	if _, exists := validators[name]; exists {
+		return fmt.Errorf("Value validator %q is already registered", name)
+	}
+	validators[name] = validator
+	return nil
+}
+
+// GetValueValidator returns the value validator registered under name.
+func GetValueValidator(name string) (ValueValidator, error) {
+	validatorsLock.RLock()
+	defer validatorsLock.RUnlock()
+
+	if validator, exists := validators[name]; exists {
+		return validator, nil
+	}
+	return nil, fmt.Errorf("Value validator %q is not registered", name)
+}
+
+// RegisterCodec adds codec under name, so that it can be selected through
+// the CodecKey option.
+func RegisterCodec(name string, codec Codec) error {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if _, exists := codecs[name]; exists {
+		return fmt.Errorf("Codec %q is already registered", name)
+	}
+	codecs[name] = codec
+	return nil
+}
+
+// GetCodec returns the codec registered under name.
+func GetCodec(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	if codec, exists := codecs[name]; exists {
+		return codec, nil
+	}
+	return nil, fmt.Errorf("Codec %q is not registered", name)
+}
+
+// RegisterPanicHook adds hook under name, so that it can be selected through
+// the PanicHookKey option.
+func RegisterPanicHook(name string, hook PanicHook) error {
+	panicHooksLock.Lock()
+	defer panicHooksLock.Unlock()
+	if _, exists := panicHooks[name]; exists {
+		return fmt.Errorf("Panic hook %q is already registered", name)
+	}
+	panicHooks[name] = hook
+	return nil
+}
+
+// GetPanicHook returns the panic hook registered under name.
+func GetPanicHook(name string) (PanicHook, error) {
+	panicHooksLock.RLock()
+	defer panicHooksLock.RUnlock()
+
+	if hook, exists := panicHooks[name]; exists {
+		return hook, nil
+	}
+	return nil, fmt.Errorf("Panic hook %q is not registered", name)
+}
@@ -0,0 +1,484 @@
+package kvdb
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// notSupported implements Kvdb by returning ErrNotSupported from every
+// method. Kvdb decorators embed it so that the methods they do not
+// implement fail rather than reach a single underlying kvdb.
+type notSupported struct {
+	controllerNotSupported
+}
+
+func (ns *notSupported) String() string {
+	return ""
+}
+
+func (ns *notSupported) Domain() string {
+	return ""
+}
+
+func (ns *notSupported) FullKey(key string) string {
+	return ""
+}
+
+func (ns *notSupported) Capabilities() int {
+	return 0
+}
+
+func (ns *notSupported) Get(key string) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) GetRaw(key string) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) GetConsistent(
+	key string,
+	level Consistency,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) CreateAlias(alias, target string) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) GetVal(key string, value interface{}) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) GetValMulti(
+	key string,
+	targets ...interface{},
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) GetMultiConsistent(
+	keys []string,
+) (KVPairs, uint64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+func (ns *notSupported) Put(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) Create(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) Update(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) PutMonotonic(
+	key string,
+	value int64,
+	ttl uint64,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) Enumerate(prefix string) (KVPairs, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) EnumerateAt(prefix string) (KVPairs, uint64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+func (ns *notSupported) EnumeratePaged(
+	prefix string,
+	limit int,
+	cursor string,
+) (KVPairs, string, error) {
+	return nil, "", ErrNotSupported
+}
+
+func (ns *notSupported) EnumerateGrouped(
+	prefix string,
+) (map[string]KVPairs, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) LatestUnder(prefix string) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) Delete(key string) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) DeleteTree(prefix string) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) DeleteTreeForce(prefix string) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) DeleteTreeWithResult(prefix string) (KVPairs, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) DeleteTreeIfVersion(
+	prefix string,
+	versionKey string,
+	expectedValue []byte,
+) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (ns *notSupported) AtomicAddBatch(
+	deltas map[string]int64,
+) (map[string]int64, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) AtomicIncrement(key string, delta int64) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (ns *notSupported) AtomicDecrement(key string, delta int64) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (ns *notSupported) AllowN(
+	key string,
+	rate float64,
+	burst int,
+	n int,
+) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (ns *notSupported) PutIfOther(
+	key string,
+	value interface{},
+	ttl uint64,
+	guardKey string,
+	guardValue []byte,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) PutWithFallback(
+	key string,
+	value interface{},
+	fallback interface{},
+	after time.Duration,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) MoveIf(
+	src,
+	dst string,
+	expectedDstValue []byte,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) Rename(oldKey, newKey string) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) ReplaceTree(
+	prefix string,
+	pairs map[string]interface{},
+	ttl uint64,
+) (int, int, error) {
+	return 0, 0, ErrNotSupported
+}
+
+func (ns *notSupported) CreateBatch(
+	pairs map[string]interface{},
+	ttl uint64,
+) (KVPairs, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) PutBulk(
+	pairs map[string]interface{},
+	ttl uint64,
+) (KVPairs, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) Keys(prefix, sep string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) CompareAndSet(
+	kvp *KVPair,
+	flags KVFlags,
+	prevValue []byte,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) CompareAndDelete(
+	kvp *KVPair,
+	flags KVFlags,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) WatchKey(
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchTree(
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchKeyOpts(
+	key string,
+	opts WatchOptions,
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchTreeOpts(
+	prefix string,
+	opts WatchOptions,
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchKeyWithContext(
+	ctx context.Context,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchTreeWithContext(
+	ctx context.Context,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchAll(
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchAllWithContext(
+	ctx context.Context,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) WatchFrom(
+	key string,
+) (*KVPair, <-chan *KVPair, func(), error) {
+	return nil, nil, nil, ErrNotSupported
+}
+
+func (ns *notSupported) ReplayHistory(
+	fromIndex uint64,
+	fn func(kvp *KVPair) error,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) HasWatchers(key string) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (ns *notSupported) PauseWatch(key string) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) ResumeWatch(key string) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) StopWatchGroup(group string) int {
+	return 0
+}
+
+func (ns *notSupported) PollChanges(
+	prefix string,
+	sinceIndex uint64,
+) (KVPairs, uint64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+func (ns *notSupported) Recode(newCodec Codec) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (ns *notSupported) Snapshot(prefix string) (Kvdb, uint64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+func (ns *notSupported) Restore(snap Kvdb) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) SnapPut(kvp *KVPair) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) LockWithID(
+	key string,
+	lockerID string,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) Lock(key string) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) LockWithPriority(
+	key string,
+	lockerID string,
+	priority int,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) LockWithTimeout(
+	key string,
+	lockerID string,
+	lockTimeout time.Duration,
+	ttl uint64,
+) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) TryLockMany(
+	keys []string,
+	lockerID string,
+	ttl uint64,
+) (acquired []*KVPair, skipped []string, err error) {
+	return nil, nil, ErrNotSupported
+}
+
+func (ns *notSupported) LockStats(key string) (LockStat, error) {
+	return LockStat{}, ErrNotSupported
+}
+
+func (ns *notSupported) Unlock(kvp *KVPair) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) RefreshLock(kvp *KVPair, ttl uint64) (*KVPair, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) TxNew() (Tx, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) AddUser(username string, password string) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) RemoveUser(username string) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) GrantUserAccess(
+	username string,
+	permType PermissionType,
+	subtree string,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) RevokeUsersAccess(
+	username string,
+	permType PermissionType,
+	subtree string,
+) error {
+	return ErrNotSupported
+}
+
+func (ns *notSupported) EnqueueDelayed(
+	queuePrefix string,
+	value []byte,
+	delay time.Duration,
+) (string, error) {
+	return "", ErrNotSupported
+}
+
+func (ns *notSupported) DequeueReady(queuePrefix string) (KVPairs, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) DeleteIfExists(key string) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (ns *notSupported) DeleteIf(
+	key string,
+	pred func([]byte) bool,
+) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (ns *notSupported) WithLock(lock *KVPair) (Kvdb, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) KeysWrittenBy(lockerID string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func (ns *notSupported) OnConnectionStateChange(cb ConnStateCB) {
+}
+
+func (ns *notSupported) Rates() (readsPerSec, writesPerSec float64) {
+	return 0, 0
+}
+
+func (ns *notSupported) WriteMetrics(w io.Writer) error {
+	return ErrNotSupported
+}
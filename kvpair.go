@@ -0,0 +1,33 @@
+package kvdb
+
+import (
+	"bytes"
+)
+
+// Clone returns a deep copy of k. The Lock is shared with k.
+func (k *KVPair) Clone() *KVPair {
+	if k == nil {
+		return nil
+	}
+	clone := *k
+	if k.Value != nil {
+		clone.Value = make([]byte, len(k.Value))
+		copy(clone.Value, k.Value)
+	}
+	return &clone
+}
+
+// Equal returns true if k and o hold the same key, value, action, TTL and
+// created and modified indexes. KVDBIndex and Lock are not compared.
+func (k *KVPair) Equal(o *KVPair) bool {
+	if k == nil || o == nil {
+		return k == o
+	}
+	return k.Key == o.Key &&
+		bytes.Equal(k.Value, o.Value) &&
+		k.Action == o.Action &&
+		k.TTL == o.TTL &&
+		k.ExpiresAt.Equal(o.ExpiresAt) &&
+		k.CreatedIndex == o.CreatedIndex &&
+		k.ModifiedIndex == o.ModifiedIndex
+}
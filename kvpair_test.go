@@ -0,0 +1,64 @@
+package kvdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKVPairClone(t *testing.T) {
+	kvp := &KVPair{
+		Key:           "foo",
+		Value:         []byte("bar"),
+		TTL:           10,
+		ExpiresAt:     time.Now(),
+		CreatedIndex:  1,
+		ModifiedIndex: 2,
+	}
+	clone := kvp.Clone()
+	assert.True(t, kvp.Equal(clone), "Clone should equal the original")
+
+	clone.Value[0] = 'c'
+	clone.Key = "other"
+	assert.Equal(t, "bar", string(kvp.Value), "Mutating the clone changed the value")
+	assert.Equal(t, "foo", kvp.Key, "Mutating the clone changed the key")
+
+	var nilKvp *KVPair
+	assert.Nil(t, nilKvp.Clone(), "Clone of nil should be nil")
+	assert.Nil(t, (&KVPair{}).Clone().Value, "Clone should keep a nil value nil")
+}
+
+func TestKVPairEqual(t *testing.T) {
+	now := time.Now()
+	base := &KVPair{Key: "foo", Value: []byte("bar"), ExpiresAt: now,
+		CreatedIndex: 1, ModifiedIndex: 2}
+
+	var nilKvp *KVPair
+	assert.True(t, nilKvp.Equal(nil), "nil pairs should be equal")
+	assert.False(t, base.Equal(nil), "nil should not equal a pair")
+	assert.False(t, nilKvp.Equal(base), "nil should not equal a pair")
+
+	same := base.Clone()
+	same.KVDBIndex = 10
+	same.ExpiresAt = now.In(time.UTC)
+	assert.True(t, base.Equal(same), "KVDBIndex and time zone should not matter")
+
+	empty := &KVPair{Value: []byte{}}
+	assert.True(t, empty.Equal(&KVPair{}), "Empty and nil values should be equal")
+
+	changes := map[string]func(k *KVPair){
+		"key":            func(k *KVPair) { k.Key = "other" },
+		"value":          func(k *KVPair) { k.Value = []byte("baz") },
+		"action":         func(k *KVPair) { k.Action = KVDelete },
+		"ttl":            func(k *KVPair) { k.TTL = 5 },
+		"expires at":     func(k *KVPair) { k.ExpiresAt = now.Add(time.Second) },
+		"created index":  func(k *KVPair) { k.CreatedIndex = 0 },
+		"modified index": func(k *KVPair) { k.ModifiedIndex = 3 },
+	}
+	for name, change := range changes {
+		other := base.Clone()
+		change(other)
+		assert.False(t, base.Equal(other), "Pairs with different %v are equal", name)
+	}
+}
@@ -2,12 +2,21 @@ package mem
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/portworx/kvdb"
 	"github.com/portworx/kvdb/common"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,8 +27,88 @@ const (
 	// Name is the name of this kvdb implementation.
 	Name = "kv-mem"
 	// KvSnap is an option passed to designate this kvdb as a snap.
-	KvSnap       = "KvSnap"
-	bootstrapKey = "bootstrap"
+	KvSnap = "KvSnap"
+	// HistorySizeKey is an option setting the number of recent updates kept
+	// for replay to new watches and PollChanges.
+	HistorySizeKey = "HistorySize"
+	// WatchBufferSizeKey is an option setting the number of updates buffered
+	// for a paused watch.
+	WatchBufferSizeKey = "WatchBufferSize"
+	// HotKeysWindowKey is an option enabling hot key tracking. Its value is
+	// a duration, such as "1m", after which the access counts are reset.
+	HotKeysWindowKey = "HotKeysWindow"
+	// ChecksumKey is an option enabling value checksums. If set to "true" a
+	// CRC-32 of each value is stored alongside it and verified on Get.
+	ChecksumKey = "Checksum"
+	// RateWindowKey is an option setting the duration, such as "30s", over
+	// which Rates averages the reads and writes.
+	RateWindowKey = "RateWindow"
+	// LockStripesKey is an option setting the number of locks the keys are
+	// spread over, 1 by default. Put, Create, Update and CompareAndSet on
+	// keys of different stripes encode and check their values concurrently,
+	// and only serialize to apply them, which keeps the index and the watch
+	// updates in order. Operations on trees, or on the whole store, lock
+	// every stripe.
+	LockStripesKey = "LockStripes"
+	// SingleWriterKey is an option running every change, from Put to
+	// transaction commits, lock writes and expiries, one at a time on a
+	// writer goroutine, if set to "true". Once a burst of them has run the
+	// writer swaps in an immutable copy of the pairs, which Get reads without
+	// taking the kvdb lock. Until then Get reads the store as usual. Each
+	// copy adds only the pairs the burst changed to the previous one. Close
+	// stops the writer goroutine, after which the kvdb works as it does
+	// without the option.
+	SingleWriterKey = "SingleWriter"
+	// LockTimeoutKey is an option setting the duration, such as "1m", that
+	// Lock, LockWithID and LockWithPriority wait for a lock before failing
+	// with ErrLockTimeout, defaultLockTimeout if unset. A duration of zero,
+	// such as "0s", makes them wait without limit.
+	LockTimeoutKey = "LockTimeout"
+	// PersistPathKey is an option setting the file the pairs are persisted
+	// to. The file is loaded by New, and changes are written to it shortly
+	// after they are made or when Flush is called.
+	PersistPathKey = "persist_path"
+	// SyncWritesKey is an option making every change durable before the
+	// call making it returns, if set to "true" along with PersistPathKey.
+	// The file is then rewritten and fsynced, along with its directory, on
+	// each change under the kvdb lock, so writes become as slow as the
+	// storage and are serialized with reads. Failures are logged, as with
+	// the delayed writes.
+	SyncWritesKey = "sync_writes"
+	// PrefixTreeKey is an option storing the keys in a prefix tree, if set
+	// to "true", so that the prefixes they share are held only once. It
+	// saves memory on stores of long keys under common prefixes, such as
+	// deep hierarchies, at the cost of a walk down the tree on each access
+	// and of a copy of the pair on each read. MemoryStats reports the bytes
+	// held for the keys as StoredKeyBytes.
+	PrefixTreeKey = "PrefixTree"
+	// AbsoluteExpiryKey is an option making Restore and the load of the
+	// persisted file keep the ExpiresAt of the keys, if set to "true".
+	// Otherwise a key keeps the part of its TTL that remained when it was
+	// captured, measured on the clock that set its expiry, so that a skewed
+	// local clock does not shorten or lengthen it. Set it only if the clocks
+	// agree and the time a persisted file was not loaded should count
+	// against the TTLs.
+	AbsoluteExpiryKey = "AbsoluteExpiry"
+	bootstrapKey      = "bootstrap"
+	// defaultHistorySize is the number of recent updates kept by default.
+	defaultHistorySize = 100
+	// defaultWatchBufferSize is the number of updates buffered by default.
+	defaultWatchBufferSize = 1000
+	// defaultRateWindow is the window Rates averages over by default.
+	defaultRateWindow = 10 * time.Second
+	// defaultLockTimeout is how long Lock waits for a lock by default.
+	defaultLockTimeout = time.Minute
+	// flushDelay is how long changes are batched before they are persisted.
+	flushDelay = 100 * time.Millisecond
+	// writerQueueSize is the number of writes queued for the writer
+	// goroutine before callers wait for it.
+	writerQueueSize = 256
+	// rateBuckets is the number of buckets a rate window is split into.
+	rateBuckets = 10
+	// maxHotKeys is the number of keys whose accesses are tracked. Once it
+	// is reached the least accessed key is evicted to track a new one.
+	maxHotKeys = 1000
 )
 
 var (
@@ -27,6 +116,20 @@ var (
 	ErrSnap = errors.New("operation not supported on snap")
 )
 
+// mem implements the optional interfaces of the kvdb package.
+var (
+	_ kvdb.DebugDumper      = &memKV{}
+	_ kvdb.Verifier         = &memKV{}
+	_ kvdb.ExpirationRunner = &memKV{}
+	_ kvdb.ChangeApplier    = &memKV{}
+	_ kvdb.HotKeyTracker    = &memKV{}
+	_ kvdb.MemoryReporter   = &memKV{}
+	_ kvdb.Flusher          = &memKV{}
+	_ kvdb.CodecProvider    = &memKV{}
+	_ kvdb.HistoryCompactor = &memKV{}
+	_ io.Closer             = &memKV{}
+)
+
 func init() {
 	if err := kvdb.Register(Name, New, Version); err != nil {
 		panic(err.Error())
@@ -36,17 +139,184 @@ func init() {
 type memKV struct {
 	common.BaseKvdb
 	// m is the key value database
-	m map[string]*kvdb.KVPair
+	m pairStore
 	// updates is the list of latest few updates
 	dist WatchDistributor
 	// mutex protects m, w, wt
 	mutex sync.Mutex
+	// stripes are the locks keys are spread over, see lockKeys
+	stripes []sync.Mutex
 	// index current kvdb index
 	index  uint64
 	domain string
+	// clock is the time source for TTLs and delayed queue items
+	clock clock
+	// expiries are the armed expiries by key
+	expiries map[string]*expiry
+	// fallbacks are the armed fallbacks of PutWithFallback by key
+	fallbacks map[string]*expiry
+	// writers maps keys written through a lockedView to the lockerID
+	writers map[string]string
+	// watches are the active watches by watched key or prefix
+	watches map[string][]*watchData
+	// lockWaiters are the callers waiting for each lock key, in the order
+	// they started waiting
+	lockWaiters map[string][]*lockWaiter
+	// codec encodes the values that are not strings or byte slices
+	codec kvdb.Codec
+	// defaultTTL is the ttl of keys put or created with a zero ttl
+	defaultTTL uint64
+	// validator checks every value written by callers, if set
+	validator kvdb.ValueValidator
+	// panicHook is told of panics in watch callbacks
+	panicHook kvdb.PanicHook
+	// hotKeysWindow is the length of a hot key tracking window, zero if hot
+	// key tracking is disabled
+	hotKeysWindow time.Duration
+	// hotKeysSince is when the current hot key tracking window started
+	hotKeysSince time.Time
+	// hotKeys are the access counts in the current window by key
+	hotKeys map[string]*kvdb.KeyStat
+	// rates counts the reads and writes for Rates
+	rates *opRates
+	// aliases are the keys that are aliases of the key in their value
+	aliases map[string]bool
+	// internal are the keys, like lock keys, whose changes are not delivered
+	// to watches
+	internal map[string]bool
+	// checksums are the CRC-32 checksums of the values by key, nil if
+	// checksums are disabled
+	checksums map[string]uint32
+	// watchBufferSize is the number of updates buffered for a paused watch
+	watchBufferSize int
+	// lockTimeout is how long Lock waits for a lock, zero if without limit
+	lockTimeout time.Duration
+	// ops counts the operations for WriteMetrics
+	ops opStats
+	// consistentReads counts the GetConsistent calls by level
+	consistentReads [kvdb.Stale + 1]int64
+	// persistPath is the file the pairs are persisted to, empty if they are
+	// not persisted
+	persistPath string
+	// flushPending is set while a flush of the changes is scheduled
+	flushPending bool
+	// syncWrites is set if each change is persisted, and fsynced, before
+	// the call making it returns
+	syncWrites bool
+	// absoluteExpiry is set if restored and loaded keys keep their
+	// ExpiresAt rather than their remaining TTL
+	absoluteExpiry bool
+	// flushMutex serializes the writes of the persisted file
+	flushMutex sync.Mutex
+	// prefixTree is set if the pairs are stored in a prefixTree
+	prefixTree bool
+	// writerMutex protects writes against Close
+	writerMutex sync.RWMutex
+	// writes are the writes queued for the writer goroutine, nil unless in
+	// single writer mode
+	writes chan func()
+	// writerDone is closed once the writer goroutine has returned
+	writerDone chan struct{}
+	// log records the changes the read view is published from, nil unless
+	// in single writer mode
+	log *changeLog
+	// view holds the *readView Get reads in single writer mode
+	view atomic.Value
 	kvdb.KvdbController
 }
 
+// changeLog is a pairStore recording the keys changed since the read view
+// was last published.
+type changeLog struct {
+	// changes counts every change, it is read without kv.mutex
+	changes uint64
+	pairStore
+	// changed are the full keys changed since the last publish
+	changed map[string]bool
+}
+
+func (l *changeLog) set(key string, kvp *kvdb.KVPair) {
+	l.pairStore.set(key, kvp)
+	l.changed[key] = true
+	atomic.AddUint64(&l.changes, 1)
+}
+
+func (l *changeLog) remove(key string) {
+	l.pairStore.remove(key)
+	l.changed[key] = true
+	atomic.AddUint64(&l.changes, 1)
+}
+
+// readView is an immutable copy of the pairs, made of layers of the pairs
+// changed between publishes. Its pairs are never changed, so they are cloned
+// before they are returned.
+type readView struct {
+	// changes is the count of changes of the store the copy was made at
+	changes uint64
+	// layers hold the copied pairs by full key, oldest first. The newest
+	// entry of a key wins, and an entry without a pair marks a removed key.
+	layers []map[string]viewEntry
+}
+
+// viewEntry is the entry of a key in a layer of a readView.
+type viewEntry struct {
+	// kvp is the copied pair, nil if the key was removed
+	kvp *kvdb.KVPair
+	// alias is set if the key is an alias
+	alias bool
+}
+
+// lookup returns the newest entry of the full key, and false if the key is
+// missing or removed.
+func (v *readView) lookup(key string) (viewEntry, bool) {
+	for i := len(v.layers) - 1; i >= 0; i-- {
+		if e, ok := v.layers[i][key]; ok {
+			return e, e.kvp != nil
+		}
+	}
+	return viewEntry{}, false
+}
+
+// lockedView is a view of the mem kvdb whose writes are attributed to the
+// holder of a lock.
+type lockedView struct {
+	*memKV
+	// lock is the lock held while writing through this view
+	lock *kvdb.KVPair
+	// lockerID identifies the lock holder
+	lockerID string
+}
+
+// clock is a source of the current time and of the timers that expire keys.
+type clock interface {
+	Now() time.Time
+	// AfterFunc calls f once d has elapsed on the clock. f locks kv, so it
+	// must not be called by AfterFunc itself.
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// timer is a call armed with clock.AfterFunc.
+type timer interface {
+	// Stop prevents the call if it has not started yet.
+	Stop() bool
+}
+
+// realClock reports the wall clock time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
+
+// expiry is the armed expiry of a key.
+type expiry struct {
+	timer timer
+}
+
 type snapMem struct {
 	*memKV
 }
@@ -59,8 +329,29 @@ type watchUpdate struct {
 	kvp kvdb.KVPair
 	// err is any error on update
 	err error
+	// control is set for updates that pause or resume a watch instead of
+	// reporting a change
+	control watchControl
+	// internal is set for changes to internal keys, which are kept in the
+	// history but not delivered to watches
+	internal bool
 }
 
+// watchControl is a control update sent to a single watch.
+type watchControl int
+
+const (
+	// watchPause starts buffering updates
+	watchPause watchControl = iota + 1
+	// watchResume flushes the buffered updates and stops buffering
+	watchResume
+	// watchStop ends the watch
+	watchStop
+	// watchCompact wakes the watch to report a compaction of changes it had
+	// not received, unless a later change reported it first
+	watchCompact
+)
+
 // WatchUpdateQueue is a producer consumer queue.
 type WatchUpdateQueue interface {
 	// Enqueue will enqueue an update. It is non-blocking.
@@ -78,6 +369,10 @@ type WatchDistributor interface {
 	Remove(WatchUpdateQueue)
 	// NewUpdate is invoked to distribute a new update
 	NewUpdate(w *watchUpdate)
+	// History returns the latest few updates, oldest first
+	History() []*watchUpdate
+	// Compact drops the updates before index from the history
+	Compact(index uint64)
 }
 
 // distributor implements WatchDistributor interface
@@ -87,10 +382,16 @@ type distributor struct {
 	updates []*watchUpdate
 	// watchers watch for updates
 	watchers []WatchUpdateQueue
+	// historySize is the number of updates kept in updates
+	historySize int
 }
 
 func NewWatchDistributor() WatchDistributor {
-	return &distributor{}
+	return newWatchDistributor(defaultHistorySize)
+}
+
+func newWatchDistributor(historySize int) WatchDistributor {
+	return &distributor{historySize: historySize}
 }
 
 func (d *distributor) Add() WatchUpdateQueue {
@@ -121,8 +422,8 @@ func (d *distributor) NewUpdate(u *watchUpdate) {
 	defer d.Unlock()
 	// collect update
 	d.updates = append(d.updates, u)
-	if len(d.updates) > 100 {
-		d.updates = d.updates[100:]
+	if len(d.updates) > d.historySize {
+		d.updates = d.updates[len(d.updates)-d.historySize:]
 	}
 	// send update to watchers
 	for _, q := range d.watchers {
@@ -130,6 +431,23 @@ func (d *distributor) NewUpdate(u *watchUpdate) {
 	}
 }
 
+func (d *distributor) Compact(index uint64) {
+	d.Lock()
+	defer d.Unlock()
+	for len(d.updates) > 0 && d.updates[0].kvp.ModifiedIndex < index {
+		d.updates[0] = nil
+		d.updates = d.updates[1:]
+	}
+}
+
+func (d *distributor) History() []*watchUpdate {
+	d.Lock()
+	defer d.Unlock()
+	updates := make([]*watchUpdate, len(d.updates))
+	copy(updates, d.updates)
+	return updates
+}
+
 // watchQueue implements WatchUpdateQueue interface for watchUpdates
 type watchQueue struct {
 	// updates is the list of updates
@@ -173,6 +491,61 @@ type watchData struct {
 	cb        kvdb.WatchCB
 	opaque    interface{}
 	waitIndex uint64
+	// filter drops the updates for which it returns false
+	filter func(kvp *kvdb.KVPair) bool
+	// stopOnDelete stops the watch after a delete is delivered
+	stopOnDelete bool
+	// q is the queue the watch receives updates on
+	q WatchUpdateQueue
+	// prefix is the watched key or prefix
+	prefix string
+	// treeWatch is set if all keys under prefix are watched
+	treeWatch bool
+	// paused is set between PauseWatch and ResumeWatch, protected by the
+	// kvdb mutex
+	paused bool
+	// initial is delivered before any update, if set
+	initial *watchUpdate
+	// stopped is closed once the watch is unregistered
+	stopped chan struct{}
+	// group is the group the watch was registered under, if any
+	group string
+	// compactionEvents is set if compacted changes are dropped and reported
+	compactionEvents bool
+	// cursor is the index of the last change the watch went past, accessed
+	// atomically
+	cursor uint64
+	// floor is the oldest index left by the last compaction of changes the
+	// watch had not received, accessed atomically
+	floor uint64
+}
+
+// matches reports whether update is delivered to the watch.
+func (v *watchData) matches(update *watchUpdate) bool {
+	if v.treeWatch {
+		if !strings.HasPrefix(update.key, v.prefix) {
+			return false
+		}
+	} else if update.key != v.prefix {
+		return false
+	}
+	if v.waitIndex != 0 && v.waitIndex >= update.kvp.ModifiedIndex {
+		return false
+	}
+	return v.filter == nil || v.filter(&update.kvp)
+}
+
+func newWatchData(opts kvdb.WatchOptions, cb kvdb.WatchCB) *watchData {
+	return &watchData{
+		cb:               cb,
+		opaque:           opts.Opaque,
+		waitIndex:        opts.WaitIndex,
+		filter:           opts.Filter,
+		stopOnDelete:     opts.StopOnDelete,
+		stopped:          make(chan struct{}),
+		group:            opts.Group,
+		compactionEvents: opts.CompactionEvents,
+	}
 }
 
 // New constructs a new kvdb.Kvdb.
@@ -186,20 +559,330 @@ func New(
 		domain = domain + "/"
 	}
 
+	historySize, err := sizeOption(options, HistorySizeKey, defaultHistorySize)
+	if err != nil {
+		return nil, err
+	}
+	watchBufferSize, err := sizeOption(options, WatchBufferSizeKey,
+		defaultWatchBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	lockStripes, err := sizeOption(options, LockStripesKey, 1)
+	if err != nil {
+		return nil, err
+	}
+	var defaultTTL uint64
+	if val, ok := options[kvdb.DefaultTTLKey]; ok {
+		// A default TTL of 0 leaves keys without expiry, as when unset.
+		if defaultTTL, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid %v: %q", kvdb.DefaultTTLKey, val)
+		}
+	}
+	var hotKeysWindow time.Duration
+	if val, ok := options[HotKeysWindowKey]; ok {
+		hotKeysWindow, err = time.ParseDuration(val)
+		if err != nil || hotKeysWindow <= 0 {
+			return nil, fmt.Errorf("Invalid %v: %q", HotKeysWindowKey, val)
+		}
+	}
+	rateWindow := defaultRateWindow
+	if val, ok := options[RateWindowKey]; ok {
+		rateWindow, err = time.ParseDuration(val)
+		if err != nil || rateWindow/rateBuckets <= 0 {
+			return nil, fmt.Errorf("Invalid %v: %q", RateWindowKey, val)
+		}
+	}
+	codec := kvdb.JSONCodec
+	if name, ok := options[kvdb.CodecKey]; ok {
+		if codec, err = kvdb.GetCodec(name); err != nil {
+			return nil, err
+		}
+	}
+	lockTimeout := defaultLockTimeout
+	if val, ok := options[LockTimeoutKey]; ok {
+		lockTimeout, err = time.ParseDuration(val)
+		if err != nil || lockTimeout < 0 {
+			return nil, fmt.Errorf("Invalid %v: %q", LockTimeoutKey, val)
+		}
+	}
+	var validator kvdb.ValueValidator
+	if name, ok := options[kvdb.ValueValidatorKey]; ok {
+		if validator, err = kvdb.GetValueValidator(name); err != nil {
+			return nil, err
+		}
+	}
+	var panicHook kvdb.PanicHook = logPanic
+	if name, ok := options[kvdb.PanicHookKey]; ok {
+		if panicHook, err = kvdb.GetPanicHook(name); err != nil {
+			return nil, err
+		}
+	}
+
+	var checksums map[string]uint32
+	if val, ok := options[ChecksumKey]; ok {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v: %q", ChecksumKey, val)
+		}
+		if enabled {
+			checksums = make(map[string]uint32)
+		}
+	}
+
+	prefixTree := false
+	if val, ok := options[PrefixTreeKey]; ok {
+		if prefixTree, err = strconv.ParseBool(val); err != nil {
+			return nil, fmt.Errorf("Invalid %v: %q", PrefixTreeKey, val)
+		}
+	}
+
 	mem := &memKV{
-		BaseKvdb:       common.BaseKvdb{FatalCb: fatalErrorCb},
-		m:              make(map[string]*kvdb.KVPair),
-		dist:           NewWatchDistributor(),
-		domain:         domain,
-		KvdbController: kvdb.KvdbControllerNotSupported,
+		BaseKvdb:        common.BaseKvdb{FatalCb: fatalErrorCb},
+		m:               newPairStore(domain, prefixTree),
+		prefixTree:      prefixTree,
+		stripes:         make([]sync.Mutex, lockStripes),
+		dist:            newWatchDistributor(historySize),
+		domain:          domain,
+		clock:           realClock{},
+		expiries:        make(map[string]*expiry),
+		fallbacks:       make(map[string]*expiry),
+		writers:         make(map[string]string),
+		watches:         make(map[string][]*watchData),
+		watchBufferSize: watchBufferSize,
+		lockWaiters:     make(map[string][]*lockWaiter),
+		codec:           codec,
+		defaultTTL:      defaultTTL,
+		validator:       validator,
+		panicHook:       panicHook,
+		hotKeysWindow:   hotKeysWindow,
+		hotKeys:         make(map[string]*kvdb.KeyStat),
+		rates:           newOpRates(rateWindow, time.Now()),
+		aliases:         make(map[string]bool),
+		internal:        make(map[string]bool),
+		checksums:       checksums,
+		lockTimeout:     lockTimeout,
+		KvdbController:  kvdb.KvdbControllerNotSupported,
 	}
 
+	if val, ok := options[AbsoluteExpiryKey]; ok {
+		if mem.absoluteExpiry, err = strconv.ParseBool(val); err != nil {
+			return nil, fmt.Errorf("Invalid %v: %q", AbsoluteExpiryKey, val)
+		}
+	}
 	if _, ok := options[KvSnap]; ok {
 		return &snapMem{memKV: mem}, nil
 	}
+	if path, ok := options[PersistPathKey]; ok {
+		if path == "" {
+			return nil, fmt.Errorf("Empty %v", PersistPathKey)
+		}
+		mem.persistPath = path
+		if val, ok := options[SyncWritesKey]; ok {
+			if mem.syncWrites, err = strconv.ParseBool(val); err != nil {
+				return nil, fmt.Errorf("Invalid %v: %q", SyncWritesKey, val)
+			}
+		}
+		if err := mem.load(); err != nil {
+			return nil, err
+		}
+	}
+	if val, ok := options[SingleWriterKey]; ok {
+		singleWriter, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %v: %q", SingleWriterKey, val)
+		}
+		if singleWriter {
+			mem.log = &changeLog{
+				pairStore: mem.m,
+				changed:   make(map[string]bool),
+			}
+			mem.m = mem.log
+			mem.publish()
+			mem.writes = make(chan func(), writerQueueSize)
+			mem.writerDone = make(chan struct{})
+			go mem.runWriter(mem.writes)
+		}
+	}
 	return mem, nil
 }
 
+// persistedState is the content of the persisted file.
+type persistedState struct {
+	// Index is the kvdb index when the state was persisted
+	Index uint64
+	// PersistedAt is when the state was persisted, on the clock of the kvdb
+	// that persisted it. It is zero in files persisted before it was added.
+	PersistedAt time.Time
+	// Pairs are the stored pairs, by key. Their ExpiresAt is kept so that
+	// TTLs run across restarts.
+	Pairs kvdb.KVPairs
+}
+
+// load reads the pairs persisted to persistPath, if it exists. Pairs keep
+// the TTL that remained when they were persisted, unless absoluteExpiry is
+// set, in which case pairs that expired in the meantime are dropped.
+func (kv *memKV) load() error {
+	b, err := ioutil.ReadFile(kv.persistPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state persistedState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("Invalid persisted file %q: %v", kv.persistPath, err)
+	}
+
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	now := kv.clock.Now()
+	persistedAt := state.PersistedAt
+	if kv.absoluteExpiry || persistedAt.IsZero() {
+		persistedAt = now
+	}
+	for _, kvp := range state.Pairs {
+		if !kvp.ExpiresAt.IsZero() {
+			remaining := kvp.ExpiresAt.Sub(persistedAt)
+			if remaining <= 0 {
+				continue
+			}
+			kvp.ExpiresAt = now.Add(remaining)
+			kv.armExpiry(kvp.Key, kvp.ExpiresAt)
+		}
+		kv.m.set(kv.domain+kvp.Key, kvp)
+		kv.setChecksum(kv.domain+kvp.Key, kvp.Value)
+	}
+	atomic.StoreUint64(&kv.index, state.Index)
+	return nil
+}
+
+// scheduleFlush persists the changes after flushDelay, along with the other
+// changes made in the meantime, unless a flush is already scheduled. With
+// syncWrites the changes are persisted at once instead. kv must be locked.
+func (kv *memKV) scheduleFlush() {
+	if kv.persistPath == "" || kv.flushPending {
+		return
+	}
+	if kv.syncWrites {
+		// kv stays locked, which serializes the writes of the file.
+		if err := kv.persist(kv.stateToPersist()); err != nil {
+			logrus.Errorf("Failed to persist kvdb to %v: %v", kv.persistPath, err)
+		}
+		return
+	}
+	kv.flushPending = true
+	time.AfterFunc(flushDelay, func() {
+		kv.mutex.Lock()
+		pending := kv.flushPending
+		kv.mutex.Unlock()
+		// The changes may have been flushed by Flush in the meantime.
+		if !pending {
+			return
+		}
+		if err := kv.Flush(); err != nil {
+			logrus.Errorf("Failed to persist kvdb to %v: %v", kv.persistPath, err)
+		}
+	})
+}
+
+// Flush writes the pairs to persistPath. Lock keys are not persisted, since
+// their holders do not survive a restart.
+func (kv *memKV) Flush() error {
+	if kv.persistPath == "" {
+		return nil
+	}
+	if kv.syncWrites {
+		// Every change was persisted as it was made.
+		return nil
+	}
+	kv.flushMutex.Lock()
+	defer kv.flushMutex.Unlock()
+
+	kv.mutex.Lock()
+	kv.flushPending = false
+	state := kv.stateToPersist()
+	kv.mutex.Unlock()
+	return kv.persist(state)
+}
+
+// stateToPersist returns the state to persist. kv must be locked.
+func (kv *memKV) stateToPersist() *persistedState {
+	state := &persistedState{
+		Index:       atomic.LoadUint64(&kv.index),
+		PersistedAt: kv.clock.Now(),
+		Pairs:       make(kvdb.KVPairs, 0, kv.m.size()),
+	}
+	kv.m.each("", func(key string, kvp *kvdb.KVPair) {
+		if kv.internal[key] {
+			return
+		}
+		persisted := kvp.Clone()
+		persisted.Key = strings.TrimPrefix(key, kv.domain)
+		state.Pairs = append(state.Pairs, persisted)
+	})
+	return state
+}
+
+// persist writes state to persistPath. With syncWrites the file and its
+// directory are fsynced, so that the new file survives a power loss.
+func (kv *memKV) persist(state *persistedState) error {
+	sort.Slice(state.Pairs, func(i, j int) bool {
+		return state.Pairs[i].Key < state.Pairs[j].Key
+	})
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Replace the file at once so that a crash never leaves it partly
+	// written.
+	tmp := kv.persistPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if kv.syncWrites {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, kv.persistPath); err != nil {
+		return err
+	}
+	if !kv.syncWrites {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(kv.persistPath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// sizeOption parses the positive integer option key, or returns def if the
+// option is not set.
+func sizeOption(options map[string]string, key string, def int) (int, error) {
+	val, ok := options[key]
+	if !ok {
+		return def, nil
+	}
+	size, err := strconv.Atoi(val)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("Invalid %v: %q", key, val)
+	}
+	return size, nil
+}
+
 // Version returns the supported version of the mem implementation
 func Version(url string, kvdbOptions map[string]string) (string, error) {
 	return kvdb.MemVersion1, nil
@@ -209,343 +892,3070 @@ func (kv *memKV) String() string {
 	return Name
 }
 
+func (kv *memKV) Domain() string {
+	return kv.domain
+}
+
+func (kv *memKV) FullKey(key string) string {
+	return kv.domain + key
+}
+
 func (kv *memKV) Capabilities() int {
 	return kvdb.KVCapabilityOrderedUpdates
 }
 
+// get returns the stored pair of key, not a copy unless the store copies
+// its pairs, so a changed pair must be stored again. kv must be locked.
 func (kv *memKV) get(key string) (*kvdb.KVPair, error) {
 	key = kv.domain + key
-	v, ok := kv.m[key]
+	v, ok := kv.m.get(key)
 	if !ok {
 		return nil, kvdb.ErrNotFound
 	}
 	return v, nil
 }
 
-func (kv *memKV) Get(key string) (*kvdb.KVPair, error) {
-	kv.mutex.Lock()
-	defer kv.mutex.Unlock()
-	return kv.get(key)
+// resolve returns the pair of key, following aliases. kv must be locked.
+func (kv *memKV) resolve(key string) (*kvdb.KVPair, error) {
+	for depth := 0; ; depth++ {
+		kvp, err := kv.get(key)
+		if err != nil || !kv.aliases[kv.domain+key] {
+			return kvp, err
+		}
+		if depth == kvdb.MaxAliasDepth {
+			return nil, kvdb.ErrAliasDepth
+		}
+		key = string(kvp.Value)
+	}
 }
 
-func (kv *memKV) Snapshot(prefix string) (kvdb.Kvdb, uint64, error) {
+// setChecksum records the checksum of value stored at the full key, if
+// checksums are enabled. kv must be locked.
+func (kv *memKV) setChecksum(key string, value []byte) {
+	if kv.checksums != nil {
+		kv.checksums[key] = crc32.ChecksumIEEE(value)
+	}
+}
+
+// verify returns kvdb.ErrCorrupt if the value of kvp does not match its
+// recorded checksum. kv must be locked.
+func (kv *memKV) verify(kvp *kvdb.KVPair) error {
+	if kv.checksums == nil {
+		return nil
+	}
+	sum, ok := kv.checksums[kv.domain+kvp.Key]
+	if ok && sum != crc32.ChecksumIEEE(kvp.Value) {
+		return fmt.Errorf("key %q: %w", kvp.Key, kvdb.ErrCorrupt)
+	}
+	return nil
+}
+
+func (kv *memKV) Get(key string) (*kvdb.KVPair, error) {
+	defer kv.ops.observe(opGet, time.Now())
+	if kvp, ok, err := kv.getFromView(key); ok {
+		return kvp, err
+	}
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
-	_, err := kv.put(bootstrapKey, time.Now().UnixNano(), 0)
+	kv.recordAccess(key, false)
+	kvp, err := kv.resolve(key)
 	if err != nil {
-		return nil, 0, fmt.Errorf("Failed to create snap bootstrap key: %v", err)
+		return nil, err
 	}
-	data := make(map[string]*kvdb.KVPair)
-	for key, value := range kv.m {
-		if !strings.HasPrefix(key, prefix) && strings.Contains(key, "/_") {
-			continue
-		}
-		snap := &kvdb.KVPair{}
-		*snap = *value
-		snap.Value = make([]byte, len(value.Value))
-		copy(snap.Value, value.Value)
-		data[key] = snap
+	if err := kv.verify(kvp); err != nil {
+		return nil, err
 	}
-	highestKvPair, _ := kv.delete(bootstrapKey)
-	// Snapshot only data, watches are not copied.
-	return &memKV{
-		m:      data,
-		domain: kv.domain,
-	}, highestKvPair.ModifiedIndex, nil
+	// Return a copy so that callers don't race with later writes.
+	return kv.withRemainingTTL(kvp.Clone()), nil
 }
 
-func (kv *memKV) put(
-	key string,
-	value interface{},
-	ttl uint64,
-) (*kvdb.KVPair, error) {
+// getFromView returns a copy of the pair of key read from the read view,
+// following aliases. It returns false if the view is missing or older than
+// the store, and when hot keys or checksums, which need kv.mutex, are
+// enabled.
+func (kv *memKV) getFromView(key string) (*kvdb.KVPair, bool, error) {
+	if kv.log == nil || kv.hotKeysWindow != 0 || kv.checksums != nil {
+		return nil, false, nil
+	}
+	view, _ := kv.view.Load().(*readView)
+	if view == nil || view.changes != atomic.LoadUint64(&kv.log.changes) {
+		return nil, false, nil
+	}
+	kv.rates.record(kv.clock.Now(), false)
+	for depth := 0; ; depth++ {
+		e, ok := view.lookup(kv.domain + key)
+		if !ok {
+			return nil, true, kvdb.ErrNotFound
+		}
+		if !e.alias {
+			return kv.withRemainingTTL(e.kvp.Clone()), true, nil
+		}
+		if depth == kvdb.MaxAliasDepth {
+			return nil, true, kvdb.ErrAliasDepth
+		}
+		key = string(e.kvp.Value)
+	}
+}
 
-	var kvp *kvdb.KVPair
+// publish swaps in a read view of the current pairs. The first view copies
+// every pair, later ones add a layer copying only the pairs changed since
+// the previous view. Layers are merged while the newest is at least half
+// the size of the one below it, so that a view has O(log n) layers and a
+// pair is copied O(log n) times on average.
+func (kv *memKV) publish() {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
 
-	suffix := key
-	key = kv.domain + suffix
-	index := atomic.AddUint64(&kv.index, 1)
-	if ttl != 0 {
-		time.AfterFunc(time.Second*time.Duration(ttl), func() {
-			// TODO: handle error
-			_, _ = kv.delete(suffix)
+	prev, _ := kv.view.Load().(*readView)
+	if prev != nil && len(kv.log.changed) == 0 {
+		return
+	}
+	var layers []map[string]viewEntry
+	if prev == nil {
+		all := make(map[string]viewEntry, kv.m.size())
+		kv.m.each("", func(key string, kvp *kvdb.KVPair) {
+			all[key] = viewEntry{kvp: kvp.Clone(), alias: kv.aliases[key]}
 		})
+		layers = []map[string]viewEntry{all}
+	} else {
+		top := make(map[string]viewEntry, len(kv.log.changed))
+		for key := range kv.log.changed {
+			var e viewEntry
+			if kvp, ok := kv.m.get(key); ok {
+				e = viewEntry{kvp: kvp.Clone(), alias: kv.aliases[key]}
+			}
+			top[key] = e
+		}
+		layers = make([]map[string]viewEntry, 0, len(prev.layers)+1)
+		layers = mergeLayers(append(append(layers, prev.layers...), top))
 	}
-	b, err := common.ToBytes(value)
-	if err != nil {
-		return nil, err
+	kv.log.changed = make(map[string]bool)
+	kv.view.Store(&readView{
+		changes: atomic.LoadUint64(&kv.log.changes),
+		layers:  layers,
+	})
+}
+
+// mergeLayers merges the newest of layers into the one below it while it is
+// at least half its size. Removed keys are dropped once merged into the
+// oldest layer.
+func mergeLayers(layers []map[string]viewEntry) []map[string]viewEntry {
+	for n := len(layers); n > 1 && 2*len(layers[n-1]) >= len(layers[n-2]); n-- {
+		below, top := layers[n-2], layers[n-1]
+		merged := make(map[string]viewEntry, len(below)+len(top))
+		for key, e := range below {
+			merged[key] = e
+		}
+		for key, e := range top {
+			if e.kvp == nil && n == 2 {
+				delete(merged, key)
+			} else {
+				merged[key] = e
+			}
+		}
+		layers = append(layers[:n-2], merged)
 	}
-	if old, ok := kv.m[key]; ok {
-		old.Value = b
-		old.Action = kvdb.KVSet
-		old.ModifiedIndex = index
-		old.KVDBIndex = index
-		kvp = old
+	return layers
+}
 
-	} else {
-		kvp = &kvdb.KVPair{
-			Key:           key,
-			Value:         b,
-			TTL:           int64(ttl),
-			KVDBIndex:     index,
-			ModifiedIndex: index,
-			CreatedIndex:  index,
-			Action:        kvdb.KVCreate,
+// runWriter runs the writes queued on writes in order, and publishes a read
+// view once those queued meanwhile have run too. It returns once writes is
+// closed.
+func (kv *memKV) runWriter(writes chan func()) {
+	defer close(kv.writerDone)
+	for write := range writes {
+		write()
+		for queued := len(writes); queued > 0; queued-- {
+			(<-writes)()
 		}
-		kv.m[key] = kvp
+		kv.publish()
 	}
+}
 
-	kv.normalize(kvp)
-	kv.dist.NewUpdate(&watchUpdate{key, *kvp, nil})
-	return kvp, nil
+// serialize runs op on the writer goroutine in single writer mode, and
+// directly otherwise, and returns its result.
+func (kv *memKV) serialize(op func() (*kvdb.KVPair, error)) (*kvdb.KVPair, error) {
+	var kvp *kvdb.KVPair
+	err := kv.serializeErr(func() error {
+		var err error
+		kvp, err = op()
+		return err
+	})
+	return kvp, err
 }
 
-func (kv *memKV) Put(
-	key string,
-	value interface{},
-	ttl uint64,
-) (*kvdb.KVPair, error) {
+// serializeErr runs op like serialize, for operations returning only an
+// error. op must not call the exported methods of kv.
+func (kv *memKV) serializeErr(op func() error) error {
+	kv.writerMutex.RLock()
+	writes := kv.writes
+	if writes == nil {
+		kv.writerMutex.RUnlock()
+		return op()
+	}
+	var err error
+	done := make(chan struct{})
+	writes <- func() {
+		defer close(done)
+		err = op()
+	}
+	kv.writerMutex.RUnlock()
+	<-done
+	return err
+}
+
+// Close stops the writer goroutine of the single writer mode once the queued
+// writes have run. The kvdb keeps working afterwards, as it does without the
+// mode. Close does nothing otherwise.
+func (kv *memKV) Close() error {
+	kv.writerMutex.Lock()
+	writes := kv.writes
+	kv.writes = nil
+	kv.writerMutex.Unlock()
+	if writes == nil {
+		return nil
+	}
+	close(writes)
+	<-kv.writerDone
 
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
-	return kv.put(key, value, ttl)
+	// Stop recording the changes, and drop the view for Get to read the
+	// store.
+	kv.m = kv.log.pairStore
+	kv.view.Store((*readView)(nil))
+	return nil
 }
 
-func (kv *memKV) GetVal(key string, v interface{}) (*kvdb.KVPair, error) {
-	kvp, err := kv.Get(key)
-	if err != nil {
-		return nil, err
+// withRemainingTTL sets the TTL of kvp to the seconds left until it expires,
+// rounded up so that a key with a TTL never reports 0, and returns it.
+func (kv *memKV) withRemainingTTL(kvp *kvdb.KVPair) *kvdb.KVPair {
+	if kvp.ExpiresAt.IsZero() {
+		return kvp
 	}
-
-	err = json.Unmarshal(kvp.Value, v)
-	return kvp, err
+	remaining := kvp.ExpiresAt.Sub(kv.clock.Now())
+	if remaining <= 0 {
+		kvp.TTL = 0
+		return kvp
+	}
+	kvp.TTL = int64((remaining + time.Second - 1) / time.Second)
+	return kvp
 }
 
-func (kv *memKV) Create(
-	key string,
-	value interface{},
-	ttl uint64,
-) (*kvdb.KVPair, error) {
+func (kv *memKV) GetRaw(key string) (*kvdb.KVPair, error) {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
-
-	result, err := kv.get(key)
+	kv.recordAccess(key, false)
+	kvp, err := kv.get(key)
 	if err != nil {
-		return kv.put(key, value, ttl)
+		return nil, err
+	}
+	if err := kv.verify(kvp); err != nil {
+		return nil, err
+	}
+	return kvp.Clone(), nil
+}
+
+func (kv *memKV) GetConsistent(
+	key string,
+	level kvdb.Consistency,
+) (*kvdb.KVPair, error) {
+	if level < kvdb.Linearizable || level > kvdb.Stale {
+		return nil, kvdb.ErrIllegal
+	}
+	// Every read returns the current value, which satisfies all levels. The
+	// level is only counted.
+	atomic.AddInt64(&kv.consistentReads[level], 1)
+	return kv.Get(key)
+}
+
+func (kv *memKV) CreateAlias(alias, target string) error {
+	unlock := kv.lockKeys(alias)
+	defer unlock()
+	return kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if _, err := kv.get(alias); err == nil {
+			return kvdb.ErrExist
+		}
+		if _, err := kv.put(alias, target, 0, false); err != nil {
+			return err
+		}
+		kv.aliases[kv.domain+alias] = true
+		return nil
+	})
+}
+
+func (kv *memKV) GetMultiConsistent(keys []string) (kvdb.KVPairs, uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for _, key := range keys {
+		kv.recordAccess(key, false)
+	}
+
+	kvps := make(kvdb.KVPairs, 0, len(keys))
+	for _, key := range keys {
+		if kvp, err := kv.get(key); err == nil {
+			kvps = append(kvps, kvp.Clone())
+		}
+	}
+	return kvps, atomic.LoadUint64(&kv.index), nil
+}
+
+func (kv *memKV) Recode(newCodec kvdb.Codec) (int, error) {
+	unlock := kv.lockAll()
+	defer unlock()
+	recoded := 0
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		// Recode every value before changing any so that a value that fails to
+		// decode leaves the store as it was. Internal keys are not encoded by
+		// the codec.
+		values := make(map[string][]byte, kv.m.size())
+		var err error
+		kv.m.each("", func(k string, kvp *kvdb.KVPair) {
+			if err != nil || kv.internal[k] {
+				return
+			}
+			var v interface{}
+			if err = kv.codec.Unmarshal(kvp.Value, &v); err != nil {
+				err = fmt.Errorf("key %q: %w", kvp.Key, err)
+				return
+			}
+			b, marshalErr := newCodec.Marshal(v)
+			if marshalErr != nil {
+				err = fmt.Errorf("key %q: %w", kvp.Key, marshalErr)
+				return
+			}
+			values[k] = b
+		})
+		if err != nil {
+			return err
+		}
+		for k, b := range values {
+			kvp, _ := kv.m.get(k)
+			kvp.Value = b
+			kv.m.set(k, kvp)
+			kv.setChecksum(k, b)
+		}
+		kv.codec = newCodec
+		recoded = len(values)
+		return nil
+	})
+	return recoded, err
+}
+
+func (kv *memKV) Snapshot(prefix string) (kvdb.Kvdb, uint64, error) {
+	unlock := kv.lockKeys(bootstrapKey)
+	defer unlock()
+	var snap *memKV
+	var index uint64
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+		_, err := kv.put(bootstrapKey, time.Now().UnixNano(), 0, false)
+		if err != nil {
+			return fmt.Errorf("Failed to create snap bootstrap key: %v", err)
+		}
+		data := newPairStore(kv.domain, kv.prefixTree)
+		aliases := make(map[string]bool)
+		internal := make(map[string]bool)
+		kv.m.each("", func(key string, value *kvdb.KVPair) {
+			if !strings.HasPrefix(key, prefix) && strings.Contains(key, "/_") {
+				return
+			}
+			copied := &kvdb.KVPair{}
+			*copied = *value
+			copied.Value = make([]byte, len(value.Value))
+			copy(copied.Value, value.Value)
+			data.set(key, copied)
+			if kv.aliases[key] {
+				aliases[key] = true
+			}
+			if kv.internal[key] {
+				internal[key] = true
+			}
+		})
+		highestKvPair, _ := kv.delete(bootstrapKey)
+		// Snapshot only data, watches are not copied.
+		snap = &memKV{
+			m:               data,
+			prefixTree:      kv.prefixTree,
+			stripes:         make([]sync.Mutex, len(kv.stripes)),
+			domain:          kv.domain,
+			clock:           kv.clock,
+			expiries:        make(map[string]*expiry),
+			fallbacks:       make(map[string]*expiry),
+			writers:         make(map[string]string),
+			watches:         make(map[string][]*watchData),
+			watchBufferSize: kv.watchBufferSize,
+			lockWaiters:     make(map[string][]*lockWaiter),
+			lockTimeout:     kv.lockTimeout,
+			validator:       kv.validator,
+			panicHook:       kv.panicHook,
+			codec:           kv.codec,
+			hotKeys:         make(map[string]*kvdb.KeyStat),
+			rates:           newOpRates(kv.rates.width*rateBuckets, kv.clock.Now()),
+			aliases:         aliases,
+			internal:        internal,
+		}
+		index = highestKvPair.ModifiedIndex
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return snap, index, nil
+}
+
+// Restore replaces the contents of kv with those of snap. Internal keys,
+// such as those of held locks, are neither restored nor replaced, and
+// aliases stay aliases. Keys that already hold their snapshot value without
+// a TTL are left as they are, so watches only see the keys Restore changes.
+func (kv *memKV) Restore(snap kvdb.Kvdb) error {
+	var src *memKV
+	switch s := snap.(type) {
+	case *memKV:
+		src = s
+	case *snapMem:
+		src = s.memKV
+	default:
+		return kvdb.ErrNotSupported
+	}
+	if src == kv {
+		return nil
+	}
+
+	src.mutex.Lock()
+	// The remaining TTLs are measured on the clock that set the expiries.
+	capturedAt := src.clock.Now()
+	restored := make(map[string]*kvdb.KVPair, src.m.size())
+	aliases := make(map[string]bool)
+	src.m.each("", func(key string, kvp *kvdb.KVPair) {
+		if src.internal[key] || key == src.domain+bootstrapKey {
+			return
+		}
+		restoredKvp := kvp.Clone()
+		restoredKvp.Key = strings.TrimPrefix(key, src.domain)
+		restored[restoredKvp.Key] = restoredKvp
+		if src.aliases[key] {
+			aliases[restoredKvp.Key] = true
+		}
+	})
+	src.mutex.Unlock()
+
+	unlock := kv.lockAll()
+	defer unlock()
+	return kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if kv.absoluteExpiry {
+			capturedAt = kv.clock.Now()
+		}
+		ttls := make(map[string]uint64, len(restored))
+		keys := make([]string, 0, len(restored))
+		for key, kvp := range restored {
+			ttl := uint64(0)
+			if !kvp.ExpiresAt.IsZero() {
+				remaining := kvp.ExpiresAt.Sub(capturedAt)
+				if remaining <= 0 {
+					continue
+				}
+				// Round up so that a key is never restored without a TTL.
+				ttl = uint64((remaining + time.Second - 1) / time.Second)
+			}
+			ttls[key] = ttl
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		deleted := make([]string, 0)
+		kv.m.each("", func(key string, kvp *kvdb.KVPair) {
+			suffix := strings.TrimPrefix(key, kv.domain)
+			if _, ok := ttls[suffix]; !ok && !kv.internal[key] {
+				deleted = append(deleted, suffix)
+			}
+		})
+		sort.Strings(deleted)
+		for _, key := range deleted {
+			if _, err := kv.delete(key); err != nil {
+				return err
+			}
+		}
+		for _, key := range keys {
+			kvp, ttl := restored[key], ttls[key]
+			if current, err := kv.get(key); err == nil {
+				if kv.internal[kv.domain+key] {
+					continue
+				}
+				if ttl == 0 && current.ExpiresAt.IsZero() &&
+					bytes.Equal(current.Value, kvp.Value) &&
+					kv.aliases[kv.domain+key] == aliases[key] {
+					continue
+				}
+			}
+			if _, err := kv.put(key, kvp.Value, ttl, false); err != nil {
+				return err
+			}
+			if aliases[key] {
+				kv.aliases[kv.domain+key] = true
+			}
+		}
+		return nil
+	})
+}
+
+// put stores value at key. A non-zero ttl (re)arms the expiry of key. A zero
+// ttl keeps the current expiry of an existing key if keepTTL is set and
+// clears it otherwise. kvdb.NoTTL always clears it. kv must be locked, so
+// that callers can check the store and put under a single hold of the lock.
+func (kv *memKV) put(
+	key string,
+	value interface{},
+	ttl uint64,
+	keepTTL bool,
+) (*kvdb.KVPair, error) {
+
+	var kvp *kvdb.KVPair
+
+	if ttl == kvdb.NoTTL {
+		ttl, keepTTL = 0, false
+	}
+
+	suffix := key
+	key = kv.domain + suffix
+	b, err := kv.toBytes(value)
+	if err != nil {
+		return nil, err
+	}
+	kv.recordAccess(suffix, true)
+	index := atomic.AddUint64(&kv.index, 1)
+	var expiresAt time.Time
+	if ttl != 0 {
+		expiresAt = kv.clock.Now().Add(time.Second * time.Duration(ttl))
+	}
+	if ttl != 0 || !keepTTL {
+		kv.armExpiry(suffix, expiresAt)
+	}
+	kv.stopFallback(suffix)
+	delete(kv.writers, key)
+	delete(kv.aliases, key)
+	if old, ok := kv.m.get(key); ok {
+		old.Value = b
+		old.Action = kvdb.KVSet
+		old.ModifiedIndex = index
+		old.KVDBIndex = index
+		if ttl != 0 || !keepTTL {
+			old.TTL = int64(ttl)
+			old.ExpiresAt = expiresAt
+		}
+		kvp = old
+
+	} else {
+		kvp = &kvdb.KVPair{
+			Key:           key,
+			Value:         b,
+			TTL:           int64(ttl),
+			ExpiresAt:     expiresAt,
+			KVDBIndex:     index,
+			ModifiedIndex: index,
+			CreatedIndex:  index,
+			Action:        kvdb.KVCreate,
+		}
+	}
+	kv.normalize(kvp)
+	kv.m.set(key, kvp)
+	kv.setChecksum(key, b)
+
+	kv.scheduleFlush()
+	kv.dist.NewUpdate(&watchUpdate{key: key, kvp: *kvp, internal: kv.internal[key]})
+	// Return a deep copy so that callers can't change the stored value.
+	return kvp.Clone(), nil
+}
+
+// armExpiry arms the expiry of key at expiresAt on kv.clock, stopping the
+// one armed before. A zero expiresAt only stops it. kv must be locked.
+func (kv *memKV) armExpiry(key string, expiresAt time.Time) {
+	if e, ok := kv.expiries[kv.domain+key]; ok {
+		e.timer.Stop()
+		delete(kv.expiries, kv.domain+key)
+	}
+	if expiresAt.IsZero() {
+		return
+	}
+	e := &expiry{}
+	e.timer = kv.clock.AfterFunc(expiresAt.Sub(kv.clock.Now()), func() {
+		kv.expire(key, e)
+	})
+	kv.expiries[kv.domain+key] = e
+}
+
+// lockKeys locks the stripes of keys, in stripe order, and returns a func
+// unlocking them. A key is only written with its stripe locked, so that an
+// operation on a few keys can encode its values without kv.mutex and take
+// it only to apply its writes. Stripes are locked before kv.mutex.
+func (kv *memKV) lockKeys(keys ...string) func() {
+	locked := make([]int, 0, len(keys))
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		locked = append(locked, int(h.Sum32()%uint32(len(kv.stripes))))
+	}
+	sort.Ints(locked)
+	for i, stripe := range locked {
+		if i == 0 || stripe != locked[i-1] {
+			kv.stripes[stripe].Lock()
+		}
+	}
+	return func() {
+		for i, stripe := range locked {
+			if i == 0 || stripe != locked[i-1] {
+				kv.stripes[stripe].Unlock()
+			}
+		}
+	}
+}
+
+// lockAll locks every stripe, for operations that may write any key, and
+// returns a func unlocking them.
+func (kv *memKV) lockAll() func() {
+	for i := range kv.stripes {
+		kv.stripes[i].Lock()
+	}
+	return func() {
+		for i := range kv.stripes {
+			kv.stripes[i].Unlock()
+		}
+	}
+}
+
+// expire deletes key if e is still its armed expiry. The timer may have
+// fired while a write re-armed or cleared the expiry, even with the same
+// expiry time.
+func (kv *memKV) expire(key string, e *expiry) {
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	// TODO: handle error
+	_ = kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if kv.expiries[kv.domain+key] != e {
+			return nil
+		}
+		_, err := kv.delete(key)
+		return err
+	})
+}
+
+// putInternal is the same as put except that key is marked internal, so its
+// changes are not delivered to watches.
+func (kv *memKV) putInternal(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	kv.internal[kv.domain+key] = true
+	return kv.put(key, value, ttl, false)
+}
+
+func (kv *memKV) Put(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	defer kv.ops.observe(opPut, time.Now())
+
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	// The value is encoded and checked before taking kv.mutex, so that
+	// writes of keys in other stripes go on meanwhile.
+	b, err := kv.encode(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+		return kv.put(key, b, kv.writeTTL(ttl), false)
+	})
+}
+
+// write is put for values written by callers. value is checked with the
+// ValueValidator and, unless keepTTL is set, a zero ttl is replaced by the
+// default TTL. Every caller write goes through write, or validates and
+// applies writeTTL itself before changing anything if it writes several
+// keys. kv must be locked.
+func (kv *memKV) write(
+	key string,
+	value interface{},
+	ttl uint64,
+	keepTTL bool,
+) (*kvdb.KVPair, error) {
+	if err := kv.validate(key, value); err != nil {
+		return nil, err
+	}
+	if !keepTTL {
+		ttl = kv.writeTTL(ttl)
+	}
+	return kv.put(key, value, ttl, keepTTL)
+}
+
+// writeTTL returns the ttl to put or create a key with, applying the default
+// TTL to a zero ttl.
+func (kv *memKV) writeTTL(ttl uint64) uint64 {
+	if ttl == 0 {
+		return kv.defaultTTL
+	}
+	return ttl
+}
+
+// validate checks value with the configured ValueValidator, if any. The
+// stripe of key or kv.mutex must be held.
+func (kv *memKV) validate(key string, value interface{}) error {
+	if kv.validator == nil {
+		return nil
+	}
+	_, err := kv.encode(key, value)
+	return err
+}
+
+// encode returns the bytes stored for value at key, once checked with the
+// ValueValidator. The stripe of key or kv.mutex must be held.
+func (kv *memKV) encode(key string, value interface{}) ([]byte, error) {
+	b, err := kv.toBytes(value)
+	if err != nil {
+		return nil, err
+	}
+	if kv.validator != nil {
+		if err := kv.validator(key, b); err != nil {
+			return nil, fmt.Errorf("%w: %v", kvdb.ErrValidation, err)
+		}
+	}
+	return b, nil
+}
+
+// toBytes converts value to the bytes stored for it. Strings and byte slices
+// are stored as is and other values are encoded by the codec. kv.mutex or a
+// stripe must be held, as Recode changes the codec with both locked.
+func (kv *memKV) toBytes(value interface{}) ([]byte, error) {
+	switch value.(type) {
+	case string, []byte:
+		return common.ToBytes(value)
+	}
+	return kv.codec.Marshal(value)
+}
+
+func (kv *memKV) Codec() kvdb.Codec {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.codec
+}
+
+// getCodec returns a copy of the pair at key along with the codec its value
+// is encoded with.
+func (kv *memKV) getCodec(key string) (*kvdb.KVPair, kvdb.Codec, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.recordAccess(key, false)
+	kvp, err := kv.resolve(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := kv.verify(kvp); err != nil {
+		return nil, nil, err
+	}
+	return kvp.Clone(), kv.codec, nil
+}
+
+func (kv *memKV) GetVal(key string, v interface{}) (*kvdb.KVPair, error) {
+	kvp, codec, err := kv.getCodec(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = codec.Unmarshal(kvp.Value, v)
+	return kvp, err
+}
+
+func (kv *memKV) GetValMulti(
+	key string,
+	targets ...interface{},
+) (*kvdb.KVPair, error) {
+	kvp, codec, err := kv.getCodec(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range targets {
+		if err := codec.Unmarshal(kvp.Value, v); err != nil {
+			return kvp, fmt.Errorf("target %d: %w", i, err)
+		}
+	}
+	return kvp, nil
+}
+
+func (kv *memKV) Create(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	defer kv.ops.observe(opCreate, time.Now())
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	b, err := kv.encode(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		result, err := kv.get(key)
+		if err != nil {
+			return kv.put(key, b, kv.writeTTL(ttl), false)
+		}
+		return result.Clone(), kvdb.ErrExist
+	})
+}
+
+func (kv *memKV) Update(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	defer kv.ops.observe(opUpdate, time.Now())
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	b, err := kv.encode(key, value)
+	if err != nil {
+		return nil, err
+	}
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if _, err := kv.get(key); err != nil {
+			return nil, kvdb.ErrNotFound
+		}
+		return kv.put(key, b, ttl, true)
+	})
+}
+
+func (kv *memKV) PutMonotonic(
+	key string,
+	value int64,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if kvp, err := kv.get(key); err == nil {
+			var stored int64
+			if err := kv.codec.Unmarshal(kvp.Value, &stored); err != nil {
+				return nil, fmt.Errorf("key %q: %w", key, err)
+			}
+			if value < stored {
+				return nil, kvdb.ErrNonMonotonic
+			}
+		}
+		return kv.write(key, value, ttl, false)
+	})
+}
+
+func (kv *memKV) Enumerate(prefix string) (kvdb.KVPairs, error) {
+	defer kv.ops.observe(opEnumerate, time.Now())
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.enumerate(prefix)
+}
+
+func (kv *memKV) EnumerateGrouped(prefix string) (map[string]kvdb.KVPairs, error) {
+	kvps, err := kv.Enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return kvdb.GroupBySegment(prefix, kvps), nil
+}
+
+func (kv *memKV) LatestUnder(prefix string) (*kvdb.KVPair, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	var latest *kvdb.KVPair
+	prefix = kv.domain + prefix
+	kv.m.each(prefix, func(k string, v *kvdb.KVPair) {
+		if strings.Contains(k, "/_") {
+			return
+		}
+		if latest == nil || v.ModifiedIndex > latest.ModifiedIndex {
+			latest = v
+		}
+	})
+	if latest == nil {
+		return nil, kvdb.ErrNotFound
+	}
+	return latest.Clone(), nil
+}
+
+func (kv *memKV) enumerate(prefix string) (kvdb.KVPairs, error) {
+	var kvp = make(kvdb.KVPairs, 0, 100)
+	prefix = kv.domain + prefix
+
+	kv.m.each(prefix, func(k string, v *kvdb.KVPair) {
+		if !strings.Contains(k, "/_") {
+			kvpLocal := kv.withRemainingTTL(v.Clone())
+			kv.normalize(kvpLocal)
+			kvp = append(kvp, kvpLocal)
+		}
+	})
+
+	return kvp, nil
+}
+
+func (kv *memKV) EnumerateAt(prefix string) (kvdb.KVPairs, uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	kvps, err := kv.enumerate(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	return kvps, atomic.LoadUint64(&kv.index), nil
+}
+
+func (kv *memKV) EnumeratePaged(
+	prefix string,
+	limit int,
+	cursor string,
+) (kvdb.KVPairs, string, error) {
+	if limit <= 0 {
+		return nil, "", kvdb.ErrIllegal
+	}
+	kvps, err := kv.Enumerate(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(kvps, func(i, j int) bool { return kvps[i].Key < kvps[j].Key })
+	start := sort.Search(len(kvps), func(i int) bool {
+		return kvps[i].Key > cursor
+	})
+	kvps = kvps[start:]
+	if len(kvps) <= limit {
+		return kvps, "", nil
+	}
+	kvps = kvps[:limit]
+	return kvps, kvps[limit-1].Key, nil
+}
+
+// delete deletes key and returns its pair with the delete's index. kv must
+// be locked.
+func (kv *memKV) delete(key string) (*kvdb.KVPair, error) {
+	kvp, err := kv.get(key)
+	if err != nil {
+		return nil, err
+	}
+	kv.recordAccess(key, true)
+	kvp.KVDBIndex = atomic.AddUint64(&kv.index, 1)
+	kvp.ModifiedIndex = kvp.KVDBIndex
+	kvp.Action = kvdb.KVDelete
+	internal := kv.internal[kv.domain+key]
+	kv.armExpiry(key, time.Time{})
+	kv.stopFallback(key)
+	kv.m.remove(kv.domain + key)
+	delete(kv.writers, kv.domain+key)
+	delete(kv.internal, kv.domain+key)
+	delete(kv.aliases, kv.domain+key)
+	delete(kv.checksums, kv.domain+key)
+	kv.scheduleFlush()
+	kv.dist.NewUpdate(&watchUpdate{
+		key:      kv.domain + key,
+		kvp:      *kvp,
+		internal: internal,
+	})
+	return kvp, nil
+}
+
+func (kv *memKV) Delete(key string) (*kvdb.KVPair, error) {
+	defer kv.ops.observe(opDelete, time.Now())
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+		return kv.delete(key)
+	})
+}
+
+func (kv *memKV) DeleteIfExists(key string) (bool, error) {
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	deleted := false
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		_, err := kv.delete(key)
+		deleted = err == nil
+		return err
+	})
+	if err == kvdb.ErrNotFound {
+		return false, nil
+	}
+	return deleted, err
+}
+
+func (kv *memKV) DeleteIf(key string, pred func([]byte) bool) (bool, error) {
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	deleted := false
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		kvp, err := kv.get(key)
+		if err != nil {
+			return err
+		}
+		if !pred(kvp.Value) {
+			return nil
+		}
+		if _, err := kv.delete(key); err != nil {
+			return err
+		}
+		deleted = true
+		return nil
+	})
+	return deleted, err
+}
+
+func (kv *memKV) DeleteTree(prefix string) error {
+	if prefix == "" {
+		return kvdb.ErrRefusingRootDelete
+	}
+	return kv.DeleteTreeForce(prefix)
+}
+
+func (kv *memKV) DeleteTreeForce(prefix string) error {
+	defer kv.ops.observe(opDeleteTree, time.Now())
+	unlock := kv.lockAll()
+	defer unlock()
+	return kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		_, err := kv.deleteTree(prefix)
+		return err
+	})
+}
+
+func (kv *memKV) DeleteTreeWithResult(prefix string) (kvdb.KVPairs, error) {
+	if prefix == "" {
+		return nil, kvdb.ErrRefusingRootDelete
+	}
+	defer kv.ops.observe(opDeleteTree, time.Now())
+	unlock := kv.lockAll()
+	defer unlock()
+	var deleted kvdb.KVPairs
+	err := kv.serializeErr(func() (err error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		deleted, err = kv.deleteTree(prefix)
+		return err
+	})
+	return deleted, err
+}
+
+// deleteTree deletes the keys sharing prefix and returns the deleted pairs
+// in key order. A failed key does not stop the others from being deleted,
+// the error names every failed key and wraps the first failure. kv must be
+// locked, so that no key is put under prefix while it is deleted.
+func (kv *memKV) deleteTree(prefix string) (kvdb.KVPairs, error) {
+	kvps, err := kv.enumerate(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(kvps, func(i, j int) bool { return kvps[i].Key < kvps[j].Key })
+	deleted := make(kvdb.KVPairs, 0, len(kvps))
+	var failed []string
+	var firstErr error
+	for _, v := range kvps {
+		kvp, err := kv.delete(v.Key)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed = append(failed, v.Key)
+			continue
+		}
+		deleted = append(deleted, kvp.Clone())
+	}
+	if len(failed) > 0 {
+		return deleted, fmt.Errorf("failed to delete %v: %w",
+			strings.Join(failed, ", "), firstErr)
+	}
+	return deleted, nil
+}
+
+func (kv *memKV) DeleteTreeIfVersion(
+	prefix string,
+	versionKey string,
+	expectedValue []byte,
+) (int, error) {
+	unlock := kv.lockAll()
+	defer unlock()
+	deleted := 0
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		version, err := kv.get(versionKey)
+		if err != nil || !bytes.Equal(version.Value, expectedValue) {
+			return kvdb.ErrValueMismatch
+		}
+		kvps, err := kv.enumerate(prefix)
+		if err != nil {
+			return err
+		}
+		for _, v := range kvps {
+			if _, err := kv.delete(v.Key); err != nil {
+				return err
+			}
+		}
+		deleted = len(kvps)
+		return nil
+	})
+	return deleted, err
+}
+
+func (kv *memKV) AtomicAddBatch(
+	deltas map[string]int64,
+) (map[string]int64, error) {
+	keys := make([]string, 0, len(deltas))
+	for key := range deltas {
+		keys = append(keys, key)
+	}
+	unlock := kv.lockKeys(keys...)
+	defer unlock()
+	var values map[string]int64
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		sums := make(map[string]int64, len(deltas))
+		existing := make(map[string]bool, len(deltas))
+		for key, delta := range deltas {
+			var n int64
+			if kvp, err := kv.get(key); err == nil {
+				if n, err = strconv.ParseInt(string(kvp.Value), 10, 64); err != nil {
+					return kvdb.ErrNotNumeric
+				}
+				existing[key] = true
+			}
+			sums[key] = n + delta
+		}
+		sort.Strings(keys)
+		// Check every value up front so that a refused value doesn't leave the
+		// batch partially applied.
+		for _, key := range keys {
+			if err := kv.validate(key, strconv.FormatInt(sums[key], 10)); err != nil {
+				return err
+			}
+		}
+		for _, key := range keys {
+			value := strconv.FormatInt(sums[key], 10)
+			// A counter keeps its TTL, and a new one takes the default TTL.
+			ttl := uint64(0)
+			if !existing[key] {
+				ttl = kv.writeTTL(0)
+			}
+			if _, err := kv.put(key, value, ttl, existing[key]); err != nil {
+				return err
+			}
+		}
+		values = sums
+		return nil
+	})
+	return values, err
+}
+
+func (kv *memKV) AtomicIncrement(key string, delta int64) (int64, error) {
+	values, err := kv.AtomicAddBatch(map[string]int64{key: delta})
+	if err != nil {
+		return 0, err
+	}
+	return values[key], nil
+}
+
+func (kv *memKV) AtomicDecrement(key string, delta int64) (int64, error) {
+	return kv.AtomicIncrement(key, -delta)
+}
+
+// tokenBucket is the state of a token bucket stored by AllowN.
+type tokenBucket struct {
+	// Tokens is the number of tokens left at Refilled
+	Tokens float64
+	// Refilled is when Tokens was last brought up to date, in nanoseconds
+	// since the epoch
+	Refilled int64
+}
+
+func (kv *memKV) AllowN(key string, rate float64, burst int, n int) (bool, error) {
+	if rate < 0 || burst <= 0 || n < 0 {
+		return false, kvdb.ErrIllegal
+	}
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	allowed := false
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		now := kv.clock.Now().UnixNano()
+		bucket := tokenBucket{Tokens: float64(burst), Refilled: now}
+		// A bucket keeps its TTL, and a new one takes the default TTL.
+		keepTTL := false
+		if kvp, err := kv.get(key); err == nil {
+			keepTTL = true
+			if err := kv.codec.Unmarshal(kvp.Value, &bucket); err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			if elapsed := now - bucket.Refilled; elapsed > 0 {
+				bucket.Tokens += rate * time.Duration(elapsed).Seconds()
+			}
+			if bucket.Tokens > float64(burst) {
+				bucket.Tokens = float64(burst)
+			}
+			bucket.Refilled = now
+		}
+		enough := bucket.Tokens >= float64(n)
+		if enough {
+			bucket.Tokens -= float64(n)
+		}
+		if _, err := kv.write(key, bucket, 0, keepTTL); err != nil {
+			return err
+		}
+		allowed = enough
+		return nil
+	})
+	return allowed, err
+}
+
+func (kv *memKV) PutIfOther(
+	key string,
+	value interface{},
+	ttl uint64,
+	guardKey string,
+	guardValue []byte,
+) (*kvdb.KVPair, error) {
+	unlock := kv.lockKeys(key, guardKey)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		guard, err := kv.get(guardKey)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(guard.Value, guardValue) {
+			return nil, kvdb.ErrValueMismatch
+		}
+		return kv.write(key, value, ttl, false)
+	})
+}
+
+func (kv *memKV) PutWithFallback(
+	key string,
+	value interface{},
+	fallback interface{},
+	after time.Duration,
+) (*kvdb.KVPair, error) {
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if err := kv.validate(key, fallback); err != nil {
+			return nil, err
+		}
+		b, err := kv.toBytes(fallback)
+		if err != nil {
+			return nil, err
+		}
+		kvp, err := kv.write(key, value, 0, false)
+		if err != nil {
+			return nil, err
+		}
+		kv.armFallback(key, b, kvp.ModifiedIndex, after)
+		return kvp, nil
+	})
+}
+
+// armFallback arms the fallback of key to value after the given duration on
+// kv.clock, for key as modified at modifiedIndex. The fallback is stopped
+// when key is written or deleted. kv must be locked.
+func (kv *memKV) armFallback(
+	key string,
+	value []byte,
+	modifiedIndex uint64,
+	after time.Duration,
+) {
+	kv.stopFallback(key)
+	e := &expiry{}
+	e.timer = kv.clock.AfterFunc(after, func() {
+		kv.fallback(key, value, modifiedIndex, e)
+	})
+	kv.fallbacks[kv.domain+key] = e
+}
+
+// stopFallback stops the fallback armed for key, if any. kv must be locked.
+func (kv *memKV) stopFallback(key string) {
+	if e, ok := kv.fallbacks[kv.domain+key]; ok {
+		e.timer.Stop()
+		delete(kv.fallbacks, kv.domain+key)
+	}
+}
+
+// fallback puts value at key if e is still its armed fallback and key was
+// not modified since modifiedIndex.
+func (kv *memKV) fallback(key string, value []byte, modifiedIndex uint64, e *expiry) {
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	// TODO: handle error
+	_ = kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if kv.fallbacks[kv.domain+key] != e {
+			return nil
+		}
+		delete(kv.fallbacks, kv.domain+key)
+		if kvp, err := kv.get(key); err != nil || kvp.ModifiedIndex != modifiedIndex {
+			return nil
+		}
+		_, err := kv.write(key, value, 0, false)
+		return err
+	})
+}
+
+func (kv *memKV) MoveIf(
+	src string,
+	dst string,
+	expectedDstValue []byte,
+) (*kvdb.KVPair, error) {
+	if src == dst {
+		return nil, kvdb.ErrIllegal
+	}
+	unlock := kv.lockKeys(src, dst)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		srcKvp, err := kv.get(src)
+		if err != nil {
+			return nil, err
+		}
+		if dstKvp, err := kv.get(dst); err == nil &&
+			!bytes.Equal(dstKvp.Value, expectedDstValue) {
+			return nil, kvdb.ErrValueMismatch
+		}
+		// The moved key keeps what remains of the TTL of src, or its lack
+		// of one.
+		ttl := kvdb.NoTTL
+		if !srcKvp.ExpiresAt.IsZero() {
+			ttl = uint64(kv.withRemainingTTL(srcKvp.Clone()).TTL)
+			if ttl == 0 {
+				// src is due to expire, so dst expires at once.
+				ttl = 1
+			}
+		}
+		result, err := kv.write(dst, srcKvp.Value, ttl, false)
+		if err != nil {
+			return nil, err
+		}
+		if !srcKvp.ExpiresAt.IsZero() {
+			// Expire dst when src would have, rather than on a whole second.
+			stored, _ := kv.get(dst)
+			stored.ExpiresAt = srcKvp.ExpiresAt
+			kv.m.set(kv.domain+dst, stored)
+			kv.armExpiry(dst, stored.ExpiresAt)
+			result.ExpiresAt = stored.ExpiresAt
+		}
+		if _, err := kv.delete(src); err != nil {
+			return nil, err
+		}
+		return result, nil
+	})
+}
+
+func (kv *memKV) Rename(oldKey, newKey string) (*kvdb.KVPair, error) {
+	unlock := kv.lockKeys(oldKey, newKey)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		old, err := kv.get(oldKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := kv.get(newKey); err == nil {
+			return nil, kvdb.ErrExist
+		}
+		if err := kv.validate(newKey, old.Value); err != nil {
+			return nil, err
+		}
+		alias := kv.aliases[kv.domain+oldKey]
+		if _, err := kv.delete(oldKey); err != nil {
+			return nil, err
+		}
+		if alias {
+			kv.aliases[kv.domain+newKey] = true
+		}
+
+		// The pair is stored directly rather than through put so that it keeps
+		// its CreatedIndex and expiry.
+		kv.recordAccess(newKey, true)
+		index := atomic.AddUint64(&kv.index, 1)
+		kv.armExpiry(newKey, old.ExpiresAt)
+		kvp := &kvdb.KVPair{
+			Key:           newKey,
+			Value:         old.Value,
+			TTL:           old.TTL,
+			ExpiresAt:     old.ExpiresAt,
+			KVDBIndex:     index,
+			ModifiedIndex: index,
+			CreatedIndex:  old.CreatedIndex,
+			Action:        kvdb.KVCreate,
+		}
+		kv.m.set(kv.domain+newKey, kvp)
+		kv.setChecksum(kv.domain+newKey, kvp.Value)
+		kv.scheduleFlush()
+		kv.dist.NewUpdate(&watchUpdate{key: kv.domain + newKey, kvp: *kvp})
+		return kvp.Clone(), nil
+	})
+}
+
+func (kv *memKV) ReplaceTree(
+	prefix string,
+	pairs map[string]interface{},
+	ttl uint64,
+) (int, int, error) {
+	unlock := kv.lockAll()
+	defer unlock()
+	written, deleted := 0, 0
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		// Encode every value up front so that a bad value doesn't leave the
+		// tree partially replaced.
+		values := make(map[string][]byte, len(pairs))
+		keys := make([]string, 0, len(pairs))
+		for k, v := range pairs {
+			if err := kv.validate(prefix+k, v); err != nil {
+				return err
+			}
+			b, err := kv.toBytes(v)
+			if err != nil {
+				return err
+			}
+			values[prefix+k] = b
+			keys = append(keys, prefix+k)
+		}
+		sort.Strings(keys)
+
+		kvps, err := kv.enumerate(prefix)
+		if err != nil {
+			return err
+		}
+		for _, kvp := range kvps {
+			if _, ok := values[kvp.Key]; ok {
+				continue
+			}
+			if _, err := kv.delete(kvp.Key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		for _, key := range keys {
+			if _, err := kv.put(key, values[key], kv.writeTTL(ttl), false); err != nil {
+				return err
+			}
+			written++
+		}
+		return nil
+	})
+	return written, deleted, err
+}
+
+func (kv *memKV) CreateBatch(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	unlock := kv.lockKeys(keys...)
+	defer unlock()
+	var kvps kvdb.KVPairs
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		// Check and encode every pair up front so that nothing is created if
+		// any of them fails.
+		values := make(map[string][]byte, len(pairs))
+		for _, key := range keys {
+			if err := kv.validate(key, pairs[key]); err != nil {
+				return err
+			}
+			if _, err := kv.get(key); err == nil {
+				return fmt.Errorf("key %q: %w", key, kvdb.ErrExist)
+			}
+			b, err := kv.toBytes(pairs[key])
+			if err != nil {
+				return err
+			}
+			values[key] = b
+		}
+		kvps = make(kvdb.KVPairs, 0, len(keys))
+		for _, key := range keys {
+			kvp, err := kv.put(key, values[key], kv.writeTTL(ttl), false)
+			if err != nil {
+				return err
+			}
+			kvps = append(kvps, kvp)
+		}
+		return nil
+	})
+	return kvps, err
+}
+
+func (kv *memKV) PutBulk(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	defer kv.ops.observe(opPut, time.Now())
+
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	unlock := kv.lockKeys(keys...)
+	defer unlock()
+	kvps := make(kvdb.KVPairs, 0, len(keys))
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		for _, key := range keys {
+			if err := kv.validate(key, pairs[key]); err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			kvp, err := kv.put(key, pairs[key], kv.writeTTL(ttl), false)
+			if err != nil {
+				return fmt.Errorf("key %q: %w", key, err)
+			}
+			kvps = append(kvps, kvp)
+		}
+		return nil
+	})
+	return kvps, err
+}
+
+func (kv *memKV) Keys(prefix, sep string) ([]string, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	if "" == sep {
+		sep = "/"
+	}
+	prefix = kv.domain + prefix
+	if prefix != "" && !strings.HasSuffix(prefix, sep) {
+		prefix += sep
+	}
+	lenPrefix := len(prefix)
+
+	seen := make(map[string]bool)
+	kv.m.each(prefix, func(k string, _ *kvdb.KVPair) {
+		if !strings.Contains(k, "/_") {
+			key := k[lenPrefix:]
+			if idx := strings.Index(key, sep); idx > 0 {
+				key = key[:idx]
+			}
+			if key != "" {
+				seen[key] = true
+			}
+		}
+	})
+	retList := make([]string, 0, len(seen))
+	for k := range seen {
+		retList = append(retList, k)
+	}
+	sort.Strings(retList)
+
+	return retList, nil
+}
+
+func (kv *memKV) CompareAndSet(
+	kvp *kvdb.KVPair,
+	flags kvdb.KVFlags,
+	prevValue []byte,
+) (*kvdb.KVPair, error) {
+
+	unlock := kv.lockKeys(kvp.Key)
+	defer unlock()
+	b, err := kv.encode(kvp.Key, kvp.Value)
+	if err != nil {
+		return nil, err
+	}
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		result, err := kv.get(kvp.Key)
+		if err != nil {
+			return nil, err
+		}
+		if prevValue != nil {
+			if !bytes.Equal(result.Value, prevValue) {
+				return nil, kvdb.ErrValueMismatch
+			}
+		}
+		if flags&kvdb.KVModifiedIndex != 0 {
+			if kvp.ModifiedIndex != result.ModifiedIndex {
+				return nil, kvdb.ErrValueMismatch
+			}
+		}
+		return kv.put(kvp.Key, b, 0, true)
+	})
+}
+
+func (kv *memKV) CompareAndDelete(
+	kvp *kvdb.KVPair,
+	flags kvdb.KVFlags,
+) (*kvdb.KVPair, error) {
+	unlock := kv.lockKeys(kvp.Key)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if flags&^kvdb.KVModifiedIndex != 0 {
+			return nil, kvdb.ErrNotSupported
+		}
+		result, err := kv.get(kvp.Key)
+		if err != nil {
+			return nil, err
+		}
+		if flags&kvdb.KVModifiedIndex != 0 {
+			if kvp.ModifiedIndex != result.ModifiedIndex {
+				return nil, kvdb.ErrValueMismatch
+			}
+		} else if !bytes.Equal(result.Value, kvp.Value) {
+			return nil, kvdb.ErrNotFound
+		}
+		return kv.delete(kvp.Key)
+	})
+}
+
+func (kv *memKV) WatchKey(
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
+	return kv.WatchKeyWithContext(context.Background(), key, waitIndex,
+		opaque, cb)
+}
+
+func (kv *memKV) WatchKeyWithContext(
+	ctx context.Context,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
+	return kv.watchKey(ctx, key,
+		kvdb.WatchOptions{WaitIndex: waitIndex, Opaque: opaque}, cb)
+}
+
+func (kv *memKV) WatchKeyOpts(
+	key string,
+	opts kvdb.WatchOptions,
+	cb kvdb.WatchCB,
+) error {
+	return kv.watchKey(context.Background(), key, opts, cb)
+}
+
+func (kv *memKV) watchKey(
+	ctx context.Context,
+	key string,
+	opts kvdb.WatchOptions,
+	cb kvdb.WatchCB,
+) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	v := newWatchData(opts, cb)
+	if opts.InitialValue {
+		// Only the changes after the initial value are delivered.
+		v.waitIndex = atomic.LoadUint64(&kv.index)
+		if kvp, err := kv.get(key); err == nil {
+			initial := *kvp.Clone()
+			initial.Action = kvdb.KVGet
+			v.initial = &watchUpdate{key: kv.domain + key, kvp: initial}
+		} else if opts.InitialNotFound {
+			v.initial = &watchUpdate{key: kv.domain + key, err: kvdb.ErrNotFound}
+		}
+	}
+	if v.waitIndex > 0 && !kv.retained(v.waitIndex) {
+		return kvdb.ErrWatchRevisionCompacted
+	}
+	kv.startWatch(kv.domain+key, v, false)
+	kv.stopOnDone(ctx, v)
+	return nil
+}
+
+func (kv *memKV) WatchTree(
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
+	return kv.WatchTreeWithContext(context.Background(), prefix, waitIndex,
+		opaque, cb)
+}
+
+func (kv *memKV) WatchTreeWithContext(
+	ctx context.Context,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
+	return kv.watchTree(ctx, prefix,
+		kvdb.WatchOptions{WaitIndex: waitIndex, Opaque: opaque}, cb)
+}
+
+func (kv *memKV) WatchAll(
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
+	return kv.WatchAllWithContext(context.Background(), waitIndex, opaque, cb)
+}
+
+func (kv *memKV) WatchAllWithContext(
+	ctx context.Context,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
+	return kv.watchTree(ctx, "", kvdb.WatchOptions{
+		WaitIndex: waitIndex,
+		Opaque:    opaque,
+		Filter: func(kvp *kvdb.KVPair) bool {
+			return !strings.Contains(kv.domain+kvp.Key, "/_")
+		},
+	}, cb)
+}
+
+func (kv *memKV) WatchTreeOpts(
+	prefix string,
+	opts kvdb.WatchOptions,
+	cb kvdb.WatchCB,
+) error {
+	return kv.watchTree(context.Background(), prefix, opts, cb)
+}
+
+func (kv *memKV) watchTree(
+	ctx context.Context,
+	prefix string,
+	opts kvdb.WatchOptions,
+	cb kvdb.WatchCB,
+) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	if opts.WaitIndex > 0 && !kv.retained(opts.WaitIndex) {
+		return kvdb.ErrWatchRevisionCompacted
+	}
+	v := newWatchData(opts, cb)
+	kv.startWatch(kv.domain+prefix, v, true)
+	kv.stopOnDone(ctx, v)
+	return nil
+}
+
+func (kv *memKV) WatchFrom(
+	key string,
+) (*kvdb.KVPair, <-chan *kvdb.KVPair, func(), error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	var current *kvdb.KVPair
+	if kvp, err := kv.get(key); err == nil {
+		current = kvp.Clone()
+	} else if err != kvdb.ErrNotFound {
+		return nil, nil, nil, err
+	}
+
+	updates := make(chan *kvdb.KVPair)
+	stop := make(chan struct{})
+	var closeOnce, stopOnce sync.Once
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+		if err != nil {
+			closeOnce.Do(func() { close(updates) })
+			return err
+		}
+		update := *kvp
+		select {
+		case updates <- &update:
+			return nil
+		case <-stop:
+			return kvdb.ErrWatchStopped
+		}
+	}
+	// Every change after the read is assigned a higher index, and none can
+	// happen before the watch is registered since kv stays locked.
+	v := newWatchData(kvdb.WatchOptions{
+		WaitIndex: atomic.LoadUint64(&kv.index),
+	}, cb)
+	kv.startWatch(kv.domain+key, v, false)
+	cancel := func() {
+		stopOnce.Do(func() {
+			close(stop)
+			v.q.Enqueue(&watchUpdate{control: watchStop})
+		})
+	}
+	return current, updates, cancel, nil
+}
+
+// retained reports whether the history holds every change after sinceIndex.
+// kv must be locked.
+func (kv *memKV) retained(sinceIndex uint64) bool {
+	if sinceIndex >= atomic.LoadUint64(&kv.index) {
+		return true
+	}
+	// Every index is assigned to exactly one update, so the history covers
+	// sinceIndex only if it starts right after it.
+	history := kv.dist.History()
+	return len(history) > 0 && history[0].kvp.ModifiedIndex <= sinceIndex+1
+}
+
+// startWatch registers v as a watch on prefix and starts delivering updates
+// to it, beginning with the retained changes after its waitIndex. kv must be
+// locked.
+func (kv *memKV) startWatch(prefix string, v *watchData, treeWatch bool) {
+	v.q = kv.dist.Add()
+	v.prefix = prefix
+	v.treeWatch = treeWatch
+	v.cursor = v.waitIndex
+	kv.watches[prefix] = append(kv.watches[prefix], v)
+	go kv.watchCb(v.q, v)
+}
+
+// stopOnDone stops v once ctx is done, unless it has stopped before.
+func (kv *memKV) stopOnDone(ctx context.Context, v *watchData) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			v.q.Enqueue(&watchUpdate{control: watchStop})
+		case <-v.stopped:
+		}
+	}()
+}
+
+// stopWatch unregisters v after its delivery has stopped.
+func (kv *memKV) stopWatch(v *watchData) {
+	kv.dist.Remove(v.q)
+	close(v.stopped)
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	watches := kv.watches[v.prefix]
+	for i, w := range watches {
+		if w == v {
+			watches = append(watches[:i], watches[i+1:]...)
+			break
+		}
+	}
+	if len(watches) == 0 {
+		delete(kv.watches, v.prefix)
+	} else {
+		kv.watches[v.prefix] = watches
+	}
+}
+
+func (kv *memKV) HasWatchers(key string) (bool, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	key = kv.domain + key
+	for prefix, watches := range kv.watches {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for _, v := range watches {
+			if v.treeWatch || prefix == key {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (kv *memKV) StopWatchGroup(group string) int {
+	if group == "" {
+		return 0
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	stopped := 0
+	for _, watches := range kv.watches {
+		for _, v := range watches {
+			if v.group == group {
+				v.q.Enqueue(&watchUpdate{control: watchStop})
+				stopped++
+			}
+		}
+	}
+	return stopped
+}
+
+func (kv *memKV) PauseWatch(key string) error {
+	return kv.setPaused(key, true)
+}
+
+func (kv *memKV) ResumeWatch(key string) error {
+	return kv.setPaused(key, false)
+}
+
+// setPaused pauses or resumes every watch on key.
+func (kv *memKV) setPaused(key string, paused bool) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	watches := kv.watches[kv.domain+key]
+	if len(watches) == 0 {
+		return kvdb.ErrNotFound
+	}
+	control := watchResume
+	if paused {
+		control = watchPause
+	}
+	for _, v := range watches {
+		if v.paused == paused {
+			continue
+		}
+		v.paused = paused
+		// Control updates are queued with kv locked, so they take effect in
+		// order with the updates around them.
+		v.q.Enqueue(&watchUpdate{control: control})
+	}
+	return nil
+}
+
+func (kv *memKV) PollChanges(
+	prefix string,
+	sinceIndex uint64,
+) (kvdb.KVPairs, uint64, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	index := atomic.LoadUint64(&kv.index)
+	changes := make(kvdb.KVPairs, 0)
+	if sinceIndex >= index {
+		return changes, index, nil
+	}
+	if !kv.retained(sinceIndex) {
+		return nil, 0, kvdb.ErrWatchRevisionCompacted
+	}
+	prefix = kv.domain + prefix
+	for _, u := range kv.dist.History() {
+		if !u.internal && u.kvp.ModifiedIndex > sinceIndex &&
+			strings.HasPrefix(u.key, prefix) {
+			kvpLocal := u.kvp
+			changes = append(changes, &kvpLocal)
+		}
+	}
+	return changes, index, nil
+}
+
+func (kv *memKV) CompactHistory(index uint64) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	if index > atomic.LoadUint64(&kv.index) {
+		return kvdb.ErrIllegal
+	}
+	kv.dist.Compact(index)
+	for _, watches := range kv.watches {
+		for _, v := range watches {
+			if !v.compactionEvents || atomic.LoadUint64(&v.cursor)+1 >= index {
+				continue
+			}
+			// The watch drops the compacted changes queued ahead of the
+			// compaction, and reports it before the first change it keeps.
+			atomic.StoreUint64(&v.floor, index)
+			v.q.Enqueue(&watchUpdate{control: watchCompact})
+		}
+	}
+	return nil
+}
+
+func (kv *memKV) ReplayHistory(
+	fromIndex uint64,
+	fn func(kvp *kvdb.KVPair) error,
+) error {
+	sinceIndex := uint64(0)
+	if fromIndex > 0 {
+		sinceIndex = fromIndex - 1
+	}
+	changes, _, err := kv.PollChanges("", sinceIndex)
+	if err != nil {
+		return err
+	}
+	for _, kvp := range changes {
+		if err := fn(kvp); err == kvdb.ErrWatchStopped {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kv *memKV) Lock(key string) (*kvdb.KVPair, error) {
+	return kv.LockWithID(key, "locked")
+}
+
+func (kv *memKV) LockWithID(
+	key string,
+	lockerID string,
+) (*kvdb.KVPair, error) {
+	return kv.LockWithPriority(key, lockerID, 0)
+}
+
+func (kv *memKV) LockWithPriority(
+	key string,
+	lockerID string,
+	priority int,
+) (*kvdb.KVPair, error) {
+	return kv.lock(key, lockerID, priority, kv.lockTimeout,
+		uint64(time.Second*3))
+}
+
+func (kv *memKV) LockWithTimeout(
+	key string,
+	lockerID string,
+	lockTimeout time.Duration,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	if lockTimeout < 0 {
+		return nil, kvdb.ErrIllegal
+	}
+	return kv.lock(key, lockerID, 0, lockTimeout, ttl)
+}
+
+// lock waits for the lock at key, giving up with ErrLockTimeout after
+// lockTimeout unless it is zero.
+func (kv *memKV) lock(
+	key string,
+	lockerID string,
+	priority int,
+	lockTimeout time.Duration,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	key = kv.domain + key
+	duration := time.Second
+	var deadline time.Time
+	if lockTimeout > 0 {
+		deadline = time.Now().Add(lockTimeout)
+	}
+
+	waiter := kv.addLockWaiter(key, priority)
+	defer kv.removeLockWaiter(key, waiter)
+	result, err := kv.createLock(key, lockerID, ttl, waiter)
+	count := 0
+	for err != nil {
+		sleep := duration
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				return nil, kvdb.ErrLockTimeout
+			}
+			if remaining < sleep {
+				sleep = remaining
+			}
+		}
+		time.Sleep(sleep)
+		result, err = kv.createLock(key, lockerID, ttl, waiter)
+		if err != nil && count > 0 && count%15 == 0 {
+			var currLockerID string
+			if _, errGet := kv.GetVal(key, currLockerID); errGet == nil {
+				logrus.Infof("Lock %v locked for %v seconds, tag: %v",
+					key, count, currLockerID)
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
 	}
-	return result, kvdb.ErrExist
+	return result, err
 }
 
-func (kv *memKV) Update(
+func (kv *memKV) TryLockMany(
+	keys []string,
+	lockerID string,
+	ttl uint64,
+) ([]*kvdb.KVPair, []string, error) {
+	lockKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lockKeys = append(lockKeys, kv.domain+key)
+	}
+	unlock := kv.lockKeys(lockKeys...)
+	defer unlock()
+	var acquired []*kvdb.KVPair
+	var skipped []string
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		acquired = make([]*kvdb.KVPair, 0, len(keys))
+		skipped = make([]string, 0)
+		for _, key := range keys {
+			// Lock keys are stored the same way as by LockWithPriority.
+			lockKey := kv.domain + key
+			if _, err := kv.get(lockKey); err == nil ||
+				len(kv.lockWaiters[lockKey]) > 0 {
+				skipped = append(skipped, key)
+				continue
+			}
+			kvp, err := kv.putInternal(lockKey, lockerID, ttl)
+			if err != nil {
+				// Release what was acquired rather than leak it.
+				for _, lock := range acquired {
+					_, _ = kv.delete(lock.Key)
+				}
+				return err
+			}
+			acquired = append(acquired, kvp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return acquired, skipped, nil
+}
+
+// lockWaiter is a caller waiting for a lock.
+type lockWaiter struct {
+	// since is when the caller started waiting
+	since time.Time
+	// priority orders the waiters, the highest acquires next
+	priority int
+}
+
+// createLock creates the lock key for lockerID on behalf of waiter. It fails
+// with ErrExist while the lock is held or an earlier waiter of at least the
+// same priority, or any waiter of higher priority, is waiting for it. Lock
+// keys are internal, so acquiring or releasing a lock doesn't wake watches.
+func (kv *memKV) createLock(
 	key string,
-	value interface{},
+	lockerID string,
 	ttl uint64,
+	waiter *lockWaiter,
 ) (*kvdb.KVPair, error) {
+	unlock := kv.lockKeys(key)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if result, err := kv.get(key); err == nil {
+			return result, kvdb.ErrExist
+		}
+		if next := kv.nextLockWaiter(key); next != waiter {
+			return nil, kvdb.ErrExist
+		}
+		return kv.putInternal(key, lockerID, ttl)
+	})
+}
+
+// nextLockWaiter returns the waiter that acquires the lock at key next: the
+// earliest of the waiters with the highest priority. kv must be locked.
+func (kv *memKV) nextLockWaiter(key string) *lockWaiter {
+	var next *lockWaiter
+	for _, w := range kv.lockWaiters[key] {
+		if next == nil || w.priority > next.priority {
+			next = w
+		}
+	}
+	return next
+}
+
+// addLockWaiter records a caller waiting for the lock at key.
+func (kv *memKV) addLockWaiter(key string, priority int) *lockWaiter {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
+	waiter := &lockWaiter{since: kv.clock.Now(), priority: priority}
+	kv.lockWaiters[key] = append(kv.lockWaiters[key], waiter)
+	return waiter
+}
 
-	if _, err := kv.get(key); err != nil {
-		return nil, kvdb.ErrNotFound
+// removeLockWaiter removes a waiter added by addLockWaiter.
+func (kv *memKV) removeLockWaiter(key string, waiter *lockWaiter) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	waiters := kv.lockWaiters[key]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(kv.lockWaiters, key)
+	} else {
+		kv.lockWaiters[key] = waiters
 	}
-	return kv.put(key, value, ttl)
 }
 
-func (kv *memKV) Enumerate(prefix string) (kvdb.KVPairs, error) {
-	var kvp = make(kvdb.KVPairs, 0, 100)
-	prefix = kv.domain + prefix
+func (kv *memKV) LockStats(key string) (kvdb.LockStat, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
 
-	for k, v := range kv.m {
-		if strings.HasPrefix(k, prefix) && !strings.Contains(k, "/_") {
-			kvpLocal := *v
-			kv.normalize(&kvpLocal)
-			kvp = append(kvp, &kvpLocal)
+	waiters := kv.lockWaiters[kv.domain+key]
+	stat := kvdb.LockStat{Waiters: len(waiters)}
+	now := kv.clock.Now()
+	for _, w := range waiters {
+		if wait := now.Sub(w.since); wait > stat.LongestWait {
+			stat.LongestWait = wait
 		}
 	}
+	return stat, nil
+}
 
-	return kvp, nil
+func (kv *memKV) Unlock(kvp *kvdb.KVPair) error {
+	_, err := kv.CompareAndDelete(kvp, kvdb.KVFlags(0))
+	return err
 }
 
-func (kv *memKV) delete(key string) (*kvdb.KVPair, error) {
-	kvp, err := kv.get(key)
-	if err != nil {
+func (kv *memKV) RefreshLock(kvp *kvdb.KVPair, ttl uint64) (*kvdb.KVPair, error) {
+	unlock := kv.lockKeys(kvp.Key)
+	defer unlock()
+	return kv.serialize(func() (*kvdb.KVPair, error) {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		current, err := kv.get(kvp.Key)
+		if err != nil || current.ModifiedIndex != kvp.ModifiedIndex ||
+			!bytes.Equal(current.Value, kvp.Value) {
+			return nil, kvdb.ErrNotFound
+		}
+		if ttl == 0 {
+			ttl = uint64(current.TTL)
+		}
+		if ttl == 0 {
+			// The lock never expires.
+			return current.Clone(), nil
+		}
+		// The index is kept so that views from WithLock stay valid.
+		expiresAt := kv.clock.Now().Add(time.Second * time.Duration(ttl))
+		current.TTL = int64(ttl)
+		current.ExpiresAt = expiresAt
+		kv.m.set(kv.domain+current.Key, current)
+		kv.armExpiry(current.Key, expiresAt)
+		return current.Clone(), nil
+	})
+}
+
+func (kv *memKV) WithLock(lock *kvdb.KVPair) (kvdb.Kvdb, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	view := &lockedView{memKV: kv, lock: lock, lockerID: string(lock.Value)}
+	if err := view.checkLock(); err != nil {
 		return nil, err
 	}
-	kvp.KVDBIndex = atomic.AddUint64(&kv.index, 1)
-	kvp.ModifiedIndex = kvp.KVDBIndex
-	kvp.Action = kvdb.KVDelete
-	delete(kv.m, kv.domain+key)
-	kv.dist.NewUpdate(&watchUpdate{kv.domain + key, *kvp, nil})
-	return kvp, nil
+	return view, nil
 }
 
-func (kv *memKV) Delete(key string) (*kvdb.KVPair, error) {
+func (kv *memKV) KeysWrittenBy(lockerID string) ([]string, error) {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 
-	return kv.delete(key)
+	keys := make([]string, 0)
+	for k, id := range kv.writers {
+		if id == lockerID {
+			keys = append(keys, strings.TrimPrefix(k, kv.domain))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
 }
 
-func (kv *memKV) DeleteTree(prefix string) error {
+// Verify checks the internal invariants of the store. Keys past their TTL
+// are not reported since they are collected asynchronously.
+func (kv *memKV) Verify() error {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 
-	kvp, err := kv.Enumerate(prefix)
+	index := atomic.LoadUint64(&kv.index)
+	var err error
+	kv.m.each("", func(k string, kvp *kvdb.KVPair) {
+		switch {
+		case err != nil:
+		case !strings.HasPrefix(k, kv.domain):
+			err = fmt.Errorf("key %q is outside domain %q", k, kv.domain)
+		case kvp.Key != strings.TrimPrefix(k, kv.domain):
+			err = fmt.Errorf("key %q stored with mismatched key %q",
+				k, kvp.Key)
+		case kvp.ModifiedIndex > index:
+			err = fmt.Errorf("key %q modified index %v is ahead of "+
+				"kvdb index %v", k, kvp.ModifiedIndex, index)
+		case kvp.CreatedIndex > kvp.ModifiedIndex:
+			err = fmt.Errorf("key %q created index %v is ahead of "+
+				"modified index %v", k, kvp.CreatedIndex, kvp.ModifiedIndex)
+		}
+	})
 	if err != nil {
 		return err
 	}
-	for _, v := range kvp {
-		// TODO: multiple errors
-		if _, iErr := kv.delete(v.Key); iErr != nil {
-			err = iErr
+	for k := range kv.writers {
+		if _, ok := kv.m.get(k); !ok {
+			return fmt.Errorf("writer recorded for deleted key %q", k)
+		}
+	}
+	return nil
+}
+
+func (kv *memKV) ApplyChange(kvp *kvdb.KVPair) error {
+	unlock := kv.lockKeys(kvp.Key)
+	defer unlock()
+	return kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		if kvp.ModifiedIndex <= atomic.LoadUint64(&kv.index) {
+			// Already reflected in this kvdb.
+			return nil
+		}
+		if kvp.Action != kvdb.KVDelete && kvp.Action != kvdb.KVExpire {
+			if err := kv.validate(kvp.Key, kvp.Value); err != nil {
+				return err
+			}
+		}
+		key := kv.domain + kvp.Key
+		kvpLocal := *kvp
+		kvpLocal.Value = append([]byte(nil), kvp.Value...)
+		kvpLocal.KVDBIndex = kvp.ModifiedIndex
+		atomic.StoreUint64(&kv.index, kvp.ModifiedIndex)
+		// Keys expire on the primary, which delivers the change.
+		kv.armExpiry(kvp.Key, time.Time{})
+		delete(kv.writers, key)
+		delete(kv.aliases, key)
+		if kvp.Action == kvdb.KVDelete || kvp.Action == kvdb.KVExpire {
+			kv.m.remove(key)
+			delete(kv.checksums, key)
+		} else {
+			stored := kvpLocal
+			kv.m.set(key, &stored)
+			kv.setChecksum(key, stored.Value)
+		}
+		kv.scheduleFlush()
+		kv.dist.NewUpdate(&watchUpdate{key: key, kvp: kvpLocal})
+		return nil
+	})
+}
+
+func (kv *memKV) DebugDump() map[string]kvdb.KVPair {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	dump := make(map[string]kvdb.KVPair, kv.m.size())
+	kv.m.each("", func(k string, kvp *kvdb.KVPair) {
+		kvpLocal := *kvp
+		kvpLocal.Value = append([]byte(nil), kvp.Value...)
+		dump[k] = kvpLocal
+	})
+	return dump
+}
+
+func (kv *memKV) RunPendingExpirations() int {
+	unlock := kv.lockAll()
+	defer unlock()
+	expired := 0
+	_ = kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		now := kv.clock.Now()
+		due := make([]string, 0)
+		kv.m.each("", func(_ string, kvp *kvdb.KVPair) {
+			if !kvp.ExpiresAt.IsZero() && !kvp.ExpiresAt.After(now) {
+				due = append(due, kvp.Key)
+			}
+		})
+		// Expire in key order so that watches see a deterministic sequence.
+		sort.Strings(due)
+		for _, key := range due {
+			// TODO: handle error
+			_, _ = kv.delete(key)
+		}
+		expired = len(due)
+		return nil
+	})
+	return expired
+}
+
+func (kv *memKV) OnConnectionStateChange(cb kvdb.ConnStateCB) {
+	// There is no connection to lose, so mem is always connected.
+	cb(kvdb.ConnStateConnected)
+}
+
+func (kv *memKV) HotKeys(n int) ([]kvdb.KeyStat, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	if kv.hotKeysWindow == 0 {
+		return nil, kvdb.ErrNotSupported
+	}
+	kv.rollHotKeys()
+	stats := make([]kvdb.KeyStat, 0, len(kv.hotKeys))
+	for _, stat := range kv.hotKeys {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		ai := stats[i].Reads + stats[i].Writes
+		aj := stats[j].Reads + stats[j].Writes
+		if ai != aj {
+			return ai > aj
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	if n >= 0 && n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats, nil
+}
+
+func (kv *memKV) Rates() (float64, float64) {
+	return kv.rates.perSecond(kv.clock.Now())
+}
+
+// opRates counts reads and writes over a sliding window split into buckets.
+// The counters are atomic so that reading the rates does not take the kvdb
+// lock.
+type opRates struct {
+	// width is the duration covered by a bucket
+	width time.Duration
+	// since is when counting started
+	since time.Time
+	// buckets are indexed by their period modulo rateBuckets
+	buckets [rateBuckets]rateBucket
+}
+
+// rateBucket counts the operations of one period of the window.
+type rateBucket struct {
+	// period is the number of bucket widths from the Unix epoch to the
+	// start of the counted period
+	period int64
+	reads  int64
+	writes int64
+}
+
+func newOpRates(window time.Duration, since time.Time) *opRates {
+	return &opRates{width: window / rateBuckets, since: since}
+}
+
+// record counts a read, or a write, at now.
+func (r *opRates) record(now time.Time, write bool) {
+	period := now.UnixNano() / int64(r.width)
+	b := &r.buckets[period%rateBuckets]
+	if old := atomic.LoadInt64(&b.period); old != period &&
+		atomic.CompareAndSwapInt64(&b.period, old, period) {
+		atomic.StoreInt64(&b.reads, 0)
+		atomic.StoreInt64(&b.writes, 0)
+	}
+	if write {
+		atomic.AddInt64(&b.writes, 1)
+	} else {
+		atomic.AddInt64(&b.reads, 1)
+	}
+}
+
+// perSecond returns the reads and writes per second in the window ending
+// at now.
+func (r *opRates) perSecond(now time.Time) (float64, float64) {
+	period := now.UnixNano() / int64(r.width)
+	var reads, writes int64
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if p := atomic.LoadInt64(&b.period); p > period-rateBuckets && p <= period {
+			reads += atomic.LoadInt64(&b.reads)
+			writes += atomic.LoadInt64(&b.writes)
 		}
 	}
+	// The current bucket is only partly elapsed, and none of the window
+	// may have elapsed before counting started.
+	elapsed := (rateBuckets-1)*r.width +
+		time.Duration(now.UnixNano()%int64(r.width))
+	if sinceStart := now.Sub(r.since); sinceStart < elapsed {
+		elapsed = sinceStart
+	}
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(reads) / elapsed.Seconds(), float64(writes) / elapsed.Seconds()
+}
+
+func (kv *memKV) MemoryStats() (kvdb.MemoryStats, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	stats := kvdb.MemoryStats{
+		Keys:           kv.m.size(),
+		StoredKeyBytes: kv.m.keyBytes(),
+	}
+	kv.m.each("", func(k string, kvp *kvdb.KVPair) {
+		stats.KeyBytes += len(k)
+		stats.ValueBytes += len(kvp.Value)
+	})
+	return stats, nil
+}
+
+// op is an operation counted by opStats.
+type op int
+
+const (
+	opGet op = iota
+	opPut
+	opCreate
+	opUpdate
+	opDelete
+	opEnumerate
+	opDeleteTree
+	numOps
+)
+
+// opNames are the metric labels of the operations.
+var opNames = [numOps]string{
+	"get",
+	"put",
+	"create",
+	"update",
+	"delete",
+	"enumerate",
+	"delete_tree",
+}
+
+// opStats counts the operations and the time spent in them since the kvdb
+// was created. The counters are atomic so that they can be updated after
+// the kvdb lock is released.
+type opStats struct {
+	counts [numOps]int64
+	nanos  [numOps]int64
+}
+
+// observe counts an operation o started at start.
+func (s *opStats) observe(o op, start time.Time) {
+	atomic.AddInt64(&s.counts[o], 1)
+	atomic.AddInt64(&s.nanos[o], int64(time.Since(start)))
+}
+
+func (kv *memKV) WriteMetrics(w io.Writer) error {
+	kv.mutex.Lock()
+	keys := kv.m.size()
+	watches := 0
+	for _, v := range kv.watches {
+		watches += len(v)
+	}
+	kv.mutex.Unlock()
+
+	var b bytes.Buffer
+	b.WriteString("# HELP kvdb_operations_total Number of kvdb operations.\n")
+	b.WriteString("# TYPE kvdb_operations_total counter\n")
+	for o, name := range opNames {
+		fmt.Fprintf(&b, "kvdb_operations_total{op=%q} %d\n",
+			name, atomic.LoadInt64(&kv.ops.counts[o]))
+	}
+	b.WriteString("# HELP kvdb_operation_duration_seconds Time spent in kvdb " +
+		"operations.\n")
+	b.WriteString("# TYPE kvdb_operation_duration_seconds summary\n")
+	for o, name := range opNames {
+		nanos := atomic.LoadInt64(&kv.ops.nanos[o])
+		fmt.Fprintf(&b, "kvdb_operation_duration_seconds_sum{op=%q} %g\n",
+			name, time.Duration(nanos).Seconds())
+		fmt.Fprintf(&b, "kvdb_operation_duration_seconds_count{op=%q} %d\n",
+			name, atomic.LoadInt64(&kv.ops.counts[o]))
+	}
+	b.WriteString("# HELP kvdb_keys Number of stored keys.\n")
+	b.WriteString("# TYPE kvdb_keys gauge\n")
+	fmt.Fprintf(&b, "kvdb_keys %d\n", keys)
+	b.WriteString("# HELP kvdb_watches Number of active watches.\n")
+	b.WriteString("# TYPE kvdb_watches gauge\n")
+	fmt.Fprintf(&b, "kvdb_watches %d\n", watches)
+	_, err := w.Write(b.Bytes())
 	return err
 }
 
-func (kv *memKV) Keys(prefix, sep string) ([]string, error) {
-	if "" == sep {
-		sep = "/"
+// recordAccess counts a read or write of key for Rates and, if hot key
+// tracking is enabled, for HotKeys. kv must be locked.
+func (kv *memKV) recordAccess(key string, write bool) {
+	kv.rates.record(kv.clock.Now(), write)
+	if kv.hotKeysWindow == 0 {
+		return
 	}
-	prefix = kv.domain + prefix
-	lenPrefix := len(prefix)
-	lenSep := len(sep)
-	if prefix[lenPrefix-lenSep:] != sep {
-		prefix += sep
-		lenPrefix += lenSep
+	kv.rollHotKeys()
+	stat, ok := kv.hotKeys[key]
+	if !ok {
+		if len(kv.hotKeys) >= maxHotKeys {
+			kv.evictColdestKey()
+		}
+		stat = &kvdb.KeyStat{Key: key}
+		kv.hotKeys[key] = stat
+	}
+	if write {
+		stat.Writes++
+	} else {
+		stat.Reads++
 	}
+}
 
-	seen := make(map[string]bool)
-	for k := range kv.m {
-		if strings.HasPrefix(k, prefix) && !strings.Contains(k, "/_") {
-			key := k[lenPrefix:]
-			if idx := strings.Index(key, sep); idx > 0 {
-				key = key[:idx]
-			}
-			seen[key] = true
+// rollHotKeys starts a new hot key tracking window once the current one has
+// elapsed. kv must be locked.
+func (kv *memKV) rollHotKeys() {
+	now := kv.clock.Now()
+	if now.Sub(kv.hotKeysSince) >= kv.hotKeysWindow {
+		kv.hotKeys = make(map[string]*kvdb.KeyStat)
+		kv.hotKeysSince = now
+	}
+}
+
+// evictColdestKey stops tracking the least accessed key. kv must be locked.
+func (kv *memKV) evictColdestKey() {
+	var coldest *kvdb.KeyStat
+	for _, stat := range kv.hotKeys {
+		if coldest == nil ||
+			stat.Reads+stat.Writes < coldest.Reads+coldest.Writes {
+			coldest = stat
 		}
 	}
-	retList := make([]string, len(seen))
-	i := 0
-	for k := range seen {
-		retList[i] = k
-		i++
+	if coldest != nil {
+		delete(kv.hotKeys, coldest.Key)
 	}
+}
 
-	return retList, nil
+func (kv *memKV) EnqueueDelayed(
+	queuePrefix string,
+	value []byte,
+	delay time.Duration,
+) (string, error) {
+	unlock := kv.lockAll()
+	defer unlock()
+	key := ""
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		// Items are keyed by the time they become visible. The index that the
+		// put is about to be assigned keeps keys unique.
+		visibleAt := kv.clock.Now().Add(delay).UnixNano()
+		item := fmt.Sprintf("%s/%020d-%020d", strings.TrimSuffix(queuePrefix, "/"),
+			visibleAt, atomic.LoadUint64(&kv.index)+1)
+		if _, err := kv.write(item, value, 0, false); err != nil {
+			return err
+		}
+		key = item
+		return nil
+	})
+	return key, err
 }
 
-func (kv *memKV) CompareAndSet(
-	kvp *kvdb.KVPair,
-	flags kvdb.KVFlags,
-	prevValue []byte,
-) (*kvdb.KVPair, error) {
+func (kv *memKV) DequeueReady(queuePrefix string) (kvdb.KVPairs, error) {
+	unlock := kv.lockAll()
+	defer unlock()
+	var kvps kvdb.KVPairs
+	err := kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		prefix := kv.domain + strings.TrimSuffix(queuePrefix, "/") + "/"
+		now := kv.clock.Now().UnixNano()
+		ready := make([]string, 0)
+		kv.m.each(prefix, func(k string, _ *kvdb.KVPair) {
+			item := k[len(prefix):]
+			idx := strings.Index(item, "-")
+			if idx < 0 {
+				return
+			}
+			visibleAt, err := strconv.ParseInt(item[:idx], 10, 64)
+			if err != nil || visibleAt > now {
+				return
+			}
+			ready = append(ready, k)
+		})
+		// Fixed width keys sort in visibility order.
+		sort.Strings(ready)
+
+		kvps = make(kvdb.KVPairs, 0, len(ready))
+		for _, k := range ready {
+			kvp, err := kv.delete(strings.TrimPrefix(k, kv.domain))
+			if err != nil {
+				return err
+			}
+			kvps = append(kvps, kvp)
+		}
+		return nil
+	})
+	return kvps, err
+}
 
+// memTx is a mem transaction. Reads see the transaction's own writes and
+// otherwise the store as it was when the transaction started.
+type memTx struct {
+	kv *memKV
+	// snapshot is the committed store at the start of the transaction
+	snapshot map[string]*kvdb.KVPair
+	// writes are the uncommitted writes by full key
+	writes map[string]*txWrite
+	// exists are the preconditions checked on commit by full key, true if
+	// the key must exist and false if it must not
+	exists map[string]bool
+	// codec encodes the values put in the transaction
+	codec kvdb.Codec
+	// done is set once the transaction is committed or aborted
+	done bool
+}
+
+// txWrite is an uncommitted write of a transaction.
+type txWrite struct {
+	// kvp is the written pair, its Action is KVDelete for a delete
+	kvp *kvdb.KVPair
+	// keepTTL preserves the expiry of the key if the ttl is zero
+	keepTTL bool
+}
+
+func (kv *memKV) TxNew() (kvdb.Tx, error) {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 
-	result, err := kv.get(kvp.Key)
+	snapshot := make(map[string]*kvdb.KVPair, kv.m.size())
+	kv.m.each("", func(k string, v *kvdb.KVPair) {
+		snapshot[k] = v.Clone()
+	})
+	return &memTx{
+		kv:       kv,
+		snapshot: snapshot,
+		writes:   make(map[string]*txWrite),
+		exists:   make(map[string]bool),
+		codec:    kv.codec,
+	}, nil
+}
+
+// write records a write of value at key. If the transaction has not written
+// key yet, exists is recorded as a precondition unless it is nil.
+func (tx *memTx) write(
+	key string,
+	value interface{},
+	ttl uint64,
+	action kvdb.KVAction,
+	keepTTL bool,
+	exists *bool,
+) (*kvdb.KVPair, error) {
+	var b []byte
+	var err error
+	switch value.(type) {
+	case string, []byte:
+		b, err = common.ToBytes(value)
+	default:
+		b, err = tx.codec.Marshal(value)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if prevValue != nil {
-		if !bytes.Equal(result.Value, prevValue) {
-			return nil, kvdb.ErrValueMismatch
+	if action != kvdb.KVDelete {
+		// Values are checked, and take the default TTL, as they are written
+		// to the transaction so that Commit cannot fail on them. b is
+		// already encoded, so validate does not need kv to be locked.
+		if err := tx.kv.validate(key, b); err != nil {
+			return nil, err
 		}
-	}
-	if flags == kvdb.KVModifiedIndex {
-		if kvp.ModifiedIndex != result.ModifiedIndex {
-			return nil, kvdb.ErrValueMismatch
+		if !keepTTL {
+			ttl = tx.kv.writeTTL(ttl)
 		}
 	}
-	return kv.put(kvp.Key, kvp.Value, 0)
+	full := tx.kv.domain + key
+	if _, ok := tx.writes[full]; !ok && exists != nil {
+		tx.exists[full] = *exists
+	}
+	kvp := &kvdb.KVPair{
+		Key:    key,
+		Value:  b,
+		TTL:    int64(ttl),
+		Action: action,
+	}
+	tx.writes[full] = &txWrite{kvp: kvp, keepTTL: keepTTL}
+	return kvp.Clone(), nil
 }
 
-func (kv *memKV) CompareAndDelete(
-	kvp *kvdb.KVPair,
-	flags kvdb.KVFlags,
+func (tx *memTx) Put(
+	key string,
+	value interface{},
+	ttl uint64,
 ) (*kvdb.KVPair, error) {
-	kv.mutex.Lock()
-	defer kv.mutex.Unlock()
+	if tx.done {
+		return nil, kvdb.ErrIllegal
+	}
+	return tx.write(key, value, ttl, kvdb.KVSet, false, nil)
+}
 
-	if flags != kvdb.KVFlags(0) {
-		return nil, kvdb.ErrNotSupported
+func (tx *memTx) Create(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	if _, err := tx.Get(key); err == nil {
+		return nil, kvdb.ErrExist
+	} else if err != kvdb.ErrNotFound {
+		return nil, err
+	}
+	exists := false
+	return tx.write(key, value, ttl, kvdb.KVCreate, false, &exists)
+}
+
+func (tx *memTx) Update(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	if _, err := tx.Get(key); err != nil {
+		return nil, err
+	}
+	exists := true
+	return tx.write(key, value, ttl, kvdb.KVSet, true, &exists)
+}
+
+func (tx *memTx) Delete(key string) (*kvdb.KVPair, error) {
+	kvp, err := tx.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	exists := true
+	if _, err := tx.write(key, kvp.Value, 0, kvdb.KVDelete, false, &exists); err != nil {
+		return nil, err
+	}
+	kvp.Action = kvdb.KVDelete
+	return kvp, nil
+}
+
+func (tx *memTx) Get(key string) (*kvdb.KVPair, error) {
+	if tx.done {
+		return nil, kvdb.ErrIllegal
+	}
+	if w, ok := tx.writes[tx.kv.domain+key]; ok {
+		if w.kvp.Action == kvdb.KVDelete {
+			return nil, kvdb.ErrNotFound
+		}
+		return w.kvp.Clone(), nil
+	}
+	if kvp, ok := tx.snapshot[tx.kv.domain+key]; ok {
+		return kvp.Clone(), nil
 	}
-	if result, err := kv.get(kvp.Key); err != nil {
+	return nil, kvdb.ErrNotFound
+}
+
+func (tx *memTx) GetVal(key string, v interface{}) (*kvdb.KVPair, error) {
+	kvp, err := tx.Get(key)
+	if err != nil {
 		return nil, err
-	} else if !bytes.Equal(result.Value, kvp.Value) {
-		return nil, kvdb.ErrNotFound
 	}
-	return kv.delete(kvp.Key)
+	return kvp, tx.codec.Unmarshal(kvp.Value, v)
 }
 
-func (kv *memKV) WatchKey(
-	key string,
-	waitIndex uint64,
-	opaque interface{},
-	cb kvdb.WatchCB,
-) error {
-	kv.mutex.Lock()
-	defer kv.mutex.Unlock()
-	key = kv.domain + key
-	go kv.watchCb(kv.dist.Add(), key,
-		&watchData{cb: cb, waitIndex: waitIndex, opaque: opaque},
-		false)
+func (tx *memTx) Prepare() error {
+	if tx.done {
+		return kvdb.ErrIllegal
+	}
 	return nil
 }
 
-func (kv *memKV) WatchTree(
-	prefix string,
-	waitIndex uint64,
-	opaque interface{},
-	cb kvdb.WatchCB,
-) error {
-	kv.mutex.Lock()
-	defer kv.mutex.Unlock()
-	prefix = kv.domain + prefix
-	go kv.watchCb(kv.dist.Add(), prefix,
-		&watchData{cb: cb, waitIndex: waitIndex, opaque: opaque},
-		true)
+func (tx *memTx) Commit() error {
+	if tx.done {
+		return kvdb.ErrIllegal
+	}
+	tx.done = true
+
+	kv := tx.kv
+	keys := make([]string, 0, len(tx.writes))
+	for _, w := range tx.writes {
+		keys = append(keys, w.kvp.Key)
+	}
+	unlock := kv.lockKeys(keys...)
+	defer unlock()
+	return kv.serializeErr(func() error {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+
+		// Check every precondition before changing anything, so a failed
+		// commit leaves the store, and its watches, untouched.
+		for k, exists := range tx.exists {
+			if _, ok := kv.m.get(k); ok != exists {
+				if exists {
+					return kvdb.ErrNotFound
+				}
+				return kvdb.ErrExist
+			}
+		}
+		full := make([]string, 0, len(tx.writes))
+		for k := range tx.writes {
+			full = append(full, k)
+		}
+		sort.Strings(full)
+		for _, k := range full {
+			w := tx.writes[k]
+			if w.kvp.Action == kvdb.KVDelete {
+				// A key created and deleted in the transaction is not in the
+				// store.
+				if _, err := kv.delete(w.kvp.Key); err != nil && err != kvdb.ErrNotFound {
+					return err
+				}
+				continue
+			}
+			if _, err := kv.put(w.kvp.Key, w.kvp.Value, uint64(w.kvp.TTL),
+				w.keepTTL); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (tx *memTx) Abort() error {
+	if tx.done {
+		return kvdb.ErrIllegal
+	}
+	tx.done = true
+	tx.writes = nil
+	tx.exists = nil
 	return nil
 }
 
-func (kv *memKV) Lock(key string) (*kvdb.KVPair, error) {
-	return kv.LockWithID(key, "locked")
+// checkLock returns ErrInvalidLock if the lock of this view is no longer
+// held. kv.mutex must be held.
+func (v *lockedView) checkLock() error {
+	current, err := v.get(v.lock.Key)
+	if err != nil || current.ModifiedIndex != v.lock.ModifiedIndex ||
+		!bytes.Equal(current.Value, v.lock.Value) {
+		return kvdb.ErrInvalidLock
+	}
+	return nil
 }
 
-func (kv *memKV) LockWithID(
+// put is the same as memKV.put except that the write is attributed to the
+// lock holder. kv.mutex must be held.
+func (v *lockedView) put(
 	key string,
-	lockerID string,
+	value interface{},
+	ttl uint64,
+	keepTTL bool,
 ) (*kvdb.KVPair, error) {
-	key = kv.domain + key
-	duration := time.Second
-
-	result, err := kv.Create(key, lockerID, uint64(duration*3))
-	count := 0
-	for err != nil {
-		time.Sleep(duration)
-		result, err = kv.Create(key, lockerID, uint64(duration*3))
-		if err != nil && count > 0 && count%15 == 0 {
-			var currLockerID string
-			if _, errGet := kv.GetVal(key, currLockerID); errGet == nil {
-				logrus.Infof("Lock %v locked for %v seconds, tag: %v",
-					key, count, currLockerID)
-			}
-		}
+	if err := v.checkLock(); err != nil {
+		return nil, err
 	}
-
+	kvp, err := v.memKV.put(key, value, ttl, keepTTL)
 	if err != nil {
 		return nil, err
 	}
-	return result, err
+	v.writers[v.domain+key] = v.lockerID
+	return kvp, nil
 }
 
-func (kv *memKV) Unlock(kvp *kvdb.KVPair) error {
-	_, err := kv.CompareAndDelete(kvp, kvdb.KVFlags(0))
-	return err
+func (v *lockedView) Put(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	// The lock key is locked as well so that the lock can't be released
+	// between the check and the write.
+	unlock := v.lockKeys(key, v.lock.Key)
+	defer unlock()
+	return v.serialize(func() (*kvdb.KVPair, error) {
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		if err := v.validate(key, value); err != nil {
+			return nil, err
+		}
+		return v.put(key, value, v.writeTTL(ttl), false)
+	})
 }
 
-func (kv *memKV) TxNew() (kvdb.Tx, error) {
-	return nil, kvdb.ErrNotSupported
+func (v *lockedView) Create(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	// The lock key is locked as well so that the lock can't be released
+	// between the check and the write.
+	unlock := v.lockKeys(key, v.lock.Key)
+	defer unlock()
+	return v.serialize(func() (*kvdb.KVPair, error) {
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		if err := v.validate(key, value); err != nil {
+			return nil, err
+		}
+
+		if result, err := v.get(key); err == nil {
+			return result.Clone(), kvdb.ErrExist
+		}
+		return v.put(key, value, v.writeTTL(ttl), false)
+	})
+}
+
+func (v *lockedView) Update(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	// The lock key is locked as well so that the lock can't be released
+	// between the check and the write.
+	unlock := v.lockKeys(key, v.lock.Key)
+	defer unlock()
+	return v.serialize(func() (*kvdb.KVPair, error) {
+		v.mutex.Lock()
+		defer v.mutex.Unlock()
+		if err := v.validate(key, value); err != nil {
+			return nil, err
+		}
+
+		if _, err := v.get(key); err != nil {
+			return nil, kvdb.ErrNotFound
+		}
+		return v.put(key, value, ttl, true)
+	})
 }
 
 func (kv *memKV) normalize(kvp *kvdb.KVPair) {
@@ -562,39 +3972,165 @@ func copyWatchKeys(w map[string]*watchData) []string {
 	return keys
 }
 
-func (kv *memKV) watchCb(
-	q WatchUpdateQueue,
-	prefix string,
-	v *watchData,
-	treeWatch bool,
-) {
+func (kv *memKV) watchCb(q WatchUpdateQueue, v *watchData) {
+	if v.initial != nil && (v.filter == nil || v.initial.err != nil ||
+		v.filter(&v.initial.kvp)) {
+		if err := kv.deliver(v, v.initial); err != nil {
+			return
+		}
+	}
+	paused, overflow := false, false
+	var buffered []*watchUpdate
+	// last is the index of the last change dequeued.
+	last := atomic.LoadUint64(&v.cursor)
+	// reported is the floor of the last compaction reported.
+	var reported uint64
+	// reportCompaction reports the last compaction, in place of the changes
+	// it dropped, unless it was reported.
+	reportCompaction := func() error {
+		floor := atomic.LoadUint64(&v.floor)
+		if floor <= reported {
+			return nil
+		}
+		reported = floor
+		kept := buffered[:0]
+		for _, u := range buffered {
+			if u.kvp.ModifiedIndex >= floor {
+				kept = append(kept, u)
+			}
+		}
+		buffered = kept
+		compacted := &watchUpdate{key: v.prefix, kvp: kvdb.KVPair{
+			Key:           strings.TrimPrefix(v.prefix, kv.domain),
+			Action:        kvdb.KVCompacted,
+			ModifiedIndex: floor,
+		}}
+		if paused {
+			buffered = append(buffered, compacted)
+			return nil
+		}
+		return kv.deliver(v, compacted)
+	}
 	for {
 		update := q.Dequeue()
-		if ((treeWatch && strings.HasPrefix(update.key, prefix)) ||
-			(!treeWatch && update.key == prefix)) &&
-			(v.waitIndex == 0 || v.waitIndex < update.kvp.ModifiedIndex) {
-			err := v.cb(update.key, v.opaque, &update.kvp, update.err)
-			if err != nil {
-				_ = v.cb("", v.opaque, nil, kvdb.ErrWatchStopped)
-				kv.dist.Remove(q)
+		if update.control == 0 {
+			last = update.kvp.ModifiedIndex
+			if !paused {
+				atomic.StoreUint64(&v.cursor, last)
+			}
+			if last < atomic.LoadUint64(&v.floor) {
+				// Compacted before the watch received it.
+				continue
+			}
+			if err := reportCompaction(); err != nil {
+				return
+			}
+		}
+		if update.internal {
+			continue
+		}
+		switch update.control {
+		case watchPause:
+			paused = true
+			continue
+		case watchStop:
+			_ = kv.callCb(v, "", nil, kvdb.ErrWatchStopped)
+			kv.stopWatch(v)
+			return
+		case watchResume:
+			if overflow {
+				_ = kv.callCb(v, "", nil, kvdb.ErrWatchOverflow)
+				kv.stopWatch(v)
+				return
+			}
+			for _, u := range buffered {
+				if err := kv.deliver(v, u); err != nil {
+					return
+				}
+			}
+			paused, buffered = false, nil
+			atomic.StoreUint64(&v.cursor, last)
+			continue
+		case watchCompact:
+			if err := reportCompaction(); err != nil {
+				return
+			}
+			continue
+		}
+		if v.matches(update) {
+			if paused {
+				if len(buffered) < kv.watchBufferSize {
+					buffered = append(buffered, update)
+				} else {
+					overflow = true
+				}
+				continue
+			}
+			if err := kv.deliver(v, update); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// deliver calls the watch callback with update and stops the watch if the
+// callback returns an error.
+func (kv *memKV) deliver(v *watchData, update *watchUpdate) error {
+	kvp := &update.kvp
+	if update.err != nil {
+		kvp = nil
+	}
+	err := kv.callCb(v, update.key, kvp, update.err)
+	if err == nil && v.stopOnDelete && update.kvp.Action == kvdb.KVDelete {
+		err = kvdb.ErrWatchStopped
+	}
+	if err != nil {
+		_ = kv.callCb(v, "", nil, kvdb.ErrWatchStopped)
+		kv.stopWatch(v)
+	}
+	return err
+}
+
+// callCb calls the watch callback, turning a panic in the callback into an
+// error so that the watch is stopped rather than the process.
+func (kv *memKV) callCb(
+	v *watchData,
+	key string,
+	kvp *kvdb.KVPair,
+	cbErr error,
+) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			kv.panicHook(v.prefix, r)
+			err = kvdb.ErrWatchStopped
+		}
+	}()
+	return v.cb(key, v.opaque, kvp, cbErr)
+}
+
+// logPanic is the PanicHook used unless one is configured.
+func logPanic(prefix string, recovered interface{}) {
+	logrus.Errorf("Watch callback on %v panicked: %v", prefix, recovered)
+}
+
 func (kv *memKV) SnapPut(snapKvp *kvdb.KVPair) (*kvdb.KVPair, error) {
 	return nil, kvdb.ErrNotSupported
 }
 
+func (kv *snapMem) Restore(snap kvdb.Kvdb) error {
+	return ErrSnap
+}
+
 func (kv *snapMem) SnapPut(snapKvp *kvdb.KVPair) (*kvdb.KVPair, error) {
 	var kvp *kvdb.KVPair
 
 	key := kv.domain + snapKvp.Key
+	unlock := kv.lockKeys(snapKvp.Key)
+	defer unlock()
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 
-	if old, ok := kv.m[key]; ok {
+	if old, ok := kv.m.get(key); ok {
 		old.Value = snapKvp.Value
 		old.Action = kvdb.KVSet
 		old.ModifiedIndex = snapKvp.ModifiedIndex
@@ -611,10 +4147,11 @@ func (kv *snapMem) SnapPut(snapKvp *kvdb.KVPair) (*kvdb.KVPair, error) {
 			CreatedIndex:  snapKvp.CreatedIndex,
 			Action:        kvdb.KVCreate,
 		}
-		kv.m[key] = kvp
 	}
+	kv.setChecksum(key, kvp.Value)
 
 	kv.normalize(kvp)
+	kv.m.set(key, kvp)
 	return kvp, nil
 }
 
@@ -642,14 +4179,133 @@ func (kv *snapMem) Update(
 	return nil, ErrSnap
 }
 
+func (kv *snapMem) PutMonotonic(
+	key string,
+	value int64,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	return nil, ErrSnap
+}
+
 func (kv *snapMem) Delete(key string) (*kvdb.KVPair, error) {
 	return nil, ErrSnap
 }
 
+func (kv *snapMem) DeleteIfExists(key string) (bool, error) {
+	return false, ErrSnap
+}
+
+func (kv *snapMem) DeleteIf(key string, pred func([]byte) bool) (bool, error) {
+	return false, ErrSnap
+}
+
 func (kv *snapMem) DeleteTree(prefix string) error {
 	return ErrSnap
 }
 
+func (kv *snapMem) DeleteTreeForce(prefix string) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) DeleteTreeWithResult(prefix string) (kvdb.KVPairs, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) DeleteTreeIfVersion(
+	prefix string,
+	versionKey string,
+	expectedValue []byte,
+) (int, error) {
+	return 0, ErrSnap
+}
+
+func (kv *snapMem) AtomicAddBatch(
+	deltas map[string]int64,
+) (map[string]int64, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) AtomicIncrement(key string, delta int64) (int64, error) {
+	return 0, ErrSnap
+}
+
+func (kv *snapMem) AtomicDecrement(key string, delta int64) (int64, error) {
+	return 0, ErrSnap
+}
+
+func (kv *snapMem) AllowN(key string, rate float64, burst int, n int) (bool, error) {
+	return false, ErrSnap
+}
+
+func (kv *snapMem) PutIfOther(
+	key string,
+	value interface{},
+	ttl uint64,
+	guardKey string,
+	guardValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) PutWithFallback(
+	key string,
+	value interface{},
+	fallback interface{},
+	after time.Duration,
+) (*kvdb.KVPair, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) MoveIf(
+	src string,
+	dst string,
+	expectedDstValue []byte,
+) (*kvdb.KVPair, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) CreateAlias(alias, target string) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) Rename(oldKey, newKey string) (*kvdb.KVPair, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) Recode(newCodec kvdb.Codec) (int, error) {
+	return 0, ErrSnap
+}
+
+func (kv *snapMem) ReplaceTree(
+	prefix string,
+	pairs map[string]interface{},
+	ttl uint64,
+) (int, int, error) {
+	return 0, 0, ErrSnap
+}
+
+func (kv *snapMem) CreateBatch(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) PutBulk(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) ApplyChange(kvp *kvdb.KVPair) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) TxNew() (kvdb.Tx, error) {
+	return nil, ErrSnap
+}
+
 func (kv *snapMem) CompareAndSet(
 	kvp *kvdb.KVPair,
 	flags kvdb.KVFlags,
@@ -665,6 +4321,22 @@ func (kv *snapMem) CompareAndDelete(
 	return nil, ErrSnap
 }
 
+func (kv *snapMem) EnqueueDelayed(
+	queuePrefix string,
+	value []byte,
+	delay time.Duration,
+) (string, error) {
+	return "", ErrSnap
+}
+
+func (kv *snapMem) DequeueReady(queuePrefix string) (kvdb.KVPairs, error) {
+	return nil, ErrSnap
+}
+
+func (kv *snapMem) WithLock(lock *kvdb.KVPair) (kvdb.Kvdb, error) {
+	return nil, ErrSnap
+}
+
 func (kv *snapMem) WatchKey(
 	key string,
 	waitIndex uint64,
@@ -683,6 +4355,65 @@ func (kv *snapMem) WatchTree(
 	return ErrSnap
 }
 
+func (kv *snapMem) WatchKeyOpts(
+	key string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) WatchTreeOpts(
+	prefix string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) WatchKeyWithContext(
+	ctx context.Context,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) WatchTreeWithContext(
+	ctx context.Context,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) WatchAll(
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) WatchAllWithContext(
+	ctx context.Context,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return ErrSnap
+}
+
+func (kv *snapMem) WatchFrom(
+	key string,
+) (*kvdb.KVPair, <-chan *kvdb.KVPair, func(), error) {
+	return nil, nil, nil, ErrSnap
+}
+
 func (kv *memKV) AddUser(username string, password string) error {
 	return kvdb.ErrNotSupported
 }
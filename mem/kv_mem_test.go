@@ -1,11 +1,4204 @@
 package mem
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/portworx/kvdb"
 	"github.com/portworx/kvdb/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// fakeClock is a manually advanced clock. Its timers fire when Advance
+// moves the clock past them.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a timer of a fakeClock.
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock by d and runs the timers that are then due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	due := make([]*fakeTimer, 0)
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// Skip moves the clock by d without running the timers that are then due,
+// as if they were late.
+func (c *fakeClock) Skip(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newWithClock returns a mem kvdb driven by a fake clock.
+func newWithClock(t *testing.T) (*memKV, *fakeClock) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	c := &fakeClock{now: time.Now()}
+	mem := kv.(*memKV)
+	mem.clock = c
+	return mem, c
+}
+
 func TestAll(t *testing.T) {
 	test.RunBasic(New, t)
 }
+
+func TestWatchConformance(t *testing.T) {
+	test.RunWatchConformance(New, t)
+}
+
+func TestCASConformance(t *testing.T) {
+	test.RunCASConformance(New, t)
+}
+
+func TestGetValMulti(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	type summary struct {
+		Name string
+	}
+	type full struct {
+		Name  string
+		Size  int
+		Nodes []string
+	}
+	stored := full{Name: "vol1", Size: 10, Nodes: []string{"n1", "n2"}}
+	key := "getvalmulti"
+	_, err = kv.Put(key, &stored, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	var s summary
+	var f full
+	kvp, err := kv.GetValMulti(key, &s, &f)
+	require.NoError(t, err, "Unexpected error in GetValMulti")
+	assert.Equal(t, key, kvp.Key, "Unexpected key")
+	assert.Equal(t, summary{Name: "vol1"}, s, "Unexpected summary view")
+	assert.Equal(t, stored, f, "Unexpected full view")
+
+	var bad struct {
+		Name int
+	}
+	_, err = kv.GetValMulti(key, &s, &bad)
+	require.Error(t, err, "Expected decode failure")
+	assert.Contains(t, err.Error(), "target 1", "Error should name the target")
+}
+
+func TestExpiresAt(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "expires/ttl"
+	ttl := uint64(10)
+	kvp, err := kv.Put(key, []byte("bar"), ttl)
+	require.NoError(t, err, "Unexpected error in Put")
+	expected := time.Now().Add(time.Duration(ttl) * time.Second)
+	assert.WithinDuration(t, expected, kvp.ExpiresAt, time.Second,
+		"ExpiresAt mismatch in Put")
+
+	kvp, err = kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.WithinDuration(t, expected, kvp.ExpiresAt, time.Second,
+		"ExpiresAt mismatch in Get")
+
+	kvp, err = kv.Put("expires/nottl", []byte("bar"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.True(t, kvp.ExpiresAt.IsZero(),
+		"Expected zero ExpiresAt for key without TTL, got %v", kvp.ExpiresAt)
+}
+
+func TestTTLExpiry(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("ttl/expired", []byte("v1"), 1)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("ttl/reput", []byte("v1"), 1)
+	require.NoError(t, err, "Unexpected error in Put")
+	// Put again before the expiry, without a TTL, so that the first expiry
+	// must not delete it.
+	_, err = kv.Put("ttl/reput", []byte("v2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	time.Sleep(2 * time.Second)
+	_, err = kv.Get("ttl/expired")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expected the key to expire")
+	kvp, err := kv.Get("ttl/reput")
+	require.NoError(t, err, "Expected the key put again to survive")
+	assert.Equal(t, "v2", string(kvp.Value), "Unexpected value")
+}
+
+func TestReturnedPairsAreCopies(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	lock, err := kv.Lock("copies/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+	view, err := kv.WithLock(lock)
+	require.NoError(t, err, "Unexpected error in WithLock")
+
+	overwrite := func(kvp *kvdb.KVPair) {
+		for i := range kvp.Value {
+			kvp.Value[i] = 'x'
+		}
+	}
+	for name, db := range map[string]kvdb.Kvdb{"kvdb": kv, "view": view} {
+		key := "copies/" + name
+		kvp, err := db.Create(key, []byte("1"), 0)
+		require.NoError(t, err, "Unexpected error in Create")
+		overwrite(kvp)
+		kvp, err = db.Create(key, []byte("2"), 0)
+		require.Equal(t, kvdb.ErrExist, err, "Expected Create to fail")
+		overwrite(kvp)
+		kvp, err = db.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, "1", string(kvp.Value),
+			"Create result aliases the store in %v", name)
+
+		overwrite(kvp)
+		kvp, err = db.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, "1", string(kvp.Value),
+			"Get result aliases the store in %v", name)
+
+		kvp, err = db.Update(key, []byte("3"), 0)
+		require.NoError(t, err, "Unexpected error in Update")
+		overwrite(kvp)
+		kvp, err = db.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, "3", string(kvp.Value),
+			"Update result aliases the store in %v", name)
+
+		kvp, err = db.Put(key, []byte("4"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+		overwrite(kvp)
+		kvp, err = db.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, "4", string(kvp.Value),
+			"Put result aliases the store in %v", name)
+	}
+}
+
+func TestRemainingTTL(t *testing.T) {
+	kv, clock := newWithClock(t)
+
+	_, err := kv.Put("remaining/ttl", []byte("v"), 10)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("remaining/none", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	clock.Advance(3 * time.Second)
+	kvp, err := kv.Get("remaining/ttl")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, int64(7), kvp.TTL, "Get should report the remaining TTL")
+	kvps, err := kv.Enumerate("remaining")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	require.Len(t, kvps, 2, "Unexpected number of pairs")
+	for _, kvp := range kvps {
+		expected := int64(7)
+		if kvp.Key == "remaining/none" {
+			expected = 0
+		}
+		assert.Equal(t, expected, kvp.TTL, "Unexpected TTL for %v", kvp.Key)
+	}
+
+	// A partial second left is still reported as a TTL.
+	clock.Advance(6*time.Second + 500*time.Millisecond)
+	kvp, err = kv.Get("remaining/ttl")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, int64(1), kvp.TTL, "Remaining TTL should be rounded up")
+}
+
+func TestExpiryOverwrite(t *testing.T) {
+	kv, clock := newWithClock(t)
+	key := "expiry/overwrite"
+
+	_, err := kv.Put(key, []byte("v1"), 1)
+	require.NoError(t, err, "Unexpected error in Put")
+	kv.mutex.Lock()
+	first := kv.expiries[kv.domain+key]
+	kv.mutex.Unlock()
+
+	// Expiry follows the clock, not the wall time.
+	time.Sleep(1500 * time.Millisecond)
+	_, err = kv.Get(key)
+	require.NoError(t, err, "Key expired while the clock was frozen")
+
+	// The clock is frozen, so the new expiry time is the same as the first.
+	_, err = kv.Put(key, []byte("v2"), 1)
+	require.NoError(t, err, "Unexpected error in Put")
+	// A timer of the first put that fired regardless is ignored.
+	kv.expire(key, first)
+	kvp, err := kv.Get(key)
+	require.NoError(t, err, "Overwritten expiry deleted the key")
+	assert.Equal(t, "v2", string(kvp.Value), "Unexpected value")
+
+	clock.Advance(time.Second)
+	_, err = kv.Get(key)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Key should expire with the clock")
+	kv.mutex.Lock()
+	assert.Empty(t, kv.expiries, "Expiry should be released with the key")
+	kv.mutex.Unlock()
+}
+
+func TestRestoreKeepsState(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	for key, value := range map[string]string{"same": "1", "changed": "2"} {
+		_, err = kv.Put("keep/"+key, []byte(value), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	require.NoError(t, kv.CreateAlias("keep/alias", "keep/same"),
+		"Unexpected error in CreateAlias")
+	snap, _, err := kv.Snapshot("")
+	require.NoError(t, err, "Unexpected error in Snapshot")
+
+	_, err = kv.Put("keep/changed", []byte("3"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	last, err := kv.Put("keep/added", []byte("4"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	lock, err := kv.Lock("keep/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree("keep", last.ModifiedIndex, nil, cb),
+		"Unexpected error in WatchTree")
+	require.NoError(t, kv.Restore(snap), "Unexpected error in Restore")
+
+	// Only the keys that differ from the snapshot change.
+	kvp := receiveUpdate(t, updates)
+	assert.Equal(t, "keep/added", kvp.Key, "Unexpected key")
+	assert.Equal(t, kvdb.KVDelete, kvp.Action, "Unexpected action")
+	kvp = receiveUpdate(t, updates)
+	assert.Equal(t, "keep/changed", kvp.Key, "Unexpected key")
+	assert.Equal(t, "2", string(kvp.Value), "Unexpected value")
+	select {
+	case kvp := <-updates:
+		t.Fatalf("Unexpected update of %v", kvp.Key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	kvp, err = kv.Get("keep/alias")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "1", string(kvp.Value), "Restored alias should resolve")
+	_, err = kv.Get("bootstrap")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Snapshot bootstrap key restored")
+	assert.NoError(t, kv.Unlock(lock), "Held lock should survive Restore")
+}
+
+func TestRestoreClockSkew(t *testing.T) {
+	src, _ := newWithClock(t)
+	_, err := src.Put("skew/ttl", []byte("t"), 10)
+	require.NoError(t, err, "Unexpected error in Put")
+	snap, _, err := src.Snapshot("")
+	require.NoError(t, err, "Unexpected error in Snapshot")
+
+	for _, absolute := range []bool{false, true} {
+		options := map[string]string{}
+		expected := 10 * time.Second
+		if absolute {
+			options[AbsoluteExpiryKey] = "true"
+			expected = 5 * time.Second
+		}
+		kv, err := New("pwx/test", nil, options, nil)
+		require.NoError(t, err, "Unexpected error in New")
+		// The local clock is 5s ahead of the one of the snapshot.
+		dst := kv.(*memKV)
+		clock := &fakeClock{now: src.clock.Now().Add(5 * time.Second)}
+		dst.clock = clock
+
+		require.NoError(t, dst.Restore(snap), "Unexpected error in Restore")
+		kvp, err := dst.Get("skew/ttl")
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, int64(expected/time.Second), kvp.TTL,
+			"Unexpected restored TTL, absolute %v", absolute)
+
+		clock.Advance(expected - time.Millisecond)
+		_, err = dst.Get("skew/ttl")
+		assert.NoError(t, err, "Key expired early, absolute %v", absolute)
+		clock.Advance(time.Millisecond)
+		_, err = dst.Get("skew/ttl")
+		assert.Equal(t, kvdb.ErrNotFound, err,
+			"Key should expire on the local clock, absolute %v", absolute)
+	}
+}
+
+func TestUpdateTTL(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	preserve, reset, cleared := "ttl/preserve", "ttl/reset", "ttl/cleared"
+	for _, key := range []string{preserve, reset, cleared} {
+		_, err = kv.Put(key, []byte("v1"), 1)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	before, err := kv.Get(preserve)
+	require.NoError(t, err, "Unexpected error in Get")
+
+	kvp, err := kv.Update(preserve, []byte("v2"), 0)
+	require.NoError(t, err, "Unexpected error in Update")
+	assert.Equal(t, int64(1), kvp.TTL, "Update with ttl 0 should keep the TTL")
+	assert.Equal(t, before.ExpiresAt, kvp.ExpiresAt,
+		"Update with ttl 0 should keep the expiry")
+
+	kvp, err = kv.Update(reset, []byte("v2"), 10)
+	require.NoError(t, err, "Unexpected error in Update")
+	assert.Equal(t, int64(10), kvp.TTL, "Update with a ttl should reset the TTL")
+
+	kvp, err = kv.Put(cleared, []byte("v2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, int64(0), kvp.TTL, "Put with ttl 0 should clear the TTL")
+	assert.True(t, kvp.ExpiresAt.IsZero(), "Put with ttl 0 should clear the expiry")
+
+	time.Sleep(2 * time.Second)
+	_, err = kv.Get(preserve)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Preserved TTL should expire the key")
+	kvp, err = kv.Get(reset)
+	assert.NoError(t, err, "Reset TTL should not expire the key yet")
+	assert.Equal(t, "v2", string(kvp.Value), "Unexpected value")
+	kvp, err = kv.Get(cleared)
+	assert.NoError(t, err, "Cleared TTL should not expire the key")
+	assert.Equal(t, "v2", string(kvp.Value), "Unexpected value")
+}
+
+func TestDelayedQueue(t *testing.T) {
+	kv, c := newWithClock(t)
+	queue := "delayed"
+
+	first, err := kv.EnqueueDelayed(queue, []byte("first"), 5*time.Second)
+	require.NoError(t, err, "Unexpected error in EnqueueDelayed")
+	_, err = kv.EnqueueDelayed(queue, []byte("second"), 10*time.Second)
+	require.NoError(t, err, "Unexpected error in EnqueueDelayed")
+
+	kvps, err := kv.DequeueReady(queue)
+	require.NoError(t, err, "Unexpected error in DequeueReady")
+	assert.Empty(t, kvps, "No item should be ready before its delay")
+
+	c.Advance(5 * time.Second)
+	kvps, err = kv.DequeueReady(queue)
+	require.NoError(t, err, "Unexpected error in DequeueReady")
+	require.Len(t, kvps, 1, "Expected only the first item to be ready")
+	assert.Equal(t, first, kvps[0].Key, "Unexpected key dequeued")
+	assert.Equal(t, "first", string(kvps[0].Value), "Unexpected value dequeued")
+
+	kvps, err = kv.DequeueReady(queue)
+	require.NoError(t, err, "Unexpected error in DequeueReady")
+	assert.Empty(t, kvps, "Dequeued item should not be returned again")
+
+	_, err = kv.EnqueueDelayed(queue, []byte("third"), 0)
+	require.NoError(t, err, "Unexpected error in EnqueueDelayed")
+	c.Advance(time.Hour)
+	kvps, err = kv.DequeueReady(queue)
+	require.NoError(t, err, "Unexpected error in DequeueReady")
+	require.Len(t, kvps, 2, "Expected remaining items to be ready")
+	assert.Equal(t, "third", string(kvps[0].Value), "Items must be in visibility order")
+	assert.Equal(t, "second", string(kvps[1].Value), "Items must be in visibility order")
+}
+
+func TestLockFencingToken(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	lastToken := uint64(0)
+	for i := 0; i < 3; i++ {
+		kvp, err := kv.Lock("fence")
+		require.NoError(t, err, "Unexpected error in Lock")
+		token := kvdb.FencingToken(kvp)
+		assert.True(t, token > lastToken,
+			"Fencing token %v must be greater than previous token %v",
+			token, lastToken)
+		lastToken = token
+		require.NoError(t, kv.Unlock(kvp), "Unexpected error in Unlock")
+		// Unrelated writes also move the index, tokens must stay increasing.
+		_, err = kv.Put("fence/other", []byte("bar"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+}
+
+func TestEnumerateWhileChurning(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "churn"
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprintf("%s/%d", prefix, i%20)
+			if i%3 == 0 {
+				_, _ = kv.Delete(key)
+				continue
+			}
+			_, err := kv.Put(key, []byte("value"), 0)
+			assert.NoError(t, err, "Unexpected error in Put")
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		kvps, err := kv.Enumerate(prefix)
+		require.NoError(t, err, "Unexpected error in Enumerate")
+		// The pairs are copies, changing them must not change the store.
+		for _, kvp := range kvps {
+			kvp.Value[0] = 'X'
+		}
+	}
+	close(stop)
+	<-done
+
+	kvps, err := kv.Enumerate(prefix)
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	for _, kvp := range kvps {
+		assert.Equal(t, "value", string(kvp.Value), "Stored value was changed")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	kv, clock := newWithClock(t)
+
+	for key, value := range map[string]string{"a": "1", "b": "2"} {
+		_, err := kv.Put("restore/"+key, []byte(value), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	_, err := kv.Put("restore/ttl", []byte("t"), 60)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	snap, version, err := kv.Snapshot("")
+	require.NoError(t, err, "Unexpected error in Snapshot")
+	assert.NotZero(t, version, "Unexpected snapshot version")
+
+	_, err = kv.Put("restore/a", []byte("changed"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Delete("restore/b")
+	require.NoError(t, err, "Unexpected error in Delete")
+	_, err = kv.Put("restore/c", []byte("3"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	expected := map[string]string{
+		"restore/a":   "1",
+		"restore/b":   "2",
+		"restore/ttl": "t",
+	}
+	contents := func(db kvdb.Kvdb) map[string]string {
+		kvps, err := db.Enumerate("restore")
+		require.NoError(t, err, "Unexpected error in Enumerate")
+		found := make(map[string]string)
+		for _, kvp := range kvps {
+			found[kvp.Key] = string(kvp.Value)
+		}
+		return found
+	}
+	assert.Equal(t, expected, contents(snap),
+		"Snapshot should not see later changes")
+
+	clock.Advance(20 * time.Second)
+	require.NoError(t, kv.Restore(snap), "Unexpected error in Restore")
+	assert.Equal(t, expected, contents(kv), "Unexpected restored contents")
+	kvp, err := kv.Get("restore/ttl")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, int64(40), kvp.TTL, "Restored TTL should be the remaining one")
+
+	fresh, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	require.NoError(t, fresh.Restore(snap), "Unexpected error in Restore")
+	assert.Equal(t, expected, contents(fresh),
+		"Snapshot should seed a fresh instance")
+}
+
+func TestEnumerateEmptyPrefix(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	keys := []string{"a/1", "a/2", "b/c/3", "d"}
+	for _, key := range keys {
+		_, err = kv.Put(key, []byte("v"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	_, err = kv.Put("a/_hidden", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	kvps, err := kv.Enumerate("")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	found := make([]string, 0, len(kvps))
+	for _, kvp := range kvps {
+		found = append(found, kvp.Key)
+	}
+	assert.ElementsMatch(t, keys, found,
+		"Empty prefix should return every key in the domain")
+
+	assert.Equal(t, kvdb.ErrRefusingRootDelete, kv.DeleteTree(""),
+		"Unforced root delete should be refused")
+	kvps, err = kv.Enumerate("")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	assert.Len(t, kvps, len(keys), "Refused root delete should keep every key")
+
+	require.NoError(t, kv.DeleteTreeForce(""),
+		"Unexpected error in DeleteTreeForce")
+	kvps, err = kv.Enumerate("")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	assert.Empty(t, kvps, "Empty prefix should delete every key in the domain")
+	_, err = kv.Get("a/_hidden")
+	assert.NoError(t, err, "Hidden keys should not be deleted")
+}
+
+func TestEnumerateAt(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "enumerateat"
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("%s/%d/%d", prefix, w, i%10)
+				_, err := kv.Put(key, []byte("value"), 0)
+				assert.NoError(t, err, "Unexpected error in Put")
+			}
+		}(w)
+	}
+
+	for i := 0; i < 100; i++ {
+		kvps, index, err := kv.EnumerateAt(prefix)
+		require.NoError(t, err, "Unexpected error in EnumerateAt")
+		for _, kvp := range kvps {
+			assert.True(t, kvp.ModifiedIndex <= index,
+				"Pair %v at index %v is newer than snapshot index %v",
+				kvp.Key, kvp.ModifiedIndex, index)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestEnumeratePaged(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "paged"
+	for i := 0; i < 250; i++ {
+		_, err := kv.Put(fmt.Sprintf("%s/%03d", prefix, i), []byte("value"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	_, err = kv.Put("pagedother", []byte("value"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	seen := make(map[string]bool)
+	var sizes []int
+	cursor, last := "", ""
+	for {
+		kvps, next, err := kv.EnumeratePaged(prefix+"/", 100, cursor)
+		require.NoError(t, err, "Unexpected error in EnumeratePaged")
+		sizes = append(sizes, len(kvps))
+		for _, kvp := range kvps {
+			assert.False(t, seen[kvp.Key], "Duplicate key %v", kvp.Key)
+			assert.True(t, kvp.Key > last, "Key %v out of order", kvp.Key)
+			seen[kvp.Key], last = true, kvp.Key
+		}
+		if next == "" {
+			break
+		}
+		assert.Equal(t, last, next, "Cursor should be the last key returned")
+		cursor = next
+	}
+	assert.Equal(t, []int{100, 100, 50}, sizes, "Unexpected page sizes")
+	assert.Len(t, seen, 250, "Every key should be returned")
+
+	_, _, err = kv.EnumeratePaged(prefix, 0, "")
+	assert.Equal(t, kvdb.ErrIllegal, err, "A limit of 0 should be refused")
+}
+
+func TestSameKeyContention(t *testing.T) {
+	for _, stripes := range []string{"1", "16"} {
+		kv, err := New("pwx/test", nil,
+			map[string]string{LockStripesKey: stripes}, nil)
+		require.NoError(t, err, "Unexpected error in New")
+		// With 16 stripes the keys are incremented in parallel.
+		keys := []string{"contention/a", "contention/b", "contention/c"}
+		for _, key := range keys {
+			_, err = kv.Put(key, []byte("0"), 0)
+			require.NoError(t, err, "Unexpected error in Put")
+		}
+		testContention(t, kv, keys)
+	}
+
+	_, err := New("pwx/test", nil, map[string]string{LockStripesKey: "0"}, nil)
+	assert.Error(t, err, "Expected zero stripes to be refused")
+}
+
+// testContention increments each of keys from several workers with
+// CompareAndSet, and checks that no increment is lost.
+func testContention(t *testing.T, kv kvdb.Kvdb, keys []string) {
+	workers, increments := 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		key := keys[w%len(keys)]
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				kvp, err := kv.Get(key)
+				if !assert.NoError(t, err, "Unexpected error in Get") {
+					return
+				}
+				n, _ := strconv.Atoi(string(kvp.Value))
+				kvp.Value = []byte(strconv.Itoa(n + 1))
+				_, err = kv.CompareAndSet(kvp, kvdb.KVModifiedIndex, nil)
+				if err == kvdb.ErrValueMismatch {
+					continue
+				}
+				if !assert.NoError(t, err, "Unexpected error in CompareAndSet") {
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, key := range keys {
+		kvp, err := kv.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		n, err := strconv.Atoi(string(kvp.Value))
+		require.NoError(t, err, "Unexpected value %q", kvp.Value)
+		total += n
+	}
+	assert.Equal(t, workers*increments, total,
+		"Every successful CompareAndSet should be counted exactly once")
+}
+
+func TestCompareAndSetModifiedIndex(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	a, err := kv.Put("cas/a", []byte("a1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("cas/b", []byte("b1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	a.Value = []byte("a2")
+	updated, err := kv.CompareAndSet(a, kvdb.KVModifiedIndex, nil)
+	require.NoError(t, err, "Writes to other keys should not fail the CAS")
+	assert.Equal(t, "a2", string(updated.Value), "Unexpected value after CAS")
+
+	a.Value = []byte("a3")
+	_, err = kv.CompareAndSet(a, kvdb.KVModifiedIndex|kvdb.KVTTL, nil)
+	assert.Equal(t, kvdb.ErrValueMismatch, err,
+		"A stale index should fail the CAS with other flags set")
+}
+
+func TestCompareAndDeleteModifiedIndex(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	stale, err := kv.Put("cad/a", []byte("a1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	current, err := kv.Put("cad/a", []byte("a2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	_, err = kv.CompareAndDelete(stale, kvdb.KVModifiedIndex)
+	assert.Equal(t, kvdb.ErrValueMismatch, err, "A stale index should fail the CAD")
+	_, err = kv.Get("cad/a")
+	require.NoError(t, err, "A failed CAD should keep the key")
+
+	// The value is not compared when the index is.
+	match := *current
+	match.Value = []byte("other")
+	deleted, err := kv.CompareAndDelete(&match, kvdb.KVModifiedIndex)
+	require.NoError(t, err, "Unexpected error in CompareAndDelete")
+	assert.Equal(t, "a2", string(deleted.Value), "Unexpected deleted value")
+	_, err = kv.Get("cad/a")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Key should be deleted")
+
+	kvp, err := kv.Put("cad/b", []byte("b1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	mismatch := *kvp
+	mismatch.Value = []byte("bad")
+	_, err = kv.CompareAndDelete(&mismatch, kvdb.KVFlags(0))
+	assert.Equal(t, kvdb.ErrNotFound, err, "A value mismatch should fail the CAD")
+	_, err = kv.CompareAndDelete(kvp, kvdb.KVPrevExists)
+	assert.Equal(t, kvdb.ErrNotSupported, err, "Only KVModifiedIndex is supported")
+	_, err = kv.CompareAndDelete(kvp, kvdb.KVModifiedIndex|kvdb.KVPrevExists)
+	assert.Equal(t, kvdb.ErrNotSupported, err, "Only KVModifiedIndex is supported")
+	_, err = kv.CompareAndDelete(kvp, kvdb.KVFlags(0))
+	require.NoError(t, err, "Value-matched CompareAndDelete should succeed")
+}
+
+// benchValue is a value that the codec has to encode.
+type benchValue struct {
+	Name   string
+	Labels map[string]string
+	Sizes  []int
+}
+
+func benchmarkPut(
+	b *testing.B,
+	options map[string]string,
+	key func(worker, i int) string,
+) {
+	kv, err := New("pwx/test", nil, options, nil)
+	require.NoError(b, err, "Unexpected error in New")
+	value := &benchValue{
+		Name:   "value",
+		Labels: map[string]string{"zone": "a", "rack": "b", "host": "c"},
+		Sizes:  []int{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+
+	var workers int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		worker := int(atomic.AddInt64(&workers, 1))
+		for i := 0; pb.Next(); i++ {
+			if _, err := kv.Put(key(worker, i), value, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func disjointKey(worker, i int) string {
+	return fmt.Sprintf("bench/%d/%d", worker, i%100)
+}
+
+func BenchmarkPutDisjointKeys(b *testing.B) {
+	benchmarkPut(b, nil, disjointKey)
+}
+
+func BenchmarkPutDisjointKeysStriped(b *testing.B) {
+	benchmarkPut(b, map[string]string{LockStripesKey: "64"}, disjointKey)
+}
+
+func BenchmarkPutSameKey(b *testing.B) {
+	benchmarkPut(b, nil, func(worker, i int) string {
+		return "bench/same"
+	})
+}
+
+func BenchmarkPutDisjointKeysSingleWriter(b *testing.B) {
+	benchmarkPut(b, map[string]string{SingleWriterKey: "true"}, disjointKey)
+}
+
+func BenchmarkGetPutMixed(b *testing.B) {
+	benchmarkGetPutMixed(b, nil)
+}
+
+func BenchmarkGetPutMixedStriped(b *testing.B) {
+	benchmarkGetPutMixed(b, map[string]string{LockStripesKey: "64"})
+}
+
+func BenchmarkGetPutMixedSingleWriter(b *testing.B) {
+	benchmarkGetPutMixed(b, map[string]string{SingleWriterKey: "true"})
+}
+
+func benchmarkGetPutMixed(b *testing.B, options map[string]string) {
+	kv, err := New("pwx/test", nil, options, nil)
+	require.NoError(b, err, "Unexpected error in New")
+	keys := 100
+	for i := 0; i < keys; i++ {
+		_, err = kv.Put(fmt.Sprintf("bench/%d", i), []byte("value"), 0)
+		require.NoError(b, err, "Unexpected error in Put")
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := fmt.Sprintf("bench/%d", i%keys)
+			var err error
+			// One write for every nine reads.
+			if i%10 == 0 {
+				_, err = kv.Put(key, []byte("value"), 0)
+			} else {
+				_, err = kv.Get(key)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestConcurrentReadsSeeOrderedWrites(t *testing.T) {
+	for _, options := range []map[string]string{
+		nil,
+		{SingleWriterKey: "true"},
+	} {
+		kv, err := New("pwx/test", nil, options, nil)
+		require.NoError(t, err, "Unexpected error in New")
+		testOrderedReads(t, kv)
+	}
+}
+
+// testOrderedReads checks that concurrent readers never see a key go back
+// to an older write.
+func testOrderedReads(t *testing.T, kv kvdb.Kvdb) {
+	writers, writes := 4, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		key := fmt.Sprintf("ordered/%d", w)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= writes; i++ {
+				_, err := kv.Put(key, []byte(strconv.Itoa(i)), 0)
+				assert.NoError(t, err, "Unexpected error in Put")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			last, lastIndex := 0, uint64(0)
+			for last < writes {
+				kvp, err := kv.Get(key)
+				if err == kvdb.ErrNotFound {
+					continue
+				}
+				if !assert.NoError(t, err, "Unexpected error in Get") {
+					return
+				}
+				n, _ := strconv.Atoi(string(kvp.Value))
+				if !assert.True(t, n >= last && kvp.ModifiedIndex >= lastIndex,
+					"Read %v at %v after %v at %v", n, kvp.ModifiedIndex,
+					last, lastIndex) {
+					return
+				}
+				last, lastIndex = n, kvp.ModifiedIndex
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSingleWriter(t *testing.T) {
+	kv, err := New("pwx/test", nil,
+		map[string]string{SingleWriterKey: "true"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+
+	// The watch callbacks run one at a time, so lastIndex is not shared.
+	var lastIndex, updates uint64
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		assert.True(t, kvp.ModifiedIndex > lastIndex,
+			"Update at %v after %v", kvp.ModifiedIndex, lastIndex)
+		lastIndex = kvp.ModifiedIndex
+		atomic.AddUint64(&updates, 1)
+		return nil
+	}
+	require.NoError(t, kv.WatchTree("single", 0, nil, cb),
+		"Unexpected error in WatchTree")
+
+	// Writers race on the same keys, each write changing the key or
+	// failing as the one before it dictates.
+	var changes uint64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("single/%d", i%5)
+				value := []byte(strconv.Itoa(w*100 + i))
+				var err error
+				switch (w + i) % 4 {
+				case 0:
+					_, err = kv.Put(key, value, 0)
+				case 1:
+					_, err = kv.Create(key, value, 0)
+				case 2:
+					_, err = kv.Update(key, value, 0)
+				case 3:
+					_, err = kv.Delete(key)
+				}
+				if err == kvdb.ErrExist || err == kvdb.ErrNotFound {
+					continue
+				}
+				if !assert.NoError(t, err, "Unexpected error in write") {
+					return
+				}
+				atomic.AddUint64(&changes, 1)
+				_, err = kv.Get(key)
+				if err != kvdb.ErrNotFound {
+					assert.NoError(t, err, "Unexpected error in Get")
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&updates) == atomic.LoadUint64(&changes)
+	}, 5*time.Second, 10*time.Millisecond, "Every write should be watched")
+
+	// Once the writer published its view, Get reads the same pairs as the
+	// store.
+	require.Eventually(t, func() bool {
+		_, ok, _ := mem.getFromView("single/0")
+		return ok
+	}, 5*time.Second, time.Millisecond, "Get should read the view")
+	checkView := func() {
+		kvps, err := kv.Enumerate("single")
+		require.NoError(t, err, "Unexpected error in Enumerate")
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("single/%d", i)
+			kvp, err := kv.Get(key)
+			var stored *kvdb.KVPair
+			for _, enumerated := range kvps {
+				if enumerated.Key == key {
+					stored = enumerated
+				}
+			}
+			if stored == nil {
+				assert.Equal(t, kvdb.ErrNotFound, err, "%v should be deleted", key)
+				continue
+			}
+			require.NoError(t, err, "Unexpected error in Get")
+			assert.Equal(t, string(stored.Value), string(kvp.Value),
+				"Unexpected value of %v", key)
+			assert.Equal(t, stored.ModifiedIndex, kvp.ModifiedIndex,
+				"Unexpected index of %v", key)
+		}
+	}
+	checkView()
+	_, err = kv.Recode(base64Codec{})
+	require.NoError(t, err, "Unexpected error in Recode")
+	checkView()
+
+	// Every kind of write runs on the writer, which publishes it in the
+	// view.
+	kvp, err := kv.Put("single/cas", []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp.Value = []byte("2")
+	_, err = kv.CompareAndSet(kvp, kvdb.KVModifiedIndex, nil)
+	require.NoError(t, err, "Unexpected error in CompareAndSet")
+	require.NoError(t, kv.CreateAlias("single/alias", "single/cas"),
+		"Unexpected error in CreateAlias")
+	_, err = kv.Put("single/tree/a", []byte("a"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Rename("single/tree/a", "single/renamed")
+	require.NoError(t, err, "Unexpected error in Rename")
+	_, err = kv.Put("single/tree/b", []byte("b"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	require.NoError(t, kv.DeleteTree("single/tree"),
+		"Unexpected error in DeleteTree")
+	require.Eventually(t, func() bool {
+		_, ok, _ := mem.getFromView("single/alias")
+		return ok
+	}, 5*time.Second, time.Millisecond, "Get should read the view")
+	kvp, err = kv.Get("single/alias")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "2", string(kvp.Value), "Alias should resolve in the view")
+	kvp, err = kv.Get("single/renamed")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "a", string(kvp.Value), "View should hold the renamed key")
+	for _, key := range []string{"single/tree/a", "single/tree/b"} {
+		_, err = kv.Get(key)
+		assert.Equal(t, kvdb.ErrNotFound, err, "%v should be deleted", key)
+	}
+
+	keys := []string{"contention/a", "contention/b"}
+	for _, key := range keys {
+		_, err = kv.Put(key, []byte("0"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	testContention(t, kv, keys)
+
+	_, err = New("pwx/test", nil, map[string]string{SingleWriterKey: "maybe"}, nil)
+	assert.Error(t, err, "Expected an invalid SingleWriter to be refused")
+}
+
+func TestSingleWriterPublishesChanges(t *testing.T) {
+	kv, err := New("pwx/test", nil,
+		map[string]string{SingleWriterKey: "true"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+	defer mem.Close()
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		_, err = kv.Put(fmt.Sprintf("keys/%d", i), []byte("0"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	for i := 0; i < n; i += 3 {
+		_, err = kv.Delete(fmt.Sprintf("keys/%d", i))
+		require.NoError(t, err, "Unexpected error in Delete")
+	}
+	require.Eventually(t, func() bool {
+		_, ok, _ := mem.getFromView("keys/1")
+		return ok
+	}, 5*time.Second, time.Millisecond, "Get should read the view")
+
+	// Each publish copied only the changed pairs, in a few layers that
+	// shrink from the oldest up.
+	view := mem.view.Load().(*readView)
+	assert.True(t, len(view.layers) <= 12, "Too many layers: %d",
+		len(view.layers))
+	for i := 1; i < len(view.layers); i++ {
+		assert.True(t, 2*len(view.layers[i]) < len(view.layers[i-1]),
+			"Layer %d of %d pairs over one of %d", i, len(view.layers[i]),
+			len(view.layers[i-1]))
+	}
+	for i := 0; i < n; i++ {
+		e, ok := view.lookup(mem.domain + fmt.Sprintf("keys/%d", i))
+		assert.Equal(t, i%3 != 0, ok, "Unexpected presence of keys/%d", i)
+		if ok {
+			assert.Equal(t, "0", string(e.kvp.Value), "Unexpected value")
+		}
+	}
+}
+
+func TestSingleWriterClose(t *testing.T) {
+	kv, err := New("pwx/test", nil,
+		map[string]string{SingleWriterKey: "true"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+	_, err = kv.Put("key", []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	done := mem.writerDone
+	require.NoError(t, mem.Close(), "Unexpected error in Close")
+	select {
+	case <-done:
+	default:
+		t.Fatal("Close should stop the writer goroutine")
+	}
+	require.NoError(t, mem.Close(), "Closing again should do nothing")
+
+	// The kvdb keeps working, reading the store.
+	_, err = kv.Put("key", []byte("2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, ok, _ := mem.getFromView("key")
+	assert.False(t, ok, "Get should not read a view once closed")
+	kvp, err := kv.Get("key")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "2", string(kvp.Value), "Unexpected value")
+	_, err = kv.Delete("key")
+	require.NoError(t, err, "Unexpected error in Delete")
+	_, err = kv.Get("key")
+	assert.Equal(t, kvdb.ErrNotFound, err, "key should be deleted")
+
+	// Without the mode Close does nothing.
+	kv, err = New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	require.NoError(t, kv.(*memKV).Close(), "Unexpected error in Close")
+}
+
+// TestConcurrentReadsAndWrites races writers against every kind of read on
+// the same keys, for go test -race to catch unguarded map access.
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	keys := []string{"race/a", "race/b", "race/c/d"}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := keys[(w+i)%len(keys)]
+				if i%5 == 0 {
+					_, _ = kv.Delete(key)
+					continue
+				}
+				_, err := kv.Put(key, i, 0)
+				assert.NoError(t, err, "Unexpected error in Put")
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := keys[(w+i)%len(keys)]
+				if _, err := kv.Get(key); err != nil {
+					assert.Equal(t, kvdb.ErrNotFound, err, "Unexpected error in Get")
+				}
+				var v int
+				if _, err := kv.GetVal(key, &v); err != nil {
+					assert.Equal(t, kvdb.ErrNotFound, err, "Unexpected error in GetVal")
+				}
+				_, err := kv.Enumerate("race")
+				assert.NoError(t, err, "Unexpected error in Enumerate")
+				_, err = kv.Keys("race", "")
+				assert.NoError(t, err, "Unexpected error in Keys")
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestDeleteIfExists(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "deleteifexists"
+	_, err = kv.Put(key, []byte("bar"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	deleted, err := kv.DeleteIfExists(key)
+	assert.NoError(t, err, "Unexpected error deleting existing key")
+	assert.True(t, deleted, "Expected existing key to be deleted")
+	_, err = kv.Get(key)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Key should be gone after delete")
+
+	deleted, err = kv.DeleteIfExists(key)
+	assert.NoError(t, err, "Unexpected error deleting missing key")
+	assert.False(t, deleted, "Expected missing key not to be reported deleted")
+
+	_, err = kv.Delete(key)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Delete should remain strict")
+}
+
+func TestDeleteIf(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "deleteif"
+	_, err = kv.Put(key, []byte("expired"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	isExpired := func(value []byte) bool { return string(value) == "expired" }
+	isLive := func(value []byte) bool { return string(value) == "live" }
+
+	deleted, err := kv.DeleteIf(key, isLive)
+	assert.NoError(t, err, "Unexpected error in DeleteIf")
+	assert.False(t, deleted, "Key should be kept when predicate is false")
+	kvp, err := kv.Get(key)
+	require.NoError(t, err, "Key should still exist")
+	assert.Equal(t, "expired", string(kvp.Value), "Value should be unchanged")
+
+	deleted, err = kv.DeleteIf(key, isExpired)
+	assert.NoError(t, err, "Unexpected error in DeleteIf")
+	assert.True(t, deleted, "Key should be deleted when predicate is true")
+	_, err = kv.Get(key)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Key should be gone after delete")
+
+	deleted, err = kv.DeleteIf(key, isExpired)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Missing key should return ErrNotFound")
+	assert.False(t, deleted, "Missing key should not be reported deleted")
+}
+
+func TestKeysWrittenBy(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	lockerID := "node:node_1,func:writer"
+	lock, err := kv.LockWithID("writers/lock", lockerID)
+	require.NoError(t, err, "Unexpected error in LockWithID")
+
+	view, err := kv.WithLock(lock)
+	require.NoError(t, err, "Unexpected error in WithLock")
+	_, err = view.Put("writers/a", []byte("a"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = view.Create("writers/b", []byte("b"), 0)
+	require.NoError(t, err, "Unexpected error in Create")
+	_, err = view.Update("writers/a", []byte("aa"), 0)
+	require.NoError(t, err, "Unexpected error in Update")
+	_, err = kv.Put("writers/c", []byte("c"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	keys, err := kv.KeysWrittenBy(lockerID)
+	require.NoError(t, err, "Unexpected error in KeysWrittenBy")
+	assert.Equal(t, []string{"writers/a", "writers/b"}, keys,
+		"Unexpected keys attributed to %v", lockerID)
+
+	// A write outside the view is no longer attributed to the locker.
+	_, err = kv.Put("writers/b", []byte("bb"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	keys, err = kv.KeysWrittenBy(lockerID)
+	require.NoError(t, err, "Unexpected error in KeysWrittenBy")
+	assert.Equal(t, []string{"writers/a"}, keys,
+		"Unexpected keys attributed to %v", lockerID)
+
+	require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	_, err = view.Put("writers/d", []byte("d"), 0)
+	assert.Equal(t, kvdb.ErrInvalidLock, err,
+		"Write through view should fail once the lock is released")
+}
+
+func TestDebugDump(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+
+	lock, err := kv.Lock("dump/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+	_, err = kv.Put("dump/_hidden", []byte("hidden"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	kvps, err := kv.Enumerate("dump")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	for _, kvp := range kvps {
+		assert.NotEqual(t, "dump/_hidden", kvp.Key, "Enumerate should hide the key")
+	}
+
+	dumper, ok := kv.(kvdb.DebugDumper)
+	require.True(t, ok, "mem should implement DebugDumper")
+	dump := dumper.DebugDump()
+	hidden, ok := dump[mem.domain+"dump/_hidden"]
+	require.True(t, ok, "Dump should include the hidden key")
+	assert.Equal(t, "hidden", string(hidden.Value), "Unexpected hidden value")
+	_, ok = dump[mem.domain+lock.Key]
+	assert.True(t, ok, "Dump should include the lock key")
+
+	hidden.Value[0] = 'X'
+	kvp, err := kv.Get("dump/_hidden")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "hidden", string(kvp.Value), "Dump should not share values")
+}
+
+func TestVerify(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+	_, ok := kv.(kvdb.Verifier)
+	assert.True(t, ok, "mem should implement Verifier")
+
+	_, err = kv.Put("verify/a", []byte("a"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("verify/b", []byte("b"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("verify/a", []byte("aa"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	require.NoError(t, mem.Verify(), "Unexpected error in Verify")
+
+	corruptions := map[string]func(kvp *kvdb.KVPair){
+		"modified index ahead of kvdb index": func(kvp *kvdb.KVPair) {
+			kvp.ModifiedIndex = mem.index + 1
+		},
+		"created index ahead of modified index": func(kvp *kvdb.KVPair) {
+			kvp.CreatedIndex = kvp.ModifiedIndex + 1
+		},
+		"mismatched key": func(kvp *kvdb.KVPair) {
+			kvp.Key = "verify/other"
+		},
+	}
+	for name, corrupt := range corruptions {
+		stored, _ := mem.m.get(mem.domain + "verify/a")
+		saved := *stored
+		corrupt(stored)
+		mem.m.set(mem.domain+"verify/a", stored)
+		assert.Error(t, mem.Verify(), "Verify should detect %v", name)
+		mem.m.set(mem.domain+"verify/a", &saved)
+		require.NoError(t, mem.Verify(), "Unexpected error in Verify")
+	}
+
+	mem.writers[mem.domain+"verify/deleted"] = "locker"
+	assert.Error(t, mem.Verify(), "Verify should detect orphaned writer")
+}
+
+// watchEvents returns a watch callback that sends updates and errors to the
+// returned channels.
+func watchEvents(
+	t *testing.T,
+	expectedOpaque interface{},
+) (kvdb.WatchCB, chan *kvdb.KVPair, chan error) {
+	updates := make(chan *kvdb.KVPair, 100)
+	errs := make(chan error, 10)
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair,
+		err error) error {
+		assert.Equal(t, expectedOpaque, opaque, "Unexpected opaque in callback")
+		if err != nil {
+			errs <- err
+			return err
+		}
+		update := *kvp
+		updates <- &update
+		return nil
+	}
+	return cb, updates, errs
+}
+
+func receiveUpdate(t *testing.T, updates chan *kvdb.KVPair) *kvdb.KVPair {
+	select {
+	case kvp := <-updates:
+		return kvp
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for watch update")
+	}
+	return nil
+}
+
+func TestWatchAll(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	before, err := kv.Put("all/before", []byte("0"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	cb, updates, _ := watchEvents(t, "all")
+	require.NoError(t, kv.WatchAll(before.ModifiedIndex, "all", cb),
+		"Unexpected error in WatchAll")
+	ctx, cancel := context.WithCancel(context.Background())
+	replayCb, replayed, replayErrs := watchEvents(t, nil)
+	require.NoError(t, kv.WatchAllWithContext(ctx, 0, nil, replayCb),
+		"Unexpected error in WatchAllWithContext")
+
+	_, err = kv.Put("all/a", []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("other/_hidden", []byte("h"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("unrelated", []byte("2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Delete("all/a")
+	require.NoError(t, err, "Unexpected error in Delete")
+
+	expected := []string{"all/a", "unrelated", "all/a"}
+	last := before.ModifiedIndex
+	var action kvdb.KVAction
+	for i, key := range expected {
+		kvp := receiveUpdate(t, updates)
+		assert.Equal(t, key, kvp.Key, "Unexpected key for change %v", i)
+		assert.True(t, kvp.ModifiedIndex > last,
+			"Change %v at index %v is out of order", i, kvp.ModifiedIndex)
+		last, action = kvp.ModifiedIndex, kvp.Action
+	}
+	assert.Equal(t, kvdb.KVDelete, action, "Last change should be the delete")
+	select {
+	case kvp := <-updates:
+		t.Fatalf("Unexpected change to %v", kvp.Key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A watch from index 0 replays the retained changes first.
+	for _, key := range append([]string{"all/before"}, expected...) {
+		kvp := receiveUpdate(t, replayed)
+		assert.Equal(t, key, kvp.Key, "Unexpected replayed key")
+	}
+	cancel()
+	select {
+	case err := <-replayErrs:
+		assert.Equal(t, kvdb.ErrWatchStopped, err, "Unexpected watch error")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for watch to stop")
+	}
+}
+
+func TestWatchOptions(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "watchopts/key"
+	_, err = kv.Put(key, []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err := kv.Put(key, []byte("2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	opaque := "opaque"
+	cb, updates, errs := watchEvents(t, opaque)
+	err = kv.WatchKeyOpts(key, kvdb.WatchOptions{
+		WaitIndex: kvp.ModifiedIndex,
+		Opaque:    opaque,
+		Filter: func(kvp *kvdb.KVPair) bool {
+			return string(kvp.Value) != "drop"
+		},
+		StopOnDelete: true,
+	}, cb)
+	require.NoError(t, err, "Unexpected error in WatchKeyOpts")
+
+	_, err = kv.Put(key, []byte("drop"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put(key, []byte("3"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	update := receiveUpdate(t, updates)
+	assert.Equal(t, "3", string(update.Value),
+		"Updates up to WaitIndex and filtered updates must not be delivered")
+
+	_, err = kv.Delete(key)
+	require.NoError(t, err, "Unexpected error in Delete")
+	update = receiveUpdate(t, updates)
+	assert.Equal(t, kvdb.KVDelete, update.Action, "Expected delete update")
+	select {
+	case err := <-errs:
+		assert.Equal(t, kvdb.ErrWatchStopped, err, "Expected watch to stop")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for watch to stop on delete")
+	}
+
+	_, err = kv.Put(key, []byte("4"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	select {
+	case kvp := <-updates:
+		t.Fatalf("Unexpected update after watch stopped: %v", kvp)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchTreeOptions(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	cb, updates, _ := watchEvents(t, nil)
+	err = kv.WatchTreeOpts("watchopts", kvdb.WatchOptions{
+		Filter: func(kvp *kvdb.KVPair) bool {
+			return kvp.Key != "watchopts/skip"
+		},
+	}, cb)
+	require.NoError(t, err, "Unexpected error in WatchTreeOpts")
+
+	_, err = kv.Put("watchopts/skip", []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("watchopts/keep", []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	update := receiveUpdate(t, updates)
+	assert.Equal(t, "watchopts/keep", update.Key, "Filtered key delivered")
+}
+
+func TestConnectionState(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	var states []kvdb.ConnState
+	kv.OnConnectionStateChange(func(s kvdb.ConnState) {
+		states = append(states, s)
+	})
+	assert.Equal(t, []kvdb.ConnState{kvdb.ConnStateConnected}, states,
+		"Mem should report connected on registration")
+}
+
+func TestPollChanges(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "poll"
+	_, err = kv.Put("other/key", []byte("ignored"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	changes, since, err := kv.PollChanges(prefix, 0)
+	require.NoError(t, err, "Unexpected error in PollChanges")
+	assert.Empty(t, changes, "No changes expected under prefix")
+
+	expected := make([]string, 0)
+	observed := make([]string, 0)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("%s/%d", prefix, i)
+			_, err = kv.Put(key, []byte(strconv.Itoa(round)), 0)
+			require.NoError(t, err, "Unexpected error in Put")
+			expected = append(expected, fmt.Sprintf("%s=%d", key, round))
+		}
+		key := fmt.Sprintf("%s/%d", prefix, round%3)
+		_, err = kv.Delete(key)
+		require.NoError(t, err, "Unexpected error in Delete")
+		expected = append(expected, key+" deleted")
+
+		var index uint64
+		changes, index, err = kv.PollChanges(prefix, since)
+		require.NoError(t, err, "Unexpected error in PollChanges")
+		for _, kvp := range changes {
+			assert.True(t, kvp.ModifiedIndex > since, "Change before since index")
+			assert.True(t, kvp.ModifiedIndex <= index, "Change after high-water index")
+			if kvp.Action == kvdb.KVDelete {
+				observed = append(observed, kvp.Key+" deleted")
+			} else {
+				observed = append(observed, kvp.Key+"="+string(kvp.Value))
+			}
+		}
+		since = index
+
+		changes, index, err = kv.PollChanges(prefix, since)
+		require.NoError(t, err, "Unexpected error in PollChanges")
+		assert.Empty(t, changes, "Repeated poll should not return changes again")
+		assert.Equal(t, since, index, "High-water index should not move")
+	}
+	assert.Equal(t, expected, observed, "Every change should be observed exactly once")
+}
+
+func TestPollChangesCompacted(t *testing.T) {
+	kv, err := New("pwx/test", nil, map[string]string{HistorySizeKey: "5"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	for i := 0; i < 10; i++ {
+		_, err = kv.Put("compacted", []byte(strconv.Itoa(i)), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	_, _, err = kv.PollChanges("compacted", 2)
+	assert.Equal(t, kvdb.ErrWatchRevisionCompacted, err,
+		"Changes older than the history should be compacted")
+
+	changes, index, err := kv.PollChanges("compacted", 5)
+	require.NoError(t, err, "Changes within the history should be returned")
+	assert.Len(t, changes, 5, "Unexpected number of changes")
+	assert.Equal(t, uint64(10), index, "Unexpected high-water index")
+
+	_, err = New("pwx/test", nil, map[string]string{HistorySizeKey: "0"}, nil)
+	assert.Error(t, err, "Expected error for invalid history size")
+}
+
+func TestCompactHistory(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	compactor := kv.(kvdb.HistoryCompactor)
+
+	prefix := "compact"
+	// The lagging watch blocks on the first change until released.
+	release := make(chan struct{})
+	lagging := make(chan *kvdb.KVPair, 10)
+	var once sync.Once
+	laggingCb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		update := *kvp
+		lagging <- &update
+		once.Do(func() { <-release })
+		return nil
+	}
+	opts := kvdb.WatchOptions{CompactionEvents: true}
+	require.NoError(t, kv.WatchTreeOpts(prefix, opts, laggingCb),
+		"Unexpected error in WatchTreeOpts")
+	cb, current, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTreeOpts(prefix, opts, cb),
+		"Unexpected error in WatchTreeOpts")
+	cb, all, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree(prefix, 0, nil, cb),
+		"Unexpected error in WatchTree")
+
+	_, err = kv.Put(prefix+"/0", []byte("value"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp := receiveUpdate(t, lagging)
+	assert.Equal(t, prefix+"/0", kvp.Key, "Unexpected update")
+	var last *kvdb.KVPair
+	for i := 1; i < 5; i++ {
+		last, err = kv.Put(fmt.Sprintf("%s/%d", prefix, i), []byte("value"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	for i := 0; i < 5; i++ {
+		kvp = receiveUpdate(t, current)
+		assert.Equal(t, fmt.Sprintf("%s/%d", prefix, i), kvp.Key,
+			"Unexpected update")
+	}
+
+	assert.Equal(t, kvdb.ErrIllegal, compactor.CompactHistory(last.ModifiedIndex+1),
+		"Compacting past the kvdb index should fail")
+	floor := last.ModifiedIndex - 1
+	require.NoError(t, compactor.CompactHistory(floor),
+		"Unexpected error in CompactHistory")
+	close(release)
+
+	// The lagging watch is told of the compaction in place of the changes
+	// it dropped, and receives the changes left.
+	kvp = receiveUpdate(t, lagging)
+	assert.Equal(t, kvdb.KVCompacted, kvp.Action, "Expected a compaction")
+	assert.Equal(t, floor, kvp.ModifiedIndex, "Unexpected oldest index")
+	for i := 3; i < 5; i++ {
+		kvp = receiveUpdate(t, lagging)
+		assert.Equal(t, fmt.Sprintf("%s/%d", prefix, i), kvp.Key,
+			"Unexpected update")
+	}
+
+	// The watch that was up to date and the one that did not ask for
+	// compaction events are not told of it.
+	for i := 0; i < 5; i++ {
+		kvp = receiveUpdate(t, all)
+		assert.Equal(t, fmt.Sprintf("%s/%d", prefix, i), kvp.Key,
+			"Unexpected update")
+	}
+	_, err = kv.Put(prefix+"/after", []byte("value"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	for _, updates := range []chan *kvdb.KVPair{lagging, current, all} {
+		kvp = receiveUpdate(t, updates)
+		assert.Equal(t, prefix+"/after", kvp.Key, "Unexpected update")
+	}
+
+	_, _, err = kv.PollChanges(prefix, floor-2)
+	assert.Equal(t, kvdb.ErrWatchRevisionCompacted, err,
+		"Compacted changes should not be returned")
+	changes, _, err := kv.PollChanges(prefix, floor-1)
+	require.NoError(t, err, "Unexpected error in PollChanges")
+	assert.Len(t, changes, 3, "Unexpected number of changes")
+}
+
+func TestWatchWaitIndexReplay(t *testing.T) {
+	kv, err := New("pwx/test", nil, map[string]string{HistorySizeKey: "5"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	var last *kvdb.KVPair
+	for i := 0; i < 10; i++ {
+		last, err = kv.Put("replay/key", []byte(strconv.Itoa(i)), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchKey("replay/key", last.ModifiedIndex-2, nil, cb),
+		"Unexpected error in WatchKey")
+	_, err = kv.Put("replay/key", []byte("live"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	for _, expected := range []string{"8", "9", "live"} {
+		kvp := receiveUpdate(t, updates)
+		assert.Equal(t, expected, string(kvp.Value), "Unexpected replayed value")
+	}
+
+	cb, _, errs := watchEvents(t, nil)
+	err = kv.WatchKey("replay/key", 2, nil, cb)
+	assert.Equal(t, kvdb.ErrWatchRevisionCompacted, err,
+		"Watch from before the history should be compacted")
+	err = kv.WatchTree("replay", 2, nil, cb)
+	assert.Equal(t, kvdb.ErrWatchRevisionCompacted, err,
+		"Tree watch from before the history should be compacted")
+	assert.Empty(t, errs, "Refused watches should not call back")
+}
+
+func TestWatchWithContext(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keyCb, keyUpdates, keyErrs := watchEvents(t, "key")
+	require.NoError(t, kv.WatchKeyWithContext(ctx, "ctx/key", 0, "key", keyCb),
+		"Unexpected error in WatchKeyWithContext")
+	treeCb, _, treeErrs := watchEvents(t, "tree")
+	require.NoError(t, kv.WatchTreeWithContext(ctx, "ctx", 0, "tree", treeCb),
+		"Unexpected error in WatchTreeWithContext")
+
+	_, err = kv.Put("ctx/key", []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp := receiveUpdate(t, keyUpdates)
+	assert.Equal(t, "1", string(kvp.Value), "Unexpected value")
+
+	// No change is needed for the watches to stop.
+	cancel()
+	for name, errs := range map[string]chan error{"key": keyErrs, "tree": treeErrs} {
+		select {
+		case err := <-errs:
+			assert.Equal(t, kvdb.ErrWatchStopped, err,
+				"Unexpected error on %v watch", name)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %v watch to stop", name)
+		}
+	}
+	require.Eventually(t, func() bool {
+		has, err := kv.HasWatchers("ctx/key")
+		return err == nil && !has
+	}, 5*time.Second, 10*time.Millisecond, "Cancelled watch still reported")
+}
+
+func TestStopWatchGroup(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	register := func(group, key string, tree bool) chan error {
+		cb, _, errs := watchEvents(t, nil)
+		opts := kvdb.WatchOptions{Group: group}
+		if tree {
+			require.NoError(t, kv.WatchTreeOpts(key, opts, cb),
+				"Unexpected error in WatchTreeOpts")
+		} else {
+			require.NoError(t, kv.WatchKeyOpts(key, opts, cb),
+				"Unexpected error in WatchKeyOpts")
+		}
+		return errs
+	}
+	stopped := []chan error{
+		register("a", "group/key1", false),
+		register("a", "group", true),
+	}
+	kept := []chan error{
+		register("b", "group/key1", false),
+		register("", "group/key2", false),
+	}
+
+	assert.Equal(t, 0, kv.StopWatchGroup("missing"),
+		"No watch should be stopped for an unknown group")
+	assert.Equal(t, 2, kv.StopWatchGroup("a"), "Unexpected stopped count")
+	for _, errs := range stopped {
+		select {
+		case err := <-errs:
+			assert.Equal(t, kvdb.ErrWatchStopped, err, "Unexpected watch error")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for grouped watch to stop")
+		}
+	}
+	require.Eventually(t, func() bool {
+		return kv.StopWatchGroup("a") == 0
+	}, 5*time.Second, 10*time.Millisecond, "Stopped watches still registered")
+
+	for _, errs := range kept {
+		assert.Empty(t, errs, "Watch outside the group should not be stopped")
+	}
+	for _, key := range []string{"group/key1", "group/key2"} {
+		has, err := kv.HasWatchers(key)
+		require.NoError(t, err, "Unexpected error in HasWatchers")
+		assert.True(t, has, "Watch on %v should be intact", key)
+	}
+}
+
+func TestReplaceTree(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "replace/"
+	for _, k := range []string{"keep", "stale1", "stale2"} {
+		_, err = kv.Put(prefix+k, []byte("old"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	_, err = kv.Put("replaced", []byte("outside"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree(prefix, 4, nil, cb), "Unexpected error in WatchTree")
+
+	put, deleted, err := kv.ReplaceTree(prefix, map[string]interface{}{
+		"keep": []byte("new"),
+		"add":  "added",
+	}, 0)
+	require.NoError(t, err, "Unexpected error in ReplaceTree")
+	assert.Equal(t, 2, put, "Unexpected number of keys put")
+	assert.Equal(t, 2, deleted, "Unexpected number of keys deleted")
+
+	kvps, err := kv.Enumerate(prefix)
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	tree := make(map[string]string)
+	for _, kvp := range kvps {
+		tree[kvp.Key] = string(kvp.Value)
+	}
+	assert.Equal(t, map[string]string{
+		prefix + "keep": "new",
+		prefix + "add":  "added",
+	}, tree, "Unexpected tree after replace")
+	kvp, err := kv.Get("replaced")
+	require.NoError(t, err, "Keys outside the prefix should be untouched")
+	assert.Equal(t, "outside", string(kvp.Value), "Unexpected value")
+
+	actions := make(map[string]kvdb.KVAction)
+	for i := 0; i < 4; i++ {
+		kvp := receiveUpdate(t, updates)
+		actions[kvp.Key] = kvp.Action
+	}
+	assert.Equal(t, map[string]kvdb.KVAction{
+		prefix + "stale1": kvdb.KVDelete,
+		prefix + "stale2": kvdb.KVDelete,
+		prefix + "keep":   kvdb.KVSet,
+		prefix + "add":    kvdb.KVCreate,
+	}, actions, "Unexpected events for replace")
+}
+
+func TestKeys(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	for _, key := range []string{
+		"tree/b/leaf",
+		"tree/b/deeper/leaf",
+		"tree/a",
+		"tree/c/leaf",
+		"tree/_hidden",
+		"treetop",
+	} {
+		_, err = kv.Put(key, []byte("v"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+
+	keys, err := kv.Keys("tree", "")
+	require.NoError(t, err, "Unexpected error in Keys")
+	assert.Equal(t, []string{"a", "b", "c"}, keys,
+		"Only the immediate children should be returned")
+	keys, err = kv.Keys("tree/b/", "/")
+	require.NoError(t, err, "Unexpected error in Keys")
+	assert.Equal(t, []string{"deeper", "leaf"}, keys, "Unexpected children of tree/b")
+	keys, err = kv.Keys("tree/a", "")
+	require.NoError(t, err, "Unexpected error in Keys")
+	assert.Empty(t, keys, "A leaf should have no children")
+
+	nodomain, err := New("", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	_, err = nodomain.Put("top/leaf", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	keys, err = nodomain.Keys("", "")
+	require.NoError(t, err, "Unexpected error in Keys")
+	assert.Contains(t, keys, "top", "Root children should be returned")
+}
+
+func TestCreateBatch(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	kvps, err := kv.CreateBatch(map[string]interface{}{
+		"config/b": "2",
+		"config/a": []byte("1"),
+	}, 0)
+	require.NoError(t, err, "Unexpected error in CreateBatch")
+	require.Len(t, kvps, 2, "Expected every pair to be created")
+	assert.Equal(t, "config/a", kvps[0].Key, "Pairs should be in key order")
+	assert.Equal(t, "config/b", kvps[1].Key, "Pairs should be in key order")
+	for _, kvp := range kvps {
+		assert.Equal(t, kvdb.KVCreate, kvp.Action, "Unexpected action")
+	}
+
+	_, err = kv.CreateBatch(map[string]interface{}{
+		"config/c": "3",
+		"config/b": "new",
+		"config/d": "4",
+	}, 0)
+	assert.True(t, errors.Is(err, kvdb.ErrExist), "Expected exist error")
+	assert.Contains(t, err.Error(), "config/b", "Error should name the existing key")
+	for _, key := range []string{"config/c", "config/d"} {
+		_, err = kv.Get(key)
+		assert.Equal(t, kvdb.ErrNotFound, err, "Nothing should be created")
+	}
+	kvp, err := kv.Get("config/b")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "2", string(kvp.Value), "Existing key should be unchanged")
+}
+
+func TestPutBulk(t *testing.T) {
+	bulk, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	single, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	pairs := make(map[string]interface{})
+	for i := 0; i < 50; i++ {
+		pairs[fmt.Sprintf("bulk/%02d", i)] = fmt.Sprintf("v%d", i)
+	}
+	for _, db := range []kvdb.Kvdb{bulk, single} {
+		_, err = db.Put("bulk/10", []byte("old"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	kvps, err := bulk.PutBulk(pairs, 0)
+	require.NoError(t, err, "Unexpected error in PutBulk")
+	require.Len(t, kvps, len(pairs), "Expected every pair to be put")
+	for i := 1; i < len(kvps); i++ {
+		assert.True(t, kvps[i].Key > kvps[i-1].Key, "Pairs should be in key order")
+		assert.Equal(t, kvps[i-1].ModifiedIndex+1, kvps[i].ModifiedIndex,
+			"Indexes should increase by one per key")
+	}
+	for _, kvp := range kvps {
+		_, err = single.Put(kvp.Key, pairs[kvp.Key], 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+
+	contents := func(db kvdb.Kvdb) map[string]string {
+		kvps, err := db.Enumerate("bulk")
+		require.NoError(t, err, "Unexpected error in Enumerate")
+		found := make(map[string]string)
+		for _, kvp := range kvps {
+			found[kvp.Key] = string(kvp.Value)
+		}
+		return found
+	}
+	assert.Equal(t, contents(single), contents(bulk),
+		"PutBulk should match individual Puts")
+
+	kvps, err = bulk.PutBulk(map[string]interface{}{
+		"partial/a": "1",
+		"partial/b": make(chan int),
+		"partial/c": "3",
+	}, 0)
+	require.Error(t, err, "Expected an unencodable value to fail")
+	assert.Contains(t, err.Error(), "partial/b", "Error should name the failed key")
+	require.Len(t, kvps, 1, "Only the pairs before the failure should be put")
+	assert.Equal(t, "partial/a", kvps[0].Key, "Unexpected put pair")
+	_, err = bulk.Get("partial/a")
+	assert.NoError(t, err, "Pairs put before the failure should be kept")
+	_, err = bulk.Get("partial/c")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Pairs after the failure should not be put")
+}
+
+func TestAtomicAddBatch(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("counters/a", []byte("5"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	values, err := kv.AtomicAddBatch(map[string]int64{
+		"counters/a": 3,
+		"counters/b": -2,
+	})
+	require.NoError(t, err, "Unexpected error in AtomicAddBatch")
+	assert.Equal(t, map[string]int64{"counters/a": 8, "counters/b": -2}, values,
+		"Unexpected counter values")
+	kvp, err := kv.Get("counters/b")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "-2", string(kvp.Value), "Unexpected stored counter")
+
+	_, err = kv.Put("counters/text", []byte("abc"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.AtomicAddBatch(map[string]int64{
+		"counters/a":    1,
+		"counters/text": 1,
+	})
+	assert.Equal(t, kvdb.ErrNotNumeric, err, "Expected non numeric error")
+	kvp, err = kv.Get("counters/a")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "8", string(kvp.Value), "Failed batch should not change counters")
+}
+
+func TestAtomicAddBatchConcurrent(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	workers, batches := 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < batches; i++ {
+				_, err := kv.AtomicAddBatch(map[string]int64{
+					"sum/ones": 1,
+					"sum/twos": 2,
+				})
+				assert.NoError(t, err, "Unexpected error in AtomicAddBatch")
+			}
+		}()
+	}
+	wg.Wait()
+
+	values, err := kv.AtomicAddBatch(map[string]int64{"sum/ones": 0, "sum/twos": 0})
+	require.NoError(t, err, "Unexpected error in AtomicAddBatch")
+	total := int64(workers * batches)
+	assert.Equal(t, map[string]int64{"sum/ones": total, "sum/twos": 2 * total},
+		values, "Unexpected sums")
+}
+
+func TestAtomicIncrement(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	n, err := kv.AtomicIncrement("seq/id", 5)
+	require.NoError(t, err, "Unexpected error in AtomicIncrement")
+	assert.Equal(t, int64(5), n, "Missing counter should start at delta")
+	n, err = kv.AtomicDecrement("seq/id", 2)
+	require.NoError(t, err, "Unexpected error in AtomicDecrement")
+	assert.Equal(t, int64(3), n, "Unexpected counter value")
+
+	_, err = kv.Put("seq/text", []byte("abc"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.AtomicIncrement("seq/text", 1)
+	assert.Equal(t, kvdb.ErrNotNumeric, err, "Expected non numeric error")
+
+	workers, increments := 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				_, err := kv.AtomicIncrement("seq/sum", int64(w))
+				assert.NoError(t, err, "Unexpected error in AtomicIncrement")
+				_, err = kv.AtomicDecrement("seq/sum", 1)
+				assert.NoError(t, err, "Unexpected error in AtomicDecrement")
+			}
+		}(w)
+	}
+	wg.Wait()
+	expected := 0
+	for w := 0; w < workers; w++ {
+		expected += increments * (w - 1)
+	}
+	kvp, err := kv.Get("seq/sum")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, strconv.Itoa(expected), string(kvp.Value),
+		"Final value should be the sum of the deltas")
+}
+
+func TestAllowN(t *testing.T) {
+	kv, clock := newWithClock(t)
+
+	allowed, err := kv.AllowN("limit/api", 2, 5, 4)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	assert.True(t, allowed, "A full bucket should allow 4 of 5 tokens")
+	allowed, err = kv.AllowN("limit/api", 2, 5, 2)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	assert.False(t, allowed, "Only 1 token should be left")
+	allowed, err = kv.AllowN("limit/api", 2, 5, 6)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	assert.False(t, allowed, "A burst beyond capacity should be rejected")
+
+	clock.Advance(time.Second)
+	allowed, err = kv.AllowN("limit/api", 2, 5, 3)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	assert.True(t, allowed, "2 tokens should be refilled after a second")
+	allowed, err = kv.AllowN("limit/api", 2, 5, 1)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	assert.False(t, allowed, "Refilled tokens should be consumed")
+
+	clock.Advance(time.Hour)
+	allowed, err = kv.AllowN("limit/api", 2, 5, 5)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	assert.True(t, allowed, "Bucket should refill up to burst")
+	allowed, err = kv.AllowN("limit/api", 2, 5, 1)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	assert.False(t, allowed, "Bucket should not refill beyond burst")
+
+	_, err = kv.AllowN("limit/api", 2, 0, 1)
+	assert.Equal(t, kvdb.ErrIllegal, err, "Expected illegal error for zero burst")
+}
+
+// treeState returns the keys under prefix with their values and indexes.
+func treeState(t *testing.T, kv kvdb.Kvdb, prefix string) map[string]string {
+	kvps, err := kv.Enumerate(prefix)
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	state := make(map[string]string)
+	for _, kvp := range kvps {
+		state[kvp.Key] = fmt.Sprintf("%s@%d/%d", kvp.Value,
+			kvp.CreatedIndex, kvp.ModifiedIndex)
+	}
+	return state
+}
+
+func TestApplyChange(t *testing.T) {
+	primary, err := New("pwx/primary", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	replica, err := New("pwx/replica", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	applier, ok := replica.(kvdb.ChangeApplier)
+	require.True(t, ok, "mem should implement ChangeApplier")
+
+	applied := make(chan uint64, 100)
+	var changes []kvdb.KVPair
+	err = primary.WatchTree("", 0, nil,
+		func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+			if err != nil {
+				return err
+			}
+			changes = append(changes, *kvp)
+			assert.NoError(t, applier.ApplyChange(kvp), "Unexpected error in ApplyChange")
+			applied <- kvp.ModifiedIndex
+			return nil
+		})
+	require.NoError(t, err, "Unexpected error in WatchTree")
+
+	var last *kvdb.KVPair
+	for i := 0; i < 5; i++ {
+		last, err = primary.Put(fmt.Sprintf("repl/%d", i), []byte(strconv.Itoa(i)), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	_, err = primary.Update("repl/1", []byte("updated"), 0)
+	require.NoError(t, err, "Unexpected error in Update")
+	last, err = primary.Delete("repl/3")
+	require.NoError(t, err, "Unexpected error in Delete")
+
+	for index := uint64(0); index < last.ModifiedIndex; {
+		select {
+		case index = <-applied:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for changes to be applied")
+		}
+	}
+	expected := treeState(t, primary, "repl")
+	assert.Equal(t, expected, treeState(t, replica, "repl"),
+		"Replica should mirror the primary")
+	require.NoError(t, replica.(*memKV).Verify(), "Unexpected error in Verify")
+
+	// Replaying the stream, duplicates and all, is a no-op.
+	for i := range changes {
+		require.NoError(t, applier.ApplyChange(&changes[i]), "Unexpected error in ApplyChange")
+	}
+	assert.Equal(t, expected, treeState(t, replica, "repl"),
+		"Duplicate changes should be ignored")
+}
+
+func TestPauseWatch(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "pause"
+	assert.Equal(t, kvdb.ErrNotFound, kv.PauseWatch(prefix),
+		"Pausing an unknown watch should fail")
+
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree(prefix, 0, nil, cb), "Unexpected error in WatchTree")
+	require.NoError(t, kv.PauseWatch(prefix), "Unexpected error in PauseWatch")
+
+	for i := 0; i < 5; i++ {
+		_, err = kv.Put(fmt.Sprintf("%s/%d", prefix, i), []byte("value"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	select {
+	case kvp := <-updates:
+		t.Fatalf("Unexpected update %v while paused", kvp.Key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, kv.ResumeWatch(prefix), "Unexpected error in ResumeWatch")
+	_, err = kv.Put(prefix+"/after", []byte("value"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	for i := 0; i < 5; i++ {
+		kvp := receiveUpdate(t, updates)
+		assert.Equal(t, fmt.Sprintf("%s/%d", prefix, i), kvp.Key,
+			"Buffered updates should be delivered in order")
+	}
+	kvp := receiveUpdate(t, updates)
+	assert.Equal(t, prefix+"/after", kvp.Key, "Unexpected update after resume")
+}
+
+func TestPauseWatchOverflow(t *testing.T) {
+	kv, err := New("pwx/test", nil, map[string]string{WatchBufferSizeKey: "2"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "overflow"
+	cb, updates, errs := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree(prefix, 0, nil, cb), "Unexpected error in WatchTree")
+	require.NoError(t, kv.PauseWatch(prefix), "Unexpected error in PauseWatch")
+	for i := 0; i < 3; i++ {
+		_, err = kv.Put(fmt.Sprintf("%s/%d", prefix, i), []byte("value"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	require.NoError(t, kv.ResumeWatch(prefix), "Unexpected error in ResumeWatch")
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, kvdb.ErrWatchOverflow, err, "Expected overflow error")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for overflow error")
+	}
+	assert.Empty(t, updates, "No updates should be delivered after overflow")
+}
+
+func TestTxReadCommitted(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("tx/a", []byte("committed"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	tx1, err := kv.TxNew()
+	require.NoError(t, err, "Unexpected error in TxNew")
+	tx2, err := kv.TxNew()
+	require.NoError(t, err, "Unexpected error in TxNew")
+
+	_, err = tx1.Put("tx/a", []byte("tx1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err := tx1.Get("tx/a")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "tx1", string(kvp.Value), "Tx should read its own writes")
+
+	_, err = tx2.Put("tx/b", []byte("tx2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = tx1.Get("tx/b")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Tx should not see uncommitted writes")
+	kvp, err = tx2.Get("tx/a")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "committed", string(kvp.Value), "Tx should not see uncommitted writes")
+	_, err = kv.Get("tx/b")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Store should not see uncommitted writes")
+
+	require.NoError(t, tx2.Commit(), "Unexpected error in Commit")
+	_, err = tx1.Get("tx/b")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Tx should read from its start snapshot")
+	kvp, err = kv.Get("tx/b")
+	require.NoError(t, err, "Committed write should be visible")
+	assert.Equal(t, "tx2", string(kvp.Value), "Unexpected committed value")
+
+	require.NoError(t, tx1.Abort(), "Unexpected error in Abort")
+	kvp, err = kv.Get("tx/a")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "committed", string(kvp.Value), "Aborted write should be discarded")
+	_, err = tx1.Get("tx/a")
+	assert.Equal(t, kvdb.ErrIllegal, err, "Finished tx should be unusable")
+}
+
+func TestTxCommit(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("txc/update", []byte("old"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("txc/delete", []byte("old"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree("txc", 0, nil, cb), "Unexpected error in WatchTree")
+	receiveUpdate(t, updates)
+	receiveUpdate(t, updates)
+
+	tx, err := kv.TxNew()
+	require.NoError(t, err, "Unexpected error in TxNew")
+	_, err = tx.Create("txc/create", []byte("new"), 0)
+	require.NoError(t, err, "Unexpected error in Create")
+	_, err = tx.Create("txc/update", []byte("new"), 0)
+	assert.Equal(t, kvdb.ErrExist, err, "Create of an existing key should fail")
+	_, err = tx.Update("txc/update", []byte("new"), 0)
+	require.NoError(t, err, "Unexpected error in Update")
+	_, err = tx.Delete("txc/delete")
+	require.NoError(t, err, "Unexpected error in Delete")
+	_, err = tx.Get("txc/delete")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Tx should read its own deletes")
+	_, err = tx.Update("txc/missing", []byte("new"), 0)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Update of a missing key should fail")
+
+	select {
+	case kvp := <-updates:
+		t.Fatalf("Unexpected update %v before commit", kvp.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, tx.Commit(), "Unexpected error in Commit")
+
+	kvps, err := kv.Enumerate("txc")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	tree := make(map[string]string)
+	for _, kvp := range kvps {
+		tree[kvp.Key] = string(kvp.Value)
+	}
+	assert.Equal(t, map[string]string{
+		"txc/create": "new",
+		"txc/update": "new",
+	}, tree, "Unexpected tree after commit")
+	actions := make(map[string]kvdb.KVAction)
+	for i := 0; i < 3; i++ {
+		kvp := receiveUpdate(t, updates)
+		actions[kvp.Key] = kvp.Action
+	}
+	assert.Equal(t, map[string]kvdb.KVAction{
+		"txc/create": kvdb.KVCreate,
+		"txc/update": kvdb.KVSet,
+		"txc/delete": kvdb.KVDelete,
+	}, actions, "Unexpected events for commit")
+}
+
+func TestTxCommitPreconditionFails(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("txp/update", []byte("old"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	tx, err := kv.TxNew()
+	require.NoError(t, err, "Unexpected error in TxNew")
+	_, err = tx.Update("txp/update", []byte("new"), 0)
+	require.NoError(t, err, "Unexpected error in Update")
+	_, err = tx.Create("txp/create", []byte("new"), 0)
+	require.NoError(t, err, "Unexpected error in Create")
+
+	_, err = kv.Create("txp/create", []byte("other"), 0)
+	require.NoError(t, err, "Unexpected error in Create")
+	assert.Equal(t, kvdb.ErrExist, tx.Commit(), "Commit should fail its precondition")
+
+	kvp, err := kv.Get("txp/update")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "old", string(kvp.Value), "Failed commit should write nothing")
+	kvp, err = kv.Get("txp/create")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "other", string(kvp.Value), "Failed commit should write nothing")
+
+	tx, err = kv.TxNew()
+	require.NoError(t, err, "Unexpected error in TxNew")
+	_, err = tx.Delete("txp/update")
+	require.NoError(t, err, "Unexpected error in Delete")
+	require.NoError(t, tx.Abort(), "Unexpected error in Abort")
+	_, err = kv.Get("txp/update")
+	assert.NoError(t, err, "Aborted delete should be discarded")
+}
+
+func TestMoveIf(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("claims/pending", []byte("job1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err := kv.MoveIf("claims/pending", "claims/worker1", nil)
+	require.NoError(t, err, "Move to an absent dst should succeed")
+	assert.Equal(t, "job1", string(kvp.Value), "Unexpected moved value")
+	_, err = kv.Get("claims/pending")
+	assert.Equal(t, kvdb.ErrNotFound, err, "src should be deleted")
+
+	_, err = kv.Put("claims/pending", []byte("job2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.MoveIf("claims/pending", "claims/worker1", []byte("other"))
+	assert.Equal(t, kvdb.ErrValueMismatch, err, "Expected dst mismatch")
+	kvp, err = kv.Get("claims/pending")
+	require.NoError(t, err, "src should be kept on mismatch")
+	assert.Equal(t, "job2", string(kvp.Value), "Unexpected src value")
+	kvp, err = kv.Get("claims/worker1")
+	require.NoError(t, err, "dst should be kept on mismatch")
+	assert.Equal(t, "job1", string(kvp.Value), "Unexpected dst value")
+
+	kvp, err = kv.MoveIf("claims/pending", "claims/worker1", []byte("job1"))
+	require.NoError(t, err, "Move onto the expected dst value should succeed")
+	assert.Equal(t, "job2", string(kvp.Value), "Unexpected moved value")
+
+	_, err = kv.MoveIf("claims/missing", "claims/worker2", nil)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expected missing src")
+}
+
+func TestMoveIfKeepsRemainingTTL(t *testing.T) {
+	kv, clock := newWithClock(t)
+
+	src, err := kv.Put("claims/pending", []byte("job"), 60)
+	require.NoError(t, err, "Unexpected error in Put")
+	clock.Advance(40*time.Second + 500*time.Millisecond)
+	kvp, err := kv.MoveIf("claims/pending", "claims/worker", nil)
+	require.NoError(t, err, "Unexpected error in MoveIf")
+	assert.Equal(t, src.ExpiresAt, kvp.ExpiresAt, "dst should expire with src")
+	kvp, err = kv.Get("claims/worker")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, int64(20), kvp.TTL, "dst should keep the remaining TTL")
+	assert.Equal(t, src.ExpiresAt, kvp.ExpiresAt, "dst should expire with src")
+
+	clock.Advance(19 * time.Second)
+	_, err = kv.Get("claims/worker")
+	require.NoError(t, err, "dst should not expire early")
+	clock.Advance(time.Second)
+	_, err = kv.Get("claims/worker")
+	assert.Equal(t, kvdb.ErrNotFound, err, "dst should expire when src would")
+
+	// A key without a TTL moves without one.
+	_, err = kv.Put("claims/pending", []byte("job"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.MoveIf("claims/pending", "claims/worker", nil)
+	require.NoError(t, err, "Unexpected error in MoveIf")
+	kvp, err = kv.Get("claims/worker")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, int64(0), kvp.TTL, "dst should have no TTL")
+	assert.True(t, kvp.ExpiresAt.IsZero(), "dst should not expire")
+}
+
+func TestLockStats(t *testing.T) {
+	kv, clock := newWithClock(t)
+
+	key := "stats/lock"
+	lock, err := kv.Lock(key)
+	require.NoError(t, err, "Unexpected error in Lock")
+
+	waiters := 3
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := kv.Lock(key)
+			if assert.NoError(t, err, "Unexpected error in Lock") {
+				assert.NoError(t, kv.Unlock(l), "Unexpected error in Unlock")
+			}
+		}()
+	}
+
+	var stat kvdb.LockStat
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		stat, err = kv.LockStats(key)
+		require.NoError(t, err, "Unexpected error in LockStats")
+		if stat.Waiters == waiters {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, waiters, stat.Waiters, "Unexpected number of waiters")
+
+	clock.Advance(time.Minute)
+	stat, err = kv.LockStats(key)
+	require.NoError(t, err, "Unexpected error in LockStats")
+	assert.True(t, stat.LongestWait >= time.Minute,
+		"Unexpected longest wait %v", stat.LongestWait)
+
+	require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	wg.Wait()
+	stat, err = kv.LockStats(key)
+	require.NoError(t, err, "Unexpected error in LockStats")
+	assert.Equal(t, kvdb.LockStat{}, stat, "No waiters expected after release")
+}
+
+func TestPutIfOther(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("guard/mode", []byte("maintenance"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	kvp, err := kv.PutIfOther("guard/config", []byte("v1"), 0,
+		"guard/mode", []byte("maintenance"))
+	require.NoError(t, err, "Write should proceed when the guard matches")
+	assert.Equal(t, "v1", string(kvp.Value), "Unexpected value")
+
+	_, err = kv.PutIfOther("guard/config", []byte("v2"), 0,
+		"guard/mode", []byte("normal"))
+	assert.Equal(t, kvdb.ErrValueMismatch, err, "Expected guard mismatch")
+	kvp, err = kv.Get("guard/config")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "v1", string(kvp.Value), "Rejected write should not be applied")
+
+	_, err = kv.PutIfOther("guard/config", []byte("v3"), 0,
+		"guard/missing", []byte("maintenance"))
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expected missing guard")
+}
+
+func TestReplayHistory(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	expected := make([]string, 0)
+	record := func(kvp *kvdb.KVPair, err error) {
+		require.NoError(t, err, "Unexpected error")
+		expected = append(expected,
+			fmt.Sprintf("%d %v %s", kvp.ModifiedIndex, kvp.Key, kvp.Value))
+	}
+	record(kv.Put("history/a", []byte("1"), 0))
+	record(kv.Put("history/b", []byte("2"), 0))
+	record(kv.Update("history/a", []byte("3"), 0))
+	record(kv.Delete("history/b"))
+	record(kv.Create("history/c", []byte("4"), 0))
+
+	replayed := make([]string, 0)
+	err = kv.ReplayHistory(0, func(kvp *kvdb.KVPair) error {
+		replayed = append(replayed,
+			fmt.Sprintf("%d %v %s", kvp.ModifiedIndex, kvp.Key, kvp.Value))
+		return nil
+	})
+	require.NoError(t, err, "Unexpected error in ReplayHistory")
+	assert.Equal(t, expected, replayed, "Replay should reproduce the history")
+
+	replayed = replayed[:0]
+	err = kv.ReplayHistory(3, func(kvp *kvdb.KVPair) error {
+		if kvp.Action == kvdb.KVDelete {
+			return kvdb.ErrWatchStopped
+		}
+		replayed = append(replayed,
+			fmt.Sprintf("%d %v %s", kvp.ModifiedIndex, kvp.Key, kvp.Value))
+		return nil
+	})
+	require.NoError(t, err, "Stopping early should not be an error")
+	assert.Equal(t, expected[2:3], replayed, "Replay should stop at the delete")
+}
+
+func TestLockDoesNotWakeWatches(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	treeCb, treeUpdates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree("locktree", 0, nil, treeCb),
+		"Unexpected error in WatchTree")
+	rootCb, rootUpdates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree("", 0, nil, rootCb),
+		"Unexpected error in WatchTree")
+
+	lock, err := kv.Lock("locktree/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+	require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	_, err = kv.Put("locktree/key", []byte("value"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	for _, updates := range []chan *kvdb.KVPair{treeUpdates, rootUpdates} {
+		kvp := receiveUpdate(t, updates)
+		assert.Equal(t, "locktree/key", kvp.Key, "Lock should not deliver watch updates")
+	}
+}
+
+func TestLockWithPriority(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "priority/lock"
+	lock, err := kv.Lock(key)
+	require.NoError(t, err, "Unexpected error in Lock")
+
+	var mu sync.Mutex
+	order := make([]string, 0)
+	var wg sync.WaitGroup
+	wait := func(lockerID string, priority int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waiterLock, err := kv.LockWithPriority(key, lockerID, priority)
+			assert.NoError(t, err, "Unexpected error in LockWithPriority")
+			mu.Lock()
+			order = append(order, lockerID)
+			mu.Unlock()
+			assert.NoError(t, kv.Unlock(waiterLock), "Unexpected error in Unlock")
+		}()
+	}
+	waitFor := func(waiters int) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			stat, err := kv.LockStats(key)
+			require.NoError(t, err, "Unexpected error in LockStats")
+			if stat.Waiters == waiters {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for %d waiters", waiters)
+	}
+
+	wait("low1", 0)
+	waitFor(1)
+	wait("low2", 0)
+	waitFor(2)
+	wait("high", 10)
+	waitFor(3)
+
+	require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	wg.Wait()
+	assert.Equal(t, []string{"high", "low1", "low2"}, order,
+		"Unexpected lock acquisition order")
+}
+
+func TestRefreshLock(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "refresh/lock"
+	lock, err := kv.LockWithTimeout(key, "holder", 0, 1)
+	require.NoError(t, err, "Unexpected error in LockWithTimeout")
+	requireHeld := func(msg string) {
+		_, err := kv.LockWithTimeout(key, "waiter", 10*time.Millisecond, 1)
+		require.Equal(t, kvdb.ErrLockTimeout, err, msg)
+	}
+
+	// Refresh well past the original expiry.
+	for i := 0; i < 5; i++ {
+		time.Sleep(500 * time.Millisecond)
+		lock, err = kv.RefreshLock(lock, 0)
+		require.NoError(t, err, "Unexpected error in RefreshLock")
+		assert.Equal(t, int64(1), lock.TTL, "Refresh should keep the TTL")
+	}
+	requireHeld("Refreshed lock should still be held")
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = kv.RefreshLock(lock, 0)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expired lock should not refresh")
+	other, err := kv.LockWithTimeout(key, "other", time.Second, 0)
+	require.NoError(t, err, "Expired lock should be acquired")
+
+	_, err = kv.RefreshLock(lock, 1)
+	assert.Equal(t, kvdb.ErrNotFound, err,
+		"A lock acquired by someone else should not refresh")
+	require.NoError(t, kv.Unlock(other), "Unexpected error in Unlock")
+	_, err = kv.RefreshLock(other, 1)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Released lock should not refresh")
+}
+
+func TestLockWithTimeout(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "timeout/lock"
+	lock, err := kv.LockWithID(key, "holder")
+	require.NoError(t, err, "Unexpected error in LockWithID")
+
+	// The holder keeps the lock past the timeout.
+	start := time.Now()
+	_, err = kv.LockWithTimeout(key, "waiter", 300*time.Millisecond, 0)
+	assert.Equal(t, kvdb.ErrLockTimeout, err, "Expected lock timeout")
+	assert.True(t, time.Since(start) < time.Second,
+		"Lock timeout took %v", time.Since(start))
+	stat, err := kv.LockStats(key)
+	require.NoError(t, err, "Unexpected error in LockStats")
+	assert.Equal(t, 0, stat.Waiters, "Timed out waiter should be removed")
+
+	// The holder releases the lock before the timeout.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		assert.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	}()
+	waiterLock, err := kv.LockWithTimeout(key, "waiter", 5*time.Second, 0)
+	require.NoError(t, err, "Lock should be acquired in time")
+	assert.Equal(t, "waiter", string(waiterLock.Value), "Unexpected locker")
+	require.NoError(t, kv.Unlock(waiterLock), "Unexpected error in Unlock")
+
+	_, err = kv.LockWithTimeout(key, "waiter", -time.Second, 0)
+	assert.Equal(t, kvdb.ErrIllegal, err,
+		"Expected negative timeout to be refused")
+}
+
+func TestLockTimeoutOption(t *testing.T) {
+	_, err := New("pwx/test", nil, map[string]string{LockTimeoutKey: "-1s"}, nil)
+	assert.Error(t, err, "Expected negative lock timeout to be refused")
+
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	assert.Equal(t, defaultLockTimeout, kv.(*memKV).lockTimeout,
+		"Lock should time out by default")
+	kv, err = New("pwx/test", nil, map[string]string{LockTimeoutKey: "0s"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	assert.Equal(t, time.Duration(0), kv.(*memKV).lockTimeout,
+		"Zero lock timeout should wait without limit")
+
+	kv, err = New("pwx/test", nil,
+		map[string]string{LockTimeoutKey: "200ms"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	lock, err := kv.Lock("option/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+	_, err = kv.Lock("option/lock")
+	assert.Equal(t, kvdb.ErrLockTimeout, err, "Expected lock timeout")
+	require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+}
+
+func TestValueValidator(t *testing.T) {
+	require.NoError(t, kvdb.RegisterValueValidator("mem-test-json",
+		func(key string, value []byte) error {
+			if !json.Valid(value) {
+				return fmt.Errorf("%v is not a JSON document", key)
+			}
+			return nil
+		}), "Unexpected error in RegisterValueValidator")
+
+	_, err := New("pwx/test", nil,
+		map[string]string{kvdb.ValueValidatorKey: "mem-test-missing"}, nil)
+	assert.Error(t, err, "Expected unknown validator to be refused")
+
+	kv, err := New("pwx/test", nil,
+		map[string]string{kvdb.ValueValidatorKey: "mem-test-json"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "validate/doc"
+	_, err = kv.Put(key, []byte(`{"a": 1}`), 0)
+	require.NoError(t, err, "Unexpected error in Put of a valid value")
+
+	_, err = kv.Put(key, []byte("{"), 0)
+	assert.True(t, errors.Is(err, kvdb.ErrValidation),
+		"Expected ErrValidation from Put, got %v", err)
+	_, err = kv.Update(key, []byte("not json"), 0)
+	assert.True(t, errors.Is(err, kvdb.ErrValidation),
+		"Expected ErrValidation from Update, got %v", err)
+	_, err = kv.Create("validate/other", []byte("{"), 0)
+	assert.True(t, errors.Is(err, kvdb.ErrValidation),
+		"Expected ErrValidation from Create, got %v", err)
+
+	kvp, err := kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, `{"a": 1}`, string(kvp.Value), "Refused writes changed the value")
+	_, err = kv.Get("validate/other")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Refused Create stored the key")
+
+	// Writes other than Put, Create and Update are checked as well.
+	tx, err := kv.TxNew()
+	require.NoError(t, err, "Unexpected error in TxNew")
+	_, err = tx.Put(key, []byte("{"), 0)
+	assert.True(t, errors.Is(err, kvdb.ErrValidation),
+		"Expected ErrValidation from a transaction Put, got %v", err)
+	require.NoError(t, tx.Commit(), "Unexpected error in Commit")
+
+	_, _, err = kv.ReplaceTree("validate/", map[string]interface{}{
+		"doc":   []byte(`{"a": 2}`),
+		"other": []byte("{"),
+	}, 0)
+	assert.True(t, errors.Is(err, kvdb.ErrValidation),
+		"Expected ErrValidation from ReplaceTree, got %v", err)
+	_, err = kv.CompareAndSet(&kvdb.KVPair{Key: key, Value: []byte("{")},
+		kvdb.KVFlags(0), nil)
+	assert.True(t, errors.Is(err, kvdb.ErrValidation),
+		"Expected ErrValidation from CompareAndSet, got %v", err)
+
+	kvp, err = kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, `{"a": 1}`, string(kvp.Value), "Refused writes changed the value")
+	_, err = kv.Get("validate/other")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Refused ReplaceTree stored the key")
+}
+
+func TestHotKeys(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	_, err = kv.(kvdb.HotKeyTracker).HotKeys(1)
+	assert.Equal(t, kvdb.ErrNotSupported, err, "Hot keys should be off by default")
+
+	kv, err = New("pwx/test", nil,
+		map[string]string{HotKeysWindowKey: "1m"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	clock := &fakeClock{now: time.Now()}
+	kv.(*memKV).clock = clock
+
+	accesses := map[string]struct{ reads, writes int }{
+		"hot/a": {reads: 30, writes: 5},
+		"hot/b": {reads: 0, writes: 20},
+		"hot/c": {reads: 8, writes: 2},
+		"hot/d": {reads: 0, writes: 1},
+	}
+	var wg sync.WaitGroup
+	for key, count := range accesses {
+		wg.Add(1)
+		go func(key string, reads, writes int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				_, err := kv.Put(key, []byte(strconv.Itoa(i)), 0)
+				assert.NoError(t, err, "Unexpected error in Put")
+			}
+			for i := 0; i < reads; i++ {
+				_, err := kv.Get(key)
+				assert.NoError(t, err, "Unexpected error in Get")
+			}
+		}(key, count.reads, count.writes)
+	}
+	wg.Wait()
+
+	stats, err := kv.(kvdb.HotKeyTracker).HotKeys(3)
+	require.NoError(t, err, "Unexpected error in HotKeys")
+	assert.Equal(t, []kvdb.KeyStat{
+		{Key: "hot/a", Reads: 30, Writes: 5},
+		{Key: "hot/b", Reads: 0, Writes: 20},
+		{Key: "hot/c", Reads: 8, Writes: 2},
+	}, stats, "Unexpected hot keys")
+
+	// Accesses from an elapsed window are no longer reported.
+	clock.Advance(time.Minute)
+	_, err = kv.Get("hot/d")
+	require.NoError(t, err, "Unexpected error in Get")
+	stats, err = kv.(kvdb.HotKeyTracker).HotKeys(3)
+	require.NoError(t, err, "Unexpected error in HotKeys")
+	assert.Equal(t, []kvdb.KeyStat{{Key: "hot/d", Reads: 1}}, stats,
+		"Unexpected hot keys in new window")
+}
+
+func TestRates(t *testing.T) {
+	_, err := New("pwx/test", nil, map[string]string{RateWindowKey: "0s"}, nil)
+	assert.Error(t, err, "Expected error for invalid rate window")
+
+	kv, err := New("pwx/test", nil, map[string]string{RateWindowKey: "10s"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	clock := &fakeClock{now: time.Now()}
+	kv.(*memKV).clock = clock
+
+	// 5 reads and 2 writes a second for twice the window.
+	for s := 0; s < 20; s++ {
+		for i := 0; i < 2; i++ {
+			_, err := kv.Put("rates/key", []byte("v"), 0)
+			require.NoError(t, err, "Unexpected error in Put")
+		}
+		for i := 0; i < 5; i++ {
+			_, err := kv.Get("rates/key")
+			require.NoError(t, err, "Unexpected error in Get")
+		}
+		clock.Advance(time.Second)
+	}
+	reads, writes := kv.Rates()
+	assert.InDelta(t, 5, reads, 0.6, "Unexpected read rate")
+	assert.InDelta(t, 2, writes, 0.3, "Unexpected write rate")
+
+	clock.Advance(time.Minute)
+	reads, writes = kv.Rates()
+	assert.Equal(t, float64(0), reads, "Reads should leave the window")
+	assert.Equal(t, float64(0), writes, "Writes should leave the window")
+}
+func TestPutWithFallback(t *testing.T) {
+	kv, clock := newWithClock(t)
+
+	key := "workflow/fires"
+	kvp, err := kv.PutWithFallback(key, []byte("running"), []byte("timed_out"),
+		time.Minute)
+	require.NoError(t, err, "Unexpected error in PutWithFallback")
+	assert.Equal(t, "running", string(kvp.Value), "Unexpected value")
+
+	clock.Advance(time.Minute - time.Second)
+	kvp, err = kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "running", string(kvp.Value), "Fallback was written early")
+	clock.Advance(time.Second)
+	kvp, err = kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "timed_out", string(kvp.Value), "Fallback was not written")
+	assert.Empty(t, kv.fallbacks, "Fired fallback should not be tracked")
+
+	// A write or a delete stops the fallback.
+	for _, stop := range []func(key string) error{
+		func(key string) error {
+			_, err := kv.Put(key, []byte("done"), 0)
+			return err
+		},
+		func(key string) error {
+			_, err := kv.Delete(key)
+			return err
+		},
+	} {
+		key = "workflow/cancelled"
+		_, err = kv.PutWithFallback(key, []byte("running"),
+			[]byte("timed_out"), time.Minute)
+		require.NoError(t, err, "Unexpected error in PutWithFallback")
+		require.NoError(t, stop(key), "Unexpected error stopping fallback")
+		assert.Empty(t, kv.fallbacks, "Stopped fallback should not be tracked")
+		assert.Empty(t, clock.timers, "Fallback timer should be stopped")
+
+		clock.Advance(time.Hour)
+		kvp, err = kv.Get(key)
+		if err == kvdb.ErrNotFound {
+			continue
+		}
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, "done", string(kvp.Value),
+			"Fallback should not overwrite an intervening write")
+	}
+
+	// A new fallback replaces the armed one.
+	key = "workflow/replaced"
+	_, err = kv.PutWithFallback(key, []byte("running"), []byte("first"),
+		time.Minute)
+	require.NoError(t, err, "Unexpected error in PutWithFallback")
+	_, err = kv.PutWithFallback(key, []byte("running"), []byte("second"),
+		2*time.Minute)
+	require.NoError(t, err, "Unexpected error in PutWithFallback")
+	clock.Advance(time.Minute)
+	kvp, err = kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "running", string(kvp.Value), "Replaced fallback fired")
+	clock.Advance(time.Minute)
+	kvp, err = kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "second", string(kvp.Value), "Fallback was not written")
+}
+
+func TestWatchInitialValue(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "initial/present"
+	_, err = kv.Put(key, []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchKeyOpts(key,
+		kvdb.WatchOptions{InitialValue: true}, cb),
+		"Unexpected error in WatchKeyOpts")
+	kvp := receiveUpdate(t, updates)
+	assert.Equal(t, kvdb.KVGet, kvp.Action, "Expected the initial value")
+	assert.Equal(t, "1", string(kvp.Value), "Unexpected initial value")
+	_, err = kv.Put(key, []byte("2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp = receiveUpdate(t, updates)
+	assert.Equal(t, kvdb.KVSet, kvp.Action, "Expected an update")
+	assert.Equal(t, "2", string(kvp.Value), "Unexpected updated value")
+
+	// An absent key delivers nothing until it is created.
+	key = "initial/absent"
+	cb, updates, _ = watchEvents(t, nil)
+	require.NoError(t, kv.WatchKeyOpts(key,
+		kvdb.WatchOptions{InitialValue: true}, cb),
+		"Unexpected error in WatchKeyOpts")
+	_, err = kv.Create(key, []byte("created"), 0)
+	require.NoError(t, err, "Unexpected error in Create")
+	kvp = receiveUpdate(t, updates)
+	assert.Equal(t, kvdb.KVCreate, kvp.Action, "Expected the create")
+}
+
+func TestWatchInitialNotFound(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "initial/missing"
+	events := make(chan error, 10)
+	err = kv.WatchKeyOpts(key,
+		kvdb.WatchOptions{InitialValue: true, InitialNotFound: true},
+		func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+			if err == nil {
+				assert.Equal(t, "created", string(kvp.Value), "Unexpected value")
+			} else {
+				assert.Nil(t, kvp, "No pair expected with an error")
+			}
+			events <- err
+			return nil
+		})
+	require.NoError(t, err, "Unexpected error in WatchKeyOpts")
+
+	select {
+	case err := <-events:
+		assert.Equal(t, kvdb.ErrNotFound, err, "Expected ErrNotFound first")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the initial callback")
+	}
+	_, err = kv.Put(key, []byte("created"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	select {
+	case err := <-events:
+		assert.NoError(t, err, "Expected the created value")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for watch update")
+	}
+}
+
+func TestHasWatchers(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	has, err := kv.HasWatchers("listened/key")
+	require.NoError(t, err, "Unexpected error in HasWatchers")
+	assert.False(t, has, "No watchers expected before a watch")
+
+	stop := make(chan struct{})
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+		select {
+		case <-stop:
+			return kvdb.ErrWatchStopped
+		default:
+		}
+		return err
+	}
+	require.NoError(t, kv.WatchTree("listened", 0, nil, cb),
+		"Unexpected error in WatchTree")
+	require.NoError(t, kv.WatchKey("single/key", 0, nil, cb),
+		"Unexpected error in WatchKey")
+
+	for key, expected := range map[string]bool{
+		"listened/key":     true,
+		"listened/a/b":     true,
+		"single/key":       true,
+		"single/key/child": false,
+		"other/key":        false,
+	} {
+		has, err := kv.HasWatchers(key)
+		require.NoError(t, err, "Unexpected error in HasWatchers")
+		assert.Equal(t, expected, has, "Unexpected watchers for %v", key)
+	}
+
+	// Stopped watches no longer count.
+	close(stop)
+	_, err = kv.Put("listened/key", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	require.Eventually(t, func() bool {
+		has, err := kv.HasWatchers("listened/key")
+		return err == nil && !has
+	}, 5*time.Second, 10*time.Millisecond, "Stopped watch still reported")
+}
+
+func TestWatchFrom(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "watchfrom/key"
+	_, err = kv.Put(key, []byte("0"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	kvp, updates, cancel, err := kv.WatchFrom(key)
+	require.NoError(t, err, "Unexpected error in WatchFrom")
+	require.NotNil(t, kvp, "Expected the current pair")
+	assert.Equal(t, "0", string(kvp.Value), "Unexpected current value")
+
+	// Writes right after the call arrive in order with no gap.
+	count := 5
+	for i := 1; i <= count; i++ {
+		_, err = kv.Put(key, []byte(strconv.Itoa(i)), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	for i := 1; i <= count; i++ {
+		select {
+		case update := <-updates:
+			assert.Equal(t, strconv.Itoa(i), string(update.Value),
+				"Unexpected update")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for update %d", i)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-updates:
+		assert.False(t, ok, "Channel should be closed after cancel")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the channel to close")
+	}
+
+	kvp, _, cancel, err = kv.WatchFrom("watchfrom/missing")
+	require.NoError(t, err, "Unexpected error in WatchFrom")
+	assert.Nil(t, kvp, "No pair expected for a missing key")
+	cancel()
+}
+
+func TestDefaultTTL(t *testing.T) {
+	_, err := New("pwx/test", nil, map[string]string{kvdb.DefaultTTLKey: "-1"}, nil)
+	assert.Error(t, err, "Expected an invalid default TTL to be refused")
+
+	kv, err := New("pwx/test", nil, map[string]string{kvdb.DefaultTTLKey: "1"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	kvp, err := kv.Put("cache/put", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, int64(1), kvp.TTL, "Put with ttl 0 should apply the default")
+	kvp, err = kv.Create("cache/create", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Create")
+	assert.Equal(t, int64(1), kvp.TTL, "Create with ttl 0 should apply the default")
+	kvp, err = kv.Put("cache/explicit", []byte("v"), 10)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, int64(10), kvp.TTL, "An explicit ttl should override the default")
+	kvp, err = kv.Put("cache/forever", []byte("v"), kvdb.NoTTL)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, int64(0), kvp.TTL, "NoTTL should store the key without TTL")
+	assert.True(t, kvp.ExpiresAt.IsZero(), "NoTTL should store the key without expiry")
+
+	tx, err := kv.TxNew()
+	require.NoError(t, err, "Unexpected error in TxNew")
+	_, err = tx.Put("cache/tx", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in transaction Put")
+	require.NoError(t, tx.Commit(), "Unexpected error in Commit")
+	_, _, err = kv.ReplaceTree("cache/tree/",
+		map[string]interface{}{"key": []byte("v")}, 0)
+	require.NoError(t, err, "Unexpected error in ReplaceTree")
+	for _, key := range []string{"cache/tx", "cache/tree/key"} {
+		kvp, err = kv.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, int64(1), kvp.TTL, "%v should take the default TTL", key)
+	}
+
+	time.Sleep(2 * time.Second)
+	for _, key := range []string{"cache/put", "cache/create", "cache/tx", "cache/tree/key"} {
+		_, err = kv.Get(key)
+		assert.Equal(t, kvdb.ErrNotFound, err, "%v should expire at the default TTL", key)
+	}
+	for _, key := range []string{"cache/explicit", "cache/forever"} {
+		_, err = kv.Get(key)
+		assert.NoError(t, err, "%v should not have expired", key)
+	}
+}
+
+func TestDefaultTTLCounters(t *testing.T) {
+	kv, err := New("pwx/test", nil, map[string]string{kvdb.DefaultTTLKey: "60"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+	clock := &fakeClock{now: time.Now()}
+	mem.clock = clock
+
+	_, err = mem.AtomicIncrement("counters/new", 1)
+	require.NoError(t, err, "Unexpected error in AtomicIncrement")
+	_, err = mem.AtomicAddBatch(map[string]int64{"counters/batch": 2})
+	require.NoError(t, err, "Unexpected error in AtomicAddBatch")
+	_, err = mem.AllowN("counters/bucket", 1, 10, 1)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	_, err = kv.Put("counters/existing", "5", 10)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	// Updates keep the TTL the counters were created with.
+	clock.Advance(30 * time.Second)
+	_, err = mem.AtomicIncrement("counters/new", 1)
+	require.NoError(t, err, "Unexpected error in AtomicIncrement")
+	_, err = mem.AllowN("counters/bucket", 1, 10, 1)
+	require.NoError(t, err, "Unexpected error in AllowN")
+	for _, key := range []string{"counters/new", "counters/batch", "counters/bucket"} {
+		kvp, err := kv.Get(key)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, int64(30), kvp.TTL, "%v should take the default TTL", key)
+	}
+	_, err = kv.Get("counters/existing")
+	assert.Equal(t, kvdb.ErrNotFound, err, "counters/existing should keep its TTL")
+
+	clock.Advance(30 * time.Second)
+	for _, key := range []string{"counters/new", "counters/batch", "counters/bucket"} {
+		_, err = kv.Get(key)
+		assert.Equal(t, kvdb.ErrNotFound, err, "%v should expire at the default TTL", key)
+	}
+
+	// A default TTL of 0 applies no TTL.
+	kv, err = New("pwx/test", nil, map[string]string{kvdb.DefaultTTLKey: "0"}, nil)
+	require.NoError(t, err, "A default TTL of 0 should be accepted")
+	_, err = kv.AtomicIncrement("counters/forever", 1)
+	require.NoError(t, err, "Unexpected error in AtomicIncrement")
+	kvp, err := kv.Get("counters/forever")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, int64(0), kvp.TTL, "Counter should have no TTL")
+	assert.True(t, kvp.ExpiresAt.IsZero(), "Counter should not expire")
+}
+
+func TestRename(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	created, err := kv.Put("rename/old", []byte("value"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("rename/old", []byte("value"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree("rename", 0, nil, cb),
+		"Unexpected error in WatchTree")
+	// Skip the history replayed to the new watch.
+	receiveUpdate(t, updates)
+	receiveUpdate(t, updates)
+
+	kvp, err := kv.Rename("rename/old", "rename/new")
+	require.NoError(t, err, "Unexpected error in Rename")
+	assert.Equal(t, "rename/new", kvp.Key, "Unexpected key")
+	assert.Equal(t, "value", string(kvp.Value), "Unexpected value")
+	assert.Equal(t, created.CreatedIndex, kvp.CreatedIndex,
+		"Rename should preserve the CreatedIndex")
+
+	_, err = kv.Get("rename/old")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Old key should be gone")
+	stored, err := kv.Get("rename/new")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, kvp, stored, "Unexpected stored pair")
+
+	update := receiveUpdate(t, updates)
+	assert.Equal(t, "rename/old", update.Key, "Expected the delete of the old key")
+	assert.Equal(t, kvdb.KVDelete, update.Action, "Expected a delete")
+	update = receiveUpdate(t, updates)
+	assert.Equal(t, "rename/new", update.Key, "Expected the create of the new key")
+	assert.Equal(t, kvdb.KVCreate, update.Action, "Expected a create")
+}
+
+func TestRenameErrors(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Rename("rename/missing", "rename/new")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expected missing old key")
+
+	_, err = kv.Put("rename/old", []byte("old"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("rename/taken", []byte("taken"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Rename("rename/old", "rename/taken")
+	assert.Equal(t, kvdb.ErrExist, err, "Expected existing new key")
+
+	for key, value := range map[string]string{
+		"rename/old":   "old",
+		"rename/taken": "taken",
+	} {
+		kvp, err := kv.Get(key)
+		require.NoError(t, err, "Failed rename should keep %v", key)
+		assert.Equal(t, value, string(kvp.Value), "Unexpected value")
+	}
+}
+
+func TestRunPendingExpirations(t *testing.T) {
+	kv, clock := newWithClock(t)
+
+	for key, ttl := range map[string]uint64{
+		"expire/10": 10,
+		"expire/20": 20,
+		"expire/30": 30,
+		"expire/no": 0,
+	} {
+		_, err := kv.Put(key, []byte("v"), ttl)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	assert.Equal(t, 0, kv.RunPendingExpirations(), "Nothing should be due yet")
+
+	clock.Skip(25 * time.Second)
+	assert.Equal(t, 2, kv.RunPendingExpirations(), "Unexpected expirations")
+	for _, key := range []string{"expire/10", "expire/20"} {
+		_, err := kv.Get(key)
+		assert.Equal(t, kvdb.ErrNotFound, err, "%v should have expired", key)
+	}
+	for _, key := range []string{"expire/30", "expire/no"} {
+		_, err := kv.Get(key)
+		assert.NoError(t, err, "%v should not have expired", key)
+	}
+	assert.Equal(t, 0, kv.RunPendingExpirations(), "Expired keys are collected once")
+}
+
+func TestGetMultiConsistent(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	keys := []string{"multi/a", "multi/b", "multi/c"}
+	for _, key := range keys {
+		_, err = kv.Put(key, []byte("initial"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_, err := kv.Put(key, []byte(strconv.Itoa(i)), 0)
+				assert.NoError(t, err, "Unexpected error in Put")
+			}
+		}(key)
+	}
+
+	for i := 0; i < 100; i++ {
+		kvps, index, err := kv.GetMultiConsistent(append(keys, "multi/missing"))
+		require.NoError(t, err, "Unexpected error in GetMultiConsistent")
+		assert.True(t, len(kvps) <= len(keys), "Missing keys should be skipped")
+		for _, kvp := range kvps {
+			assert.True(t, kvp.ModifiedIndex <= index,
+				"%v modified at %v after read index %v", kvp.Key,
+				kvp.ModifiedIndex, index)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	kvps, index, err := kv.GetMultiConsistent(keys)
+	require.NoError(t, err, "Unexpected error in GetMultiConsistent")
+	assert.Len(t, kvps, len(keys), "Expected every key")
+	highest := uint64(0)
+	for _, kvp := range kvps {
+		if kvp.ModifiedIndex > highest {
+			highest = kvp.ModifiedIndex
+		}
+	}
+	assert.Equal(t, highest, index, "Read index should be the latest write")
+}
+
+// base64Codec stores values as base64 encoded JSON.
+type base64Codec struct{}
+
+func (base64Codec) Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+func (base64Codec) Unmarshal(data []byte, v interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+type recodeValue struct {
+	Name  string
+	Count int
+}
+
+func TestRecode(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	values := map[string]recodeValue{
+		"recode/a": {Name: "a", Count: 1},
+		"recode/b": {Name: "b", Count: 2},
+	}
+	for key, value := range values {
+		_, err = kv.Put(key, &value, 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	before, err := kv.Get("recode/a")
+	require.NoError(t, err, "Unexpected error in Get")
+
+	count, err := kv.Recode(base64Codec{})
+	require.NoError(t, err, "Unexpected error in Recode")
+	assert.Equal(t, len(values), count, "Unexpected number of recoded values")
+
+	kvp, err := kv.Get("recode/a")
+	require.NoError(t, err, "Unexpected error in Get")
+	var raw recodeValue
+	require.NoError(t, base64Codec{}.Unmarshal(kvp.Value, &raw),
+		"Value was not recoded")
+	assert.Equal(t, values["recode/a"], raw, "Unexpected recoded value")
+	assert.Equal(t, before.ModifiedIndex, kvp.ModifiedIndex,
+		"Recode should keep the indices")
+
+	for key, value := range values {
+		var got recodeValue
+		_, err = kv.GetVal(key, &got)
+		require.NoError(t, err, "Unexpected error in GetVal")
+		assert.Equal(t, value, got, "Unexpected value for %v", key)
+	}
+
+	// New writes use the new codec.
+	_, err = kv.Put("recode/c", &recodeValue{Name: "c", Count: 3}, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	var got recodeValue
+	_, err = kv.GetVal("recode/c", &got)
+	require.NoError(t, err, "Unexpected error in GetVal")
+	assert.Equal(t, recodeValue{Name: "c", Count: 3}, got, "Unexpected value")
+}
+
+func TestRecodeAbort(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("recode/json", &recodeValue{Name: "json"}, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("recode/raw", []byte("not json"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	_, err = kv.Recode(base64Codec{})
+	assert.Error(t, err, "Expected a value that fails to decode to abort")
+
+	var got recodeValue
+	_, err = kv.GetVal("recode/json", &got)
+	require.NoError(t, err, "Codec should be unchanged after an abort")
+	assert.Equal(t, recodeValue{Name: "json"}, got, "Value should be unchanged")
+	kvp, err := kv.Get("recode/raw")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "not json", string(kvp.Value), "Value should be unchanged")
+}
+
+// gobCodec stores values in the gob encoding.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func TestCodecOption(t *testing.T) {
+	require.NoError(t, kvdb.RegisterCodec("mem-test-gob", gobCodec{}),
+		"Unexpected error in RegisterCodec")
+	_, err := New("pwx/test", nil,
+		map[string]string{kvdb.CodecKey: "mem-test-missing"}, nil)
+	assert.Error(t, err, "Expected unknown codec to be refused")
+
+	kv, err := New("pwx/test", nil,
+		map[string]string{kvdb.CodecKey: "mem-test-gob"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	value := recodeValue{Name: "gob", Count: 3}
+	kvp, err := kv.Put("codec/struct", &value, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	var raw recodeValue
+	require.NoError(t, gobCodec{}.Unmarshal(kvp.Value, &raw),
+		"Value should be gob encoded")
+	var got recodeValue
+	_, err = kv.GetVal("codec/struct", &got)
+	require.NoError(t, err, "Unexpected error in GetVal")
+	assert.Equal(t, value, got, "Value should round-trip")
+
+	// Strings and byte slices are stored as is.
+	kvp, err = kv.Put("codec/string", "plain", 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, "plain", string(kvp.Value), "String should not be encoded")
+	kvp, err = kv.Put("codec/bytes", []byte("raw"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, "raw", string(kvp.Value), "Bytes should not be encoded")
+}
+
+// putNotified puts value at key and returns the opaques of the watches the
+// put is delivered to.
+func putNotified(
+	t *testing.T,
+	kv *memKV,
+	key string,
+	value interface{},
+) (*kvdb.KVPair, []interface{}) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kvp, err := kv.put(key, value, 0, false)
+	require.NoError(t, err, "Unexpected error in put")
+
+	update := &watchUpdate{key: kv.domain + key, kvp: *kvp}
+	notified := make([]interface{}, 0)
+	for _, watches := range kv.watches {
+		for _, v := range watches {
+			if v.matches(update) {
+				notified = append(notified, v.opaque)
+			}
+		}
+	}
+	return kvp, notified
+}
+
+func TestWatchersNotified(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+		return err
+	}
+	for opaque, prefix := range map[string]string{
+		"tree":  "notify",
+		"sub":   "notify/sub",
+		"other": "other",
+	} {
+		require.NoError(t, kv.WatchTree(prefix, 0, opaque, cb),
+			"Unexpected error in WatchTree")
+	}
+	require.NoError(t, kv.WatchKey("notify/sub/key", 0, "key", cb),
+		"Unexpected error in WatchKey")
+	require.NoError(t, kv.WatchTreeOpts("notify", kvdb.WatchOptions{
+		Opaque: "filtered",
+		Filter: func(kvp *kvdb.KVPair) bool { return false },
+	}, cb), "Unexpected error in WatchTreeOpts")
+
+	_, notified := putNotified(t, mem, "notify/sub/key", []byte("v"))
+	assert.ElementsMatch(t, []interface{}{"tree", "sub", "key"}, notified,
+		"Unexpected watchers notified")
+	_, notified = putNotified(t, mem, "notify/other", []byte("v"))
+	assert.ElementsMatch(t, []interface{}{"tree"}, notified,
+		"Unexpected watchers notified")
+	_, notified = putNotified(t, mem, "unwatched", []byte("v"))
+	assert.Empty(t, notified, "No watchers expected")
+}
+
+func TestGetConsistent(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	mem := kv.(*memKV)
+
+	_, err = kv.Put("consistent/key", []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	put, err := kv.Put("consistent/key", []byte("2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	for _, level := range []kvdb.Consistency{
+		kvdb.Linearizable,
+		kvdb.Serializable,
+		kvdb.Stale,
+	} {
+		kvp, err := kv.GetConsistent("consistent/key", level)
+		require.NoError(t, err, "Unexpected error in GetConsistent(%v)", level)
+		assert.Equal(t, "2", string(kvp.Value), "Unexpected value at %v", level)
+		assert.Equal(t, put.ModifiedIndex, kvp.ModifiedIndex,
+			"Unexpected index at %v", level)
+		_, err = kv.GetConsistent("consistent/missing", level)
+		assert.Equal(t, kvdb.ErrNotFound, err, "Expected ErrNotFound at %v", level)
+		assert.Equal(t, int64(2), atomic.LoadInt64(&mem.consistentReads[level]),
+			"Unexpected reads recorded at %v", level)
+	}
+
+	_, err = kv.GetConsistent("consistent/key", kvdb.Consistency(-1))
+	assert.Equal(t, kvdb.ErrIllegal, err, "Expected unknown level to be refused")
+}
+
+func TestAlias(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("config/v3", []byte("third"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	require.NoError(t, kv.CreateAlias("config/current", "config/v3"),
+		"Unexpected error in CreateAlias")
+	require.NoError(t, kv.CreateAlias("config/latest", "config/current"),
+		"Unexpected error in CreateAlias")
+	assert.Equal(t, kvdb.ErrExist, kv.CreateAlias("config/current", "config/v2"),
+		"Expected an existing alias to be refused")
+
+	for _, alias := range []string{"config/current", "config/latest"} {
+		kvp, err := kv.Get(alias)
+		require.NoError(t, err, "Unexpected error in Get")
+		assert.Equal(t, "config/v3", kvp.Key, "Alias should resolve to its target")
+		assert.Equal(t, "third", string(kvp.Value), "Unexpected resolved value")
+	}
+	raw, err := kv.GetRaw("config/latest")
+	require.NoError(t, err, "Unexpected error in GetRaw")
+	assert.Equal(t, "config/current", string(raw.Value),
+		"GetRaw should return the alias record")
+
+	// Overwriting an alias makes it a plain key.
+	_, err = kv.Put("config/latest", []byte("plain"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err := kv.Get("config/latest")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "plain", string(kvp.Value), "Unexpected value")
+}
+
+func TestAliasDangling(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("config/v3", []byte("third"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	require.NoError(t, kv.CreateAlias("config/current", "config/v3"),
+		"Unexpected error in CreateAlias")
+	_, err = kv.Delete("config/v3")
+	require.NoError(t, err, "Unexpected error in Delete")
+
+	_, err = kv.Get("config/current")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Dangling alias should not resolve")
+	_, err = kv.GetRaw("config/current")
+	assert.NoError(t, err, "Dangling alias record should remain")
+}
+
+func TestAliasCycle(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	require.NoError(t, kv.CreateAlias("cycle/a", "cycle/b"),
+		"Unexpected error in CreateAlias")
+	require.NoError(t, kv.CreateAlias("cycle/b", "cycle/a"),
+		"Unexpected error in CreateAlias")
+	_, err = kv.Get("cycle/a")
+	assert.Equal(t, kvdb.ErrAliasDepth, err, "Expected the cycle to be detected")
+	var v string
+	_, err = kv.GetVal("cycle/b", &v)
+	assert.Equal(t, kvdb.ErrAliasDepth, err, "Expected the cycle to be detected")
+}
+
+func TestChecksum(t *testing.T) {
+	kv, err := New("pwx/test", nil, map[string]string{ChecksumKey: "true"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("key", map[string]string{"a": "b"}, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put("other", []byte("intact"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Get("key")
+	require.NoError(t, err, "Unexpected error in Get")
+
+	// Mutate the stored value behind the kvdb's back.
+	mem := kv.(*memKV)
+	mem.mutex.Lock()
+	stored, _ := mem.m.get("pwx/test/key")
+	stored.Value[0] ^= 0xff
+	mem.mutex.Unlock()
+
+	_, err = kv.Get("key")
+	assert.True(t, errors.Is(err, kvdb.ErrCorrupt), "Expected ErrCorrupt, got %v", err)
+	var v map[string]string
+	_, err = kv.GetVal("key", &v)
+	assert.True(t, errors.Is(err, kvdb.ErrCorrupt), "Expected ErrCorrupt, got %v", err)
+	_, err = kv.Get("other")
+	assert.NoError(t, err, "Other keys should not be reported corrupt")
+
+	// Rewriting the key stores a fresh checksum.
+	_, err = kv.Put("key", []byte("fixed"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err := kv.Get("key")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "fixed", string(kvp.Value), "Unexpected value")
+
+	_, err = New("pwx/test", nil, map[string]string{ChecksumKey: "maybe"}, nil)
+	assert.Error(t, err, "Expected an invalid checksum option to be refused")
+}
+
+func TestPutMonotonic(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.PutMonotonic("version", 5, 0)
+	require.NoError(t, err, "Unexpected error creating key")
+	_, err = kv.PutMonotonic("version", 7, 0)
+	assert.NoError(t, err, "Expected an increasing value to be accepted")
+	_, err = kv.PutMonotonic("version", 7, 0)
+	assert.NoError(t, err, "Expected an equal value to be accepted")
+	_, err = kv.PutMonotonic("version", 6, 0)
+	assert.Equal(t, kvdb.ErrNonMonotonic, err, "Expected a decreasing value to be rejected")
+	var v int64
+	_, err = kv.GetVal("version", &v)
+	require.NoError(t, err, "Unexpected error in GetVal")
+	assert.Equal(t, int64(7), v, "Rejected value should not be stored")
+
+	_, err = kv.Put("name", []byte("not a number"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.PutMonotonic("name", 1, 0)
+	assert.Error(t, err, "Expected a non integer value to be refused")
+
+	// Writers racing with values in every order must leave the highest one,
+	// and a writer is only rejected if a higher value was stored before it.
+	const writers = 50
+	var wg sync.WaitGroup
+	var rejected int32
+	for i := 1; i <= writers; i++ {
+		wg.Add(1)
+		go func(value int64) {
+			defer wg.Done()
+			if _, err := kv.PutMonotonic("counter", value, 0); err != nil {
+				assert.Equal(t, kvdb.ErrNonMonotonic, err, "Unexpected error")
+				atomic.AddInt32(&rejected, 1)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	_, err = kv.GetVal("counter", &v)
+	require.NoError(t, err, "Unexpected error in GetVal")
+	assert.Equal(t, int64(writers), v, "Expected the highest value to win")
+	assert.True(t, rejected < writers, "Expected some writes to be accepted")
+}
+
+func TestEnumerateGrouped(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	for _, key := range []string{"tenants/a/x", "tenants/a/y", "tenants/b/y", "tenants/c", "other/d"} {
+		_, err = kv.Put(key, []byte(key), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	groups, err := kv.EnumerateGrouped("tenants")
+	require.NoError(t, err, "Unexpected error in EnumerateGrouped")
+	assert.Len(t, groups, 3, "Unexpected buckets %v", groups)
+	assert.Len(t, groups["a"], 2, "Unexpected bucket a")
+	assert.Len(t, groups["b"], 1, "Unexpected bucket b")
+	require.Len(t, groups["c"], 1, "Unexpected bucket c")
+	assert.Equal(t, "tenants/c", groups["c"][0].Key, "Unexpected key in bucket c")
+}
+
+func TestWatchCallbackPanic(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	stopped := make(chan error, 1)
+	panicking := func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+		if err != nil {
+			stopped <- err
+			return err
+		}
+		panic("callback bug")
+	}
+	updates := make(chan string, 10)
+	healthy := func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+		if err != nil {
+			return err
+		}
+		updates <- string(kvp.Value)
+		return nil
+	}
+	require.NoError(t, kv.WatchKey("key", 0, nil, panicking), "Unexpected error in WatchKey")
+	require.NoError(t, kv.WatchKey("key", 0, nil, healthy), "Unexpected error in WatchKey")
+
+	_, err = kv.Put("key", []byte("first"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	select {
+	case err := <-stopped:
+		assert.Equal(t, kvdb.ErrWatchStopped, err, "Expected the panicking watch to stop")
+	case <-time.After(time.Second):
+		t.Fatal("Panicking watch was not stopped")
+	}
+	mem := kv.(*memKV)
+	require.Eventually(t, func() bool {
+		mem.mutex.Lock()
+		defer mem.mutex.Unlock()
+		return len(mem.watches["pwx/test/key"]) == 1
+	}, time.Second, 10*time.Millisecond, "Expected the panicking watch to be removed")
+
+	_, err = kv.Put("key", []byte("second"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-updates:
+			assert.Equal(t, want, got, "Unexpected update")
+		case <-time.After(time.Second):
+			t.Fatalf("Healthy watch missed %q", want)
+		}
+	}
+	kvp, err := kv.Get("key")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "second", string(kvp.Value), "Unexpected value")
+}
+
+func TestPanicHookOption(t *testing.T) {
+	type recovered struct {
+		prefix string
+		value  interface{}
+	}
+	panics := make(chan recovered, 1)
+	require.NoError(t, kvdb.RegisterPanicHook("mem-test-hook",
+		func(prefix string, value interface{}) {
+			panics <- recovered{prefix: prefix, value: value}
+		}), "Unexpected error in RegisterPanicHook")
+	_, err := New("pwx/test", nil,
+		map[string]string{kvdb.PanicHookKey: "mem-test-missing"}, nil)
+	assert.Error(t, err, "Expected unknown panic hook to be refused")
+
+	kv, err := New("pwx/test", nil,
+		map[string]string{kvdb.PanicHookKey: "mem-test-hook"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	require.NoError(t, kv.WatchKey("hook/key", 0, nil,
+		func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+			if err != nil {
+				return err
+			}
+			panic("callback bug")
+		}), "Unexpected error in WatchKey")
+	_, err = kv.Put("hook/key", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	select {
+	case got := <-panics:
+		assert.Equal(t, "pwx/test/hook/key", got.prefix, "Unexpected prefix")
+		assert.Equal(t, "callback bug", got.value, "Unexpected recovered value")
+	case <-time.After(time.Second):
+		t.Fatal("Panic hook was not called")
+	}
+}
+
+func TestTryLockMany(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	held, err := kv.LockWithID("jobs/b", "other")
+	require.NoError(t, err, "Unexpected error in LockWithID")
+	_, err = kv.LockWithID("jobs/d", "other")
+	require.NoError(t, err, "Unexpected error in LockWithID")
+
+	acquired, skipped, err := kv.TryLockMany(
+		[]string{"jobs/a", "jobs/b", "jobs/c", "jobs/d"}, "batch", 0)
+	require.NoError(t, err, "Unexpected error in TryLockMany")
+	assert.Equal(t, []string{"jobs/b", "jobs/d"}, skipped, "Unexpected skipped keys")
+	require.Len(t, acquired, 2, "Unexpected acquired locks")
+	for _, lock := range acquired {
+		assert.Equal(t, "batch", string(lock.Value), "Unexpected lock owner")
+	}
+
+	// The acquired locks block other lockers until unlocked.
+	_, skipped, err = kv.TryLockMany([]string{"jobs/a", "jobs/c"}, "late", 0)
+	require.NoError(t, err, "Unexpected error in TryLockMany")
+	assert.Equal(t, []string{"jobs/a", "jobs/c"}, skipped, "Expected held locks to be skipped")
+
+	require.NoError(t, kv.Unlock(held), "Unexpected error in Unlock")
+	for _, lock := range acquired {
+		require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	}
+	acquired, skipped, err = kv.TryLockMany([]string{"jobs/a", "jobs/b", "jobs/c"}, "late", 0)
+	require.NoError(t, err, "Unexpected error in TryLockMany")
+	assert.Len(t, acquired, 3, "Expected released locks to be acquired")
+	assert.Empty(t, skipped, "Unexpected skipped keys")
+}
+
+func TestFullKey(t *testing.T) {
+	for _, domain := range []string{"pwx/test", "pwx/test/", ""} {
+		kv, err := New(domain, nil, nil, nil)
+		require.NoError(t, err, "Unexpected error in New")
+		mem := kv.(*memKV)
+		if domain != "" {
+			assert.Equal(t, "pwx/test/", kv.Domain(), "Unexpected domain")
+		} else {
+			assert.Equal(t, "", kv.Domain(), "Unexpected domain")
+		}
+
+		for _, key := range []string{"key", "dir/key"} {
+			_, err = kv.Put(key, []byte("value"), 0)
+			require.NoError(t, err, "Unexpected error in Put")
+			full := kv.FullKey(key)
+			mem.mutex.Lock()
+			_, ok := mem.m.get(full)
+			mem.mutex.Unlock()
+			assert.True(t, ok, "Expected %q to be stored at %q", key, full)
+
+			kvp := &kvdb.KVPair{Key: full}
+			mem.normalize(kvp)
+			assert.Equal(t, key, kvp.Key, "Normalizing the full key should give key")
+		}
+	}
+}
+
+func TestDeleteTreeWithResult(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.DeleteTreeWithResult("")
+	assert.Equal(t, kvdb.ErrRefusingRootDelete, err, "Empty prefix should be refused")
+
+	prefix := "deleted"
+	expected := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprintf("%s/%02d", prefix, i), fmt.Sprintf("v%d", i)
+		_, err = kv.Put(key, []byte(value), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+		expected[key] = value
+	}
+	_, err = kv.Put("deletedother", []byte("kept"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	cb, updates, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree(prefix+"/", 0, nil, cb),
+		"Unexpected error in WatchTree")
+
+	// Keep putting under the prefix while it is deleted.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err := kv.Put(fmt.Sprintf("%s/new/%d", prefix, i), []byte("new"), 0)
+			assert.NoError(t, err, "Unexpected error in Put")
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	kvps, err := kv.DeleteTreeWithResult(prefix + "/")
+	close(stop)
+	wg.Wait()
+	require.NoError(t, err, "Unexpected error in DeleteTreeWithResult")
+
+	found := make(map[string]string)
+	var lastDelete uint64
+	for i, kvp := range kvps {
+		if i > 0 {
+			assert.True(t, kvp.Key > kvps[i-1].Key, "Pairs should be in key order")
+		}
+		assert.Equal(t, kvdb.KVDelete, kvp.Action, "Unexpected action")
+		if !strings.HasPrefix(kvp.Key, prefix+"/new/") {
+			found[kvp.Key] = string(kvp.Value)
+		}
+		if kvp.ModifiedIndex > lastDelete {
+			lastDelete = kvp.ModifiedIndex
+		}
+	}
+	assert.Equal(t, expected, found, "Unexpected deleted pairs")
+
+	// Every key left under the prefix was put after the whole tree was
+	// deleted.
+	remaining, err := kv.Enumerate(prefix + "/")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	for _, kvp := range remaining {
+		assert.True(t, kvp.CreatedIndex > lastDelete,
+			"Key %v put at %v survived the delete at %v", kvp.Key,
+			kvp.CreatedIndex, lastDelete)
+	}
+	_, err = kv.Get("deletedother")
+	assert.NoError(t, err, "Keys outside the prefix should be kept")
+
+	deletes := 0
+	for deletes < len(kvps) {
+		if kvp := receiveUpdate(t, updates); kvp.Action == kvdb.KVDelete {
+			deletes++
+		}
+	}
+}
+
+func TestDeleteTreeIfVersion(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("build/version", []byte("v1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	for _, key := range []string{"cache/a", "cache/b/c"} {
+		_, err = kv.Put(key, []byte(key), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+
+	for _, version := range []string{"v2", ""} {
+		n, err := kv.DeleteTreeIfVersion("cache", "build/version", []byte(version))
+		assert.Equal(t, kvdb.ErrValueMismatch, err, "Expected a version mismatch")
+		assert.Equal(t, 0, n, "Nothing should be deleted on a mismatch")
+	}
+	_, err = kv.DeleteTreeIfVersion("cache", "build/missing", []byte("v1"))
+	assert.Equal(t, kvdb.ErrValueMismatch, err, "Expected a missing version key to mismatch")
+	kvps, err := kv.Enumerate("cache")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	assert.Len(t, kvps, 2, "Subtree should be intact after a mismatch")
+
+	n, err := kv.DeleteTreeIfVersion("cache", "build/version", []byte("v1"))
+	require.NoError(t, err, "Unexpected error in DeleteTreeIfVersion")
+	assert.Equal(t, 2, n, "Unexpected number of deleted keys")
+	kvps, err = kv.Enumerate("cache")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	assert.Empty(t, kvps, "Subtree should be deleted")
+	_, err = kv.Get("build/version")
+	assert.NoError(t, err, "Version key outside the subtree should be kept")
+}
+
+func TestLatestUnder(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.LatestUnder("writers")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expected ErrNotFound for an empty prefix")
+
+	for _, key := range []string{"writers/b", "writers/c", "writers/a", "others/d"} {
+		_, err = kv.Put(key, []byte(key), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	kvp, err := kv.LatestUnder("writers")
+	require.NoError(t, err, "Unexpected error in LatestUnder")
+	assert.Equal(t, "writers/a", kvp.Key, "Expected the last written key")
+
+	_, err = kv.Put("writers/c", []byte("again"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err = kv.LatestUnder("writers")
+	require.NoError(t, err, "Unexpected error in LatestUnder")
+	assert.Equal(t, "writers/c", kvp.Key, "Expected the last modified key")
+	assert.Equal(t, "again", string(kvp.Value), "Unexpected value")
+}
+
+func TestMemoryStats(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	prefix := "clusters/east/racks/r1/nodes/"
+	n := 100
+	for i := 0; i < n; i++ {
+		_, err = kv.Put(fmt.Sprintf("%s%03d", prefix, i), []byte("up"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	stats, err := kv.(kvdb.MemoryReporter).MemoryStats()
+	require.NoError(t, err, "Unexpected error in MemoryStats")
+	fullPrefix := len("pwx/test/") + len(prefix)
+	assert.Equal(t, n, stats.Keys, "Unexpected key count")
+	assert.Equal(t, n*(fullPrefix+3), stats.KeyBytes, "Unexpected key bytes")
+	assert.Equal(t, stats.KeyBytes, stats.StoredKeyBytes,
+		"Unexpected stored key bytes")
+	assert.Equal(t, n*len("up"), stats.ValueBytes, "Unexpected value bytes")
+}
+
+// metricSample matches a sample line of the Prometheus text format.
+var metricSample = regexp.MustCompile(
+	`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"\\]*"` +
+		`(,[a-zA-Z_][a-zA-Z0-9_]*="[^"\\]*")*\})? (\S+)$`)
+
+// parseMetrics checks that text is in the Prometheus text format and
+// returns the sample values by metric name and labels.
+func parseMetrics(t *testing.T, text string) map[string]float64 {
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			require.True(t, len(fields) >= 3 &&
+				(fields[1] == "HELP" || fields[1] == "TYPE"),
+				"Invalid comment line %q", line)
+			if fields[1] == "TYPE" {
+				require.Len(t, fields, 4, "Invalid TYPE line %q", line)
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+		m := metricSample.FindStringSubmatch(line)
+		require.NotNil(t, m, "Invalid sample line %q", line)
+		family := m[1]
+		for _, suffix := range []string{"_sum", "_count"} {
+			if base := strings.TrimSuffix(family, suffix); types[base] == "summary" {
+				family = base
+			}
+		}
+		require.Contains(t, types, family, "Sample %q precedes its TYPE", line)
+		value, err := strconv.ParseFloat(m[4], 64)
+		require.NoError(t, err, "Invalid value in %q", line)
+		samples[m[1]+m[2]] = value
+	}
+	return samples
+}
+
+func TestWriteMetrics(t *testing.T) {
+	kv, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	for i := 0; i < 3; i++ {
+		_, err = kv.Put(fmt.Sprintf("metrics/%d", i), []byte("v"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	_, err = kv.Get("metrics/0")
+	require.NoError(t, err, "Unexpected error in Get")
+	cb, _, _ := watchEvents(t, nil)
+	require.NoError(t, kv.WatchTree("metrics", 0, nil, cb),
+		"Unexpected error in WatchTree")
+
+	var b bytes.Buffer
+	require.NoError(t, kv.WriteMetrics(&b), "Unexpected error in WriteMetrics")
+	samples := parseMetrics(t, b.String())
+	for sample, expected := range map[string]float64{
+		`kvdb_operations_total{op="put"}`:                 3,
+		`kvdb_operations_total{op="get"}`:                 1,
+		`kvdb_operations_total{op="delete"}`:              0,
+		`kvdb_operation_duration_seconds_count{op="put"}`: 3,
+		"kvdb_keys":    3,
+		"kvdb_watches": 1,
+	} {
+		assert.Contains(t, samples, sample, "Missing sample")
+		assert.Equal(t, expected, samples[sample], "Unexpected %v", sample)
+	}
+	assert.Contains(t, samples, `kvdb_operation_duration_seconds_sum{op="put"}`,
+		"Missing sample")
+}
+
+func TestPersistPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvdb-mem")
+	require.NoError(t, err, "Unexpected error in TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kvdb.json")
+	options := map[string]string{PersistPathKey: path}
+
+	kv, err := New("pwx/test", nil, options, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	_, err = kv.Put("persist/key", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	ttlKvp, err := kv.Put("persist/ttl", []byte("t"), 3600)
+	require.NoError(t, err, "Unexpected error in Put")
+	lock, err := kv.Lock("persist/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+	require.NoError(t, kv.(kvdb.Flusher).Flush(), "Unexpected error in Flush")
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "Unexpected error in ReadFile")
+	assert.NotContains(t, string(b), "persist/lock",
+		"Locks should not be persisted")
+	require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	require.NoError(t, kv.(kvdb.Flusher).Flush(), "Unexpected error in Flush")
+
+	restarted, err := New("pwx/test", nil, options, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	kvp, err := restarted.Get("persist/key")
+	require.NoError(t, err, "Persisted key should be loaded")
+	assert.Equal(t, "v", string(kvp.Value), "Unexpected persisted value")
+	kvp, err = restarted.Get("persist/ttl")
+	require.NoError(t, err, "Unexpired key should be loaded")
+	assert.Equal(t, ttlKvp.TTL, kvp.TTL, "Remaining TTL should survive a restart")
+	put, err := restarted.Put("persist/key", []byte("v2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.True(t, put.ModifiedIndex > ttlKvp.ModifiedIndex,
+		"Index should continue from the persisted one")
+
+	// Changes are persisted without Flush once the batch is written.
+	require.Eventually(t, func() bool {
+		b, err := ioutil.ReadFile(path)
+		return err == nil && strings.Contains(string(b), base64.StdEncoding.
+			EncodeToString([]byte("v2")))
+	}, 5*time.Second, 10*time.Millisecond, "Change was not persisted")
+}
+
+func TestPersistPathClockSkew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvdb-mem")
+	require.NoError(t, err, "Unexpected error in TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kvdb.json")
+
+	// The file was persisted on a clock an hour behind, when the key had a
+	// minute left.
+	persistedAt := time.Now().Add(-time.Hour)
+	b, err := json.Marshal(&persistedState{
+		Index:       1,
+		PersistedAt: persistedAt,
+		Pairs: kvdb.KVPairs{
+			{Key: "skew", Value: []byte("x"), TTL: 60,
+				ExpiresAt: persistedAt.Add(time.Minute), ModifiedIndex: 1},
+		},
+	})
+	require.NoError(t, err, "Unexpected error in Marshal")
+	require.NoError(t, ioutil.WriteFile(path, b, 0600),
+		"Unexpected error in WriteFile")
+
+	kv, err := New("pwx/test", nil, map[string]string{PersistPathKey: path}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	kvp, err := kv.Get("skew")
+	require.NoError(t, err, "Key should keep its remaining TTL")
+	assert.Equal(t, int64(60), kvp.TTL, "Unexpected remaining TTL")
+
+	_, err = New("pwx/test", nil, map[string]string{
+		PersistPathKey:    path,
+		AbsoluteExpiryKey: "maybe",
+	}, nil)
+	assert.Error(t, err, "Expected an invalid AbsoluteExpiry to be refused")
+	kv, err = New("pwx/test", nil, map[string]string{
+		PersistPathKey:    path,
+		AbsoluteExpiryKey: "true",
+	}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	_, err = kv.Get("skew")
+	assert.Equal(t, kvdb.ErrNotFound, err,
+		"Key past its absolute expiry should be dropped")
+}
+
+func TestSyncWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvdb-mem")
+	require.NoError(t, err, "Unexpected error in TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kvdb.json")
+
+	_, err = New("pwx/test", nil,
+		map[string]string{PersistPathKey: path, SyncWritesKey: "always"}, nil)
+	assert.Error(t, err, "Expected an invalid sync_writes to be refused")
+
+	kv, err := New("pwx/test", nil,
+		map[string]string{PersistPathKey: path, SyncWritesKey: "true"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	assert.True(t, kv.(*memKV).syncWrites, "sync_writes should be set")
+
+	for _, value := range []string{"v1", "v2"} {
+		_, err = kv.Put("sync/key", []byte(value), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+		// The write is on disk as soon as Put returns.
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err, "Unexpected error in ReadFile")
+		var state persistedState
+		require.NoError(t, json.Unmarshal(b, &state), "Unexpected error in Unmarshal")
+		require.Len(t, state.Pairs, 1, "Unexpected persisted pairs")
+		assert.Equal(t, value, string(state.Pairs[0].Value),
+			"Put should be persisted before it returns")
+	}
+	_, err = kv.Delete("sync/key")
+	require.NoError(t, err, "Unexpected error in Delete")
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "Unexpected error in ReadFile")
+	assert.NotContains(t, string(b), "sync/key",
+		"Delete should be persisted before it returns")
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "Temporary file should be renamed")
+}
+
+func TestPersistPathExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvdb-mem")
+	require.NoError(t, err, "Unexpected error in TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kvdb.json")
+
+	b, err := json.Marshal(&persistedState{
+		Index: 2,
+		Pairs: kvdb.KVPairs{
+			{Key: "expired", Value: []byte("x"), TTL: 1,
+				ExpiresAt: time.Now().Add(-time.Minute), ModifiedIndex: 1},
+			{Key: "live", Value: []byte("y"), ModifiedIndex: 2},
+		},
+	})
+	require.NoError(t, err, "Unexpected error in Marshal")
+	require.NoError(t, ioutil.WriteFile(path, b, 0600),
+		"Unexpected error in WriteFile")
+
+	kv, err := New("pwx/test", nil, map[string]string{PersistPathKey: path}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	_, err = kv.Get("expired")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expired key should be dropped")
+	kvp, err := kv.Get("live")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "y", string(kvp.Value), "Unexpected loaded value")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600),
+		"Unexpected error in WriteFile")
+	_, err = New("pwx/test", nil, map[string]string{PersistPathKey: path}, nil)
+	assert.Error(t, err, "Expected a corrupt file to be refused")
+}
@@ -0,0 +1,261 @@
+package mem
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/portworx/kvdb"
+)
+
+// pairStore holds the stored pairs by full key. kv must be locked to use it.
+type pairStore interface {
+	// get returns the pair of key. Whether changes to the pair are stored
+	// depends on the store, so a changed pair must be passed to set.
+	get(key string) (*kvdb.KVPair, bool)
+	// set stores kvp at key.
+	set(key string, kvp *kvdb.KVPair)
+	// remove removes the pair of key, if any.
+	remove(key string)
+	// size returns the number of stored pairs.
+	size() int
+	// each calls f with every pair whose key starts with prefix. f must
+	// not change the store.
+	each(prefix string, f func(key string, kvp *kvdb.KVPair))
+	// keyBytes returns the number of bytes held for the keys.
+	keyBytes() int
+}
+
+// newPairStore returns an empty pairStore, a prefixTree if tree is set and a
+// pairMap otherwise.
+func newPairStore(domain string, tree bool) pairStore {
+	if tree {
+		return &prefixTree{domain: domain}
+	}
+	return make(pairMap)
+}
+
+// pairMap is a pairStore keeping every key in full. Its pairs are shared
+// with its callers.
+type pairMap map[string]*kvdb.KVPair
+
+func (m pairMap) get(key string) (*kvdb.KVPair, bool) {
+	kvp, ok := m[key]
+	return kvp, ok
+}
+
+func (m pairMap) set(key string, kvp *kvdb.KVPair) {
+	m[key] = kvp
+}
+
+func (m pairMap) remove(key string) {
+	delete(m, key)
+}
+
+func (m pairMap) size() int {
+	return len(m)
+}
+
+func (m pairMap) each(prefix string, f func(key string, kvp *kvdb.KVPair)) {
+	for key, kvp := range m {
+		if strings.HasPrefix(key, prefix) {
+			f(key, kvp)
+		}
+	}
+}
+
+func (m pairMap) keyBytes() int {
+	n := 0
+	for key := range m {
+		n += len(key)
+	}
+	return n
+}
+
+// prefixTree is a pairStore holding the prefixes its keys share only once.
+// Each node is labelled with the part of the key it adds to its parent, and
+// the pairs are stored without their key. get and each return copies of the
+// pairs with their key set.
+type prefixTree struct {
+	// domain is trimmed from the keys to set the key of the pairs
+	domain string
+	// root is labelled with the empty string
+	root prefixNode
+	// count is the number of stored pairs
+	count int
+}
+
+// prefixNode is a node of a prefixTree.
+type prefixNode struct {
+	// label is the part of the key added by the node
+	label string
+	// children are sorted by the first byte of their label, which differs
+	// between siblings
+	children []*prefixNode
+	// kvp is the pair stored at the node, nil if none
+	kvp *kvdb.KVPair
+}
+
+// child returns the position of the child of n whose label starts with c,
+// and the child if there is one.
+func (n *prefixNode) child(c byte) (int, *prefixNode) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].label[0] >= c
+	})
+	if i < len(n.children) && n.children[i].label[0] == c {
+		return i, n.children[i]
+	}
+	return i, nil
+}
+
+func (t *prefixTree) get(key string) (*kvdb.KVPair, bool) {
+	n := &t.root
+	for rest := key; rest != ""; {
+		_, child := n.child(rest[0])
+		if child == nil || !strings.HasPrefix(rest, child.label) {
+			return nil, false
+		}
+		rest = rest[len(child.label):]
+		n = child
+	}
+	if n.kvp == nil {
+		return nil, false
+	}
+	return t.pair(key, n.kvp), true
+}
+
+// pair returns a copy of the stored pair of key with its key set.
+func (t *prefixTree) pair(key string, stored *kvdb.KVPair) *kvdb.KVPair {
+	kvp := *stored
+	kvp.Key = strings.TrimPrefix(key, t.domain)
+	return &kvp
+}
+
+func (t *prefixTree) set(key string, kvp *kvdb.KVPair) {
+	stored := *kvp
+	stored.Key = ""
+	n := &t.root
+	for rest := key; rest != ""; {
+		i, child := n.child(rest[0])
+		if child == nil {
+			// The label is copied so that it does not hold on to key.
+			leaf := &prefixNode{label: string([]byte(rest)), kvp: &stored}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			t.count++
+			return
+		}
+		common := commonPrefixLen(rest, child.label)
+		if common < len(child.label) {
+			// Split the child where key leaves its label.
+			split := &prefixNode{
+				label:    child.label[:common],
+				children: []*prefixNode{child},
+			}
+			child.label = child.label[common:]
+			n.children[i] = split
+			child = split
+		}
+		rest = rest[common:]
+		n = child
+	}
+	if n.kvp == nil {
+		t.count++
+	}
+	n.kvp = &stored
+}
+
+func (t *prefixTree) remove(key string) {
+	// path holds the nodes from the root to the node of key.
+	path := []*prefixNode{&t.root}
+	for rest := key; rest != ""; {
+		_, child := path[len(path)-1].child(rest[0])
+		if child == nil || !strings.HasPrefix(rest, child.label) {
+			return
+		}
+		rest = rest[len(child.label):]
+		path = append(path, child)
+	}
+	n := path[len(path)-1]
+	if n.kvp == nil {
+		return
+	}
+	n.kvp = nil
+	t.count--
+
+	// Drop the nodes left without a pair or a child, then merge a node left
+	// with a single child and no pair into that child.
+	for i := len(path) - 1; i > 0 && n.kvp == nil && len(n.children) == 0; i-- {
+		parent := path[i-1]
+		j, _ := parent.child(n.label[0])
+		parent.children = append(parent.children[:j], parent.children[j+1:]...)
+		n = parent
+	}
+	if n != &t.root && n.kvp == nil && len(n.children) == 1 {
+		child := n.children[0]
+		n.label += child.label
+		n.children = child.children
+		n.kvp = child.kvp
+	}
+}
+
+func (t *prefixTree) size() int {
+	return t.count
+}
+
+func (t *prefixTree) each(prefix string, f func(key string, kvp *kvdb.KVPair)) {
+	// Find the node under which every key starts with prefix, along with
+	// the key of its parent.
+	n, parentKey := &t.root, ""
+	for rest := prefix; rest != ""; {
+		_, child := n.child(rest[0])
+		switch {
+		case child == nil:
+			return
+		case strings.HasPrefix(rest, child.label):
+			parentKey += n.label
+			rest = rest[len(child.label):]
+			n = child
+		case strings.HasPrefix(child.label, rest):
+			parentKey += n.label
+			rest = ""
+			n = child
+		default:
+			return
+		}
+	}
+
+	var walk func(n *prefixNode, key []byte)
+	walk = func(n *prefixNode, key []byte) {
+		key = append(key, n.label...)
+		if n.kvp != nil {
+			full := string(key)
+			f(full, t.pair(full, n.kvp))
+		}
+		for _, child := range n.children {
+			walk(child, key)
+		}
+	}
+	walk(n, []byte(parentKey))
+}
+
+func (t *prefixTree) keyBytes() int {
+	var count func(n *prefixNode) int
+	count = func(n *prefixNode) int {
+		bytes := len(n.label)
+		for _, child := range n.children {
+			bytes += count(child)
+		}
+		return bytes
+	}
+	return count(&t.root)
+}
+
+// commonPrefixLen returns the length of the longest common prefix of a and b.
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
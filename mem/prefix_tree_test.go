@@ -0,0 +1,206 @@
+package mem
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/portworx/kvdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkPrefixTree fails t if a node of tree other than its root is left
+// without a pair and with fewer than two children, if the children of a
+// node are out of order, or if the pair count is off.
+func checkPrefixTree(t *testing.T, tree *prefixTree) {
+	count := 0
+	var check func(n *prefixNode, root bool)
+	check = func(n *prefixNode, root bool) {
+		if n.kvp != nil {
+			count++
+		} else if !root && len(n.children) < 2 {
+			t.Fatalf("node %q has no pair and %d children",
+				n.label, len(n.children))
+		}
+		for i, child := range n.children {
+			if child.label == "" {
+				t.Fatalf("empty label under %q", n.label)
+			}
+			if i > 0 && n.children[i-1].label[0] >= child.label[0] {
+				t.Fatalf("children of %q out of order", n.label)
+			}
+			check(child, false)
+		}
+	}
+	check(&tree.root, true)
+	assert.Equal(t, count, tree.size(), "Unexpected size")
+}
+
+// sortedPairs returns the keys and values of the pairs of store under
+// prefix, sorted by key.
+func sortedPairs(store pairStore, prefix string) []string {
+	pairs := make([]string, 0)
+	store.each(prefix, func(key string, kvp *kvdb.KVPair) {
+		pairs = append(pairs, key+"="+kvp.Key+"="+string(kvp.Value))
+	})
+	sort.Strings(pairs)
+	return pairs
+}
+
+func TestPrefixTree(t *testing.T) {
+	domain := "pwx/test/"
+	tree := newPairStore(domain, true).(*prefixTree)
+	m := newPairStore(domain, false)
+	r := rand.New(rand.NewSource(1))
+	segments := []string{"a", "ab", "abc", "b", "ba", "/", "c"}
+	randomKey := func() string {
+		key := domain
+		for n := r.Intn(5); n >= 0; n-- {
+			key += segments[r.Intn(len(segments))]
+		}
+		return key
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := randomKey()
+		if r.Intn(3) == 0 {
+			tree.remove(key)
+			m.remove(key)
+		} else {
+			kvp := &kvdb.KVPair{
+				Key:   key[len(domain):],
+				Value: []byte(fmt.Sprint(i)),
+			}
+			tree.set(key, kvp)
+			m.set(key, kvp)
+		}
+		checkPrefixTree(t, tree)
+
+		key = randomKey()
+		want, wantOK := m.get(key)
+		got, ok := tree.get(key)
+		require.Equal(t, wantOK, ok, "Unexpected presence of %q", key)
+		if ok {
+			assert.Equal(t, want, got, "Unexpected pair of %q", key)
+		}
+		prefix := key[:r.Intn(len(key)+1)]
+		require.Equal(t, sortedPairs(m, prefix), sortedPairs(tree, prefix),
+			"Unexpected pairs under %q", prefix)
+	}
+
+	// Emptied, the tree holds no key bytes.
+	m.each("", func(key string, _ *kvdb.KVPair) { tree.remove(key) })
+	checkPrefixTree(t, tree)
+	assert.Equal(t, 0, tree.size(), "Unexpected size")
+	assert.Equal(t, 0, tree.keyBytes(), "Unexpected key bytes")
+}
+
+func TestPrefixTreeCopiesPairs(t *testing.T) {
+	tree := newPairStore("", true)
+	kvp := &kvdb.KVPair{Key: "key", Value: []byte("value")}
+	tree.set("key", kvp)
+	kvp.ModifiedIndex = 1
+
+	got, ok := tree.get("key")
+	require.True(t, ok, "Expected key to be stored")
+	assert.Equal(t, uint64(0), got.ModifiedIndex, "Change to set pair was stored")
+	got.ModifiedIndex = 2
+	got, _ = tree.get("key")
+	assert.Equal(t, uint64(0), got.ModifiedIndex, "Change to got pair was stored")
+}
+
+// hierarchyKey returns the i-th key of a deep hierarchy whose keys share
+// long prefixes.
+func hierarchyKey(i int) string {
+	return fmt.Sprintf("clusters/cluster-%d/racks/rack-%d/nodes/node-%d/"+
+		"volumes/volume-%d/state", i/2000, i/200%10, i/20%10, i)
+}
+
+func TestPrefixTreeKvdb(t *testing.T) {
+	kvMap, err := New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	kvTree, err := New("pwx/test", nil,
+		map[string]string{PrefixTreeKey: "true"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	n := 2000
+	for _, kv := range []kvdb.Kvdb{kvMap, kvTree} {
+		for i := 0; i < n; i++ {
+			_, err = kv.Put(hierarchyKey(i), []byte(fmt.Sprint(i)), 0)
+			require.NoError(t, err, "Unexpected error in Put")
+		}
+		for i := 0; i < n; i += 7 {
+			_, err = kv.Delete(hierarchyKey(i))
+			require.NoError(t, err, "Unexpected error in Delete")
+		}
+		err = kv.DeleteTree("clusters/cluster-0/racks/rack-5")
+		require.NoError(t, err, "Unexpected error in DeleteTree")
+		_, err = kv.Update(hierarchyKey(1), []byte("updated"), 0)
+		require.NoError(t, err, "Unexpected error in Update")
+	}
+
+	for i := 0; i < n; i++ {
+		want, wantErr := kvMap.Get(hierarchyKey(i))
+		got, err := kvTree.Get(hierarchyKey(i))
+		require.Equal(t, wantErr, err, "Unexpected error in Get")
+		assert.Equal(t, want, got, "Unexpected pair of %q", hierarchyKey(i))
+	}
+	for _, prefix := range []string{"", "clusters/", "clusters/cluster-0",
+		"clusters/cluster-0/racks/rack-1", "clusters/cluster-0/racks/rack-1/",
+		"clusters/cluster-1", "other"} {
+		want, err := kvMap.Enumerate(prefix)
+		require.NoError(t, err, "Unexpected error in Enumerate")
+		got, err := kvTree.Enumerate(prefix)
+		require.NoError(t, err, "Unexpected error in Enumerate")
+		sort.Slice(want, func(i, j int) bool { return want[i].Key < want[j].Key })
+		sort.Slice(got, func(i, j int) bool { return got[i].Key < got[j].Key })
+		assert.Equal(t, want, got, "Unexpected pairs under %q", prefix)
+	}
+
+	mapStats, err := kvMap.(kvdb.MemoryReporter).MemoryStats()
+	require.NoError(t, err, "Unexpected error in MemoryStats")
+	treeStats, err := kvTree.(kvdb.MemoryReporter).MemoryStats()
+	require.NoError(t, err, "Unexpected error in MemoryStats")
+	assert.Equal(t, mapStats.Keys, treeStats.Keys, "Unexpected key count")
+	assert.Equal(t, mapStats.KeyBytes, treeStats.KeyBytes,
+		"Unexpected key bytes")
+	assert.Equal(t, mapStats.KeyBytes, mapStats.StoredKeyBytes,
+		"Unexpected stored key bytes without a prefix tree")
+	assert.True(t, treeStats.StoredKeyBytes < mapStats.StoredKeyBytes/2,
+		"Expected the prefix tree to hold less than half the key bytes, "+
+			"held %v of %v", treeStats.StoredKeyBytes, mapStats.StoredKeyBytes)
+}
+
+func BenchmarkKeyMemory(b *testing.B) {
+	for _, tree := range []string{"false", "true"} {
+		b.Run(PrefixTreeKey+"="+tree, func(b *testing.B) {
+			benchmarkKeyMemory(b, map[string]string{PrefixTreeKey: tree})
+		})
+	}
+}
+
+// benchmarkKeyMemory reports the heap held per key by stores of keys under
+// a deep hierarchy.
+func benchmarkKeyMemory(b *testing.B, options map[string]string) {
+	keys := 10000
+	var heap int64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		kv, err := New("pwx/test", nil, options, nil)
+		require.NoError(b, err, "Unexpected error in New")
+		for j := 0; j < keys; j++ {
+			_, err = kv.Put(hierarchyKey(j), []byte("up"), 0)
+			require.NoError(b, err, "Unexpected error in Put")
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		heap += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+		runtime.KeepAlive(kv)
+	}
+	b.ReportMetric(float64(heap)/float64(b.N*keys), "heap-bytes/key")
+}
@@ -0,0 +1,690 @@
+// Package mock provides a kvdb.Kvdb that records every call and returns
+// programmed results, for testing code that consumes kvdb.
+package mock
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/portworx/kvdb"
+)
+
+// Call is a recorded method invocation.
+type Call struct {
+	// Method is the name of the invoked method.
+	Method string
+	// Args are the arguments the method was invoked with.
+	Args []interface{}
+}
+
+// MockKvdb implements kvdb.Kvdb. Methods return the results programmed
+// through On, or zero values if nothing was programmed.
+type MockKvdb struct {
+	// mu protects calls and results
+	mu sync.Mutex
+	// calls are the recorded calls in invocation order
+	calls []Call
+	// results are the programmed results by method name
+	results map[string]results
+}
+
+// results are the programmed return values of a method.
+type results []interface{}
+
+var _ kvdb.Kvdb = &MockKvdb{}
+
+// New returns a MockKvdb with no programmed results.
+func New() *MockKvdb {
+	return &MockKvdb{results: make(map[string]results)}
+}
+
+// On programs method to return results, given in the order of the method's
+// return values.
+func (m *MockKvdb) On(method string, rets ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[method] = results(rets)
+}
+
+// Calls returns all recorded calls in invocation order.
+func (m *MockKvdb) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	calls := make([]Call, len(m.calls))
+	copy(calls, m.calls)
+	return calls
+}
+
+// CallsTo returns the recorded calls to method in invocation order.
+func (m *MockKvdb) CallsTo(method string) []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	calls := make([]Call, 0)
+	for _, c := range m.calls {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset clears the recorded calls and programmed results.
+func (m *MockKvdb) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = nil
+	m.results = make(map[string]results)
+}
+
+// called records a call to method and returns its programmed results.
+func (m *MockKvdb) called(method string, args ...interface{}) results {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, Call{Method: method, Args: args})
+	return m.results[method]
+}
+
+func (r results) get(i int) interface{} {
+	if i < len(r) {
+		return r[i]
+	}
+	return nil
+}
+
+func (r results) err(i int) error {
+	v, _ := r.get(i).(error)
+	return v
+}
+
+func (r results) kvp(i int) *kvdb.KVPair {
+	v, _ := r.get(i).(*kvdb.KVPair)
+	return v
+}
+
+func (r results) kvps(i int) kvdb.KVPairs {
+	v, _ := r.get(i).(kvdb.KVPairs)
+	return v
+}
+
+func (r results) kv(i int) kvdb.Kvdb {
+	v, _ := r.get(i).(kvdb.Kvdb)
+	return v
+}
+
+func (r results) str(i int) string {
+	v, _ := r.get(i).(string)
+	return v
+}
+
+func (r results) strs(i int) []string {
+	v, _ := r.get(i).([]string)
+	return v
+}
+
+func (r results) boolean(i int) bool {
+	v, _ := r.get(i).(bool)
+	return v
+}
+
+func (r results) integer(i int) int {
+	v, _ := r.get(i).(int)
+	return v
+}
+
+func (r results) uint(i int) uint64 {
+	v, _ := r.get(i).(uint64)
+	return v
+}
+
+func (m *MockKvdb) AddMember(
+	nodeIP string,
+	nodePeerPort string,
+	nodeName string,
+) (map[string][]string, error) {
+	r := m.called("AddMember", nodeIP, nodePeerPort, nodeName)
+	v, _ := r.get(0).(map[string][]string)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) RemoveMember(nodeID string) error {
+	return m.called("RemoveMember", nodeID).err(0)
+}
+
+func (m *MockKvdb) ListMembers() (map[string]*kvdb.MemberUrls, error) {
+	r := m.called("ListMembers")
+	v, _ := r.get(0).(map[string]*kvdb.MemberUrls)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) SetEndpoints(endpoints []string) error {
+	return m.called("SetEndpoints", endpoints).err(0)
+}
+
+func (m *MockKvdb) GetEndpoints() []string {
+	return m.called("GetEndpoints").strs(0)
+}
+
+func (m *MockKvdb) String() string {
+	return m.called("String").str(0)
+}
+
+func (m *MockKvdb) Domain() string {
+	return m.called("Domain").str(0)
+}
+
+func (m *MockKvdb) FullKey(key string) string {
+	return m.called("FullKey", key).str(0)
+}
+
+func (m *MockKvdb) Capabilities() int {
+	return m.called("Capabilities").integer(0)
+}
+
+func (m *MockKvdb) Get(key string) (*kvdb.KVPair, error) {
+	r := m.called("Get", key)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) GetRaw(key string) (*kvdb.KVPair, error) {
+	r := m.called("GetRaw", key)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) GetConsistent(
+	key string,
+	level kvdb.Consistency,
+) (*kvdb.KVPair, error) {
+	r := m.called("GetConsistent", key, level)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) CreateAlias(alias, target string) error {
+	return m.called("CreateAlias", alias, target).err(0)
+}
+
+func (m *MockKvdb) GetVal(key string, value interface{}) (*kvdb.KVPair, error) {
+	r := m.called("GetVal", key, value)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) GetValMulti(
+	key string,
+	targets ...interface{},
+) (*kvdb.KVPair, error) {
+	r := m.called("GetValMulti", key, targets)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) GetMultiConsistent(keys []string) (kvdb.KVPairs, uint64, error) {
+	r := m.called("GetMultiConsistent", keys)
+	return r.kvps(0), r.uint(1), r.err(2)
+}
+
+func (m *MockKvdb) Put(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	r := m.called("Put", key, value, ttl)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) Create(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	r := m.called("Create", key, value, ttl)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) Update(
+	key string,
+	value interface{},
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	r := m.called("Update", key, value, ttl)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) PutMonotonic(
+	key string,
+	value int64,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	r := m.called("PutMonotonic", key, value, ttl)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) Enumerate(prefix string) (kvdb.KVPairs, error) {
+	r := m.called("Enumerate", prefix)
+	return r.kvps(0), r.err(1)
+}
+
+func (m *MockKvdb) EnumerateAt(prefix string) (kvdb.KVPairs, uint64, error) {
+	r := m.called("EnumerateAt", prefix)
+	return r.kvps(0), r.uint(1), r.err(2)
+}
+
+func (m *MockKvdb) EnumeratePaged(
+	prefix string,
+	limit int,
+	cursor string,
+) (kvdb.KVPairs, string, error) {
+	r := m.called("EnumeratePaged", prefix, limit, cursor)
+	return r.kvps(0), r.str(1), r.err(2)
+}
+
+func (m *MockKvdb) EnumerateGrouped(prefix string) (map[string]kvdb.KVPairs, error) {
+	r := m.called("EnumerateGrouped", prefix)
+	v, _ := r.get(0).(map[string]kvdb.KVPairs)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) LatestUnder(prefix string) (*kvdb.KVPair, error) {
+	r := m.called("LatestUnder", prefix)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) Delete(key string) (*kvdb.KVPair, error) {
+	r := m.called("Delete", key)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) DeleteTree(prefix string) error {
+	return m.called("DeleteTree", prefix).err(0)
+}
+
+func (m *MockKvdb) DeleteTreeForce(prefix string) error {
+	return m.called("DeleteTreeForce", prefix).err(0)
+}
+
+func (m *MockKvdb) DeleteTreeWithResult(prefix string) (kvdb.KVPairs, error) {
+	r := m.called("DeleteTreeWithResult", prefix)
+	return r.kvps(0), r.err(1)
+}
+
+func (m *MockKvdb) DeleteTreeIfVersion(
+	prefix string,
+	versionKey string,
+	expectedValue []byte,
+) (int, error) {
+	r := m.called("DeleteTreeIfVersion", prefix, versionKey, expectedValue)
+	return r.integer(0), r.err(1)
+}
+
+func (m *MockKvdb) AtomicAddBatch(
+	deltas map[string]int64,
+) (map[string]int64, error) {
+	r := m.called("AtomicAddBatch", deltas)
+	v, _ := r.get(0).(map[string]int64)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) AtomicIncrement(key string, delta int64) (int64, error) {
+	r := m.called("AtomicIncrement", key, delta)
+	v, _ := r.get(0).(int64)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) AtomicDecrement(key string, delta int64) (int64, error) {
+	r := m.called("AtomicDecrement", key, delta)
+	v, _ := r.get(0).(int64)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) AllowN(key string, rate float64, burst int, n int) (bool, error) {
+	r := m.called("AllowN", key, rate, burst, n)
+	return r.boolean(0), r.err(1)
+}
+
+func (m *MockKvdb) PutIfOther(
+	key string,
+	value interface{},
+	ttl uint64,
+	guardKey string,
+	guardValue []byte,
+) (*kvdb.KVPair, error) {
+	r := m.called("PutIfOther", key, value, ttl, guardKey, guardValue)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) PutWithFallback(
+	key string,
+	value interface{},
+	fallback interface{},
+	after time.Duration,
+) (*kvdb.KVPair, error) {
+	r := m.called("PutWithFallback", key, value, fallback, after)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) MoveIf(
+	src string,
+	dst string,
+	expectedDstValue []byte,
+) (*kvdb.KVPair, error) {
+	r := m.called("MoveIf", src, dst, expectedDstValue)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) Rename(oldKey, newKey string) (*kvdb.KVPair, error) {
+	r := m.called("Rename", oldKey, newKey)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) ReplaceTree(
+	prefix string,
+	pairs map[string]interface{},
+	ttl uint64,
+) (int, int, error) {
+	r := m.called("ReplaceTree", prefix, pairs, ttl)
+	return r.integer(0), r.integer(1), r.err(2)
+}
+
+func (m *MockKvdb) CreateBatch(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	r := m.called("CreateBatch", pairs, ttl)
+	return r.kvps(0), r.err(1)
+}
+
+func (m *MockKvdb) PutBulk(
+	pairs map[string]interface{},
+	ttl uint64,
+) (kvdb.KVPairs, error) {
+	r := m.called("PutBulk", pairs, ttl)
+	return r.kvps(0), r.err(1)
+}
+
+func (m *MockKvdb) Keys(prefix, sep string) ([]string, error) {
+	r := m.called("Keys", prefix, sep)
+	return r.strs(0), r.err(1)
+}
+
+func (m *MockKvdb) CompareAndSet(
+	kvp *kvdb.KVPair,
+	flags kvdb.KVFlags,
+	prevValue []byte,
+) (*kvdb.KVPair, error) {
+	r := m.called("CompareAndSet", kvp, flags, prevValue)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) CompareAndDelete(
+	kvp *kvdb.KVPair,
+	flags kvdb.KVFlags,
+) (*kvdb.KVPair, error) {
+	r := m.called("CompareAndDelete", kvp, flags)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) WatchKey(
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchKey", key, waitIndex, opaque, watchCB).err(0)
+}
+
+func (m *MockKvdb) WatchTree(
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchTree", prefix, waitIndex, opaque, watchCB).err(0)
+}
+
+func (m *MockKvdb) WatchKeyOpts(
+	key string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchKeyOpts", key, opts, watchCB).err(0)
+}
+
+func (m *MockKvdb) WatchTreeOpts(
+	prefix string,
+	opts kvdb.WatchOptions,
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchTreeOpts", prefix, opts, watchCB).err(0)
+}
+
+func (m *MockKvdb) WatchKeyWithContext(
+	ctx context.Context,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchKeyWithContext", ctx, key, waitIndex, opaque,
+		watchCB).err(0)
+}
+
+func (m *MockKvdb) WatchTreeWithContext(
+	ctx context.Context,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchTreeWithContext", ctx, prefix, waitIndex, opaque,
+		watchCB).err(0)
+}
+
+func (m *MockKvdb) WatchAll(
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchAll", waitIndex, opaque, watchCB).err(0)
+}
+
+func (m *MockKvdb) WatchAllWithContext(
+	ctx context.Context,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB kvdb.WatchCB,
+) error {
+	return m.called("WatchAllWithContext", ctx, waitIndex, opaque,
+		watchCB).err(0)
+}
+
+func (m *MockKvdb) ReplayHistory(
+	fromIndex uint64,
+	fn func(kvp *kvdb.KVPair) error,
+) error {
+	return m.called("ReplayHistory", fromIndex, fn).err(0)
+}
+
+func (m *MockKvdb) WatchFrom(
+	key string,
+) (*kvdb.KVPair, <-chan *kvdb.KVPair, func(), error) {
+	r := m.called("WatchFrom", key)
+	ch, _ := r.get(1).(<-chan *kvdb.KVPair)
+	cancel, _ := r.get(2).(func())
+	return r.kvp(0), ch, cancel, r.err(3)
+}
+
+func (m *MockKvdb) HasWatchers(key string) (bool, error) {
+	r := m.called("HasWatchers", key)
+	return r.boolean(0), r.err(1)
+}
+
+func (m *MockKvdb) PauseWatch(key string) error {
+	return m.called("PauseWatch", key).err(0)
+}
+
+func (m *MockKvdb) ResumeWatch(key string) error {
+	return m.called("ResumeWatch", key).err(0)
+}
+
+func (m *MockKvdb) StopWatchGroup(group string) int {
+	return m.called("StopWatchGroup", group).integer(0)
+}
+
+func (m *MockKvdb) PollChanges(
+	prefix string,
+	sinceIndex uint64,
+) (kvdb.KVPairs, uint64, error) {
+	r := m.called("PollChanges", prefix, sinceIndex)
+	return r.kvps(0), r.uint(1), r.err(2)
+}
+
+func (m *MockKvdb) Recode(newCodec kvdb.Codec) (int, error) {
+	r := m.called("Recode", newCodec)
+	return r.integer(0), r.err(1)
+}
+
+func (m *MockKvdb) Snapshot(prefix string) (kvdb.Kvdb, uint64, error) {
+	r := m.called("Snapshot", prefix)
+	return r.kv(0), r.uint(1), r.err(2)
+}
+
+func (m *MockKvdb) Restore(snap kvdb.Kvdb) error {
+	return m.called("Restore", snap).err(0)
+}
+
+func (m *MockKvdb) SnapPut(kvp *kvdb.KVPair) (*kvdb.KVPair, error) {
+	r := m.called("SnapPut", kvp)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) LockWithID(key string, lockerID string) (*kvdb.KVPair, error) {
+	r := m.called("LockWithID", key, lockerID)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) Lock(key string) (*kvdb.KVPair, error) {
+	r := m.called("Lock", key)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) LockWithPriority(
+	key string,
+	lockerID string,
+	priority int,
+) (*kvdb.KVPair, error) {
+	r := m.called("LockWithPriority", key, lockerID, priority)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) LockWithTimeout(
+	key string,
+	lockerID string,
+	lockTimeout time.Duration,
+	ttl uint64,
+) (*kvdb.KVPair, error) {
+	r := m.called("LockWithTimeout", key, lockerID, lockTimeout, ttl)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) TryLockMany(
+	keys []string,
+	lockerID string,
+	ttl uint64,
+) ([]*kvdb.KVPair, []string, error) {
+	r := m.called("TryLockMany", keys, lockerID, ttl)
+	acquired, _ := r.get(0).([]*kvdb.KVPair)
+	return acquired, r.strs(1), r.err(2)
+}
+
+func (m *MockKvdb) LockStats(key string) (kvdb.LockStat, error) {
+	r := m.called("LockStats", key)
+	v, _ := r.get(0).(kvdb.LockStat)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) Unlock(kvp *kvdb.KVPair) error {
+	return m.called("Unlock", kvp).err(0)
+}
+
+func (m *MockKvdb) RefreshLock(kvp *kvdb.KVPair, ttl uint64) (*kvdb.KVPair, error) {
+	r := m.called("RefreshLock", kvp, ttl)
+	return r.kvp(0), r.err(1)
+}
+
+func (m *MockKvdb) TxNew() (kvdb.Tx, error) {
+	r := m.called("TxNew")
+	v, _ := r.get(0).(kvdb.Tx)
+	return v, r.err(1)
+}
+
+func (m *MockKvdb) AddUser(username string, password string) error {
+	return m.called("AddUser", username, password).err(0)
+}
+
+func (m *MockKvdb) RemoveUser(username string) error {
+	return m.called("RemoveUser", username).err(0)
+}
+
+func (m *MockKvdb) GrantUserAccess(
+	username string,
+	permType kvdb.PermissionType,
+	subtree string,
+) error {
+	return m.called("GrantUserAccess", username, permType, subtree).err(0)
+}
+
+func (m *MockKvdb) RevokeUsersAccess(
+	username string,
+	permType kvdb.PermissionType,
+	subtree string,
+) error {
+	return m.called("RevokeUsersAccess", username, permType, subtree).err(0)
+}
+
+func (m *MockKvdb) EnqueueDelayed(
+	queuePrefix string,
+	value []byte,
+	delay time.Duration,
+) (string, error) {
+	r := m.called("EnqueueDelayed", queuePrefix, value, delay)
+	return r.str(0), r.err(1)
+}
+
+func (m *MockKvdb) DequeueReady(queuePrefix string) (kvdb.KVPairs, error) {
+	r := m.called("DequeueReady", queuePrefix)
+	return r.kvps(0), r.err(1)
+}
+
+func (m *MockKvdb) DeleteIfExists(key string) (bool, error) {
+	r := m.called("DeleteIfExists", key)
+	return r.boolean(0), r.err(1)
+}
+
+func (m *MockKvdb) DeleteIf(key string, pred func([]byte) bool) (bool, error) {
+	r := m.called("DeleteIf", key, pred)
+	return r.boolean(0), r.err(1)
+}
+
+func (m *MockKvdb) WithLock(lock *kvdb.KVPair) (kvdb.Kvdb, error) {
+	r := m.called("WithLock", lock)
+	return r.kv(0), r.err(1)
+}
+
+func (m *MockKvdb) KeysWrittenBy(lockerID string) ([]string, error) {
+	r := m.called("KeysWrittenBy", lockerID)
+	return r.strs(0), r.err(1)
+}
+
+func (m *MockKvdb) OnConnectionStateChange(cb kvdb.ConnStateCB) {
+	m.called("OnConnectionStateChange", cb)
+}
+
+func (m *MockKvdb) Rates() (float64, float64) {
+	r := m.called("Rates")
+	reads, _ := r.get(0).(float64)
+	writes, _ := r.get(1).(float64)
+	return reads, writes
+}
+
+func (m *MockKvdb) WriteMetrics(w io.Writer) error {
+	return m.called("WriteMetrics", w).err(0)
+}
@@ -0,0 +1,60 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/portworx/kvdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordedCalls(t *testing.T) {
+	m := New()
+	var kv kvdb.Kvdb = m
+
+	_, err := kv.Put("foo", []byte("bar"), 10)
+	assert.NoError(t, err, "Unprogrammed method should not fail")
+	_, err = kv.Get("foo")
+	assert.NoError(t, err, "Unprogrammed method should not fail")
+	_, err = kv.Get("baz")
+	assert.NoError(t, err, "Unprogrammed method should not fail")
+
+	expected := []Call{
+		{Method: "Put", Args: []interface{}{"foo", []byte("bar"), uint64(10)}},
+		{Method: "Get", Args: []interface{}{"foo"}},
+		{Method: "Get", Args: []interface{}{"baz"}},
+	}
+	assert.Equal(t, expected, m.Calls(), "Unexpected recorded calls")
+	assert.Equal(t, expected[1:], m.CallsTo("Get"), "Unexpected recorded Get calls")
+	assert.Empty(t, m.CallsTo("Delete"), "Delete was never called")
+
+	m.Reset()
+	assert.Empty(t, m.Calls(), "Reset should clear recorded calls")
+}
+
+func TestProgrammedResults(t *testing.T) {
+	m := New()
+	var kv kvdb.Kvdb = m
+
+	stored := &kvdb.KVPair{Key: "foo", Value: []byte("bar")}
+	m.On("Get", stored, nil)
+	m.On("Delete", nil, kvdb.ErrNotFound)
+	m.On("DeleteIfExists", true, nil)
+	m.On("Keys", []string{"a", "b"}, nil)
+
+	kvp, err := kv.Get("foo")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, stored, kvp, "Get should return the programmed pair")
+
+	kvp, err = kv.Delete("foo")
+	assert.Nil(t, kvp, "Delete should return the programmed nil pair")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Delete should return the programmed error")
+
+	deleted, err := kv.DeleteIfExists("foo")
+	assert.NoError(t, err, "Unexpected error in DeleteIfExists")
+	assert.True(t, deleted, "DeleteIfExists should return the programmed result")
+
+	keys, err := kv.Keys("", "")
+	assert.NoError(t, err, "Unexpected error in Keys")
+	assert.Equal(t, []string{"a", "b"}, keys, "Keys should return the programmed keys")
+}
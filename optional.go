@@ -0,0 +1,78 @@
+package kvdb
+
+// The interfaces below are implemented by backends that hold their data in
+// process, such as mem. They are not part of Kvdb since the other backends
+// cannot support them; callers type-assert a Kvdb to use them.
+
+// DebugDumper is implemented by backends that can expose their raw state.
+type DebugDumper interface {
+	// DebugDump returns a copy of the raw internal state of the kvdb keyed
+	// by internal key, including hidden and lock keys. The format is
+	// unstable and meant for debugging only.
+	DebugDump() map[string]KVPair
+}
+
+// Verifier is implemented by backends that can check their own state.
+type Verifier interface {
+	// Verify checks the internal consistency of the kvdb and returns an
+	// error describing the first violation found. Meant for debugging.
+	Verify() error
+}
+
+// ExpirationRunner is implemented by backends that expire keys in process.
+type ExpirationRunner interface {
+	// RunPendingExpirations synchronously deletes the keys whose TTL has
+	// elapsed but that have not been collected yet, and returns how many
+	// were deleted.
+	RunPendingExpirations() int
+}
+
+// ChangeApplier is implemented by backends that can mirror another kvdb.
+type ChangeApplier interface {
+	// ApplyChange applies a change delivered by a watch on a primary kvdb,
+	// preserving its indexes so that this kvdb mirrors the primary. Changes
+	// at or below the current kvdb index are duplicates or out of order and
+	// are ignored.
+	ApplyChange(kvp *KVPair) error
+}
+
+// HotKeyTracker is implemented by backends that can count key accesses.
+type HotKeyTracker interface {
+	// HotKeys returns the n most accessed keys in the current tracking
+	// window, most accessed first. Hot key tracking is off by default,
+	// ErrNotSupported is returned unless the backend was configured to
+	// track key accesses.
+	HotKeys(n int) ([]KeyStat, error)
+}
+
+// HistoryCompactor is implemented by backends that keep a history of the
+// changes.
+type HistoryCompactor interface {
+	// CompactHistory drops the changes before index from the history, so
+	// that watches and polls can no longer resume from them. The watches set
+	// up with WatchOptions.CompactionEvents that had not received them are
+	// sent a KVCompacted pair instead. ErrIllegal is returned if index is
+	// past the kvdb index.
+	CompactHistory(index uint64) error
+}
+
+// MemoryReporter is implemented by backends that hold their data in memory.
+type MemoryReporter interface {
+	// MemoryStats returns the memory taken by the keys and values held by
+	// the kvdb.
+	MemoryStats() (MemoryStats, error)
+}
+
+// Flusher is implemented by backends that persist writes asynchronously.
+type Flusher interface {
+	// Flush writes the changes not yet persisted to storage.
+	Flush() error
+}
+
+// CodecProvider is implemented by backends whose value encoding can be
+// configured.
+type CodecProvider interface {
+	// Codec returns the codec values are encoded with, the one GetVal
+	// decodes them with.
+	Codec() Codec
+}
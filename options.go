@@ -0,0 +1,155 @@
+package kvdb
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// OptionsBuilder builds the options passed to New with typed setters. Values
+// are validated as they are set and the first invalid one is reported by
+// Build.
+type OptionsBuilder struct {
+	// options are the options set so far
+	options map[string]string
+	// err is the first invalid value
+	err error
+}
+
+// NewOptionsBuilder returns an OptionsBuilder with no options set.
+func NewOptionsBuilder() *OptionsBuilder {
+	return &OptionsBuilder{options: make(map[string]string)}
+}
+
+// With sets the backend specific option key to value.
+func (b *OptionsBuilder) With(key, value string) *OptionsBuilder {
+	if key == "" {
+		b.fail(fmt.Errorf("Empty option key"))
+		return b
+	}
+	b.options[key] = value
+	return b
+}
+
+// WithAuth sets the credentials of an authenticated kvdb endpoint.
+func (b *OptionsBuilder) WithAuth(username, password string) *OptionsBuilder {
+	if username != "" && password == "" {
+		b.fail(ErrNoPassword)
+		return b
+	}
+	b.options[UsernameKey] = username
+	b.options[PasswordKey] = password
+	return b
+}
+
+// WithCAFile sets the CA file path of an authenticated kvdb endpoint.
+func (b *OptionsBuilder) WithCAFile(caFile string) *OptionsBuilder {
+	return b.withPath(CAFileKey, caFile)
+}
+
+// WithTrustedCAFile sets the trusted CA file path.
+func (b *OptionsBuilder) WithTrustedCAFile(caFile string) *OptionsBuilder {
+	return b.withPath(TrustedCAFileKey, caFile)
+}
+
+// WithCertFile sets the client certificate and its key.
+func (b *OptionsBuilder) WithCertFile(certFile, keyFile string) *OptionsBuilder {
+	b.withPath(CertFileKey, certFile)
+	return b.withPath(CertKeyFileKey, keyFile)
+}
+
+// WithClientCertAuth sets whether the client is authenticated by its
+// certificate.
+func (b *OptionsBuilder) WithClientCertAuth(enabled bool) *OptionsBuilder {
+	b.options[ClientCertAuthKey] = strconv.FormatBool(enabled)
+	return b
+}
+
+// WithRetryCount sets the number of times failed operations are retried.
+func (b *OptionsBuilder) WithRetryCount(count int) *OptionsBuilder {
+	if count <= 0 {
+		b.fail(fmt.Errorf("Invalid %v: %d", RetryCountKey, count))
+		return b
+	}
+	b.options[RetryCountKey] = strconv.Itoa(count)
+	return b
+}
+
+// WithACLToken sets the token of ACL based kvdbs.
+func (b *OptionsBuilder) WithACLToken(token string) *OptionsBuilder {
+	if token == "" {
+		b.fail(fmt.Errorf("Empty %v", ACLTokenKey))
+		return b
+	}
+	b.options[ACLTokenKey] = token
+	return b
+}
+
+// WithValueValidator selects the ValueValidator registered under name.
+func (b *OptionsBuilder) WithValueValidator(name string) *OptionsBuilder {
+	if _, err := GetValueValidator(name); err != nil {
+		b.fail(err)
+		return b
+	}
+	b.options[ValueValidatorKey] = name
+	return b
+}
+
+// WithCodec selects the Codec registered under name.
+func (b *OptionsBuilder) WithCodec(name string) *OptionsBuilder {
+	if _, err := GetCodec(name); err != nil {
+		b.fail(err)
+		return b
+	}
+	b.options[CodecKey] = name
+	return b
+}
+
+// WithPanicHook selects the PanicHook registered under name.
+func (b *OptionsBuilder) WithPanicHook(name string) *OptionsBuilder {
+	if _, err := GetPanicHook(name); err != nil {
+		b.fail(err)
+		return b
+	}
+	b.options[PanicHookKey] = name
+	return b
+}
+
+// WithDefaultTTL sets the ttl, in seconds, of keys put or created with a
+// zero ttl.
+func (b *OptionsBuilder) WithDefaultTTL(ttl uint64) *OptionsBuilder {
+	if ttl == 0 || ttl == NoTTL {
+		b.fail(fmt.Errorf("Invalid %v: %d", DefaultTTLKey, ttl))
+		return b
+	}
+	b.options[DefaultTTLKey] = strconv.FormatUint(ttl, 10)
+	return b
+}
+
+// Build returns the options, or the first invalid value that was set.
+func (b *OptionsBuilder) Build() (map[string]string, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	options := make(map[string]string, len(b.options))
+	for k, v := range b.options {
+		options[k] = v
+	}
+	return options, nil
+}
+
+// withPath sets the file path option key.
+func (b *OptionsBuilder) withPath(key, path string) *OptionsBuilder {
+	if path == "" {
+		b.fail(fmt.Errorf("Empty %v", key))
+		return b
+	}
+	b.options[key] = path
+	return b
+}
+
+// fail records err unless an earlier value was already invalid.
+func (b *OptionsBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
@@ -0,0 +1,75 @@
+package kvdb_test
+
+import (
+	"testing"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptionsBuilder(t *testing.T) {
+	require.NoError(t, kvdb.RegisterValueValidator("options-test",
+		func(key string, value []byte) error { return nil }),
+		"Unexpected error in RegisterValueValidator")
+	require.NoError(t, kvdb.RegisterPanicHook("options-test",
+		func(prefix string, recovered interface{}) {}),
+		"Unexpected error in RegisterPanicHook")
+
+	options, err := kvdb.NewOptionsBuilder().
+		WithAuth("user", "secret").
+		WithCAFile("/etc/ca.pem").
+		WithCertFile("/etc/cert.pem", "/etc/key.pem").
+		WithClientCertAuth(true).
+		WithRetryCount(3).
+		WithValueValidator("options-test").
+		WithCodec(kvdb.JSONCodecName).
+		WithPanicHook("options-test").
+		WithDefaultTTL(60).
+		With(mem.HistorySizeKey, "10").
+		Build()
+	require.NoError(t, err, "Unexpected error in Build")
+	assert.Equal(t, map[string]string{
+		kvdb.UsernameKey:       "user",
+		kvdb.PasswordKey:       "secret",
+		kvdb.CAFileKey:         "/etc/ca.pem",
+		kvdb.CertFileKey:       "/etc/cert.pem",
+		kvdb.CertKeyFileKey:    "/etc/key.pem",
+		kvdb.ClientCertAuthKey: "true",
+		kvdb.RetryCountKey:     "3",
+		kvdb.ValueValidatorKey: "options-test",
+		kvdb.CodecKey:          kvdb.JSONCodecName,
+		kvdb.PanicHookKey:      "options-test",
+		kvdb.DefaultTTLKey:     "60",
+		mem.HistorySizeKey:     "10",
+	}, options, "Unexpected options")
+
+	kv, err := mem.New("pwx/test", nil, options, nil)
+	require.NoError(t, err, "Built options should be accepted by mem")
+	kvp, err := kv.Put("options/key", []byte("v"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, int64(60), kvp.TTL, "Default TTL should be applied")
+}
+
+func TestOptionsBuilderInvalid(t *testing.T) {
+	for name, b := range map[string]*kvdb.OptionsBuilder{
+		"missing password":   kvdb.NewOptionsBuilder().WithAuth("user", ""),
+		"empty CA file":      kvdb.NewOptionsBuilder().WithCAFile(""),
+		"empty key file":     kvdb.NewOptionsBuilder().WithCertFile("/etc/cert.pem", ""),
+		"zero retry count":   kvdb.NewOptionsBuilder().WithRetryCount(0),
+		"empty ACL token":    kvdb.NewOptionsBuilder().WithACLToken(""),
+		"unknown validator":  kvdb.NewOptionsBuilder().WithValueValidator("missing"),
+		"unknown codec":      kvdb.NewOptionsBuilder().WithCodec("missing"),
+		"unknown panic hook": kvdb.NewOptionsBuilder().WithPanicHook("missing"),
+		"zero default TTL":   kvdb.NewOptionsBuilder().WithDefaultTTL(0),
+		"empty key":          kvdb.NewOptionsBuilder().With("", "v"),
+	} {
+		options, err := b.WithRetryCount(1).Build()
+		assert.Error(t, err, "Expected %v to be refused", name)
+		assert.Nil(t, options, "No options expected for %v", name)
+	}
+
+	_, err := kvdb.NewOptionsBuilder().WithAuth("user", "").Build()
+	assert.Equal(t, kvdb.ErrNoPassword, err, "Expected ErrNoPassword")
+}
@@ -0,0 +1,334 @@
+package kvdb
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// replicated is a Kvdb that replicates reads and writes across several kvdbs
+// using read and write quorums. Operations that are not replicated return
+// ErrNotSupported, as serving them from a single replica would let the
+// replicas drift apart.
+type replicated struct {
+	notSupported
+	// replicas are the kvdbs holding copies of the data
+	replicas []Kvdb
+	// readQuorum is the number of replicas consulted on a read
+	readQuorum int
+	// writeQuorum is the number of replicas that must accept a write
+	writeQuorum int
+	// mutex protects seq and versions
+	mutex sync.Mutex
+	// seq is the sequence number of the last write
+	seq uint64
+	// versions holds, by key, the version of the key on each replica as of
+	// the last write applied to it through r, indexed like replicas
+	versions map[string][]replicaVersion
+}
+
+// replicaVersion identifies the value a replica holds for a key. Indexes are
+// only ever compared against those of the same replica, as each replica
+// numbers its writes independently.
+type replicaVersion struct {
+	// seq is the sequence number of the write that produced the value, 0 if
+	// no write through the decorator reached the replica
+	seq uint64
+	// index is the ModifiedIndex the replica assigned to the value
+	index uint64
+	// deleted is set if the write removed the key
+	deleted bool
+}
+
+// replicaRead is the response of a replica to a read. kvp is nil if the
+// replica does not have the key.
+type replicaRead struct {
+	replica int
+	kvp     *KVPair
+	// version is the version of the value read, known is false if the value
+	// was not written through the decorator
+	version replicaVersion
+	known   bool
+}
+
+// NewReplicated returns a Kvdb that writes to every replica and reports
+// success once writeQuorum replicas accepted the write. Reads consult
+// readQuorum replicas and return the value of the most recent write.
+// Consulted replicas that missed that write are repaired in the background.
+// Only Get, GetVal, Put, Create, Update, Delete, DeleteTree and
+// DeleteTreeForce are replicated, the other data operations return
+// ErrNotSupported.
+func NewReplicated(replicas []Kvdb, readQuorum, writeQuorum int) (Kvdb, error) {
+	if len(replicas) == 0 ||
+		readQuorum <= 0 || readQuorum > len(replicas) ||
+		writeQuorum <= 0 || writeQuorum > len(replicas) {
+		return nil, ErrIllegal
+	}
+	return &replicated{
+		replicas:    replicas,
+		readQuorum:  readQuorum,
+		writeQuorum: writeQuorum,
+		versions:    make(map[string][]replicaVersion),
+	}, nil
+}
+
+func (r *replicated) String() string {
+	return "replicated"
+}
+
+func (r *replicated) Domain() string {
+	return r.replicas[0].Domain()
+}
+
+func (r *replicated) FullKey(key string) string {
+	return r.replicas[0].FullKey(key)
+}
+
+func (r *replicated) Capabilities() int {
+	return 0
+}
+
+func (r *replicated) Get(key string) (*KVPair, error) {
+	reads := make([]replicaRead, 0, r.readQuorum)
+	var firstErr error
+	for i, replica := range r.replicas {
+		if len(reads) == r.readQuorum {
+			break
+		}
+		kvp, err := replica.Get(key)
+		if err == ErrNotFound {
+			kvp, err = nil, nil
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		reads = append(reads, replicaRead{replica: i, kvp: kvp})
+	}
+	if len(reads) < r.readQuorum {
+		return nil, firstErr
+	}
+
+	r.mutex.Lock()
+	for i := range reads {
+		reads[i].version, reads[i].known = r.identify(key, &reads[i])
+	}
+	r.mutex.Unlock()
+
+	// The freshest read is the one produced by the latest write. Values
+	// not written through the decorator cannot be ordered and are only
+	// returned if no read is known.
+	freshest := -1
+	for i, read := range reads {
+		if read.known &&
+			(freshest < 0 || read.version.seq > reads[freshest].version.seq) {
+			freshest = i
+		}
+	}
+	if freshest < 0 {
+		for _, read := range reads {
+			if read.kvp != nil {
+				return read.kvp, nil
+			}
+		}
+		return nil, ErrNotFound
+	}
+	fresh := reads[freshest]
+	for _, read := range reads {
+		if read.known && read.version.seq < fresh.version.seq {
+			go r.repair(key, read, fresh)
+		}
+	}
+	if fresh.kvp == nil {
+		return nil, ErrNotFound
+	}
+	return fresh.kvp, nil
+}
+
+func (r *replicated) GetVal(key string, val interface{}) (*KVPair, error) {
+	kvp, err := r.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(kvp.Value, val); err != nil {
+		return kvp, ErrUnmarshal
+	}
+	return kvp, nil
+}
+
+func (r *replicated) Put(key string, val interface{}, ttl uint64) (*KVPair, error) {
+	return r.write(key, false, func(replica Kvdb) (*KVPair, error) {
+		return replica.Put(key, val, ttl)
+	})
+}
+
+func (r *replicated) Create(key string, val interface{}, ttl uint64) (*KVPair, error) {
+	return r.write(key, false, func(replica Kvdb) (*KVPair, error) {
+		return replica.Create(key, val, ttl)
+	})
+}
+
+func (r *replicated) Update(key string, val interface{}, ttl uint64) (*KVPair, error) {
+	return r.write(key, false, func(replica Kvdb) (*KVPair, error) {
+		return replica.Update(key, val, ttl)
+	})
+}
+
+func (r *replicated) Delete(key string) (*KVPair, error) {
+	return r.write(key, true, func(replica Kvdb) (*KVPair, error) {
+		return replica.Delete(key)
+	})
+}
+
+func (r *replicated) DeleteTree(prefix string) error {
+	return r.deleteTree(prefix, func(replica Kvdb) error {
+		return replica.DeleteTree(prefix)
+	})
+}
+
+func (r *replicated) DeleteTreeForce(prefix string) error {
+	return r.deleteTree(prefix, func(replica Kvdb) error {
+		return replica.DeleteTreeForce(prefix)
+	})
+}
+
+// write applies op on key to every replica, deleted is set if op removes
+// key. It returns the result of the first replica that accepted the write if
+// at least writeQuorum did, and the first error otherwise.
+func (r *replicated) write(
+	key string,
+	deleted bool,
+	op func(replica Kvdb) (*KVPair, error),
+) (*KVPair, error) {
+	seq := r.nextSeq()
+	var result *KVPair
+	var firstErr error
+	accepted := 0
+	for i, replica := range r.replicas {
+		kvp, err := op(replica)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		r.record(key, i, replicaVersion{
+			seq:     seq,
+			index:   kvp.ModifiedIndex,
+			deleted: deleted,
+		})
+		if result == nil {
+			result = kvp
+		}
+		accepted++
+	}
+	if accepted < r.writeQuorum {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// deleteTree applies op on prefix to every replica and records the known
+// keys under prefix as deleted on the replicas that accepted it.
+func (r *replicated) deleteTree(prefix string, op func(replica Kvdb) error) error {
+	seq := r.nextSeq()
+	var firstErr error
+	accepted := 0
+	for i, replica := range r.replicas {
+		if err := op(replica); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		r.mutex.Lock()
+		for key := range r.versions {
+			if strings.HasPrefix(key, prefix) {
+				r.recordLocked(key, i, replicaVersion{seq: seq, deleted: true})
+			}
+		}
+		r.mutex.Unlock()
+		accepted++
+	}
+	if accepted < r.writeQuorum {
+		return firstErr
+	}
+	return nil
+}
+
+func (r *replicated) nextSeq() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.seq++
+	return r.seq
+}
+
+// record sets the version of key on replica i, unless a later write was
+// already recorded.
+func (r *replicated) record(key string, i int, version replicaVersion) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.recordLocked(key, i, version)
+}
+
+// recordLocked is record with r.mutex held.
+func (r *replicated) recordLocked(key string, i int, version replicaVersion) {
+	versions, ok := r.versions[key]
+	if !ok {
+		versions = make([]replicaVersion, len(r.replicas))
+		r.versions[key] = versions
+	}
+	if version.seq > versions[i].seq {
+		versions[i] = version
+	}
+}
+
+// identify returns the version of the value read from a replica. The value
+// is known if it is the one recorded for the replica, or if the replica
+// does not have a key that was never written through the decorator.
+// r.mutex must be held.
+func (r *replicated) identify(key string, read *replicaRead) (replicaVersion, bool) {
+	var version replicaVersion
+	if versions, ok := r.versions[key]; ok {
+		version = versions[read.replica]
+	}
+	if read.kvp == nil {
+		return version, version.seq == 0 || version.deleted
+	}
+	return version, version.seq != 0 && !version.deleted &&
+		version.index == read.kvp.ModifiedIndex
+}
+
+// repair brings the value of key on the stale replica up to date with the
+// fresh read. The stale value is replaced only if it is still the one that
+// was read, so a write that reached the replica since is never overwritten.
+func (r *replicated) repair(key string, stale, fresh replicaRead) {
+	replica := r.replicas[stale.replica]
+	var kvp *KVPair
+	var err error
+	switch {
+	case fresh.kvp == nil:
+		kvp, err = replica.CompareAndDelete(stale.kvp, KVModifiedIndex)
+	case stale.kvp == nil:
+		kvp, err = replica.Create(key, fresh.kvp.Value, uint64(fresh.kvp.TTL))
+	default:
+		kvp, err = replica.CompareAndSet(&KVPair{
+			Key:           key,
+			Value:         fresh.kvp.Value,
+			ModifiedIndex: stale.kvp.ModifiedIndex,
+		}, KVModifiedIndex, nil)
+	}
+	if err != nil {
+		logrus.Warnf("Failed to repair %v on %v: %v", key, replica, err)
+		return
+	}
+	r.record(key, stale.replica, replicaVersion{
+		seq:     fresh.version.seq,
+		index:   kvp.ModifiedIndex,
+		deleted: fresh.kvp == nil,
+	})
+}
@@ -0,0 +1,211 @@
+package kvdb_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/portworx/kvdb/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newReplicas(t *testing.T, count int) []kvdb.Kvdb {
+	replicas := make([]kvdb.Kvdb, 0, count)
+	for i := 0; i < count; i++ {
+		kv, err := mem.New("pwx/test", nil, nil, nil)
+		require.NoError(t, err, "Unexpected error in New")
+		replicas = append(replicas, kv)
+	}
+	return replicas
+}
+
+// downKvdb rejects writes while down is set, so that its kvdb misses them.
+type downKvdb struct {
+	kvdb.Kvdb
+	down int32
+}
+
+func (d *downKvdb) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&d.down, 1)
+	} else {
+		atomic.StoreInt32(&d.down, 0)
+	}
+}
+
+func (d *downKvdb) isDown() bool {
+	return atomic.LoadInt32(&d.down) != 0
+}
+
+func (d *downKvdb) Put(key string, val interface{}, ttl uint64) (*kvdb.KVPair, error) {
+	if d.isDown() {
+		return nil, kvdb.ErrNotSupported
+	}
+	return d.Kvdb.Put(key, val, ttl)
+}
+
+func (d *downKvdb) DeleteTree(prefix string) error {
+	if d.isDown() {
+		return kvdb.ErrNotSupported
+	}
+	return d.Kvdb.DeleteTree(prefix)
+}
+
+// racingKvdb writes racer to the key it is asked to compare and set just
+// before doing so, as a write racing with a repair would.
+type racingKvdb struct {
+	kvdb.Kvdb
+	racer []byte
+	done  chan error
+}
+
+func (r *racingKvdb) CompareAndSet(
+	kvp *kvdb.KVPair,
+	flags kvdb.KVFlags,
+	prevValue []byte,
+) (*kvdb.KVPair, error) {
+	if _, err := r.Kvdb.Put(kvp.Key, r.racer, 0); err != nil {
+		r.done <- err
+		return nil, err
+	}
+	kvp, err := r.Kvdb.CompareAndSet(kvp, flags, prevValue)
+	r.done <- err
+	return kvp, err
+}
+
+func eventuallyValue(t *testing.T, kv kvdb.Kvdb, key, value string) {
+	require.Eventually(t, func() bool {
+		kvp, err := kv.Get(key)
+		if value == "" {
+			return err == kvdb.ErrNotFound
+		}
+		return err == nil && string(kvp.Value) == value
+	}, 5*time.Second, 10*time.Millisecond, "Replica should hold %q", value)
+}
+
+func TestReplicatedRead(t *testing.T) {
+	replicas := newReplicas(t, 3)
+	first := &downKvdb{Kvdb: replicas[0]}
+	kv, err := kvdb.NewReplicated(
+		[]kvdb.Kvdb{first, replicas[1], replicas[2]}, 2, 2)
+	require.NoError(t, err, "Unexpected error in NewReplicated")
+
+	key := "replicated"
+	_, err = kv.Put(key, []byte("v1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	for _, replica := range replicas {
+		kvp, err := replica.Get(key)
+		require.NoError(t, err, "Write should reach every replica")
+		assert.Equal(t, "v1", string(kvp.Value), "Unexpected replica value")
+	}
+
+	// Leave the first replica stale.
+	first.setDown(true)
+	_, err = kv.Put(key, []byte("v2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	first.setDown(false)
+
+	kvp, err := kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "v2", string(kvp.Value), "Read should return the freshest value")
+	eventuallyValue(t, replicas[0], key, "v2")
+
+	// A value written outside the decorator is not taken for a newer one.
+	_, err = replicas[0].Put(key, []byte("outside"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	kvp, err = kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "v2", string(kvp.Value), "Unknown value should not win")
+}
+
+func TestReplicatedRepairRace(t *testing.T) {
+	replicas := newReplicas(t, 2)
+	first := &downKvdb{Kvdb: replicas[0]}
+	racing := &racingKvdb{Kvdb: first, racer: []byte("v3"), done: make(chan error, 1)}
+	kv, err := kvdb.NewReplicated([]kvdb.Kvdb{racing, replicas[1]}, 2, 1)
+	require.NoError(t, err, "Unexpected error in NewReplicated")
+
+	key := "race"
+	_, err = kv.Put(key, []byte("v1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	first.setDown(true)
+	_, err = kv.Put(key, []byte("v2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	first.setDown(false)
+
+	kvp, err := kv.Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "v2", string(kvp.Value), "Read should return the freshest value")
+	select {
+	case err = <-racing.done:
+		assert.Equal(t, kvdb.ErrValueMismatch, err,
+			"Repair should not overwrite a racing write")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Repair not attempted")
+	}
+	kvp, err = replicas[0].Get(key)
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, "v3", string(kvp.Value), "Racing write should survive repair")
+}
+
+func TestReplicatedNotSupported(t *testing.T) {
+	replicas := newReplicas(t, 2)
+	kv, err := kvdb.NewReplicated(replicas, 1, 1)
+	require.NoError(t, err, "Unexpected error in NewReplicated")
+
+	_, err = kv.CompareAndSet(&kvdb.KVPair{Key: "cas", Value: []byte("v1")},
+		kvdb.KVFlags(0), nil)
+	assert.Equal(t, kvdb.ErrNotSupported, err, "CompareAndSet is not replicated")
+	_, err = kv.Enumerate("cas")
+	assert.Equal(t, kvdb.ErrNotSupported, err, "Enumerate is not replicated")
+	for _, replica := range replicas {
+		_, err := replica.Get("cas")
+		assert.Equal(t, kvdb.ErrNotFound, err, "Unsupported write reached a replica")
+	}
+}
+
+func TestReplicatedDeleteTree(t *testing.T) {
+	replicas := newReplicas(t, 3)
+	last := &downKvdb{Kvdb: replicas[2]}
+	kv, err := kvdb.NewReplicated(
+		[]kvdb.Kvdb{replicas[0], replicas[1], last}, 3, 2)
+	require.NoError(t, err, "Unexpected error in NewReplicated")
+
+	key := "tree/key"
+	_, err = kv.Put(key, []byte("v1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	last.setDown(true)
+	require.NoError(t, kv.DeleteTree("tree"), "Unexpected error in DeleteTree")
+	last.setDown(false)
+	for _, replica := range replicas[:2] {
+		_, err := replica.Get(key)
+		assert.Equal(t, kvdb.ErrNotFound, err, "DeleteTree should reach every replica")
+	}
+
+	_, err = kv.Get(key)
+	assert.Equal(t, kvdb.ErrNotFound, err, "Deleted key should not be resurrected")
+	eventuallyValue(t, replicas[2], key, "")
+}
+
+func TestReplicatedWriteQuorum(t *testing.T) {
+	replicas := newReplicas(t, 2)
+	failing := mock.New()
+	failing.On("Put", nil, kvdb.ErrNotSupported)
+	replicas = append(replicas, failing)
+
+	kv, err := kvdb.NewReplicated(replicas, 1, 2)
+	require.NoError(t, err, "Unexpected error in NewReplicated")
+	_, err = kv.Put("quorum", []byte("v1"), 0)
+	assert.NoError(t, err, "Write should meet a quorum of two")
+
+	kv, err = kvdb.NewReplicated(replicas, 1, 3)
+	require.NoError(t, err, "Unexpected error in NewReplicated")
+	_, err = kv.Put("quorum", []byte("v2"), 0)
+	assert.Equal(t, kvdb.ErrNotSupported, err, "Write should miss a quorum of three")
+
+	_, err = kvdb.NewReplicated(replicas, 4, 1)
+	assert.Equal(t, kvdb.ErrIllegal, err, "Read quorum larger than replicas")
+}
@@ -0,0 +1,63 @@
+package kvdb
+
+import (
+	"time"
+)
+
+// RetryPolicy bounds the retries of an operation that failed transiently.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one.
+	MaxAttempts int
+	// Backoff is the wait before the first retry. It doubles after every
+	// retry.
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries if set.
+	MaxBackoff time.Duration
+	// Retryable reports whether an error is transient. If nil, every error
+	// except the kvdb errors that report a definite outcome is retried.
+	Retryable func(err error) bool
+}
+
+// retryable reports whether err is worth retrying under p.
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	switch err {
+	case ErrNotFound, ErrValueMismatch, ErrModified, ErrInvalidLock,
+		ErrIllegal, ErrNotSupported:
+		return false
+	}
+	return true
+}
+
+// nextBackoff returns the wait before the retry that follows a wait of
+// backoff under p.
+func (p *RetryPolicy) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// UnlockWithRetry unlocks kvp, retrying the unlock under policy while it
+// fails with a retryable error. A retry that finds the lock gone counts as
+// released since the failed attempt may have released it.
+func UnlockWithRetry(db Kvdb, kvp *KVPair, policy RetryPolicy) error {
+	backoff := policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = db.Unlock(kvp)
+		switch {
+		case err == nil:
+			return nil
+		case err == ErrNotFound && attempt > 1:
+			return nil
+		case !policy.retryable(err) || attempt >= policy.MaxAttempts:
+			return err
+		}
+		time.Sleep(backoff)
+		backoff = policy.nextBackoff(backoff)
+	}
+}
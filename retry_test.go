@@ -0,0 +1,81 @@
+package kvdb_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errTransient = errors.New("transient failure")
+
+// flakyKvdb fails the first failures calls to Unlock with err.
+type flakyKvdb struct {
+	kvdb.Kvdb
+	mu       sync.Mutex
+	failures int
+	err      error
+	attempts int
+}
+
+func (f *flakyKvdb) Unlock(kvp *kvdb.KVPair) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	if f.attempts <= f.failures {
+		return f.err
+	}
+	return f.Kvdb.Unlock(kvp)
+}
+
+func TestUnlockWithRetry(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	policy := kvdb.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	lock, err := kv.Lock("retry/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+	flaky := &flakyKvdb{Kvdb: kv, failures: 1, err: errTransient}
+	require.NoError(t, kvdb.UnlockWithRetry(flaky, lock, policy),
+		"Unexpected error in UnlockWithRetry")
+	assert.Equal(t, 2, flaky.attempts, "Expected a single retry")
+
+	// The lock was released, so it can be taken again without waiting.
+	relocked := make(chan error, 1)
+	go func() {
+		lock, err := kv.Lock("retry/lock")
+		if err == nil {
+			err = kv.Unlock(lock)
+		}
+		relocked <- err
+	}()
+	select {
+	case err := <-relocked:
+		assert.NoError(t, err, "Unexpected error relocking")
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("Lock was not released")
+	}
+}
+
+func TestUnlockWithRetryExhausted(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	policy := kvdb.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	lock, err := kv.Lock("retry/lock")
+	require.NoError(t, err, "Unexpected error in Lock")
+	flaky := &flakyKvdb{Kvdb: kv, failures: 5, err: errTransient}
+	assert.Equal(t, errTransient, kvdb.UnlockWithRetry(flaky, lock, policy),
+		"Expected the transient error once the budget is exhausted")
+	assert.Equal(t, 3, flaky.attempts, "Unexpected number of attempts")
+
+	flaky = &flakyKvdb{Kvdb: kv, failures: 5, err: kvdb.ErrInvalidLock}
+	assert.Equal(t, kvdb.ErrInvalidLock, kvdb.UnlockWithRetry(flaky, lock, policy),
+		"Expected a non retryable error to be returned")
+	assert.Equal(t, 1, flaky.attempts, "Non retryable errors should not be retried")
+}
@@ -0,0 +1,82 @@
+package kvdb
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RunLocked acquires the lock at key for lockerID, waiting as long as it
+// takes, runs fn and releases the lock. The lock expires after ttl seconds
+// unless ttl is 0, it is refreshed every ttl/2 seconds while fn runs if db
+// supports RefreshLock. The lock is released even if fn panics, in which case
+// the panic is returned as an error. The error of fn takes precedence over
+// the error refreshing the lock, which takes precedence over the error
+// releasing it.
+//
+// RunLocked is not named WithLock as Kvdb.WithLock already returns a view of
+// the kvdb that writes under a held lock.
+func RunLocked(
+	db Kvdb,
+	key string,
+	lockerID string,
+	ttl uint64,
+	fn func() error,
+) (err error) {
+	lock, err := db.LockWithTimeout(key, lockerID, 0, ttl)
+	if err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	var refreshErr error
+	var wg sync.WaitGroup
+	if ttl > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, refreshErr = refreshLock(db, lock, ttl, stop)
+		}()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic while holding lock %v: %v", key, r)
+		}
+		close(stop)
+		wg.Wait()
+		if err == nil {
+			err = refreshErr
+		}
+		if unlockErr := db.Unlock(lock); err == nil {
+			err = unlockErr
+		}
+	}()
+	return fn()
+}
+
+// refreshLock refreshes lock every ttl/2 seconds until stop is closed, and
+// returns the last refreshed lock. It gives up on the first error, which is
+// returned unless db does not support RefreshLock.
+func refreshLock(
+	db Kvdb,
+	lock *KVPair,
+	ttl uint64,
+	stop chan struct{},
+) (*KVPair, error) {
+	ticker := time.NewTicker(time.Duration(ttl) * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return lock, nil
+		case <-ticker.C:
+		}
+		refreshed, err := db.RefreshLock(lock, ttl)
+		if err == ErrNotSupported {
+			return lock, nil
+		}
+		if err != nil {
+			return lock, fmt.Errorf("Failed to refresh lock %v: %w", lock.Key, err)
+		}
+		lock = refreshed
+	}
+}
@@ -0,0 +1,69 @@
+package kvdb_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunLocked(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "runlocked/lock"
+	requireReleased := func(name string) {
+		lock, err := kv.LockWithTimeout(key, "check", time.Second, 0)
+		require.NoError(t, err, "Lock should be released after %v", name)
+		require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+	}
+
+	ran := false
+	err = kvdb.RunLocked(kv, key, "runner", 0, func() error {
+		_, err := kv.LockWithTimeout(key, "other", 10*time.Millisecond, 0)
+		assert.Equal(t, kvdb.ErrLockTimeout, err,
+			"Lock should be held while fn runs")
+		ran = true
+		return nil
+	})
+	require.NoError(t, err, "Unexpected error in RunLocked")
+	assert.True(t, ran, "fn should run")
+	requireReleased("fn returned")
+
+	fnErr := errors.New("fn failed")
+	err = kvdb.RunLocked(kv, key, "runner", 0, func() error {
+		return fnErr
+	})
+	assert.Equal(t, fnErr, err, "The error of fn should be returned")
+	requireReleased("fn failed")
+
+	err = kvdb.RunLocked(kv, key, "runner", 0, func() error {
+		panic("fn panicked")
+	})
+	assert.Error(t, err, "A panic in fn should be returned as an error")
+	requireReleased("fn panicked")
+}
+
+func TestRunLockedRefresh(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	// fn outlasts the lock TTL, the lock must be refreshed meanwhile.
+	key := "runlocked/refresh"
+	err = kvdb.RunLocked(kv, key, "runner", 1, func() error {
+		time.Sleep(2500 * time.Millisecond)
+		_, err := kv.LockWithTimeout(key, "other", 10*time.Millisecond, 0)
+		assert.Equal(t, kvdb.ErrLockTimeout, err,
+			"Lock should still be held after its TTL")
+		return nil
+	})
+	require.NoError(t, err, "Unexpected error in RunLocked")
+
+	lock, err := kv.LockWithTimeout(key, "check", time.Second, 0)
+	require.NoError(t, err, "Lock should be released after fn returned")
+	require.NoError(t, kv.Unlock(lock), "Unexpected error in Unlock")
+}
@@ -0,0 +1,45 @@
+package kvdb
+
+import (
+	"bytes"
+	"sort"
+)
+
+// SnapshotDiff compares two sets of pairs, such as two enumerations of the
+// same tree, by key. It returns the pairs of b whose key is not in a, the
+// pairs of b whose value or ModifiedIndex differs from a, and the pairs of a
+// whose key is not in b. Each result is sorted by key.
+func SnapshotDiff(a, b KVPairs) (added, changed, deleted KVPairs) {
+	before := make(map[string]*KVPair, len(a))
+	for _, kvp := range a {
+		before[kvp.Key] = kvp
+	}
+	after := make(map[string]*KVPair, len(b))
+	for _, kvp := range b {
+		after[kvp.Key] = kvp
+		old, ok := before[kvp.Key]
+		switch {
+		case !ok:
+			added = append(added, kvp)
+		case !bytes.Equal(old.Value, kvp.Value) ||
+			old.ModifiedIndex != kvp.ModifiedIndex:
+			changed = append(changed, kvp)
+		}
+	}
+	for _, kvp := range a {
+		if _, ok := after[kvp.Key]; !ok {
+			deleted = append(deleted, kvp)
+		}
+	}
+	for _, kvps := range []KVPairs{added, changed, deleted} {
+		sortByKey(kvps)
+	}
+	return added, changed, deleted
+}
+
+// sortByKey sorts kvps by key.
+func sortByKey(kvps KVPairs) {
+	sort.Slice(kvps, func(i, j int) bool {
+		return kvps[i].Key < kvps[j].Key
+	})
+}
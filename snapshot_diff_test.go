@@ -0,0 +1,43 @@
+package kvdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func diffKeys(kvps KVPairs) []string {
+	keys := make([]string, 0, len(kvps))
+	for _, kvp := range kvps {
+		keys = append(keys, kvp.Key)
+	}
+	return keys
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	a := KVPairs{
+		{Key: "same", Value: []byte("v"), ModifiedIndex: 1},
+		{Key: "value", Value: []byte("old"), ModifiedIndex: 2},
+		{Key: "index", Value: []byte("v"), ModifiedIndex: 3},
+		{Key: "gone", Value: []byte("v"), ModifiedIndex: 4},
+	}
+	b := KVPairs{
+		{Key: "new", Value: []byte("v"), ModifiedIndex: 9},
+		{Key: "index", Value: []byte("v"), ModifiedIndex: 7},
+		{Key: "value", Value: []byte("new"), ModifiedIndex: 2},
+		{Key: "same", Value: []byte("v"), ModifiedIndex: 1},
+		{Key: "added", Value: []byte("v"), ModifiedIndex: 8},
+	}
+
+	added, changed, deleted := SnapshotDiff(a, b)
+	assert.Equal(t, []string{"added", "new"}, diffKeys(added), "Unexpected added keys")
+	assert.Equal(t, []string{"index", "value"}, diffKeys(changed),
+		"Unexpected changed keys")
+	assert.Equal(t, "new", string(changed[1].Value), "Changed pairs should come from b")
+	assert.Equal(t, []string{"gone"}, diffKeys(deleted), "Unexpected deleted keys")
+
+	added, changed, deleted = SnapshotDiff(a, a)
+	assert.Empty(t, added, "No adds expected between equal snapshots")
+	assert.Empty(t, changed, "No changes expected between equal snapshots")
+	assert.Empty(t, deleted, "No deletes expected between equal snapshots")
+}
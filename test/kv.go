@@ -64,6 +64,7 @@ func Run(datastoreInit kvdb.DatastoreInit, t *testing.T) kvdb.Kvdb {
 	watchKey(kv, t)
 	watchTree(kv, t)
 	watchWithIndex(kv, t)
+	watchWithContext(kv, t)
 	collect(kv, t)
 	return kv
 }
@@ -88,6 +89,7 @@ func RunBasic(datastoreInit kvdb.DatastoreInit, t *testing.T) {
 	watchTree(kv, t)
 	watchKey(kv, t)
 	watchWithIndex(kv, t)
+	watchWithContext(kv, t)
 	cas(kv, t)
 }
 
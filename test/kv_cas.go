@@ -0,0 +1,161 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/portworx/kvdb"
+	"github.com/stretchr/testify/require"
+)
+
+// RunCASConformance verifies that CompareAndSet and CompareAndDelete apply
+// every condition set in their flags and leave the key untouched, with one
+// of the documented errors, when a condition does not hold.
+func RunCASConformance(datastoreInit kvdb.DatastoreInit, t *testing.T) {
+	kv, err := datastoreInit("pwx/test", nil, nil, fatalErrorCb())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	casConformance(kv, t)
+	cadConformance(kv, t)
+}
+
+// requireRefused fails unless err is one of accepted and key still holds
+// value, or is absent if value is nil.
+func requireRefused(
+	t *testing.T,
+	kv kvdb.Kvdb,
+	key string,
+	value []byte,
+	err error,
+	accepted ...error,
+) {
+	require.Error(t, err, "Expected %v to be refused", key)
+	require.Contains(t, accepted, err, "Unexpected error for %v", key)
+	kvp, getErr := kv.Get(key)
+	if value == nil {
+		require.Equal(t, kvdb.ErrNotFound, getErr,
+			"Refused operation created %v", key)
+		return
+	}
+	require.NoError(t, getErr, "Refused operation deleted %v", key)
+	require.Equal(t, string(value), string(kvp.Value),
+		"Refused operation changed %v", key)
+}
+
+func casConformance(kv kvdb.Kvdb, t *testing.T) {
+	fmt.Println("casConformance")
+
+	prefix := "casconformance"
+	key := prefix + "/key"
+	kv.DeleteTree(prefix)
+	defer kv.DeleteTree(prefix)
+
+	// Index only.
+	stale, err := kv.Put(key, []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	current, err := kv.Put(key, []byte("2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.Put(prefix+"/other", []byte("other"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	update := *stale
+	update.Value = []byte("3")
+	_, err = kv.CompareAndSet(&update, kvdb.KVModifiedIndex, nil)
+	requireRefused(t, kv, key, []byte("2"), err,
+		kvdb.ErrModified, kvdb.ErrValueMismatch)
+	update = *current
+	update.Value = []byte("3")
+	current, err = kv.CompareAndSet(&update, kvdb.KVModifiedIndex, nil)
+	require.NoError(t, err, "Index-only CompareAndSet should succeed "+
+		"despite writes to other keys")
+	require.Equal(t, "3", string(current.Value), "Unexpected value")
+
+	// Value only.
+	update = *current
+	update.Value = []byte("4")
+	_, err = kv.CompareAndSet(&update, kvdb.KVFlags(0), []byte("bad"))
+	requireRefused(t, kv, key, []byte("3"), err, kvdb.ErrValueMismatch)
+	result, err := kv.CompareAndSet(&update, kvdb.KVFlags(0), []byte("3"))
+	if err == kvdb.ErrNotSupported {
+		fmt.Println("Value-only CompareAndSet not supported")
+	} else {
+		require.NoError(t, err, "Value-only CompareAndSet should succeed")
+		require.Equal(t, "4", string(result.Value), "Unexpected value")
+		current = result
+	}
+
+	// Value and index, both conditions must hold.
+	previous := string(current.Value)
+	update = *current
+	update.Value = []byte("5")
+	_, err = kv.CompareAndSet(&update, kvdb.KVModifiedIndex, []byte("bad"))
+	requireRefused(t, kv, key, []byte(previous), err,
+		kvdb.ErrModified, kvdb.ErrValueMismatch)
+	update.ModifiedIndex = stale.ModifiedIndex
+	_, err = kv.CompareAndSet(&update, kvdb.KVModifiedIndex, []byte(previous))
+	requireRefused(t, kv, key, []byte(previous), err,
+		kvdb.ErrModified, kvdb.ErrValueMismatch)
+	update.ModifiedIndex = current.ModifiedIndex
+	result, err = kv.CompareAndSet(&update, kvdb.KVModifiedIndex, []byte(previous))
+	require.NoError(t, err, "CompareAndSet on value and index should succeed")
+	require.Equal(t, "5", string(result.Value), "Unexpected value")
+
+	// Absent key.
+	absent := kvdb.KVPair{
+		Key:           prefix + "/absent",
+		Value:         []byte("1"),
+		ModifiedIndex: result.ModifiedIndex,
+	}
+	_, err = kv.CompareAndSet(&absent, kvdb.KVModifiedIndex, nil)
+	requireRefused(t, kv, absent.Key, nil, err,
+		kvdb.ErrNotFound, kvdb.ErrModified, kvdb.ErrValueMismatch)
+	_, err = kv.CompareAndSet(&absent, kvdb.KVFlags(0), []byte("1"))
+	requireRefused(t, kv, absent.Key, nil, err,
+		kvdb.ErrNotFound, kvdb.ErrValueMismatch, kvdb.ErrNotSupported)
+}
+
+func cadConformance(kv kvdb.Kvdb, t *testing.T) {
+	fmt.Println("cadConformance")
+
+	prefix := "cadconformance"
+	key := prefix + "/key"
+	kv.DeleteTree(prefix)
+	defer kv.DeleteTree(prefix)
+
+	// Value only. A mismatch is reported as ErrNotFound by backends whose
+	// Unlock treats it as a lock that is no longer held.
+	kvp, err := kv.Put(key, []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	mismatch := *kvp
+	mismatch.Value = []byte("bad")
+	_, err = kv.CompareAndDelete(&mismatch, kvdb.KVFlags(0))
+	requireRefused(t, kv, key, []byte("1"), err,
+		kvdb.ErrValueMismatch, kvdb.ErrNotFound)
+	_, err = kv.CompareAndDelete(kvp, kvdb.KVFlags(0))
+	require.NoError(t, err, "Value-only CompareAndDelete should succeed")
+	_, err = kv.Get(key)
+	require.Equal(t, kvdb.ErrNotFound, err, "Key should be deleted")
+
+	// Absent key.
+	_, err = kv.CompareAndDelete(kvp, kvdb.KVFlags(0))
+	requireRefused(t, kv, key, nil, err,
+		kvdb.ErrNotFound, kvdb.ErrValueMismatch)
+
+	// Index only.
+	stale, err := kv.Put(key, []byte("1"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	current, err := kv.Put(key, []byte("2"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, err = kv.CompareAndDelete(stale, kvdb.KVModifiedIndex)
+	if err == kvdb.ErrNotSupported {
+		fmt.Println("Index CompareAndDelete not supported")
+		return
+	}
+	requireRefused(t, kv, key, []byte("2"), err,
+		kvdb.ErrModified, kvdb.ErrValueMismatch)
+	_, err = kv.CompareAndDelete(current, kvdb.KVModifiedIndex)
+	require.NoError(t, err, "Index-only CompareAndDelete should succeed")
+	_, err = kv.Get(key)
+	require.Equal(t, kvdb.ErrNotFound, err, "Key should be deleted")
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/stretchr/testify/require"
+)
+
+// watchEvent is an update expected or observed by a watch.
+type watchEvent struct {
+	key    string
+	action kvdb.KVAction
+	index  uint64
+}
+
+// RunWatchConformance verifies that a tree watch observes every update in
+// order, with contiguous indexes and the correct actions.
+func RunWatchConformance(datastoreInit kvdb.DatastoreInit, t *testing.T) {
+	kv, err := datastoreInit("pwx/test", nil, nil, fatalErrorCb())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	watchConformance(kv, t)
+}
+
+func watchConformance(kv kvdb.Kvdb, t *testing.T) {
+	fmt.Println("watchConformance")
+
+	prefix := "watchconformance"
+	keyA := prefix + "/a"
+	keyB := prefix + "/b"
+	stopKey := prefix + "/stop"
+	kv.DeleteTree(prefix)
+	defer kv.DeleteTree(prefix)
+
+	// Updates at or before the base index must not be delivered.
+	base, err := kv.Put(prefix+"/base", []byte("base"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	observed := make(chan watchEvent, 100)
+	stopped := make(chan struct{})
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair,
+		err error) error {
+		if err != nil {
+			if err == kvdb.ErrWatchStopped {
+				close(stopped)
+			}
+			return err
+		}
+		observed <- watchEvent{kvp.Key, kvp.Action, kvp.ModifiedIndex}
+		if kvp.Key == stopKey {
+			return errors.New("stop")
+		}
+		return nil
+	}
+	err = kv.WatchTree(prefix, base.ModifiedIndex, nil, cb)
+	if err != nil {
+		fmt.Printf("Cannot test watchConformance: %v\n", err)
+		return
+	}
+
+	expected := make([]watchEvent, 0)
+	record := func(kvp *kvdb.KVPair, err error, action kvdb.KVAction) {
+		require.NoError(t, err, "Unexpected error updating kvdb")
+		expected = append(expected,
+			watchEvent{kvp.Key, action, kvp.ModifiedIndex})
+	}
+	kvp, err := kv.Create(keyA, []byte("1"), 0)
+	record(kvp, err, kvdb.KVCreate)
+	kvp, err = kv.Put(keyA, []byte("2"), 0)
+	record(kvp, err, kvdb.KVSet)
+	kvp, err = kv.Create(keyB, []byte("1"), 0)
+	record(kvp, err, kvdb.KVCreate)
+	kvp, err = kv.Update(keyA, []byte("3"), 0)
+	record(kvp, err, kvdb.KVSet)
+	kvp, err = kv.Delete(keyB)
+	record(kvp, err, kvdb.KVDelete)
+	kvp, err = kv.Put(keyB, []byte("2"), 0)
+	record(kvp, err, kvdb.KVCreate)
+	kvp, err = kv.Delete(keyA)
+	record(kvp, err, kvdb.KVDelete)
+	kvp, err = kv.Create(stopKey, []byte("stop"), 0)
+	record(kvp, err, kvdb.KVCreate)
+
+	for i, want := range expected {
+		select {
+		case got := <-observed:
+			require.Equal(t, want.key, got.key,
+				"Event %d: dropped or reordered event", i)
+			require.Equal(t, want.action, got.action,
+				"Event %d: wrong action for key %v", i, got.key)
+			require.Equal(t, want.index, got.index,
+				"Event %d: wrong index for key %v", i, got.key)
+			if i > 0 {
+				require.Equal(t, expected[i-1].index+1, got.index,
+					"Event %d: non contiguous index", i)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Event %d: timed out waiting for %v on %v",
+				i, want.action, want.key)
+		}
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for watch to stop")
+	}
+	select {
+	case got := <-observed:
+		t.Fatalf("Unexpected event after watch stopped: %v", got)
+	default:
+	}
+}
+
+// watchWithContext verifies that cancelling the context of a watch stops it
+// promptly, even if the watched key never changes.
+func watchWithContext(kv kvdb.Kvdb, t *testing.T) {
+	fmt.Println("watchWithContext")
+
+	key := "watchctx/key"
+	kv.Delete(key)
+	defer kv.Delete(key)
+
+	updates := make(chan *kvdb.KVPair, 10)
+	errs := make(chan error, 10)
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair,
+		err error) error {
+		if err != nil {
+			errs <- err
+			return err
+		}
+		updates <- kvp
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err := kv.WatchKeyWithContext(ctx, key, 0, nil, cb)
+	if err != nil {
+		cancel()
+		fmt.Printf("Cannot test watchWithContext: %v\n", err)
+		return
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		require.Equal(t, kvdb.ErrWatchStopped, err, "Unexpected watch error")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the cancelled watch to stop")
+	}
+	_, err = kv.Put(key, []byte("after"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case kvp := <-updates:
+		t.Fatalf("Unexpected update after watch stopped: %v", kvp.Key)
+	case err := <-errs:
+		t.Fatalf("Unexpected error after watch stopped: %v", err)
+	default:
+	}
+}
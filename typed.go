@@ -0,0 +1,81 @@
+package kvdb
+
+// TypedWatchCB is called with the decoded value when a watched key or tree is
+// modified. val is the zero value for deletes and for updates that fail to
+// decode, in which case err is ErrUnmarshal. Otherwise it has the same
+// semantics as WatchCB.
+type TypedWatchCB[T any] func(prefix string, val T, kvp *KVPair, err error) error
+
+// Typed is a view of a Kvdb that stores values of type T encoded by the codec
+// of the kvdb, as reported by CodecProvider, or as JSON if it has none.
+type Typed[T any] struct {
+	db Kvdb
+}
+
+// NewTyped returns a Typed view of db.
+func NewTyped[T any](db Kvdb) *Typed[T] {
+	return &Typed[T]{db: db}
+}
+
+// codec returns the codec values are encoded with.
+func (t *Typed[T]) codec() Codec {
+	if provider, ok := t.db.(CodecProvider); ok {
+		return provider.Codec()
+	}
+	return JSONCodec
+}
+
+// Get returns the decoded value at key along with its KVPair.
+func (t *Typed[T]) Get(key string) (T, *KVPair, error) {
+	var val T
+	kvp, err := t.db.Get(key)
+	if err != nil {
+		return val, nil, err
+	}
+	if err := t.codec().Unmarshal(kvp.Value, &val); err != nil {
+		return val, kvp, ErrUnmarshal
+	}
+	return val, kvp, nil
+}
+
+// Put encodes val and inserts it at key with the given ttl.
+func (t *Typed[T]) Put(key string, val T, ttl uint64) (*KVPair, error) {
+	b, err := t.codec().Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	return t.db.Put(key, b, ttl)
+}
+
+// WatchKey watches key and calls cb with each decoded update.
+func (t *Typed[T]) WatchKey(
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	cb TypedWatchCB[T],
+) error {
+	return t.db.WatchKey(key, waitIndex, opaque, t.watchCb(cb))
+}
+
+// WatchTree watches all keys that share prefix and calls cb with each decoded
+// update.
+func (t *Typed[T]) WatchTree(
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	cb TypedWatchCB[T],
+) error {
+	return t.db.WatchTree(prefix, waitIndex, opaque, t.watchCb(cb))
+}
+
+func (t *Typed[T]) watchCb(cb TypedWatchCB[T]) WatchCB {
+	return func(prefix string, opaque interface{}, kvp *KVPair, err error) error {
+		var val T
+		if err == nil && kvp.Action != KVDelete && kvp.Action != KVExpire {
+			if t.codec().Unmarshal(kvp.Value, &val) != nil {
+				err = ErrUnmarshal
+			}
+		}
+		return cb(prefix, val, kvp, err)
+	}
+}
@@ -0,0 +1,113 @@
+package kvdb_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type volume struct {
+	Name  string
+	Size  int
+	Nodes []string
+}
+
+func TestTyped(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	volumes := kvdb.NewTyped[volume](kv)
+
+	v := volume{Name: "vol1", Size: 10, Nodes: []string{"n1"}}
+	kvp, err := volumes.Put("volumes/vol1", v, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	got, getKvp, err := volumes.Get("volumes/vol1")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, v, got, "Unexpected typed value")
+	assert.Equal(t, kvp.ModifiedIndex, getKvp.ModifiedIndex, "Unexpected index")
+
+	_, err = kv.Put("volumes/bad", []byte("not json"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	_, _, err = volumes.Get("volumes/bad")
+	assert.Equal(t, kvdb.ErrUnmarshal, err, "Expected decode error")
+
+	_, _, err = volumes.Get("volumes/missing")
+	assert.Equal(t, kvdb.ErrNotFound, err, "Expected missing key")
+}
+
+func TestTypedWatch(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	volumes := kvdb.NewTyped[volume](kv)
+
+	updates := make(chan volume, 10)
+	err = volumes.WatchTree("volumes", 0, nil,
+		func(prefix string, v volume, kvp *kvdb.KVPair, err error) error {
+			if err != nil {
+				return err
+			}
+			updates <- v
+			return nil
+		})
+	require.NoError(t, err, "Unexpected error in WatchTree")
+
+	expected := []volume{{Name: "vol1", Size: 10}, {Name: "vol1", Size: 20}}
+	for _, v := range expected {
+		_, err = volumes.Put("volumes/vol1", v, 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	for _, v := range expected {
+		select {
+		case got := <-updates:
+			assert.Equal(t, v, got, "Unexpected typed update")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for typed update")
+		}
+	}
+}
+
+// gobCodec stores values in the gob encoding.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func TestTypedCodec(t *testing.T) {
+	require.NoError(t, kvdb.RegisterCodec("typed-test-gob", gobCodec{}),
+		"Unexpected error in RegisterCodec")
+	kv, err := mem.New("pwx/test", nil,
+		map[string]string{kvdb.CodecKey: "typed-test-gob"}, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	volumes := kvdb.NewTyped[volume](kv)
+
+	v := volume{Name: "vol1", Size: 10, Nodes: []string{"n1"}}
+	kvp, err := volumes.Put("volumes/vol1", v, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	var raw volume
+	require.NoError(t, gobCodec{}.Unmarshal(kvp.Value, &raw),
+		"Value should be encoded by the kvdb codec")
+	assert.Equal(t, v, raw, "Unexpected encoded value")
+
+	var got volume
+	_, err = kv.GetVal("volumes/vol1", &got)
+	require.NoError(t, err, "Unexpected error in GetVal")
+	assert.Equal(t, v, got, "GetVal should decode the typed value")
+	got, _, err = volumes.Get("volumes/vol1")
+	require.NoError(t, err, "Unexpected error in Get")
+	assert.Equal(t, v, got, "Unexpected typed value")
+}
@@ -0,0 +1,58 @@
+package kvdb
+
+import (
+	"context"
+	"time"
+)
+
+// WaitForEmpty blocks until there are no keys under prefix, or returns
+// ErrWatchTimeout once timeout elapses.
+func WaitForEmpty(db Kvdb, prefix string, timeout time.Duration) error {
+	kvps, waitIndex, err := watchStart(db, prefix)
+	if err != nil {
+		return err
+	}
+	if len(kvps) == 0 {
+		return nil
+	}
+
+	empty := make(chan error, 1)
+	notify := func(err error) {
+		select {
+		case empty <- err:
+		default:
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = db.WatchTreeWithContext(ctx, prefix, waitIndex, nil,
+		func(key string, opaque interface{}, kvp *KVPair, err error) error {
+			if err != nil {
+				notify(err)
+				return err
+			}
+			if kvp.Action != KVDelete && kvp.Action != KVExpire {
+				return nil
+			}
+			kvps, err := db.Enumerate(prefix)
+			if err != nil {
+				notify(err)
+				return err
+			}
+			if len(kvps) == 0 {
+				notify(nil)
+				return ErrWatchStopped
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-empty:
+		return err
+	case <-time.After(timeout):
+		return ErrWatchTimeout
+	}
+}
@@ -0,0 +1,69 @@
+package kvdb_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForEmpty(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	require.NoError(t, kvdb.WaitForEmpty(kv, "claims", time.Second),
+		"Empty tree should not block")
+
+	count := 5
+	for i := 0; i < count; i++ {
+		_, err = kv.Put("claims/"+strconv.Itoa(i), []byte("worker"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			time.Sleep(time.Duration(i*10) * time.Millisecond)
+			_, err := kv.Delete("claims/" + strconv.Itoa(i))
+			assert.NoError(t, err, "Unexpected error in Delete")
+		}(i)
+	}
+	require.NoError(t, kvdb.WaitForEmpty(kv, "claims", 5*time.Second),
+		"Unexpected error waiting for empty tree")
+	kvps, err := kv.Enumerate("claims")
+	require.NoError(t, err, "Unexpected error in Enumerate")
+	assert.Empty(t, kvps, "Tree should be empty")
+}
+
+func TestWaitForEmptyTimeout(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	_, err = kv.Put("claims/held", []byte("worker"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, kvdb.ErrWatchTimeout,
+		kvdb.WaitForEmpty(kv, "claims", 100*time.Millisecond),
+		"Expected timeout while a claim is held")
+	// The watch must not outlive the call on a tree that stays quiet.
+	require.Eventually(t, func() bool {
+		has, err := kv.HasWatchers("claims")
+		return err == nil && !has
+	}, 5*time.Second, 10*time.Millisecond, "Watch on claims leaked")
+}
+
+func TestWaitForEmptyOldWrite(t *testing.T) {
+	kv, compact := newShortHistory(t)
+	_, err := kv.Put("claims/old", []byte("worker"), 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	compact()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, err := kv.Delete("claims/old")
+		assert.NoError(t, err, "Unexpected error in Delete")
+	}()
+	require.NoError(t, kvdb.WaitForEmpty(kv, "claims", 5*time.Second),
+		"A key written before the history should be watched")
+}
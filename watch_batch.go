@@ -0,0 +1,98 @@
+package kvdb
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// WatchBatchCB is called with a batch of updates in ModifiedIndex order. If
+// it returns an error the watch is stopped.
+type WatchBatchCB func(kvps KVPairs) error
+
+// watchBatcher accumulates watch updates and delivers them in batches.
+type watchBatcher struct {
+	sync.Mutex
+	// maxBatch is the number of updates that triggers a delivery
+	maxBatch int
+	// maxDelay is the longest an update waits before being delivered
+	maxDelay time.Duration
+	// cb is the batch callback
+	cb WatchBatchCB
+	// pending are the updates not yet delivered
+	pending KVPairs
+	// timer flushes pending updates after maxDelay
+	timer *time.Timer
+	// generation identifies the current batch, so that a timer that fired
+	// for an already delivered batch does nothing
+	generation uint64
+	// err is the error returned by cb, it stops the watch
+	err error
+}
+
+// WatchTreeBatch watches all keys that share prefix and delivers the updates
+// to cb in batches of up to maxBatch updates. A partial batch is delivered
+// once its oldest update has waited for maxDelay.
+func WatchTreeBatch(
+	db Kvdb,
+	prefix string,
+	maxBatch int,
+	maxDelay time.Duration,
+	cb WatchBatchCB,
+) error {
+	if maxBatch <= 0 || maxDelay <= 0 {
+		return ErrIllegal
+	}
+	b := &watchBatcher{maxBatch: maxBatch, maxDelay: maxDelay, cb: cb}
+	return db.WatchTree(prefix, 0, nil, b.watchCb)
+}
+
+func (b *watchBatcher) watchCb(
+	prefix string,
+	opaque interface{},
+	kvp *KVPair,
+	err error,
+) error {
+	b.Lock()
+	defer b.Unlock()
+	if err != nil {
+		b.flush()
+		return err
+	}
+	if b.err != nil {
+		return b.err
+	}
+	update := *kvp
+	b.pending = append(b.pending, &update)
+	if len(b.pending) >= b.maxBatch {
+		b.flush()
+	} else if b.timer == nil {
+		generation := b.generation
+		b.timer = time.AfterFunc(b.maxDelay, func() {
+			b.Lock()
+			defer b.Unlock()
+			if b.generation == generation {
+				b.flush()
+			}
+		})
+	}
+	return b.err
+}
+
+// flush delivers the pending updates. b must be locked.
+func (b *watchBatcher) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.generation++
+	if len(b.pending) == 0 || b.err != nil {
+		return
+	}
+	batch := b.pending
+	b.pending = nil
+	sort.Slice(batch, func(i, j int) bool {
+		return batch[i].ModifiedIndex < batch[j].ModifiedIndex
+	})
+	b.err = b.cb(batch)
+}
@@ -0,0 +1,66 @@
+package kvdb_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchTreeBatch(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	maxDelay := 500 * time.Millisecond
+	batches := make(chan kvdb.KVPairs, 10)
+	err = kvdb.WatchTreeBatch(kv, "batch", 3, maxDelay,
+		func(kvps kvdb.KVPairs) error {
+			batches <- kvps
+			return nil
+		})
+	require.NoError(t, err, "Unexpected error in WatchTreeBatch")
+
+	count := 7
+	for i := 0; i < count; i++ {
+		_, err := kv.Put("batch/"+strconv.Itoa(i), []byte("bar"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	lastPut := time.Now()
+
+	lastIndex := uint64(0)
+	received := 0
+	for _, size := range []int{3, 3, 1} {
+		select {
+		case batch := <-batches:
+			require.Len(t, batch, size, "Unexpected batch size")
+			for _, kvp := range batch {
+				assert.True(t, kvp.ModifiedIndex > lastIndex,
+					"Update %v delivered out of order", kvp.Key)
+				lastIndex = kvp.ModifiedIndex
+				assert.Equal(t, "batch/"+strconv.Itoa(received), kvp.Key,
+					"Unexpected key in batch")
+				received++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for batch of %d", size)
+		}
+	}
+	assert.True(t, time.Since(lastPut) >= maxDelay,
+		"Partial batch should only be flushed after maxDelay")
+}
+
+func TestWatchTreeBatchInvalidArgs(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	cb := func(kvps kvdb.KVPairs) error { return nil }
+	assert.Equal(t, kvdb.ErrIllegal,
+		kvdb.WatchTreeBatch(kv, "batch", 0, time.Second, cb),
+		"Expected error on invalid batch size")
+	assert.Equal(t, kvdb.ErrIllegal,
+		kvdb.WatchTreeBatch(kv, "batch", 1, 0, cb),
+		"Expected error on invalid delay")
+}
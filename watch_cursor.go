@@ -0,0 +1,58 @@
+package kvdb
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// cursorVersion is the encoding version of a serialized WatchCursor.
+const cursorVersion = 1
+
+// WatchCursor is the position of a watch on a key or tree. It can be handed
+// off to another process and used to resume the watch from where it left off
+// by passing Index as the waitIndex to WatchKey or WatchTree.
+type WatchCursor struct {
+	// Prefix is the watched key or tree prefix.
+	Prefix string
+	// Index is the ModifiedIndex of the last update seen by the watcher.
+	Index uint64
+}
+
+// Encode returns a compact opaque representation of the cursor, safe to use
+// in URLs and file names. It can be turned back into a cursor with DecodeCursor.
+func (c *WatchCursor) Encode() string {
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+
+		len(c.Prefix)+crc32.Size)
+	buf[0] = cursorVersion
+	n := binary.PutUvarint(buf[1:], c.Index)
+	buf = append(buf[:1+n], c.Prefix...)
+	var sum [crc32.Size]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf))
+	buf = append(buf, sum[:]...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// DecodeCursor parses a token returned by WatchCursor.Encode. ErrInvalidCursor
+// is returned if the token is malformed or fails its checksum.
+func DecodeCursor(token string) (*WatchCursor, error) {
+	buf, err := base64.RawURLEncoding.Strict().DecodeString(token)
+	if err != nil || len(buf) < 1+1+crc32.Size {
+		return nil, ErrInvalidCursor
+	}
+	data, sum := buf[:len(buf)-crc32.Size], buf[len(buf)-crc32.Size:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(sum) {
+		return nil, ErrInvalidCursor
+	}
+	if data[0] != cursorVersion {
+		return nil, ErrInvalidCursor
+	}
+	index, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &WatchCursor{
+		Prefix: string(data[1+n:]),
+		Index:  index,
+	}, nil
+}
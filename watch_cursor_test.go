@@ -0,0 +1,45 @@
+package kvdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchCursorRoundTrip(t *testing.T) {
+	cursors := []WatchCursor{
+		{Prefix: "", Index: 0},
+		{Prefix: "tree", Index: 1},
+		{Prefix: "pwx/test/tree/key", Index: 1<<64 - 1},
+	}
+	for _, c := range cursors {
+		token := c.Encode()
+		decoded, err := DecodeCursor(token)
+		require.NoError(t, err, "Unexpected error decoding %q", token)
+		assert.Equal(t, c, *decoded, "Cursor mismatch after round trip")
+	}
+}
+
+func TestWatchCursorCorruption(t *testing.T) {
+	c := &WatchCursor{Prefix: "tree", Index: 42}
+	token := []byte(c.Encode())
+
+	for i := range token {
+		corrupt := make([]byte, len(token))
+		copy(corrupt, token)
+		if corrupt[i] == 'A' {
+			corrupt[i] = 'B'
+		} else {
+			corrupt[i] = 'A'
+		}
+		_, err := DecodeCursor(string(corrupt))
+		assert.Equal(t, ErrInvalidCursor, err,
+			"Expected corruption at offset %d to be detected", i)
+	}
+
+	_, err := DecodeCursor("")
+	assert.Equal(t, ErrInvalidCursor, err, "Expected error on empty token")
+	_, err = DecodeCursor("not a token!")
+	assert.Equal(t, ErrInvalidCursor, err, "Expected error on bad encoding")
+}
@@ -0,0 +1,113 @@
+package kvdb
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WatchFieldCB is called with the old and new value of a watched JSON field.
+// A missing field or key has a nil value. If it returns an error the watch is
+// stopped.
+type WatchFieldCB func(oldVal, newVal interface{}) error
+
+// fieldWatcher tracks the value of a JSON field across watch updates.
+type fieldWatcher struct {
+	sync.Mutex
+	// tokens is the parsed JSON pointer
+	tokens []string
+	// value is the last seen value of the field
+	value interface{}
+	// cb is the field callback
+	cb WatchFieldCB
+}
+
+// WatchField watches key and calls cb whenever the value at jsonPointer
+// (RFC 6901) in the JSON document stored at key changes. Writes that leave
+// the field unchanged are ignored.
+func WatchField(
+	db Kvdb,
+	key string,
+	jsonPointer string,
+	cb WatchFieldCB,
+) error {
+	tokens, err := parsePointer(jsonPointer)
+	if err != nil {
+		return err
+	}
+	w := &fieldWatcher{tokens: tokens, cb: cb}
+	kvps, waitIndex, err := watchStart(db, key)
+	if err != nil {
+		return err
+	}
+	// The fetched value is the baseline the changes are compared with.
+	if kvp := findKey(kvps, key); kvp != nil {
+		w.value = w.field(kvp.Value)
+	}
+	return db.WatchKey(key, waitIndex, nil, w.watchCb)
+}
+
+func (w *fieldWatcher) watchCb(
+	prefix string,
+	opaque interface{},
+	kvp *KVPair,
+	err error,
+) error {
+	if err != nil {
+		return err
+	}
+	w.Lock()
+	defer w.Unlock()
+	var value interface{}
+	if kvp.Action != KVDelete && kvp.Action != KVExpire {
+		value = w.field(kvp.Value)
+	}
+	if reflect.DeepEqual(w.value, value) {
+		return nil
+	}
+	old := w.value
+	w.value = value
+	return w.cb(old, value)
+}
+
+// field returns the value of the watched field in doc, or nil if doc is not
+// JSON or does not contain the field.
+func (w *fieldWatcher) field(doc []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil
+	}
+	for _, token := range w.tokens {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[token]
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// parsePointer splits a JSON pointer into its unescaped reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, ErrIllegal
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		token = strings.Replace(token, "~1", "/", -1)
+		tokens[i] = strings.Replace(token, "~0", "~", -1)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,89 @@
+package kvdb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fieldChange struct {
+	oldVal interface{}
+	newVal interface{}
+}
+
+func TestWatchField(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	key := "config"
+	config := map[string]interface{}{
+		"name":   "cluster",
+		"limits": map[string]interface{}{"max/size": 10},
+	}
+	_, err = kv.Put(key, config, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	changes := make(chan fieldChange, 10)
+	err = kvdb.WatchField(kv, key, "/limits/max~1size",
+		func(oldVal, newVal interface{}) error {
+			changes <- fieldChange{oldVal, newVal}
+			return nil
+		})
+	require.NoError(t, err, "Unexpected error in WatchField")
+
+	config["name"] = "renamed"
+	_, err = kv.Put(key, config, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	select {
+	case c := <-changes:
+		t.Fatalf("Unexpected callback for unrelated field: %v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	config["limits"] = map[string]interface{}{"max/size": 20}
+	_, err = kv.Put(key, config, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	select {
+	case c := <-changes:
+		assert.Equal(t, fieldChange{float64(10), float64(20)}, c,
+			"Unexpected field change")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for field change")
+	}
+}
+
+func TestWatchFieldInvalidPointer(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	err = kvdb.WatchField(kv, "config", "limits",
+		func(oldVal, newVal interface{}) error { return nil })
+	assert.Equal(t, kvdb.ErrIllegal, err, "Expected error for invalid pointer")
+}
+
+func TestWatchFieldOldWrite(t *testing.T) {
+	kv, compact := newShortHistory(t)
+	_, err := kv.Put("config", map[string]interface{}{"size": 10}, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	compact()
+
+	changes := make(chan fieldChange, 10)
+	err = kvdb.WatchField(kv, "config", "/size",
+		func(oldVal, newVal interface{}) error {
+			changes <- fieldChange{oldVal, newVal}
+			return nil
+		})
+	require.NoError(t, err, "A key written before the history should be watched")
+	_, err = kv.Put("config", map[string]interface{}{"size": 20}, 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	select {
+	case c := <-changes:
+		assert.Equal(t, fieldChange{float64(10), float64(20)}, c,
+			"Change should be relative to the fetched value")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for field change")
+	}
+}
@@ -0,0 +1,135 @@
+package kvdb
+
+import (
+	"sync"
+	"time"
+)
+
+// reconnectingWatch is a watch that is re-established when it fails with a
+// transient error.
+type reconnectingWatch struct {
+	sync.Mutex
+	// db is the watched kvdb
+	db Kvdb
+	// prefix is the watched key or prefix
+	prefix string
+	// treeWatch is set if all keys under prefix are watched
+	treeWatch bool
+	// policy bounds the attempts to re-establish the watch
+	policy RetryPolicy
+	// cb is the consumer's callback
+	cb WatchCB
+	// lastIndex is the ModifiedIndex of the last update delivered to cb, or
+	// the index the watch started from
+	lastIndex uint64
+}
+
+// WatchReconnecting is the same as WatchKey, or WatchTree if treeWatch is
+// set, except that a watch that ends with an error retryable under policy is
+// re-established from the last update delivered to cb, so that cb sees no
+// interruption. Each reconnection is attempted up to policy.MaxAttempts
+// times, without bound if it is 0, after which cb is called with the last
+// error. If the updates since the last delivered one are no longer retained,
+// cb is called with ErrWatchRevisionCompacted to signal the gap. If it
+// returns nil the watch resumes from the current kvdb index, otherwise the
+// watch ends.
+func WatchReconnecting(
+	db Kvdb,
+	prefix string,
+	treeWatch bool,
+	waitIndex uint64,
+	policy RetryPolicy,
+	cb WatchCB,
+) error {
+	w := &reconnectingWatch{
+		db:        db,
+		prefix:    prefix,
+		treeWatch: treeWatch,
+		policy:    policy,
+		cb:        cb,
+		lastIndex: waitIndex,
+	}
+	return w.start()
+}
+
+// start establishes the watch from lastIndex.
+func (w *reconnectingWatch) start() error {
+	w.Lock()
+	waitIndex := w.lastIndex
+	w.Unlock()
+	if w.treeWatch {
+		return w.db.WatchTree(w.prefix, waitIndex, nil, w.connCb())
+	}
+	return w.db.WatchKey(w.prefix, waitIndex, nil, w.connCb())
+}
+
+// connCb returns the callback for one established watch. Once that watch
+// ends, its callback ignores any further call.
+func (w *reconnectingWatch) connCb() WatchCB {
+	ended, stopping := false, false
+	return func(prefix string, opaque interface{}, kvp *KVPair, err error) error {
+		if ended {
+			return ErrWatchStopped
+		}
+		if err == nil {
+			if err := w.cb(prefix, opaque, kvp, nil); err != nil {
+				stopping = true
+				return err
+			}
+			w.Lock()
+			w.lastIndex = kvp.ModifiedIndex
+			w.Unlock()
+			return nil
+		}
+		ended = true
+		switch {
+		case stopping || err == ErrWatchStopped:
+			return w.cb(prefix, opaque, nil, err)
+		case err == ErrWatchRevisionCompacted:
+			go w.gap()
+		case !w.policy.retryable(err):
+			return w.cb(prefix, opaque, nil, err)
+		default:
+			go w.reconnect()
+		}
+		return err
+	}
+}
+
+// reconnect re-establishes the watch, backing off between attempts.
+func (w *reconnectingWatch) reconnect() {
+	backoff := w.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		time.Sleep(backoff)
+		err := w.start()
+		switch {
+		case err == nil:
+			return
+		case err == ErrWatchRevisionCompacted:
+			w.gap()
+			return
+		case !w.policy.retryable(err) ||
+			(w.policy.MaxAttempts > 0 && attempt >= w.policy.MaxAttempts):
+			_ = w.cb(w.prefix, nil, nil, err)
+			return
+		}
+		backoff = w.policy.nextBackoff(backoff)
+	}
+}
+
+// gap signals cb that updates were missed and, unless cb returns an error,
+// resumes the watch from the current kvdb index.
+func (w *reconnectingWatch) gap() {
+	if err := w.cb(w.prefix, nil, nil, ErrWatchRevisionCompacted); err != nil {
+		return
+	}
+	_, index, err := w.db.EnumerateAt(w.prefix)
+	if err != nil {
+		_ = w.cb(w.prefix, nil, nil, err)
+		return
+	}
+	w.Lock()
+	w.lastIndex = index
+	w.Unlock()
+	w.reconnect()
+}
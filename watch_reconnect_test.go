@@ -0,0 +1,138 @@
+package kvdb_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// droppingKvdb ends its first watch with errTransient after one update and
+// fails the next attempts to watch with startErrs, in order.
+type droppingKvdb struct {
+	kvdb.Kvdb
+	mu        sync.Mutex
+	watches   int
+	startErrs []error
+}
+
+func (d *droppingKvdb) WatchKey(
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	cb kvdb.WatchCB,
+) error {
+	d.mu.Lock()
+	d.watches++
+	first := d.watches == 1
+	if !first && len(d.startErrs) > 0 {
+		err := d.startErrs[0]
+		d.startErrs = d.startErrs[1:]
+		d.mu.Unlock()
+		return err
+	}
+	d.mu.Unlock()
+
+	delivered := false
+	return d.Kvdb.WatchKey(key, waitIndex, opaque,
+		func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+			if err == nil && first && delivered {
+				return cb(prefix, opaque, nil, errTransient)
+			}
+			delivered = true
+			return cb(prefix, opaque, kvp, err)
+		})
+}
+
+func (d *droppingKvdb) watchCount() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.watches
+}
+
+// reconnectEvents returns a watch callback that reports values and errors.
+func reconnectEvents() (kvdb.WatchCB, chan string, chan error) {
+	values := make(chan string, 10)
+	errs := make(chan error, 10)
+	cb := func(prefix string, opaque interface{}, kvp *kvdb.KVPair, err error) error {
+		if err != nil {
+			errs <- err
+			if err == kvdb.ErrWatchRevisionCompacted {
+				return nil
+			}
+			return err
+		}
+		values <- string(kvp.Value)
+		return nil
+	}
+	return cb, values, errs
+}
+
+func receiveValue(t *testing.T, values chan string) string {
+	select {
+	case v := <-values:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for watch update")
+	}
+	return ""
+}
+
+func TestWatchReconnecting(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	dropping := &droppingKvdb{Kvdb: kv, startErrs: []error{errTransient}}
+	policy := kvdb.RetryPolicy{Backoff: time.Millisecond}
+
+	cb, values, errs := reconnectEvents()
+	require.NoError(t, kvdb.WatchReconnecting(dropping, "reconnect/key", false,
+		0, policy, cb), "Unexpected error in WatchReconnecting")
+	for i := 1; i <= 3; i++ {
+		_, err = kv.Put("reconnect/key", strconv.Itoa(i), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+	}
+	for i := 1; i <= 3; i++ {
+		assert.Equal(t, strconv.Itoa(i), receiveValue(t, values),
+			"Updates should resume where the dropped watch left off")
+	}
+	assert.Equal(t, 3, dropping.watchCount(),
+		"Expected a failed and a successful reconnect")
+	assert.Empty(t, errs, "Reconnecting should be transparent")
+}
+
+func TestWatchReconnectingGap(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+	dropping := &droppingKvdb{
+		Kvdb:      kv,
+		startErrs: []error{kvdb.ErrWatchRevisionCompacted},
+	}
+	policy := kvdb.RetryPolicy{Backoff: time.Millisecond}
+
+	cb, values, errs := reconnectEvents()
+	require.NoError(t, kvdb.WatchReconnecting(dropping, "gap/key", false,
+		0, policy, cb), "Unexpected error in WatchReconnecting")
+	_, err = kv.Put("gap/key", "1", 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, "1", receiveValue(t, values), "Unexpected first update")
+	_, err = kv.Put("gap/key", "2", 0)
+	require.NoError(t, err, "Unexpected error in Put")
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, kvdb.ErrWatchRevisionCompacted, err, "Expected a gap signal")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for gap signal")
+	}
+	require.Eventually(t, func() bool { return dropping.watchCount() == 3 },
+		5*time.Second, time.Millisecond, "Watch should resume after the gap")
+	_, err = kv.Put("gap/key", "3", 0)
+	require.NoError(t, err, "Unexpected error in Put")
+	assert.Equal(t, "3", receiveValue(t, values),
+		"Updates after the gap should be delivered")
+}
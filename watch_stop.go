@@ -0,0 +1,86 @@
+package kvdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// WatchStopper stops a watch it was returned for.
+type WatchStopper interface {
+	// Stop unregisters the watch. The watch callback is called with
+	// ErrWatchStopped exactly once, unless the watch already ended, and
+	// receives no further updates. Stop may be called more than once.
+	Stop()
+}
+
+// watchStopper cancels the context of a watch started with
+// WatchKeyWithContext or WatchTreeWithContext.
+type watchStopper struct {
+	once sync.Once
+	// stopped is set once Stop is called, updates raced with it are dropped
+	stopped int32
+	cancel  context.CancelFunc
+}
+
+func (w *watchStopper) Stop() {
+	w.once.Do(func() {
+		atomic.StoreInt32(&w.stopped, 1)
+		w.cancel()
+	})
+}
+
+// filter wraps cb so that it sees no update after Stop.
+func (w *watchStopper) filter(cb WatchCB) WatchCB {
+	return func(
+		prefix string,
+		opaque interface{},
+		kvp *KVPair,
+		err error,
+	) error {
+		if err == nil && atomic.LoadInt32(&w.stopped) != 0 {
+			return nil
+		}
+		return cb(prefix, opaque, kvp, err)
+	}
+}
+
+// WatchKeyWithStopper is the same as WatchKey except that it returns a
+// WatchStopper to stop the watch. It requires db to support
+// WatchKeyWithContext.
+func WatchKeyWithStopper(
+	db Kvdb,
+	key string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) (WatchStopper, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watchStopper{cancel: cancel}
+	err := db.WatchKeyWithContext(ctx, key, waitIndex, opaque, w.filter(watchCB))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return w, nil
+}
+
+// WatchTreeWithStopper is the same as WatchTree except that it returns a
+// WatchStopper to stop the watch. It requires db to support
+// WatchTreeWithContext.
+func WatchTreeWithStopper(
+	db Kvdb,
+	prefix string,
+	waitIndex uint64,
+	opaque interface{},
+	watchCB WatchCB,
+) (WatchStopper, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &watchStopper{cancel: cancel}
+	err := db.WatchTreeWithContext(ctx, prefix, waitIndex, opaque, w.filter(watchCB))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return w, nil
+}
@@ -0,0 +1,84 @@
+package kvdb_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/portworx/kvdb"
+	"github.com/portworx/kvdb/mem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingCb records the updates and errors its watch is called with.
+type recordingCb struct {
+	mu      sync.Mutex
+	updates []string
+	errs    []error
+}
+
+func (r *recordingCb) cb(
+	prefix string,
+	opaque interface{},
+	kvp *kvdb.KVPair,
+	err error,
+) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errs = append(r.errs, err)
+		return err
+	}
+	r.updates = append(r.updates, string(kvp.Value))
+	return nil
+}
+
+func (r *recordingCb) calls() ([]string, []error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.updates...), append([]error(nil), r.errs...)
+}
+
+func TestWatchStopper(t *testing.T) {
+	kv, err := mem.New("pwx/test", nil, nil, nil)
+	require.NoError(t, err, "Unexpected error in New")
+
+	for _, tree := range []bool{false, true} {
+		// Each watch uses its own keys, as earlier updates are replayed.
+		prefix := fmt.Sprintf("stopper%v", tree)
+		key := prefix + "/key"
+		r := &recordingCb{}
+		var stopper kvdb.WatchStopper
+		if tree {
+			stopper, err = kvdb.WatchTreeWithStopper(kv, prefix, 0, nil, r.cb)
+		} else {
+			stopper, err = kvdb.WatchKeyWithStopper(kv, key, 0, nil, r.cb)
+		}
+		require.NoError(t, err, "Unexpected error in watch, tree %v", tree)
+
+		_, err = kv.Put(key, []byte("1"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+		require.Eventually(t, func() bool {
+			updates, _ := r.calls()
+			return len(updates) == 1
+		}, 5*time.Second, 10*time.Millisecond, "Update not delivered")
+
+		stopper.Stop()
+		stopper.Stop()
+		require.Eventually(t, func() bool {
+			has, err := kv.HasWatchers(key)
+			return err == nil && !has
+		}, 5*time.Second, 10*time.Millisecond, "Stopped watch still reported")
+
+		_, err = kv.Put(key, []byte("2"), 0)
+		require.NoError(t, err, "Unexpected error in Put")
+		time.Sleep(100 * time.Millisecond)
+		updates, errs := r.calls()
+		assert.Equal(t, []string{"1"}, updates,
+			"Unexpected updates, tree %v", tree)
+		assert.Equal(t, []error{kvdb.ErrWatchStopped}, errs,
+			"ErrWatchStopped should be delivered once, tree %v", tree)
+	}
+}